@@ -1,27 +1,103 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"device-fleet-monitoring/internal/alerting"
 	"device-fleet-monitoring/internal/api"
+	"device-fleet-monitoring/internal/auth"
+	"device-fleet-monitoring/internal/events"
+	"device-fleet-monitoring/internal/notify"
 	"device-fleet-monitoring/internal/platform"
+	"device-fleet-monitoring/internal/registry"
 	"device-fleet-monitoring/internal/storage"
-	"encoding/csv"
 	"flag"
 	"fmt"
-	"net/http"
+	"io"
+	"log/slog"
+	"net"
 	"os"
+	"os/signal"
+	"regexp"
+	"syscall"
+	"time"
 )
 
 func main() {
 	// Define command-line flags
 	port := flag.String("port", getEnv("PORT", "6733"), "HTTP server port")
 	devicesCSV := flag.String("devices", getEnv("DEVICES_CSV", "devices.csv"), "Path to devices CSV file")
+	devicesPoll := flag.Duration("devices-poll-interval", registry.DefaultPollInterval, "How often to check the devices CSV for changes (0 disables; SIGHUP always reloads)")
+	dataDir := flag.String("data-dir", getEnv("DATA_DIR", ""), "Directory for the write-ahead log (in-memory only when empty)")
+	snapshotInterval := flag.Duration("snapshot-interval", 5*time.Minute, "How often to snapshot the store and compact the log (0 disables)")
+	retainSnapshots := flag.Int("snapshot-retain", storage.DefaultRetainSnapshots, "Number of snapshot generations to keep")
+	uploadRetention := flag.Duration("upload-retention", storage.DefaultUploadRetention, "How long upload samples are kept for windowed upload queries (0 keeps them all)")
+	batchMaxItems := flag.Int("batch-max-items", api.DefaultMaxBatchItems, "Maximum number of events in one batch ingestion request")
+	batchMaxBytes := flag.Int64("batch-max-bytes", api.DefaultMaxBatchBytes, "Maximum body size in bytes of one batch ingestion request")
+	uptimeThreshold := flag.Float64("uptime-threshold", api.DefaultUptimeThreshold, "Uptime percentage below which fleet stats count a device as degraded")
+	logLevel := flag.String("log-level", "info", "Minimum log level: debug, info, warn or error (adjustable at runtime via /admin/log-level)")
+	logFormat := flag.String("log-format", string(platform.FormatLogfmt), "Log output format: logfmt or json")
+	readTimeout := flag.Duration("read-timeout", platform.DefaultReadTimeout, "Maximum duration for reading an entire request, including the body")
+	readHeaderTimeout := flag.Duration("read-header-timeout", platform.DefaultReadHeaderTimeout, "Maximum duration for reading request headers")
+	writeTimeout := flag.Duration("write-timeout", platform.DefaultWriteTimeout, "Maximum duration before timing out writes of a response")
+	idleTimeout := flag.Duration("idle-timeout", platform.DefaultIdleTimeout, "Maximum time to wait for the next request on a keep-alive connection")
+	maxHeaderBytes := flag.Int("max-header-bytes", platform.DefaultMaxHeaderBytes, "Maximum size of request headers in bytes")
+	maxBodyBytes := flag.Int64("max-body-bytes", api.DefaultMaxBodyBytes, "Maximum body size in bytes of a single-event request")
+	shutdownTimeout := flag.Duration("shutdown-timeout", platform.DefaultShutdownTimeout, "Maximum time to wait for in-flight requests on shutdown")
+	drainDelay := flag.Duration("drain-delay", 0, "How long to report not ready before closing the listener on shutdown")
+	deviceSecrets := flag.String("device-secrets", getEnv("DEVICE_SECRETS", ""), "Path to a device_id,secret CSV; when set, ingest requests must authenticate as their device")
+	operatorTokens := flag.String("operator-tokens", getEnv("OPERATOR_TOKENS", ""), "Path to a name,token,scopes CSV; when set, read and admin endpoints require a token")
+	authClockSkew := flag.Duration("auth-clock-skew", auth.DefaultClockSkew, "Maximum difference between a signed request's timestamp and the server clock")
+	tlsCert := flag.String("tls-cert", "", "PEM server certificate; serves HTTPS when set together with -tls-key")
+	tlsKey := flag.String("tls-key", "", "PEM private key of -tls-cert")
+	clientCA := flag.String("client-ca", "", "PEM CA bundle for client certificates; when set, ingest requests need a certificate naming their device")
+	heartbeatRate := flag.Float64("heartbeat-rate", 0, "Heartbeat requests per second allowed per device (0 disables)")
+	heartbeatBurst := flag.Int("heartbeat-burst", 0, "Heartbeat requests a device may send at once (default: -heartbeat-rate rounded up)")
+	statsRate := flag.Float64("stats-rate", 0, "Stats posts per second allowed per device (0 disables)")
+	statsBurst := flag.Int("stats-burst", 0, "Stats posts a device may send at once (default: -stats-rate rounded up)")
+	readRate := flag.Float64("read-rate", 0, "Read requests per second allowed per client IP (0 disables)")
+	readBurst := flag.Int("read-burst", 0, "Read requests a client IP may send at once (default: -read-rate rounded up)")
+	clientIPRate := flag.Float64("client-ip-rate", 0, "Ingest requests per second allowed per client IP, checked before authentication (0 disables)")
+	clientIPBurst := flag.Int("client-ip-burst", 0, "Ingest requests a client IP may send at once (default: -client-ip-rate rounded up)")
+	rateLimitKeys := flag.Int("rate-limit-max-keys", platform.DefaultRateLimitMaxKeys, "Maximum devices or client IPs tracked per rate limit")
+	deviceIDPattern := flag.String("device-id-pattern", platform.DefaultDeviceIDPattern, "Regular expression device IDs in request paths must match")
+	alertRules := flag.String("alert-rules", getEnv("ALERT_RULES", ""), "Path to an alert rules CSV (name,kind,threshold,resolve,window,for,match); reloaded on SIGHUP")
+	alertInterval := flag.Duration("alert-interval", alerting.DefaultInterval, "How often alert rules are evaluated")
+	webhooksCSV := flag.String("webhooks", getEnv("WEBHOOKS", ""), "Path to a name,url,secret,events CSV of webhook endpoints for device events")
+	webhookQueue := flag.Int("webhook-queue-size", notify.DefaultQueueSize, "Maximum deliveries waiting per webhook endpoint")
+	webhookAttempts := flag.Int("webhook-max-attempts", notify.DefaultMaxAttempts, "Attempts per webhook delivery before it is dead-lettered")
+	webhookMaxBackoff := flag.Duration("webhook-max-backoff", notify.DefaultMaxBackoff, "Maximum wait between webhook delivery attempts")
+	webhookTimeout := flag.Duration("webhook-timeout", notify.DefaultTimeout, "Maximum duration of one webhook delivery attempt")
+	webhookDeadLetters := flag.Int("webhook-dead-letters", notify.DefaultDeadLetterLimit, "Maximum undelivered webhooks kept for inspection and retry")
+	eventBuffer := flag.Int("event-buffer", events.DefaultBufferSize, "Number of recent events kept so event stream clients can resume with Last-Event-ID")
+	eventQueue := flag.Int("event-subscriber-queue", events.DefaultSubscriberQueue, "Events waiting per event stream client before it is dropped as too slow")
+	udpAddr := flag.String("udp-addr", getEnv("UDP_ADDR", ""), "Address such as :6734 to receive UDP heartbeat datagrams on (disabled when empty)")
+	metricsPerDevice := flag.Bool("metrics-per-device", false, "Export per-device uptime and average upload gauges on /metrics")
 	flag.Parse()
 
 	// Initialize logger
-	logger := platform.NewLogger()
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -log-level: %v\n", err)
+		os.Exit(2)
+	}
+	format, err := platform.ParseLogFormat(*logFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -log-format: %v\n", err)
+		os.Exit(2)
+	}
+	deviceIDRegexp, err := regexp.Compile(*deviceIDPattern)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -device-id-pattern: %v\n", err)
+		os.Exit(2)
+	}
+	logger := platform.NewLogger(platform.LoggerConfig{Format: format, Level: level})
+
+	// Route the standard library logger through the structured logger too
+	slog.SetDefault(logger.Logger)
 
 	// Load device IDs from CSV
-	deviceIDs, err := loadDeviceIDs(*devicesCSV)
+	devices, err := registry.Load(*devicesCSV)
 	if err != nil {
 		logger.Error("failed to load devices from CSV",
 			"file", *devicesCSV,
@@ -31,83 +107,376 @@ func main() {
 
 	logger.Info("loaded devices from CSV",
 		"file", *devicesCSV,
-		"count", len(deviceIDs))
+		"count", len(devices))
+
+	// Create store with loaded device IDs, persisted when a data directory is set
+	deviceIDs := registry.IDs(devices)
+	var store storage.Store
+	if *dataDir != "" {
+		fileStore, err := storage.NewFileStore(storage.FileStoreConfig{
+			Dir:              *dataDir,
+			SnapshotInterval: *snapshotInterval,
+			RetainSnapshots:  *retainSnapshots,
+			UploadRetention:  *uploadRetention,
+		}, deviceIDs)
+		if err != nil {
+			logger.Error("failed to open data directory",
+				"dir", *dataDir,
+				"error", err)
+			os.Exit(1)
+		}
+		store = fileStore
+
+		logger.Info("opened persistent store",
+			"dir", *dataDir,
+			"snapshot_interval", *snapshotInterval,
+			"snapshot_retain", *retainSnapshots)
+	} else {
+		store = storage.NewMemoryStore(deviceIDs, storage.WithUploadRetention(*uploadRetention))
+	}
+
+	// Attach registry metadata and retire devices restored from the data
+	// directory that the file no longer lists
+	_, retired, err := store.ReconcileDevices(context.Background(), devices)
+	if err != nil {
+		logger.Error("failed to apply device metadata",
+			"file", *devicesCSV,
+			"error", err)
+		os.Exit(1)
+	}
+	if len(retired) > 0 {
+		logger.Info("retired restored devices missing from CSV",
+			"file", *devicesCSV,
+			"count", len(retired))
+	}
+
+	// Shut down on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Background workers outlive the signal: requests still draining after it
+	// reach the registry, alerts and webhooks, so these stop only once the
+	// server has shut down. Webhooks stop last to deliver what alerts raised.
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	webhooksCtx, stopWebhooks := context.WithCancel(context.Background())
+	defer stopWebhooks()
 
-	// Create memory store with loaded device IDs
-	store := storage.NewMemoryStore(deviceIDs)
+	// Reconcile the store with the devices CSV whenever it changes or on SIGHUP
+	watcher := registry.NewWatcher(registry.WatcherConfig{
+		Path:      *devicesCSV,
+		Interval:  *devicesPoll,
+		Reconcile: store.ReconcileDevices,
+		Logger:    logger.Logger,
+	})
+	watcherDone := make(chan struct{})
+	go func() {
+		watcher.Run(workersCtx)
+		close(watcherDone)
+	}()
+
+	// Load device secrets and operator tokens; either left unset disables that side of authentication
+	authenticator := auth.NewAuthenticator(auth.Config{ClockSkew: *authClockSkew})
+	if err := loadCredentials(authenticator, *deviceSecrets, *operatorTokens); err != nil {
+		logger.Error("failed to load credentials",
+			"error", err)
+		os.Exit(1)
+	}
+	logger.Info("configured authentication",
+		"device_auth", authenticator.DeviceAuthEnabled(),
+		"operator_auth", authenticator.OperatorAuthEnabled())
+	if authenticator.DeviceAuthEnabled() && !authenticator.OperatorAuthEnabled() {
+		logger.Warn("POST /api/v1/ingest is refused until -operator-tokens grants the ingest scope")
+	}
+
+	// Load TLS certificates when serving HTTPS
+	var certs *platform.CertReloader
+	if *tlsCert != "" || *tlsKey != "" || *clientCA != "" {
+		certs, err = platform.NewCertReloader(platform.TLSConfig{
+			CertFile:     *tlsCert,
+			KeyFile:      *tlsKey,
+			ClientCAFile: *clientCA,
+		})
+		if err != nil {
+			logger.Error("failed to load TLS certificates",
+				"error", err)
+			os.Exit(1)
+		}
+		logger.Info("configured TLS",
+			"cert", *tlsCert,
+			"client_ca", *clientCA)
+	}
+
+	// Load alert rules; without a file no alerts are raised
+	var rules []alerting.Rule
+	if *alertRules != "" {
+		if rules, err = alerting.LoadRules(*alertRules); err != nil {
+			logger.Error("failed to load alert rules",
+				"file", *alertRules,
+				"error", err)
+			os.Exit(1)
+		}
+		logger.Info("loaded alert rules",
+			"file", *alertRules,
+			"count", len(rules))
+	}
+
+	// Deliver alert and first seen events to webhook endpoints
+	var webhooks *notify.Dispatcher
+	var notifiers []alerting.Notifier
+	webhooksDone := make(chan struct{})
+	if *webhooksCSV != "" {
+		endpoints, err := notify.LoadEndpoints(*webhooksCSV)
+		if err != nil {
+			logger.Error("failed to load webhook endpoints",
+				"file", *webhooksCSV,
+				"error", err)
+			os.Exit(1)
+		}
+		logger.Info("loaded webhook endpoints",
+			"file", *webhooksCSV,
+			"count", len(endpoints))
+		webhooks = notify.NewDispatcher(notify.DispatcherConfig{
+			Endpoints:       endpoints,
+			QueueSize:       *webhookQueue,
+			MaxAttempts:     *webhookAttempts,
+			MaxBackoff:      *webhookMaxBackoff,
+			Timeout:         *webhookTimeout,
+			FlushTimeout:    *shutdownTimeout,
+			DeadLetterLimit: *webhookDeadLetters,
+			Logger:          logger.Logger,
+		})
+		notifiers = append(notifiers, webhooks)
+		go func() {
+			webhooks.Run(webhooksCtx)
+			close(webhooksDone)
+		}()
+	} else {
+		close(webhooksDone)
+	}
+
+	// Evaluate alert rules against every device in the background
+	alerts := alerting.NewEngine(alerting.EngineConfig{
+		Store:     store,
+		Rules:     rules,
+		Interval:  *alertInterval,
+		Notifiers: notifiers,
+		Logger:    logger.Logger,
+	})
+	alertsDone := make(chan struct{})
+	go func() {
+		alerts.Run(workersCtx)
+		close(alertsDone)
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logger.Info("received SIGHUP, reloading device registry, credentials and alert rules", "file", *devicesCSV)
+			watcher.Trigger()
+			if err := loadCredentials(authenticator, *deviceSecrets, *operatorTokens); err != nil {
+				logger.Error("failed to reload credentials, keeping current credentials",
+					"error", err)
+			}
+			if certs != nil {
+				if err := certs.Reload(); err != nil {
+					logger.Error("failed to reload TLS certificates, keeping current certificates",
+						"error", err)
+				}
+			}
+			if *alertRules != "" {
+				if rules, err := alerting.LoadRules(*alertRules); err != nil {
+					logger.Error("failed to reload alert rules, keeping current rules",
+						"file", *alertRules,
+						"error", err)
+				} else {
+					alerts.SetRules(rules)
+					logger.Info("reloaded alert rules",
+						"file", *alertRules,
+						"count", len(rules))
+				}
+			}
+		}
+	}()
+
+	// Token-bucket limits per device and client IP
+	limiter := platform.NewRateLimiter(platform.RateLimitConfig{
+		Heartbeat: platform.RateLimit{Rate: *heartbeatRate, Burst: *heartbeatBurst},
+		Stats:     platform.RateLimit{Rate: *statsRate, Burst: *statsBurst},
+		Read:      platform.RateLimit{Rate: *readRate, Burst: *readBurst},
+		ClientIP:  platform.RateLimit{Rate: *clientIPRate, Burst: *clientIPBurst},
+		MaxKeys:   *rateLimitKeys,
+	})
+
+	// Collect request, ingest, rate limit and store metrics for /metrics
+	metrics := platform.NewMetrics(platform.MetricsConfig{
+		Store:       store,
+		PerDevice:   *metricsPerDevice,
+		RateLimiter: limiter,
+	})
+
+	// Fan accepted telemetry out to GET /events clients
+	broker := events.NewBroker(events.BrokerConfig{
+		BufferSize:      *eventBuffer,
+		SubscriberQueue: *eventQueue,
+	})
 
 	// Create handlers with store
-	handlers := api.NewHandlers(store)
+	handlers := api.NewHandlers(store,
+		api.WithUptimeThreshold(*uptimeThreshold),
+		api.WithBatchLimits(*batchMaxItems, *batchMaxBytes),
+		api.WithMaxBodyBytes(*maxBodyBytes),
+		api.WithIngestRecorder(metrics),
+		api.WithAlerts(alerts),
+		api.WithWebhooks(webhooks),
+		api.WithEvents(broker),
+		api.WithLogger(logger.Logger),
+	)
 
 	// Set up router with handlers
+	readiness := &platform.Readiness{}
 	router := platform.NewRouter(platform.RouterConfig{
-		Handlers:    handlers,
-		Logger:      logger,
-		DeviceCount: len(deviceIDs),
+		Handlers:  handlers,
+		Logger:    logger,
+		Metrics:   metrics,
+		Readiness: readiness,
+		Auth:      authenticator,
+		// Device signatures may cover batch bodies, the largest accepted
+		MaxBodyBytes:      max(*batchMaxBytes, *maxBodyBytes),
+		RequireClientCert: certs != nil && certs.ClientAuth(),
+		RateLimiter:       limiter,
+		DeviceIDPattern:   deviceIDRegexp,
 	})
 
+	// Receive heartbeat datagrams through the same handlers, credentials and limits
+	udpDone := make(chan struct{})
+	udpCtx, stopUDP := context.WithCancel(context.Background())
+	defer stopUDP()
+	if *udpAddr != "" {
+		// Datagrams can't carry client certificates; secrets must stand in
+		if certs != nil && certs.ClientAuth() && !authenticator.DeviceAuthEnabled() {
+			logger.Error("-udp-addr with -client-ca requires -device-secrets")
+			os.Exit(2)
+		}
+		udpConn, err := net.ListenPacket("udp", *udpAddr)
+		if err != nil {
+			logger.Error("failed to listen for UDP heartbeats",
+				"address", *udpAddr,
+				"error", err)
+			os.Exit(1)
+		}
+		udp := platform.NewUDPListener(platform.UDPConfig{
+			Handlers:        handlers,
+			Logger:          logger,
+			Metrics:         metrics,
+			Auth:            authenticator,
+			RateLimiter:     limiter,
+			DeviceIDPattern: deviceIDRegexp,
+		})
+		go func() {
+			if err := udp.Serve(udpCtx, udpConn); err != nil {
+				logger.Error("UDP listener failed",
+					"error", err)
+			}
+			close(udpDone)
+		}()
+		logger.Info("listening for UDP heartbeats",
+			"address", udpConn.LocalAddr().String(),
+			"signed", authenticator.DeviceAuthEnabled())
+	} else {
+		close(udpDone)
+	}
+
 	// Start HTTP server
 	addr := ":" + *port
+	var tlsConfig *tls.Config
+	if certs != nil {
+		tlsConfig = certs.TLSConfig()
+	}
+	server := platform.NewServer(platform.ServerConfig{
+		Addr:              addr,
+		Handler:           router,
+		Logger:            logger,
+		ReadTimeout:       *readTimeout,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+		MaxHeaderBytes:    *maxHeaderBytes,
+		TLSConfig:         tlsConfig,
+		Readiness:         readiness,
+		DrainDelay:        *drainDelay,
+		ShutdownTimeout:   *shutdownTimeout,
+		// End event streams so they don't hold up shutdown
+		OnShutdown: broker.Close,
+	})
 	logger.Info("starting server",
 		"port", *port,
-		"address", addr)
+		"address", addr,
+		"tls", tlsConfig != nil)
 
-	if err := http.ListenAndServe(addr, router); err != nil {
+	serveErr := server.ListenAndServe(ctx)
+	if serveErr != nil {
 		logger.Error("server failed",
-			"error", err)
-		os.Exit(1)
+			"error", serveErr)
 	}
-}
 
-// getEnv retrieves an environment variable or returns a default value
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
-	}
-	return defaultValue
-}
-
-// loadDeviceIDs reads device IDs from a CSV file
-func loadDeviceIDs(filename string) ([]string, error) {
-	// Open CSV file
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %w", err)
-	}
-	defer file.Close()
-
-	// Parse CSV
-	reader := csv.NewReader(file)
-	records, err := reader.ReadAll()
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse CSV: %w", err)
+	// Stop receiving UDP heartbeats along with HTTP ones. Device streams
+	// are hijacked connections the server doesn't wait for; close them,
+	// then stop reloading the registry and evaluating alerts, flush the
+	// webhook queues, and flush and close the store once no request can
+	// reach it
+	stopUDP()
+	<-udpDone
+	handlers.CloseStreams()
+	stopWorkers()
+	<-watcherDone
+	<-alertsDone
+	stopWebhooks()
+	<-webhooksDone
+	if closer, ok := store.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logger.Error("failed to close store",
+				"error", err)
+			os.Exit(1)
+		}
 	}
-
-	// Validate CSV has at least header row
-	if len(records) < 1 {
-		return nil, fmt.Errorf("CSV file is empty")
+	if serveErr != nil {
+		os.Exit(1)
 	}
+	logger.Info("server stopped")
+}
 
-	// Validate header
-	if len(records[0]) < 1 || records[0][0] != "device_id" {
-		return nil, fmt.Errorf("CSV must have 'device_id' column header")
+// loadCredentials reads the device secrets and operator token files into
+// authenticator. An empty path leaves that kind of credential disabled.
+// Nothing is replaced unless both files load.
+func loadCredentials(authenticator *auth.Authenticator, secretsPath, tokensPath string) error {
+	var secrets map[string]string
+	if secretsPath != "" {
+		var err error
+		if secrets, err = auth.LoadDeviceSecrets(secretsPath); err != nil {
+			return fmt.Errorf("device secrets %s: %w", secretsPath, err)
+		}
 	}
-
-	// Extract device IDs (skip header row)
-	deviceIDs := make([]string, 0, len(records)-1)
-	for i := 1; i < len(records); i++ {
-		if len(records[i]) < 1 {
-			continue // Skip empty rows
+	var tokens []auth.OperatorToken
+	if tokensPath != "" {
+		var err error
+		if tokens, err = auth.LoadOperatorTokens(tokensPath); err != nil {
+			return fmt.Errorf("operator tokens %s: %w", tokensPath, err)
 		}
-		deviceID := records[i][0]
-		if deviceID != "" {
-			deviceIDs = append(deviceIDs, deviceID)
+		if tokens == nil {
+			tokens = []auth.OperatorToken{} // An empty file still enables authentication
 		}
 	}
+	authenticator.SetDeviceSecrets(secrets)
+	authenticator.SetOperatorTokens(tokens)
+	return nil
+}
 
-	if len(deviceIDs) == 0 {
-		return nil, fmt.Errorf("no device IDs found in CSV")
+// getEnv retrieves an environment variable or returns a default value
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
 	}
-
-	return deviceIDs, nil
+	return defaultValue
 }
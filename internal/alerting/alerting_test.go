@@ -0,0 +1,330 @@
+package alerting
+
+import (
+	"context"
+	"device-fleet-monitoring/internal/storage"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recorder is a Notifier that keeps every event
+type recorder struct {
+	events []Event
+}
+
+func (r *recorder) Notify(event Event) {
+	r.events = append(r.events, event)
+}
+
+// take returns the events received since the last call as rule/device=state
+func (r *recorder) take() string {
+	var out []string
+	for _, e := range r.events {
+		out = append(out, e.Rule+"/"+e.DeviceID+"="+string(e.State))
+	}
+	r.events = nil
+	return strings.Join(out, " ")
+}
+
+// testEngine returns an engine over store with a settable clock
+func testEngine(store storage.Store, rules []Rule) (*Engine, *recorder, *time.Time) {
+	now := time.Unix(1700000000, 0)
+	events := &recorder{}
+	engine := NewEngine(EngineConfig{
+		Store:     store,
+		Rules:     rules,
+		Notifiers: []Notifier{events},
+		Logger:    slog.New(slog.DiscardHandler),
+		Now:       func() time.Time { return now },
+	})
+	return engine, events, &now
+}
+
+func TestParseRules(t *testing.T) {
+	input := "name,kind,threshold,resolve,window,for,match\n" +
+		"camera-offline,offline,5m,,,2m,type=camera\n" +
+		"\n" +
+		"low-uptime,uptime_below,90,95,1h,,\n" +
+		"slow-uploads,p95_upload_above,30s,20s,1h,,site=lab; tag=outdoor\n"
+	rules, err := ParseRules(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ParseRules failed: %v", err)
+	}
+	want := []Rule{
+		{Name: "camera-offline", Kind: KindOffline, Threshold: 300, Resolve: 300, For: 2 * time.Minute, Match: []MatchTerm{{"type", "camera"}}},
+		{Name: "low-uptime", Kind: KindUptimeBelow, Threshold: 90, Resolve: 95, Window: time.Hour},
+		{Name: "slow-uploads", Kind: KindP95UploadAbove, Threshold: 30, Resolve: 20, Window: time.Hour, Match: []MatchTerm{{"site", "lab"}, {"tag", "outdoor"}}},
+	}
+	if fmt.Sprint(rules) != fmt.Sprint(want) {
+		t.Errorf("got %+v\nwant %+v", rules, want)
+	}
+
+	invalid := []string{
+		"",
+		"name,kind\na,offline\n",
+		"name,kind,threshold\na,flaky,5m\n",
+		"name,kind,threshold\n,offline,5m\n",
+		"name,kind,threshold\na,offline,5\n",
+		"name,kind,threshold,window\na,offline,5m,1h\n",
+		"name,kind,threshold\na,uptime_below,90\n",
+		"name,kind,threshold,window\na,uptime_below,101,1h\n",
+		"name,kind,threshold,resolve,window\na,uptime_below,90,80,1h\n",
+		"name,kind,threshold,resolve,window\na,avg_upload_above,10s,20s,1h\n",
+		"name,kind,threshold,for\na,offline,5m,-1m\n",
+		"name,kind,threshold,match\na,offline,5m,color=red\n",
+		"name,kind,threshold\na,offline,5m\na,offline,10m\n",
+	}
+	for _, input := range invalid {
+		if _, err := ParseRules(strings.NewReader(input)); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestEngine_OfflineFiresOnceAndResolves(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore(nil)
+	store.ReconcileDevices(ctx, []storage.DeviceInfo{
+		{ID: "cam-1", Metadata: storage.DeviceMetadata{Type: "camera"}},
+		{ID: "cam-2", Metadata: storage.DeviceMetadata{Type: "camera"}},
+		{ID: "sw-1", Metadata: storage.DeviceMetadata{Type: "switch"}},
+		{ID: "cam-new", Metadata: storage.DeviceMetadata{Type: "camera"}},
+	})
+	engine, events, now := testEngine(store, []Rule{
+		{Name: "offline", Kind: KindOffline, Threshold: 300, Resolve: 300, For: time.Minute, Match: []MatchTerm{{"type", "camera"}}},
+	})
+	for _, id := range []string{"cam-1", "cam-2", "sw-1"} {
+		store.AddHeartbeat(ctx, id, *now)
+	}
+	step := func(d time.Duration) {
+		*now = now.Add(d)
+		store.AddHeartbeat(ctx, "cam-2", *now)
+		if err := engine.Evaluate(ctx); err != nil {
+			t.Fatalf("Evaluate failed: %v", err)
+		}
+	}
+
+	step(5 * time.Minute)
+	if got := events.take(); got != "" {
+		t.Errorf("expected no events at the threshold, got %q", got)
+	}
+
+	step(time.Minute)
+	alerts, _ := engine.Alerts()
+	if len(alerts) != 1 || alerts[0].DeviceID != "cam-1" || alerts[0].State != StatePending || alerts[0].Value != 360 {
+		t.Fatalf("expected a pending alert for cam-1, got %+v", alerts)
+	}
+	if got := events.take(); got != "" {
+		t.Errorf("expected pending alerts not to notify, got %q", got)
+	}
+
+	step(time.Minute)
+	if got := events.take(); got != "offline/cam-1=firing" {
+		t.Errorf("expected cam-1 to fire after For, got %q", got)
+	}
+	step(time.Minute)
+	if got := events.take(); got != "" {
+		t.Errorf("expected a firing alert to be reported once, got %q", got)
+	}
+
+	store.AddHeartbeat(ctx, "cam-1", now.Add(-time.Second))
+	step(time.Minute)
+	if got := events.take(); got != "offline/cam-1=resolved" {
+		t.Errorf("expected cam-1 to resolve after a heartbeat, got %q", got)
+	}
+	if alerts, _ := engine.Alerts(); len(alerts) != 0 {
+		t.Errorf("expected no alerts, got %+v", alerts)
+	}
+}
+
+func TestEngine_Hysteresis(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore([]string{"cam-1"})
+	engine, events, now := testEngine(store, []Rule{
+		{Name: "slow", Kind: KindAvgUploadAbove, Threshold: 10, Resolve: 5, Window: time.Hour},
+	})
+	upload := func(seconds int) {
+		*now = now.Add(time.Minute)
+		store.AddUpload(ctx, "cam-1", *now, seconds*int(time.Second))
+		if err := engine.Evaluate(ctx); err != nil {
+			t.Fatalf("Evaluate failed: %v", err)
+		}
+	}
+
+	upload(12)
+	if got := events.take(); got != "slow/cam-1=firing" {
+		t.Errorf("expected an average of 12s to fire without a For, got %q", got)
+	}
+	upload(4) // Average 8s: below the threshold but above Resolve
+	if got := events.take(); got != "" {
+		t.Errorf("expected the alert to keep firing between Threshold and Resolve, got %q", got)
+	}
+	alerts, _ := engine.Alerts()
+	if len(alerts) != 1 || alerts[0].State != StateFiring || alerts[0].Value != 8 {
+		t.Errorf("expected a firing alert at 8s, got %+v", alerts)
+	}
+	upload(0)
+	upload(0) // Average 4s
+	if got := events.take(); got != "slow/cam-1=resolved" {
+		t.Errorf("expected the alert to resolve at Resolve, got %q", got)
+	}
+}
+
+func TestEngine_UptimeFiresAfterHeartbeatsStop(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore([]string{"cam-1"})
+	engine, events, now := testEngine(store, []Rule{
+		{Name: "uptime", Kind: KindUptimeBelow, Threshold: 90, Resolve: 95, Window: time.Hour},
+	})
+	beat := func(from, to time.Time) {
+		for at := from; !at.After(to); at = at.Add(time.Minute) {
+			store.AddHeartbeat(ctx, "cam-1", at)
+		}
+	}
+
+	// Every minute for two hours, then silence for the last half of the window
+	beat(now.Add(-150*time.Minute), now.Add(-30*time.Minute))
+	if err := engine.Evaluate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := events.take(); got != "uptime/cam-1=firing" {
+		t.Fatalf("expected the uptime alert to fire, got %q", got)
+	}
+	alerts, _ := engine.Alerts()
+	if want := 31.0 / 61 * 100; len(alerts) != 1 || math.Abs(alerts[0].Value-want) > 1e-9 {
+		t.Errorf("expected uptime %v, got %+v", want, alerts)
+	}
+
+	// Once a whole window is covered again the alert resolves
+	beat(now.Add(time.Minute), now.Add(time.Hour))
+	*now = now.Add(time.Hour)
+	if err := engine.Evaluate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := events.take(); got != "uptime/cam-1=resolved" {
+		t.Errorf("expected the uptime alert to resolve, got %q", got)
+	}
+}
+
+func TestEngine_PendingRestartsAfterNoData(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore([]string{"cam-1"})
+	engine, events, now := testEngine(store, []Rule{
+		{Name: "uptime", Kind: KindUptimeBelow, Threshold: 90, Resolve: 95, Window: time.Hour, For: 30 * time.Minute},
+	})
+	// Heartbeats in 2 of 11 minutes
+	breach := func() {
+		store.AddHeartbeat(ctx, "cam-1", now.Add(-10*time.Minute))
+		store.AddHeartbeat(ctx, "cam-1", *now)
+		if err := engine.Evaluate(ctx); err != nil {
+			t.Fatalf("Evaluate failed: %v", err)
+		}
+	}
+
+	breach()
+	start := *now
+	if alerts, _ := engine.Alerts(); len(alerts) != 1 || alerts[0].State != StatePending {
+		t.Fatalf("expected a pending alert, got %+v", alerts)
+	}
+
+	// No heartbeat in the window: the breach is no longer continuous
+	*now = now.Add(2 * time.Hour)
+	if err := engine.Evaluate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if alerts, _ := engine.Alerts(); len(alerts) != 0 {
+		t.Fatalf("expected the pending alert to be cleared, got %+v", alerts)
+	}
+
+	// A new breach waits out the whole For again
+	*now = now.Add(time.Minute)
+	breach()
+	if got := events.take(); got != "" {
+		t.Errorf("expected the new breach not to fire at once, got %q", got)
+	}
+	alerts, _ := engine.Alerts()
+	if len(alerts) != 1 || alerts[0].State != StatePending || !alerts[0].Since.Equal(*now) || alerts[0].Since.Equal(start) {
+		t.Fatalf("expected a pending alert since %v, got %+v", *now, alerts)
+	}
+	*now = now.Add(30 * time.Minute)
+	breach()
+	if got := events.take(); got != "uptime/cam-1=firing" {
+		t.Errorf("expected the alert to fire after For, got %q", got)
+	}
+}
+
+func TestEngine_ResolvesWhenNoLongerEvaluated(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore([]string{"cam-1", "cam-2"})
+	engine, events, now := testEngine(store, []Rule{
+		{Name: "uptime", Kind: KindUptimeBelow, Threshold: 90, Resolve: 95, Window: time.Hour},
+		{Name: "p95", Kind: KindP95UploadAbove, Threshold: 1, Resolve: 1, Window: time.Hour},
+	})
+	// Heartbeats in 2 of 11 minutes
+	for _, id := range []string{"cam-1", "cam-2"} {
+		store.AddHeartbeat(ctx, id, now.Add(-10*time.Minute))
+		store.AddHeartbeat(ctx, id, *now)
+		store.AddUpload(ctx, id, *now, int(2*time.Second))
+	}
+	if err := engine.Evaluate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := events.take(); got != "p95/cam-1=firing p95/cam-2=firing uptime/cam-1=firing uptime/cam-2=firing" {
+		t.Fatalf("unexpected events %q", got)
+	}
+
+	// Dropping a rule or decommissioning a device resolves its alerts
+	engine.SetRules(engine.Rules()[:1])
+	store.DecommissionDevice(ctx, "cam-2", false)
+	if err := engine.Evaluate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := events.take(); got != "p95/cam-1=resolved p95/cam-2=resolved uptime/cam-2=resolved" {
+		t.Errorf("unexpected events %q", got)
+	}
+
+	// Without heartbeats in the window the uptime alert keeps its state
+	*now = now.Add(2 * time.Hour)
+	if err := engine.Evaluate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	alerts, evaluatedAt := engine.Alerts()
+	if len(alerts) != 1 || alerts[0].Rule != "uptime" || math.Abs(alerts[0].Value-200.0/11) > 1e-9 || !evaluatedAt.Equal(*now) {
+		t.Errorf("expected the uptime alert to be kept, got %+v at %v", alerts, evaluatedAt)
+	}
+}
+
+func TestEngine_FirstSeen(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore([]string{"cam-1", "cam-2"})
+	engine, events, now := testEngine(store, nil)
+	store.AddHeartbeat(ctx, "cam-1", *now)
+
+	if err := engine.Evaluate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := events.take(); got != "" {
+		t.Errorf("expected devices heard from before the first evaluation not to be reported, got %q", got)
+	}
+
+	store.AddHeartbeat(ctx, "cam-1", *now)
+	store.AddHeartbeat(ctx, "cam-2", *now)
+	store.RegisterDevices(ctx, []string{"cam-3"})
+	store.AddHeartbeat(ctx, "cam-3", *now)
+	if err := engine.Evaluate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := events.take(); got != "/cam-2=first_seen /cam-3=first_seen" {
+		t.Errorf("unexpected events %q", got)
+	}
+	if err := engine.Evaluate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := events.take(); got != "" {
+		t.Errorf("expected first seen to be reported once, got %q", got)
+	}
+}
@@ -0,0 +1,386 @@
+package alerting
+
+import (
+	"context"
+	"device-fleet-monitoring/internal/storage"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultInterval is how often rules are evaluated when none is configured
+const DefaultInterval = 30 * time.Second
+
+// State is the stage of an alert
+type State string
+
+// Alert states. Pending and firing alerts are held by the engine; resolved
+// and first seen only appear in events.
+const (
+	StatePending   State = "pending"    // Breached, waiting out the rule's For duration
+	StateFiring    State = "firing"     // Breached for at least For
+	StateResolved  State = "resolved"   // Back to the rule's Resolve value, or no longer evaluated
+	StateFirstSeen State = "first_seen" // The device sent its first heartbeat; not tied to a rule
+)
+
+// Alert is the state of one rule for one device
+type Alert struct {
+	Rule      string
+	Kind      Kind
+	DeviceID  string
+	State     State     // Pending or firing
+	Value     float64   // Latest measured value, in the unit of Kind
+	Threshold float64   // The rule's threshold when the alert was last evaluated
+	Since     time.Time // When the breach was first seen
+	FiredAt   time.Time // When the alert started firing; zero while pending
+}
+
+// Event reports an alert starting to fire or resolving, or a device being
+// heard from for the first time. Each alert fires at most once until it
+// resolves. First seen events leave Rule, Kind, Value and Threshold unset.
+type Event struct {
+	Rule      string
+	Kind      Kind
+	DeviceID  string
+	State     State // Firing, resolved or first seen
+	Value     float64
+	Threshold float64
+	Since     time.Time // When the breach was first seen, or the device's first heartbeat minute
+	At        time.Time // When the state changed
+}
+
+// Notifier receives alert events. Notify is called from the evaluation loop,
+// one event at a time, and should hand slow work off rather than block it.
+type Notifier interface {
+	Notify(Event)
+}
+
+// EngineConfig holds configuration for an alerting engine
+type EngineConfig struct {
+	Store storage.Store
+	Rules []Rule
+
+	// Interval is how often rules are evaluated. Defaults to DefaultInterval.
+	Interval time.Duration
+
+	// Notifiers receive every firing and resolved event
+	Notifiers []Notifier
+
+	Logger *slog.Logger
+	Now    func() time.Time // Defaults to time.Now
+}
+
+// alertKey identifies the alert of one rule for one device
+type alertKey struct {
+	rule     string
+	deviceID string
+}
+
+// Engine periodically evaluates rules against every active device and keeps
+// one alert per rule and device, so a breach that persists is reported once.
+// A rule's For duration must pass before a breach fires, and a firing alert
+// resolves only once the value is back to the rule's Resolve value.
+type Engine struct {
+	config EngineConfig
+
+	// evaluating serializes evaluations so events are delivered in order,
+	// and guards heard
+	evaluating sync.Mutex
+
+	// heard records, per device, whether it had sent a heartbeat at the
+	// previous evaluation; nil before the first
+	heard map[string]bool
+
+	mu          sync.Mutex
+	rules       []Rule
+	alerts      map[alertKey]*Alert
+	evaluatedAt time.Time
+}
+
+// NewEngine creates an engine for config. Nothing is evaluated until Run or Evaluate.
+func NewEngine(config EngineConfig) *Engine {
+	if config.Interval <= 0 {
+		config.Interval = DefaultInterval
+	}
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	return &Engine{
+		config: config,
+		rules:  config.Rules,
+		alerts: make(map[alertKey]*Alert),
+	}
+}
+
+// SetRules replaces the rules, e.g. after the rules file is reloaded. Alerts
+// of rules that keep their name carry over; firing alerts of removed rules
+// resolve at the next evaluation.
+func (e *Engine) SetRules(rules []Rule) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rules = rules
+}
+
+// Rules returns the current rules
+func (e *Engine) Rules() []Rule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.rules
+}
+
+// Alerts returns the pending and firing alerts ordered by rule and device,
+// and when they were last evaluated
+func (e *Engine) Alerts() ([]Alert, time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	alerts := make([]Alert, 0, len(e.alerts))
+	for _, a := range e.alerts {
+		alerts = append(alerts, *a)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].Rule != alerts[j].Rule {
+			return alerts[i].Rule < alerts[j].Rule
+		}
+		return alerts[i].DeviceID < alerts[j].DeviceID
+	})
+	return alerts, e.evaluatedAt
+}
+
+// Run evaluates the rules every Interval until ctx is cancelled
+func (e *Engine) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := e.Evaluate(ctx); err != nil && ctx.Err() == nil {
+				e.config.Logger.Error("failed to evaluate alert rules, keeping current alerts",
+					"error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// measurement is the value of one rule for one device
+type measurement struct {
+	rule     Rule
+	deviceID string
+	value    float64
+	ok       bool // False when the device has no data in the rule's window
+	failed   bool // The query failed; the alert is kept as it is
+}
+
+// Evaluate checks every rule against every active device once, updates the
+// alerts and delivers the resulting events
+func (e *Engine) Evaluate(ctx context.Context) error {
+	e.evaluating.Lock()
+	defer e.evaluating.Unlock()
+
+	now := e.config.Now()
+	rules := e.Rules()
+
+	// Collect active devices first; windowed queries lock each device again.
+	// Devices heard from since the previous evaluation are first seen; on the
+	// first evaluation every device's state is only recorded.
+	var devices []storage.DeviceSummary
+	var events []Event
+	heard := make(map[string]bool, len(e.heard))
+	err := e.config.Store.ScanDevices(ctx, func(d storage.DeviceSummary) bool {
+		heard[d.ID] = !d.NeverSeen()
+		if d.Decommissioned {
+			return true
+		}
+		if e.heard != nil && heard[d.ID] && !e.heard[d.ID] {
+			events = append(events, Event{DeviceID: d.ID, State: StateFirstSeen, Since: d.FirstSeen, At: now})
+		}
+		d.Uploads = nil // Not needed; don't hold every sketch copy at once
+		devices = append(devices, d)
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("scan devices: %w", err)
+	}
+	e.heard = heard
+
+	var measurements []measurement
+	for _, rule := range rules {
+		for _, d := range devices {
+			if !rule.matches(d.Metadata) {
+				continue
+			}
+			m, err := e.measure(ctx, rule, d, now)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				if errors.Is(err, storage.ErrDeviceNotFound) || errors.Is(err, storage.ErrDeviceDecommissioned) {
+					continue // Removed since the scan; its alerts resolve below
+				}
+				// Keep the alert as it is rather than resolve it on a failed query
+				e.config.Logger.Warn("failed to evaluate alert rule",
+					"rule", rule.Name,
+					"device_id", d.ID,
+					"error", err)
+				m.failed = true
+			}
+			measurements = append(measurements, m)
+		}
+	}
+
+	for _, event := range append(events, e.apply(measurements, now)...) {
+		e.log(event)
+		for _, n := range e.config.Notifiers {
+			n.Notify(event)
+		}
+	}
+	return nil
+}
+
+// measure computes the value of rule for device d
+func (e *Engine) measure(ctx context.Context, rule Rule, d storage.DeviceSummary, now time.Time) (measurement, error) {
+	m := measurement{rule: rule, deviceID: d.ID}
+	from := now.Add(-rule.Window)
+	switch rule.Kind {
+	case KindOffline:
+		// Devices never heard from have no heartbeat to go silent after
+		if d.NeverSeen() {
+			return m, nil
+		}
+		m.value, m.ok = now.Sub(d.LastSeen).Seconds(), true
+	case KindUptimeBelow:
+		uptime, _, err := e.config.Store.GetStatsWindow(ctx, d.ID, from, now)
+		if err != nil {
+			return m, err
+		}
+		// Silence since the last heartbeat lowers uptime; zero means no
+		// heartbeat in the window at all, which offline rules cover
+		m.value, m.ok = uptime, uptime > 0
+	case KindAvgUploadAbove, KindP95UploadAbove:
+		dist, err := e.config.Store.GetUploadDistribution(ctx, d.ID, from, now)
+		if err != nil {
+			return m, err
+		}
+		if dist.Count == 0 {
+			return m, nil
+		}
+		// Upload times are nanoseconds, thresholds seconds
+		value := dist.Sum / float64(dist.Count)
+		if rule.Kind == KindP95UploadAbove {
+			value = dist.P95
+		}
+		m.value, m.ok = time.Duration(value).Seconds(), true
+	}
+	return m, nil
+}
+
+// apply advances the alerts with measurements taken at now and returns the
+// resulting events. Alerts whose rule or device was not measured resolve.
+func (e *Engine) apply(measurements []measurement, now time.Time) []Event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var events []Event
+	seen := make(map[alertKey]bool, len(measurements))
+	for _, m := range measurements {
+		key := alertKey{m.rule.Name, m.deviceID}
+		seen[key] = true
+		if !m.ok {
+			// Without data a breach is no longer continuous, so a pending
+			// alert starts over; a firing one waits for data to resolve
+			if a, ok := e.alerts[key]; ok && a.State == StatePending && !m.failed {
+				delete(e.alerts, key)
+			}
+			continue
+		}
+
+		breached := m.rule.Kind.breaches(m.value, m.rule.Threshold)
+		a, ok := e.alerts[key]
+		if !ok {
+			if !breached {
+				continue
+			}
+			a = &Alert{Rule: m.rule.Name, DeviceID: m.deviceID, State: StatePending, Since: now}
+			e.alerts[key] = a
+		}
+		a.Kind, a.Value, a.Threshold = m.rule.Kind, m.value, m.rule.Threshold
+
+		switch a.State {
+		case StatePending:
+			if !breached {
+				delete(e.alerts, key)
+			} else if now.Sub(a.Since) >= m.rule.For {
+				a.State, a.FiredAt = StateFiring, now
+				events = append(events, a.event(StateFiring, now))
+			}
+		case StateFiring:
+			// Between Threshold and Resolve the alert keeps firing
+			if !m.rule.Kind.breaches(m.value, m.rule.Resolve) {
+				delete(e.alerts, key)
+				events = append(events, a.event(StateResolved, now))
+			}
+		}
+	}
+
+	// Rules removed or no longer matching, and devices decommissioned or removed
+	for key, a := range e.alerts {
+		if seen[key] {
+			continue
+		}
+		delete(e.alerts, key)
+		if a.State == StateFiring {
+			events = append(events, a.event(StateResolved, now))
+		}
+	}
+	e.evaluatedAt = now
+
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Rule != events[j].Rule {
+			return events[i].Rule < events[j].Rule
+		}
+		return events[i].DeviceID < events[j].DeviceID
+	})
+	return events
+}
+
+// event reports a change of a to state at time at
+func (a *Alert) event(state State, at time.Time) Event {
+	return Event{
+		Rule:      a.Rule,
+		Kind:      a.Kind,
+		DeviceID:  a.DeviceID,
+		State:     state,
+		Value:     a.Value,
+		Threshold: a.Threshold,
+		Since:     a.Since,
+		At:        at,
+	}
+}
+
+// log records event at warn level when firing and info level otherwise
+func (e *Engine) log(event Event) {
+	if event.State == StateFirstSeen {
+		e.config.Logger.Info("device first seen",
+			"device_id", event.DeviceID,
+			"first_seen", event.Since)
+		return
+	}
+	level := slog.LevelInfo
+	if event.State == StateFiring {
+		level = slog.LevelWarn
+	}
+	e.config.Logger.Log(context.Background(), level, "alert "+string(event.State),
+		"rule", event.Rule,
+		"kind", event.Kind,
+		"device_id", event.DeviceID,
+		"value", event.Value,
+		"threshold", event.Threshold)
+}
@@ -0,0 +1,232 @@
+// Package alerting evaluates rules against every device's recent heartbeats
+// and uploads and tracks the resulting alerts from pending through firing to
+// resolved
+package alerting
+
+import (
+	"bytes"
+	"device-fleet-monitoring/internal/storage"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// matchSeparator splits the terms of a rule's match column
+const matchSeparator = ";"
+
+// Kind is the condition a rule checks
+type Kind string
+
+// Rule kinds
+const (
+	KindOffline        Kind = "offline"          // No heartbeat for longer than Threshold seconds
+	KindUptimeBelow    Kind = "uptime_below"     // Uptime over Window below Threshold percent
+	KindAvgUploadAbove Kind = "avg_upload_above" // Average upload time over Window above Threshold seconds
+	KindP95UploadAbove Kind = "p95_upload_above" // 95th percentile upload time over Window above Threshold seconds
+)
+
+// Unit returns the unit of the values a rule of kind k measures
+func (k Kind) Unit() string {
+	if k == KindUptimeBelow {
+		return "percent"
+	}
+	return "seconds"
+}
+
+// breaches reports whether value is past threshold
+func (k Kind) breaches(value, threshold float64) bool {
+	if k == KindUptimeBelow {
+		return value < threshold
+	}
+	return value > threshold
+}
+
+// MatchTerm requires a metadata key to have a given value
+type MatchTerm struct {
+	Key   string // type, site, model, firmware, tag or label.<name>
+	Value string
+}
+
+// Rule is one condition evaluated against every matching device
+type Rule struct {
+	Name string
+	Kind Kind
+
+	// Threshold is the value that breaches the rule: seconds of silence for
+	// offline rules, an uptime percentage, or an upload time in seconds.
+	// A firing alert resolves only once the value is back to Resolve, which
+	// lies on the healthy side of Threshold so that a device hovering around
+	// the threshold doesn't flap.
+	Threshold float64
+	Resolve   float64
+
+	Window time.Duration // How far back uptime and upload rules look
+	For    time.Duration // How long the condition must hold before the alert fires
+
+	Match []MatchTerm // Metadata the device must have; every term must match
+}
+
+// matches reports whether md satisfies every match term of the rule
+func (r Rule) matches(md storage.DeviceMetadata) bool {
+	for _, term := range r.Match {
+		found := false
+		for _, value := range md.Values(term.Key) {
+			if value == term.Value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadRules reads alert rules from a CSV file, see ParseRules
+func LoadRules(filename string) ([]Rule, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	return ParseRules(bytes.NewReader(data))
+}
+
+// ParseRules reads alert rules from CSV content with the columns name, kind
+// and threshold, and optionally resolve, window, for and match, in any order.
+//
+// Offline thresholds are durations of silence, e.g. 10m; uptime thresholds
+// are percentages; upload thresholds are durations, e.g. 30s. Resolve takes
+// the same form and defaults to the threshold. Window is required for
+// uptime and upload rules and not allowed for offline ones. Match lists
+// key=value metadata terms separated by ";", e.g. type=camera;site=lab.
+func ParseRules(r io.Reader) ([]Rule, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("CSV file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CSV: %w", err)
+	}
+
+	positions := make(map[string]int, len(header))
+	for i, name := range header {
+		positions[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, column := range []string{"name", "kind", "threshold"} {
+		if _, ok := positions[column]; !ok {
+			return nil, fmt.Errorf("CSV must have '%s' column header", column)
+		}
+	}
+	field := func(record []string, column string) string {
+		if i, ok := positions[column]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var rules []Rule
+	seen := make(map[string]bool)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rules, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CSV: %w", err)
+		}
+		if strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue
+		}
+
+		line, _ := reader.FieldPos(0)
+		rule, err := parseRule(func(column string) string { return field(record, column) })
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if seen[rule.Name] {
+			return nil, fmt.Errorf("line %d: duplicate rule name %q", line, rule.Name)
+		}
+		seen[rule.Name] = true
+		rules = append(rules, rule)
+	}
+}
+
+// parseRule builds and validates one rule from its column values
+func parseRule(field func(column string) string) (Rule, error) {
+	rule := Rule{Name: field("name"), Kind: Kind(field("kind"))}
+	if rule.Name == "" {
+		return Rule{}, fmt.Errorf("name must not be empty")
+	}
+	switch rule.Kind {
+	case KindOffline, KindUptimeBelow, KindAvgUploadAbove, KindP95UploadAbove:
+	default:
+		return Rule{}, fmt.Errorf("unknown kind %q, must be one of offline, uptime_below, avg_upload_above, p95_upload_above", rule.Kind)
+	}
+
+	var err error
+	if rule.Threshold, err = parseValue(rule.Kind, field("threshold")); err != nil {
+		return Rule{}, fmt.Errorf("threshold: %w", err)
+	}
+	rule.Resolve = rule.Threshold
+	if value := field("resolve"); value != "" {
+		if rule.Resolve, err = parseValue(rule.Kind, value); err != nil {
+			return Rule{}, fmt.Errorf("resolve: %w", err)
+		}
+		if rule.Kind.breaches(rule.Resolve, rule.Threshold) {
+			return Rule{}, fmt.Errorf("resolve %s is past threshold %s", field("resolve"), field("threshold"))
+		}
+	}
+
+	if value := field("window"); value != "" {
+		if rule.Kind == KindOffline {
+			return Rule{}, fmt.Errorf("window is not used by offline rules")
+		}
+		if rule.Window, err = time.ParseDuration(value); err != nil || rule.Window <= 0 {
+			return Rule{}, fmt.Errorf("window must be a positive duration, got %q", value)
+		}
+	} else if rule.Kind != KindOffline {
+		return Rule{}, fmt.Errorf("window is required for %s rules", rule.Kind)
+	}
+	if value := field("for"); value != "" {
+		if rule.For, err = time.ParseDuration(value); err != nil || rule.For < 0 {
+			return Rule{}, fmt.Errorf("for must be a non-negative duration, got %q", value)
+		}
+	}
+
+	for _, term := range strings.Split(field("match"), matchSeparator) {
+		if term = strings.TrimSpace(term); term == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(term, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || value == "" || !storage.IsMetadataKey(key) {
+			return Rule{}, fmt.Errorf("match term %q must be key=value with key one of type, site, model, firmware, tag, label.<name>", term)
+		}
+		rule.Match = append(rule.Match, MatchTerm{Key: key, Value: value})
+	}
+	return rule, nil
+}
+
+// parseValue reads a threshold in the form of kind: a percentage between 0
+// and 100 for uptime rules, a positive duration in seconds otherwise
+func parseValue(kind Kind, value string) (float64, error) {
+	if kind == KindUptimeBelow {
+		percent, err := strconv.ParseFloat(value, 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return 0, fmt.Errorf("must be a percentage between 0 and 100, got %q", value)
+		}
+		return percent, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("must be a positive duration, got %q", value)
+	}
+	return d.Seconds(), nil
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"device-fleet-monitoring/internal/alerting"
+	"encoding/json"
+	"net/http"
+)
+
+// HandleAlerts handles GET /alerts
+func (h *Handlers) HandleAlerts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	// Parse optional filters
+	state := alerting.State(query.Get("state"))
+	if state != "" && state != alerting.StatePending && state != alerting.StateFiring {
+		writeError(w, r, http.StatusBadRequest, "state must be pending or firing")
+		h.logger.WarnContext(r.Context(), "invalid state", "endpoint", "/alerts", "value", state)
+		return
+	}
+	rule, deviceID := query.Get("rule"), query.Get("device_id")
+
+	resp := AlertListResponse{Alerts: []AlertItem{}}
+	if h.alerts != nil {
+		alerts, evaluatedAt := h.alerts.Alerts()
+		for _, a := range alerts {
+			if (state != "" && a.State != state) || (rule != "" && a.Rule != rule) || (deviceID != "" && a.DeviceID != deviceID) {
+				continue
+			}
+			resp.Alerts = append(resp.Alerts, newAlertItem(a))
+		}
+		if !evaluatedAt.IsZero() {
+			resp.EvaluatedAt = &evaluatedAt
+		}
+	}
+
+	// Return 200 with JSON response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+	h.logger.InfoContext(r.Context(), "request completed", "method", "GET", "endpoint", "/alerts", "count", len(resp.Alerts), "status", 200)
+}
+
+// newAlertItem converts an alert to its response form
+func newAlertItem(a alerting.Alert) AlertItem {
+	item := AlertItem{
+		Rule:      a.Rule,
+		Kind:      string(a.Kind),
+		DeviceID:  a.DeviceID,
+		State:     string(a.State),
+		Value:     a.Value,
+		Threshold: a.Threshold,
+		Unit:      a.Kind.Unit(),
+		Since:     a.Since,
+	}
+	if !a.FiredAt.IsZero() {
+		item.FiredAt = &a.FiredAt
+	}
+	return item
+}
@@ -0,0 +1,271 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"device-fleet-monitoring/internal/storage"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+)
+
+// Batch ingestion limits used when none are configured
+const (
+	DefaultMaxBatchItems       = 1000
+	DefaultMaxBatchBytes int64 = 1 << 20
+)
+
+// Event types accepted by POST /ingest
+const (
+	ingestHeartbeat = "heartbeat"
+	ingestStats     = "stats"
+)
+
+// Per-item result statuses
+const (
+	itemAccepted = "accepted"
+	itemRejected = "rejected"
+)
+
+// errBatchTooLarge reports a batch with more items than allowed
+var errBatchTooLarge = errors.New("batch too large")
+
+// HandleHeartbeatBatch handles POST /devices/{device_id}/heartbeats:batch
+func (h *Handlers) HandleHeartbeatBatch(w http.ResponseWriter, r *http.Request) {
+	// Parse device_id from URL path
+	deviceID := extractDeviceID(r, "/api/v1/devices/", "/heartbeats:batch")
+	if deviceID == "" {
+		writeError(w, r, http.StatusBadRequest, "invalid device_id in path")
+		h.logger.WarnContext(r.Context(), "invalid device_id in path", "endpoint", "/heartbeats:batch")
+		return
+	}
+
+	items, ok := h.readBatch(w, r, "/heartbeats:batch")
+	if !ok {
+		return
+	}
+
+	// Validate each item like POST /heartbeat
+	b := newBatch(len(items))
+	for i, raw := range items {
+		var req HeartbeatRequest
+		if raw == nil || json.Unmarshal(raw, &req) != nil {
+			b.reject(i, "invalid JSON payload")
+			continue
+		}
+		if req.SentAt.IsZero() {
+			b.reject(i, "invalid sent_at timestamp")
+			continue
+		}
+		event := storage.Event{DeviceID: deviceID, Kind: storage.EventHeartbeat, SentAt: req.SentAt.Time}
+		if reason := filterEvent(r.Context(), event); reason != "" {
+			b.reject(i, reason)
+			continue
+		}
+		b.add(i, event)
+	}
+
+	h.applyBatch(w, r, b, "/heartbeats:batch")
+}
+
+// HandleIngest handles POST /ingest
+func (h *Handlers) HandleIngest(w http.ResponseWriter, r *http.Request) {
+	items, ok := h.readBatch(w, r, "/ingest")
+	if !ok {
+		return
+	}
+
+	// Validate each item like POST /heartbeat or POST /stats
+	b := newBatch(len(items))
+	for i, raw := range items {
+		var req IngestEvent
+		if raw == nil || json.Unmarshal(raw, &req) != nil {
+			b.reject(i, "invalid JSON payload")
+			continue
+		}
+		if req.DeviceID == "" {
+			b.reject(i, "device_id is required")
+			continue
+		}
+
+		event := storage.Event{DeviceID: req.DeviceID, SentAt: req.SentAt.Time}
+		switch req.Type {
+		case ingestHeartbeat:
+			if req.SentAt.IsZero() {
+				b.reject(i, "invalid sent_at timestamp")
+				continue
+			}
+			event.Kind = storage.EventHeartbeat
+		case ingestStats:
+			if req.UploadTime < 0 {
+				b.reject(i, "upload_time must be non-negative")
+				continue
+			}
+			event.Kind = storage.EventUpload
+			event.UploadTime = req.UploadTime
+		default:
+			b.reject(i, "type must be heartbeat or stats")
+			continue
+		}
+		if reason := filterEvent(r.Context(), event); reason != "" {
+			b.reject(i, reason)
+			continue
+		}
+		b.add(i, event)
+	}
+
+	h.applyBatch(w, r, b, "/ingest")
+}
+
+// batch collects the validated events of a request and the result of every item
+type batch struct {
+	results   []BatchItemResult
+	events    []storage.Event
+	positions []int // Item index of each event
+}
+
+// newBatch creates a batch for n items
+func newBatch(n int) *batch {
+	return &batch{results: make([]BatchItemResult, n)}
+}
+
+// reject marks item i as rejected without storing it
+func (b *batch) reject(i int, reason string) {
+	b.results[i] = BatchItemResult{Index: i, Status: itemRejected, Reason: reason}
+}
+
+// add queues item i's event for the store
+func (b *batch) add(i int, event storage.Event) {
+	b.events = append(b.events, event)
+	b.positions = append(b.positions, i)
+}
+
+// applyBatch stores the batch's events and writes the per-item results
+func (h *Handlers) applyBatch(w http.ResponseWriter, r *http.Request, b *batch, endpoint string) {
+	errs, err := h.store.AddEvents(r.Context(), b.events)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "internal server error")
+		h.logger.ErrorContext(r.Context(), "internal error", "endpoint", endpoint, "error", err)
+		return
+	}
+	var stored []storage.Event
+	for j, i := range b.positions {
+		if errs[j] != nil {
+			b.reject(i, rejectReason(errs[j]))
+			continue
+		}
+		b.results[i] = BatchItemResult{Index: i, Status: itemAccepted}
+		stored = append(stored, b.events[j])
+	}
+	h.publishEvents(r.Context(), stored)
+
+	resp := BatchResponse{Results: b.results}
+	for _, result := range b.results {
+		if result.Status == itemAccepted {
+			resp.Accepted++
+		} else {
+			resp.Rejected++
+		}
+	}
+	h.ingest.RecordIngest(endpoint, resp.Accepted, resp.Rejected)
+
+	// Return 200 with per-item results, even if some were rejected
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+	h.logger.InfoContext(r.Context(), "request completed", "method", "POST", "endpoint", endpoint, "accepted", resp.Accepted, "rejected", resp.Rejected, "status", 200)
+}
+
+// rejectReason maps a store error for one event to its response reason
+func rejectReason(err error) string {
+	switch {
+	case errors.Is(err, storage.ErrDeviceNotFound):
+		return "device not found"
+	case errors.Is(err, storage.ErrDeviceDecommissioned):
+		return "device decommissioned"
+	case errors.Is(err, storage.ErrInvalidInput):
+		return "invalid input"
+	}
+	return "internal error"
+}
+
+// readBatch reads the items of a batch body, writing an error response and
+// returning false if the body as a whole is unusable
+func (h *Handlers) readBatch(w http.ResponseWriter, r *http.Request, endpoint string) ([]json.RawMessage, bool) {
+	body := http.MaxBytesReader(w, r.Body, h.maxBatchBytes)
+	items, err := decodeBatch(body, isNDJSON(r), h.maxBatchItems)
+	if err == nil {
+		return items, true
+	}
+
+	var maxBytes *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytes):
+		writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", h.maxBatchBytes))
+	case errors.Is(err, errBatchTooLarge):
+		writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("batch exceeds %d items", h.maxBatchItems))
+	default:
+		writeError(w, r, http.StatusBadRequest, "invalid JSON payload")
+	}
+	h.logger.WarnContext(r.Context(), "failed to read batch", "endpoint", endpoint, "error", err)
+	return nil, false
+}
+
+// isNDJSON reports whether the request body is newline-delimited JSON
+func isNDJSON(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/x-ndjson" || mediaType == "application/ndjson"
+}
+
+// decodeBatch splits a JSON array or NDJSON body into raw items. In NDJSON a
+// line that is not valid JSON yields a nil item so it can be rejected on its
+// own; blank lines are skipped. A malformed JSON array fails as a whole.
+func decodeBatch(body io.Reader, ndjson bool, maxItems int) ([]json.RawMessage, error) {
+	var items []json.RawMessage
+
+	if ndjson {
+		// Line length is bounded by the body size limit, not the scanner
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(make([]byte, 0, 64*1024), math.MaxInt32)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			if len(items) == maxItems {
+				return nil, errBatchTooLarge
+			}
+			if !json.Valid(line) {
+				items = append(items, nil)
+				continue
+			}
+			items = append(items, json.RawMessage(bytes.Clone(line)))
+		}
+		return items, scanner.Err()
+	}
+
+	dec := json.NewDecoder(body)
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('[') {
+		return nil, errors.New("expected a JSON array")
+	}
+	for dec.More() {
+		if len(items) == maxItems {
+			return nil, errBatchTooLarge
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+		items = append(items, raw)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
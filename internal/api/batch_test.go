@@ -0,0 +1,169 @@
+package api
+
+import (
+	"context"
+	"device-fleet-monitoring/internal/storage"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// postBatch sends a batch body to handler and decodes the response when it is 200
+func postBatch(t *testing.T, handler http.HandlerFunc, path, contentType, body string) (int, BatchResponse) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+
+	handler(w, req)
+
+	var resp BatchResponse
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+	}
+	return w.Code, resp
+}
+
+// reasons summarizes per-item results as "index:status[:reason]"
+func reasons(resp BatchResponse) string {
+	parts := make([]string, len(resp.Results))
+	for i, r := range resp.Results {
+		parts[i] = fmt.Sprintf("%d:%s", r.Index, r.Status)
+		if r.Reason != "" {
+			parts[i] += ":" + r.Reason
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// TestHandleHeartbeatBatch tests a JSON array of heartbeats for one device
+func TestHandleHeartbeatBatch(t *testing.T) {
+	store := seedFleet(t)
+	handlers := NewHandlers(store)
+
+	body := `[{"sent_at":"2024-01-01T12:00:00Z"}, {"sent_at":1704110460}, {"sent_at":"yesterday"}, {}]`
+	code, resp := postBatch(t, handlers.HandleHeartbeatBatch, "/api/v1/devices/dev-c/heartbeats:batch", "application/json", body)
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if resp.Accepted != 2 || resp.Rejected != 2 {
+		t.Errorf("accepted/rejected = %d/%d, want 2/2", resp.Accepted, resp.Rejected)
+	}
+	want := "0:accepted 1:accepted 2:rejected:invalid JSON payload 3:rejected:invalid sent_at timestamp"
+	if got := reasons(resp); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// dev-c was never seen before; two consecutive minutes give a span of one
+	if uptime, _, _ := store.GetStats(context.Background(), "dev-c"); uptime != 200 {
+		t.Errorf("dev-c uptime = %v, want 200", uptime)
+	}
+}
+
+// TestHandleIngest_NDJSON tests mixed-device NDJSON ingestion with per-item rejections
+func TestHandleIngest_NDJSON(t *testing.T) {
+	store := seedFleet(t)
+	store.DecommissionDevice(context.Background(), "dev-b", false)
+	handlers := NewHandlers(store)
+
+	body := strings.Join([]string{
+		`{"device_id":"dev-c","type":"heartbeat","sent_at":"2024-01-01T12:00:00Z"}`,
+		`{"device_id":"dev-c","type":"stats","sent_at":"2024-01-01T12:00:00Z","upload_time":5000000000}`,
+		``,
+		`not json`,
+		`{"device_id":"unknown","type":"heartbeat","sent_at":60}`,
+		`{"device_id":"dev-b","type":"heartbeat","sent_at":60}`,
+		`{"device_id":"dev-c","type":"reboot","sent_at":60}`,
+		`{"device_id":"dev-c","type":"stats","upload_time":-1}`,
+		`{"type":"heartbeat","sent_at":60}`,
+	}, "\n")
+	code, resp := postBatch(t, handlers.HandleIngest, "/api/v1/ingest", "application/x-ndjson", body)
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	want := "0:accepted 1:accepted 2:rejected:invalid JSON payload 3:rejected:device not found " +
+		"4:rejected:device decommissioned 5:rejected:type must be heartbeat or stats " +
+		"6:rejected:upload_time must be non-negative 7:rejected:device_id is required"
+	if got := reasons(resp); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if _, avg, _ := store.GetStats(context.Background(), "dev-c"); avg != 5e9 {
+		t.Errorf("dev-c avg upload = %v, want 5e9", avg)
+	}
+}
+
+// TestHandleIngest_Limits tests batch size, body size and malformed body errors
+func TestHandleIngest_Limits(t *testing.T) {
+	var stored int
+	store := &mockStore{
+		addEventsFunc: func(ctx context.Context, events []storage.Event) ([]error, error) {
+			stored += len(events)
+			return make([]error, len(events)), nil
+		},
+	}
+	handlers := NewHandlers(store, WithBatchLimits(2, 200))
+
+	item := `{"device_id":"d","type":"heartbeat","sent_at":60}`
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantStatus  int
+	}{
+		{name: "within limits", contentType: "application/json", body: "[" + item + "," + item + "]", wantStatus: http.StatusOK},
+		{name: "too many items", contentType: "application/json", body: "[" + item + "," + item + "," + item + "]", wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "too many lines", contentType: "application/x-ndjson", body: item + "\n" + item + "\n" + item, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "body too large", contentType: "application/json", body: `[{"device_id":"` + strings.Repeat("d", 300) + `"}]`, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "not an array", contentType: "application/json", body: item, wantStatus: http.StatusBadRequest},
+		{name: "truncated array", contentType: "application/json", body: "[" + item, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if code, _ := postBatch(t, handlers.HandleIngest, "/api/v1/ingest", tt.contentType, tt.body); code != tt.wantStatus {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.wantStatus, code)
+		}
+	}
+	if stored != 2 {
+		t.Errorf("expected only the valid batch to be stored, got %d events", stored)
+	}
+}
+
+// TestHandleIngest_EventFilters tests that filters in the request context reject items in order
+func TestHandleIngest_EventFilters(t *testing.T) {
+	store := seedFleet(t)
+	handlers := NewHandlers(store)
+	onlyDevC := func(event storage.Event) string {
+		if event.DeviceID != "dev-c" {
+			return "not dev-c"
+		}
+		return ""
+	}
+	noUploads := func(event storage.Event) string {
+		if event.Kind == storage.EventUpload {
+			return "no uploads"
+		}
+		return ""
+	}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		ctx := WithEventFilter(WithEventFilter(r.Context(), onlyDevC), noUploads)
+		handlers.HandleIngest(w, r.WithContext(ctx))
+	}
+
+	body := `[{"device_id":"dev-c","type":"heartbeat","sent_at":60},
+		{"device_id":"dev-a","type":"stats","sent_at":60,"upload_time":1},
+		{"device_id":"dev-c","type":"stats","sent_at":60,"upload_time":1},
+		{"device_id":"dev-a","type":"reboot"}]`
+	code, resp := postBatch(t, handler, "/api/v1/ingest", "application/json", body)
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	want := "0:accepted 1:rejected:not dev-c 2:rejected:no uploads 3:rejected:type must be heartbeat or stats"
+	if got := reasons(resp); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,393 @@
+package api
+
+import (
+	"device-fleet-monitoring/internal/storage"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Device listing page size limits
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+// Sort keys accepted by GET /devices
+const (
+	sortByID        = "id"
+	sortByUptime    = "uptime"
+	sortByLastSeen  = "last_seen"
+	sortByAvgUpload = "avg_upload"
+)
+
+// listCursor marks the last device returned on a page. Pages continue from
+// the first device that sorts strictly after it, so devices whose stats
+// change between requests are neither skipped nor repeated by position.
+type listCursor struct {
+	Sort  string    `json:"s"`
+	Desc  bool      `json:"d,omitempty"`
+	ID    string    `json:"i"`
+	Value float64   `json:"v,omitempty"`
+	Time  time.Time `json:"t,omitempty"`
+}
+
+// listQuery holds the parsed parameters of a device listing request
+type listQuery struct {
+	limit  int
+	sort   string
+	desc   bool
+	cursor *listCursor
+
+	status         string
+	uptimeLT       *float64
+	lastSeenBefore time.Time
+	neverSeen      *bool
+	metadata       metadataFilter
+}
+
+// Device statuses accepted by the status filter of GET /devices
+const (
+	statusActive         = "active"
+	statusDecommissioned = "decommissioned"
+	statusAll            = "all"
+)
+
+// HandleDeviceList handles GET /devices
+func (h *Handlers) HandleDeviceList(w http.ResponseWriter, r *http.Request) {
+	query, err := parseListQuery(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		h.logger.WarnContext(r.Context(), "invalid device list query", "endpoint", "/devices", "error", err)
+		return
+	}
+
+	// Collect matching devices
+	var devices []storage.DeviceSummary
+	err = h.store.ScanDevices(r.Context(), func(d storage.DeviceSummary) bool {
+		if query.matches(d) {
+			d.Uploads = nil // Not needed for listing
+			devices = append(devices, d)
+		}
+		return true
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "internal server error")
+		h.logger.ErrorContext(r.Context(), "internal error", "endpoint", "/devices", "error", err)
+		return
+	}
+
+	// Sort, then skip everything up to and including the cursor
+	sort.Slice(devices, func(i, j int) bool {
+		return query.less(query.cursorFor(devices[i]), query.cursorFor(devices[j]))
+	})
+	start := 0
+	if query.cursor != nil {
+		start = sort.Search(len(devices), func(i int) bool {
+			return query.less(*query.cursor, query.cursorFor(devices[i]))
+		})
+	}
+	end := min(start+query.limit, len(devices))
+
+	resp := DeviceListResponse{Devices: make([]DeviceListItem, 0, end-start)}
+	for _, d := range devices[start:end] {
+		resp.Devices = append(resp.Devices, newDeviceListItem(d))
+	}
+	if end < len(devices) {
+		resp.NextCursor = encodeCursor(query.cursorFor(devices[end-1]))
+	}
+
+	// Return 200 with JSON response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+	h.logger.InfoContext(r.Context(), "request completed", "method", "GET", "endpoint", "/devices", "count", len(resp.Devices), "status", 200)
+}
+
+// HandleDeviceRegister handles POST /devices
+func (h *Handlers) HandleDeviceRegister(w http.ResponseWriter, r *http.Request) {
+	// Parse and validate JSON body; a registration may list as many IDs as a batch
+	var req RegisterDevicesRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, h.maxBatchBytes)).Decode(&req); err != nil {
+		var maxBytes *http.MaxBytesError
+		if errors.As(err, &maxBytes) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", h.maxBatchBytes))
+		} else {
+			writeError(w, r, http.StatusBadRequest, "invalid JSON payload")
+		}
+		h.logger.WarnContext(r.Context(), "failed to decode JSON", "endpoint", "/devices", "error", err)
+		return
+	}
+	ids := req.DeviceIDs
+	if req.DeviceID != "" {
+		ids = append([]string{req.DeviceID}, ids...)
+	}
+	if len(ids) == 0 {
+		writeError(w, r, http.StatusBadRequest, "device_id or device_ids is required")
+		h.logger.WarnContext(r.Context(), "no device IDs to register", "endpoint", "/devices")
+		return
+	}
+
+	// Call store.RegisterDevices
+	registered, err := h.store.RegisterDevices(r.Context(), ids)
+	if err != nil {
+		if errors.Is(err, storage.ErrInvalidInput) {
+			writeError(w, r, http.StatusBadRequest, "invalid device_id")
+			h.logger.WarnContext(r.Context(), "invalid device ID", "endpoint", "/devices", "error", err)
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, "internal server error")
+		h.logger.ErrorContext(r.Context(), "internal error", "endpoint", "/devices", "error", err)
+		return
+	}
+
+	// Everything requested but not newly registered was already active
+	resp := RegisterDevicesResponse{Registered: []string{}, Existing: []string{}}
+	added := make(map[string]bool, len(registered))
+	for _, id := range registered {
+		added[id] = true
+		resp.Registered = append(resp.Registered, id)
+	}
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if !added[id] && !seen[id] {
+			resp.Existing = append(resp.Existing, id)
+		}
+		seen[id] = true
+	}
+
+	// Return 201 when anything changed, 200 when the request was a no-op
+	status := http.StatusOK
+	if len(resp.Registered) > 0 {
+		status = http.StatusCreated
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+	h.logger.InfoContext(r.Context(), "request completed", "method", "POST", "endpoint", "/devices", "registered", len(resp.Registered), "status", status)
+}
+
+// HandleDeviceDecommission handles DELETE /devices/{device_id}
+func (h *Handlers) HandleDeviceDecommission(w http.ResponseWriter, r *http.Request) {
+	// Parse device_id from URL path
+	deviceID := extractDeviceID(r, "/api/v1/devices/", "")
+	if deviceID == "" {
+		writeError(w, r, http.StatusBadRequest, "invalid device_id in path")
+		h.logger.WarnContext(r.Context(), "invalid device_id in path", "endpoint", "/devices")
+		return
+	}
+
+	// Parse optional purge flag; history is retained by default
+	purge := false
+	if value := r.URL.Query().Get("purge"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "purge must be true or false")
+			h.logger.WarnContext(r.Context(), "invalid purge flag", "device_id", deviceID, "endpoint", "/devices", "value", value)
+			return
+		}
+		purge = parsed
+	}
+
+	// Call store.DecommissionDevice
+	if err := h.store.DecommissionDevice(r.Context(), deviceID, purge); err != nil {
+		if errors.Is(err, storage.ErrDeviceNotFound) {
+			writeError(w, r, http.StatusNotFound, "device not found")
+			h.logger.WarnContext(r.Context(), "device not found", "device_id", deviceID, "endpoint", "/devices", "error", err)
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, "internal server error")
+		h.logger.ErrorContext(r.Context(), "internal error", "device_id", deviceID, "endpoint", "/devices", "error", err)
+		return
+	}
+
+	// Return 204 on success; decommissioning twice is not an error
+	w.WriteHeader(http.StatusNoContent)
+	h.logger.InfoContext(r.Context(), "request completed", "method", "DELETE", "endpoint", "/devices", "device_id", deviceID, "purge", purge, "status", 204)
+}
+
+// newDeviceListItem converts a device summary to its response form
+func newDeviceListItem(d storage.DeviceSummary) DeviceListItem {
+	item := DeviceListItem{
+		DeviceID:      d.ID,
+		Uptime:        d.Uptime,
+		AvgUploadTime: formatDuration(d.AvgUpload),
+		UploadCount:   d.UploadCount,
+
+		Decommissioned: d.Decommissioned,
+		Metadata:       newDeviceMetadata(d.Metadata),
+	}
+	if !d.NeverSeen() {
+		firstSeen, lastSeen := d.FirstSeen, d.LastSeen
+		item.FirstSeen, item.LastSeen = &firstSeen, &lastSeen
+	}
+	return item
+}
+
+// parseListQuery reads and validates the listing query parameters
+func parseListQuery(r *http.Request) (listQuery, error) {
+	values := r.URL.Query()
+	query := listQuery{limit: DefaultPageSize, sort: sortByID, status: statusActive}
+
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > MaxPageSize {
+			return listQuery{}, errors.New("limit must be between 1 and " + strconv.Itoa(MaxPageSize))
+		}
+		query.limit = limit
+	}
+
+	if value := values.Get("sort"); value != "" {
+		switch value {
+		case sortByID, sortByUptime, sortByLastSeen, sortByAvgUpload:
+			query.sort = value
+		default:
+			return listQuery{}, errors.New("sort must be one of id, uptime, last_seen, avg_upload")
+		}
+	}
+
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		query.desc = true
+	default:
+		return listQuery{}, errors.New("order must be asc or desc")
+	}
+
+	if value := values.Get("cursor"); value != "" {
+		cursor, err := decodeCursor(value)
+		if err != nil || cursor.Sort != query.sort || cursor.Desc != query.desc {
+			return listQuery{}, errors.New("invalid cursor for this sort order")
+		}
+		query.cursor = &cursor
+	}
+
+	if value := values.Get("status"); value != "" {
+		switch value {
+		case statusActive, statusDecommissioned, statusAll:
+			query.status = value
+		default:
+			return listQuery{}, errors.New("status must be one of active, decommissioned, all")
+		}
+	}
+
+	if value := values.Get("uptime_lt"); value != "" {
+		uptime, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return listQuery{}, errors.New("uptime_lt must be a number")
+		}
+		query.uptimeLT = &uptime
+	}
+
+	if value := values.Get("last_seen_before"); value != "" {
+		before, err := ParseFlexTime(value)
+		if err != nil {
+			return listQuery{}, errors.New("invalid last_seen_before timestamp")
+		}
+		query.lastSeenBefore = before
+	}
+
+	if value := values.Get("never_seen"); value != "" {
+		neverSeen, err := strconv.ParseBool(value)
+		if err != nil {
+			return listQuery{}, errors.New("never_seen must be true or false")
+		}
+		query.neverSeen = &neverSeen
+	}
+
+	metadata, err := parseMetadataFilter(values)
+	if err != nil {
+		return listQuery{}, err
+	}
+	query.metadata = metadata
+
+	return query, nil
+}
+
+// matches reports whether a device passes every filter in the query
+func (q listQuery) matches(d storage.DeviceSummary) bool {
+	if q.status != statusAll && d.Decommissioned != (q.status == statusDecommissioned) {
+		return false
+	}
+	if q.neverSeen != nil && d.NeverSeen() != *q.neverSeen {
+		return false
+	}
+	if !q.metadata.matches(d.Metadata) {
+		return false
+	}
+	if q.uptimeLT != nil && !(d.Uptime < *q.uptimeLT) {
+		return false
+	}
+	// Devices never seen have no last heartbeat, so they are always "before"
+	if !q.lastSeenBefore.IsZero() && !d.NeverSeen() && !d.LastSeen.Before(q.lastSeenBefore) {
+		return false
+	}
+	return true
+}
+
+// cursorFor returns the sort key of a device as a cursor
+func (q listQuery) cursorFor(d storage.DeviceSummary) listCursor {
+	cursor := listCursor{Sort: q.sort, Desc: q.desc, ID: d.ID}
+	switch q.sort {
+	case sortByUptime:
+		cursor.Value = d.Uptime
+	case sortByAvgUpload:
+		cursor.Value = d.AvgUpload
+	case sortByLastSeen:
+		cursor.Time = d.LastSeen
+	}
+	return cursor
+}
+
+// less orders two sort keys by the requested field and direction, breaking ties by device ID
+func (q listQuery) less(a, b listCursor) bool {
+	cmp := 0
+	switch q.sort {
+	case sortByUptime, sortByAvgUpload:
+		cmp = compare(a.Value < b.Value, a.Value > b.Value)
+	case sortByLastSeen:
+		cmp = compare(a.Time.Before(b.Time), a.Time.After(b.Time))
+	}
+	if cmp == 0 {
+		cmp = compare(a.ID < b.ID, a.ID > b.ID)
+	}
+	if q.desc {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+// compare turns a pair of less/greater results into -1, 0 or 1
+func compare(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}
+
+// encodeCursor serializes a cursor as an opaque URL-safe token
+func encodeCursor(cursor listCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses a token produced by encodeCursor
+func decodeCursor(token string) (listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return listCursor{}, err
+	}
+	var cursor listCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return listCursor{}, err
+	}
+	return cursor, nil
+}
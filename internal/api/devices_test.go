@@ -0,0 +1,256 @@
+package api
+
+import (
+	"context"
+	"device-fleet-monitoring/internal/storage"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listDevices performs GET /devices with the given query and decodes the response
+func listDevices(t *testing.T, handlers *Handlers, query url.Values) (int, DeviceListResponse) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/devices?"+query.Encode(), nil)
+	w := httptest.NewRecorder()
+
+	handlers.HandleDeviceList(w, req)
+
+	var resp DeviceListResponse
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+	}
+	return w.Code, resp
+}
+
+// deviceIDs returns the device IDs of a listing page
+func deviceIDs(resp DeviceListResponse) []string {
+	ids := make([]string, len(resp.Devices))
+	for i, d := range resp.Devices {
+		ids[i] = d.DeviceID
+	}
+	return ids
+}
+
+// TestHandleDeviceList_Filters tests uptime_lt, last_seen_before and never_seen
+func TestHandleDeviceList_Filters(t *testing.T) {
+	store := seedFleet(t)
+	labelFleet(t, store)
+	handlers := NewHandlers(store)
+
+	tests := []struct {
+		query url.Values
+		want  []string
+	}{
+		{query: url.Values{}, want: []string{"dev-a", "dev-b", "dev-c"}},
+		{query: url.Values{"uptime_lt": {"95"}}, want: []string{"dev-b", "dev-c"}},
+		{query: url.Values{"never_seen": {"true"}}, want: []string{"dev-c"}},
+		{query: url.Values{"never_seen": {"false"}, "uptime_lt": {"95"}}, want: []string{"dev-b"}},
+		// dev-a last heartbeat at minute 10, dev-b at minute 10 too
+		{query: url.Values{"last_seen_before": {"600"}}, want: []string{"dev-c"}},
+		{query: url.Values{"last_seen_before": {"601"}}, want: []string{"dev-a", "dev-b", "dev-c"}},
+		{query: url.Values{"type": {"camera"}, "uptime_lt": {"95"}}, want: []string{"dev-b"}},
+		{query: url.Values{"tag": {"outdoor", "ptz"}}, want: []string{"dev-a"}},
+	}
+	for _, tt := range tests {
+		code, resp := listDevices(t, handlers, tt.query)
+		if code != http.StatusOK {
+			t.Errorf("%v: expected status 200, got %d", tt.query, code)
+			continue
+		}
+		if got := deviceIDs(resp); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+// TestHandleDeviceList_Metadata tests that registry metadata is returned
+func TestHandleDeviceList_Metadata(t *testing.T) {
+	store := seedFleet(t)
+	labelFleet(t, store)
+	handlers := NewHandlers(store)
+
+	_, resp := listDevices(t, handlers, url.Values{"site": {"s1"}})
+	if len(resp.Devices) != 1 {
+		t.Fatalf("expected 1 device, got %d", len(resp.Devices))
+	}
+	md := resp.Devices[0].Metadata
+	if md == nil || md.Type != "camera" || md.Site != "s1" || fmt.Sprint(md.Tags) != "[outdoor ptz]" {
+		t.Errorf("unexpected metadata %+v", md)
+	}
+}
+
+// TestHandleDeviceList_SortAndPaginate tests cursor pagination across sort orders
+func TestHandleDeviceList_SortAndPaginate(t *testing.T) {
+	ids := make([]string, 7)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("dev-%d", i)
+	}
+	store := storage.NewMemoryStore(ids)
+	ctx := context.Background()
+	for i, id := range ids {
+		// Upload times collide for pairs of devices to exercise ID tie-breaks
+		store.AddUpload(ctx, id, time.Unix(60, 0), (i/2)*1000)
+		store.AddHeartbeat(ctx, id, time.Unix(int64(i)*60, 0))
+	}
+	handlers := NewHandlers(store)
+
+	tests := []struct {
+		sort, order string
+		want        []string
+	}{
+		{sort: "avg_upload", order: "desc", want: []string{"dev-6", "dev-5", "dev-4", "dev-3", "dev-2", "dev-1", "dev-0"}},
+		{sort: "last_seen", order: "asc", want: []string{"dev-0", "dev-1", "dev-2", "dev-3", "dev-4", "dev-5", "dev-6"}},
+		{sort: "id", order: "desc", want: []string{"dev-6", "dev-5", "dev-4", "dev-3", "dev-2", "dev-1", "dev-0"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		cursor := ""
+		for page := 0; page < 10; page++ {
+			query := url.Values{"sort": {tt.sort}, "order": {tt.order}, "limit": {"3"}}
+			if cursor != "" {
+				query.Set("cursor", cursor)
+			}
+			code, resp := listDevices(t, handlers, query)
+			if code != http.StatusOK {
+				t.Fatalf("%s %s: expected status 200, got %d", tt.sort, tt.order, code)
+			}
+			got = append(got, deviceIDs(resp)...)
+			if resp.NextCursor == "" {
+				break
+			}
+			cursor = resp.NextCursor
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s %s: got %v, want %v", tt.sort, tt.order, got, tt.want)
+		}
+	}
+}
+
+// TestHandleDeviceList_InvalidQuery tests 400 responses for bad parameters
+func TestHandleDeviceList_InvalidQuery(t *testing.T) {
+	handlers := NewHandlers(seedFleet(t))
+
+	_, first := listDevices(t, handlers, url.Values{"limit": {"1"}, "sort": {"uptime"}})
+
+	for _, query := range []url.Values{
+		{"limit": {"0"}},
+		{"limit": {"10000"}},
+		{"sort": {"name"}},
+		{"order": {"sideways"}},
+		{"cursor": {"not-a-cursor"}},
+		{"cursor": {first.NextCursor}, "sort": {"id"}}, // Cursor from a different sort
+		{"status": {"retired"}},
+		{"uptime_lt": {"high"}},
+		{"last_seen_before": {"yesterday"}},
+		{"never_seen": {"maybe"}},
+	} {
+		if code, _ := listDevices(t, handlers, query); code != http.StatusBadRequest {
+			t.Errorf("%v: expected status 400, got %d", query, code)
+		}
+	}
+}
+
+// TestHandleDeviceRegister tests registering new, existing and invalid devices
+func TestHandleDeviceRegister(t *testing.T) {
+	handlers := NewHandlers(seedFleet(t))
+
+	tests := []struct {
+		body           string
+		wantStatus     int
+		wantRegistered []string
+		wantExisting   []string
+	}{
+		{body: `{"device_id":"dev-d"}`, wantStatus: http.StatusCreated, wantRegistered: []string{"dev-d"}, wantExisting: []string{}},
+		{body: `{"device_ids":["dev-a","dev-e","dev-e"]}`, wantStatus: http.StatusCreated, wantRegistered: []string{"dev-e"}, wantExisting: []string{"dev-a"}},
+		{body: `{"device_ids":["dev-a"]}`, wantStatus: http.StatusOK, wantRegistered: []string{}, wantExisting: []string{"dev-a"}},
+		{body: `{}`, wantStatus: http.StatusBadRequest},
+		{body: `{"device_id":"a/b"}`, wantStatus: http.StatusBadRequest},
+		{body: `not json`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/devices", strings.NewReader(tt.body))
+		w := httptest.NewRecorder()
+
+		handlers.HandleDeviceRegister(w, req)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: expected status %d, got %d", tt.body, tt.wantStatus, w.Code)
+			continue
+		}
+		if w.Code >= 300 {
+			continue
+		}
+		var resp RegisterDevicesResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		if fmt.Sprint(resp.Registered) != fmt.Sprint(tt.wantRegistered) || fmt.Sprint(resp.Existing) != fmt.Sprint(tt.wantExisting) {
+			t.Errorf("%s: got registered=%v existing=%v, want %v %v", tt.body, resp.Registered, resp.Existing, tt.wantRegistered, tt.wantExisting)
+		}
+	}
+
+	_, resp := listDevices(t, handlers, url.Values{})
+	if got := deviceIDs(resp); fmt.Sprint(got) != "[dev-a dev-b dev-c dev-d dev-e]" {
+		t.Errorf("listing after registration got %v", got)
+	}
+}
+
+// TestHandleDeviceDecommission tests retiring devices with and without purge
+func TestHandleDeviceDecommission(t *testing.T) {
+	store := seedFleet(t)
+	handlers := NewHandlers(store)
+
+	decommission := func(path string) int {
+		req := httptest.NewRequest(http.MethodDelete, path, nil)
+		w := httptest.NewRecorder()
+		handlers.HandleDeviceDecommission(w, req)
+		return w.Code
+	}
+
+	if code := decommission("/api/v1/devices/dev-a"); code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", code)
+	}
+	if code := decommission("/api/v1/devices/dev-b?purge=true"); code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", code)
+	}
+	if code := decommission("/api/v1/devices/unknown"); code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", code)
+	}
+	if code := decommission("/api/v1/devices/dev-c?purge=maybe"); code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", code)
+	}
+
+	// Heartbeats are rejected with 410
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/devices/dev-a/heartbeat", strings.NewReader(`{"sent_at":"2024-01-01T12:00:00Z"}`))
+	w := httptest.NewRecorder()
+	handlers.HandleHeartbeat(w, req)
+	if w.Code != http.StatusGone {
+		t.Errorf("expected status 410, got %d", w.Code)
+	}
+
+	// Listing hides decommissioned devices unless asked
+	_, active := listDevices(t, handlers, url.Values{})
+	_, retired := listDevices(t, handlers, url.Values{"status": {"decommissioned"}})
+	if fmt.Sprint(deviceIDs(active)) != "[dev-c]" || fmt.Sprint(deviceIDs(retired)) != "[dev-a dev-b]" {
+		t.Errorf("got active=%v decommissioned=%v", deviceIDs(active), deviceIDs(retired))
+	}
+	if retired.Devices[0].UploadCount != 2 || retired.Devices[1].UploadCount != 0 {
+		t.Errorf("expected dev-a history retained and dev-b purged, got %+v", retired.Devices)
+	}
+
+	// Fleet stats exclude decommissioned devices
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/fleet/stats", nil)
+	w = httptest.NewRecorder()
+	handlers.HandleFleetStats(w, req)
+	var fleet FleetStatsResponse
+	json.NewDecoder(w.Body).Decode(&fleet)
+	if fleet.Devices != 1 || fleet.Decommissioned != 2 || fleet.UploadCount != 0 {
+		t.Errorf("unexpected fleet stats %+v", fleet)
+	}
+}
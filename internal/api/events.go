@@ -0,0 +1,182 @@
+package api
+
+import (
+	"context"
+	"device-fleet-monitoring/internal/events"
+	"device-fleet-monitoring/internal/storage"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Event stream timing
+const (
+	eventKeepAlive    = 15 * time.Second // Comment sent on an idle stream so proxies keep it open
+	eventWriteTimeout = 10 * time.Second // Longest a client may take to accept one write
+	eventRetry        = 5 * time.Second  // Reconnection delay suggested to clients
+)
+
+// HandleEvents handles GET /events, streaming accepted heartbeats, uploads
+// and the resulting stats as Server-Sent Events
+func (h *Handlers) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	// Parse optional device and metadata filters
+	filter, err := parseMetadataFilter(query)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		h.logger.WarnContext(r.Context(), "invalid metadata filter", "endpoint", "/events", "error", err)
+		return
+	}
+	devices := make(map[string]bool)
+	for _, id := range query["device_id"] {
+		devices[id] = true
+	}
+	match := func(e events.Event) bool {
+		return (len(devices) == 0 || devices[e.DeviceID]) && filter.matches(e.Metadata)
+	}
+
+	// Resume after the Last-Event-ID a reconnecting client sends
+	var lastEventID uint64
+	resume := r.Header.Get("Last-Event-ID") != ""
+	if resume {
+		if lastEventID, err = strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid Last-Event-ID")
+			h.logger.WarnContext(r.Context(), "invalid Last-Event-ID", "endpoint", "/events", "value", r.Header.Get("Last-Event-ID"))
+			return
+		}
+	}
+
+	if h.events == nil {
+		writeError(w, r, http.StatusServiceUnavailable, "event stream is not enabled")
+		h.logger.WarnContext(r.Context(), "event stream is not enabled", "endpoint", "/events")
+		return
+	}
+
+	// The stream outlives the server's read and write timeouts; each write
+	// gets its own deadline instead
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Stop nginx buffering the stream
+	if err := rc.Flush(); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "streaming not supported")
+		h.logger.ErrorContext(r.Context(), "streaming not supported", "endpoint", "/events", "error", err)
+		return
+	}
+
+	// Subscribe before writing anything so no event is missed. A new
+	// stream, or one resuming from an event no longer kept, starts by
+	// moving the client's last event ID to the latest event; the latter
+	// also gets a reset event telling it to refetch what it displays.
+	var sub *events.Subscription
+	var missed []events.Event
+	var latest uint64
+	preamble := fmt.Sprintf("retry: %d\n", eventRetry.Milliseconds())
+	if resume {
+		var complete bool
+		sub, missed, latest, complete = h.events.Resume(match, lastEventID)
+		if !complete {
+			preamble += fmt.Sprintf("id: %d\nevent: reset\ndata: {}\n", latest)
+		}
+	} else {
+		sub, latest = h.events.Subscribe(match)
+		preamble += fmt.Sprintf("id: %d\n", latest)
+	}
+	defer sub.Cancel()
+
+	sent := 0
+	write := func(data string) bool {
+		rc.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		if _, err := fmt.Fprint(w, data); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+	ok := write(preamble + "\n")
+	for _, event := range missed {
+		if ok = write(formatEvent(event)); !ok {
+			break
+		}
+		sent++
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for ok {
+		select {
+		case <-r.Context().Done():
+			ok = false
+		case <-keepAlive.C:
+			ok = write(": keepalive\n\n")
+		case event, open := <-sub.Events():
+			if open {
+				ok = write(formatEvent(event))
+				sent++
+				continue
+			}
+			// Dropped for falling behind, or the server is shutting down
+			if errors.Is(sub.Err(), events.ErrSlowConsumer) {
+				h.logger.WarnContext(r.Context(), "dropped slow event stream client", "endpoint", "/events", "events", sent)
+			}
+			ok = false
+		}
+	}
+	h.logger.InfoContext(r.Context(), "request completed", "method", "GET", "endpoint", "/events", "events", sent, "resumed", resume, "status", 200)
+}
+
+// formatEvent formats an event as a Server-Sent Events message
+func formatEvent(e events.Event) string {
+	return fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, e.Data)
+}
+
+// publishEvents announces stored heartbeats and uploads to event stream
+// subscribers, followed by the updated stats of each device involved
+func (h *Handlers) publishEvents(ctx context.Context, stored []storage.Event) {
+	if h.events == nil || len(stored) == 0 {
+		return
+	}
+
+	metadata := make(map[string]storage.DeviceMetadata)
+	var devices []string
+	for _, e := range stored {
+		md, seen := metadata[e.DeviceID]
+		if !seen {
+			md, _ = h.store.GetMetadata(ctx, e.DeviceID)
+			metadata[e.DeviceID] = md
+			devices = append(devices, e.DeviceID)
+		}
+
+		event := events.Event{DeviceID: e.DeviceID, Metadata: md}
+		switch e.Kind {
+		case storage.EventHeartbeat:
+			event.Type = events.TypeHeartbeat
+			event.Data, _ = json.Marshal(HeartbeatEvent{DeviceID: e.DeviceID, SentAt: e.SentAt})
+		case storage.EventUpload:
+			data := UploadEvent{DeviceID: e.DeviceID, UploadTime: formatDuration(float64(e.UploadTime))}
+			if !e.SentAt.IsZero() {
+				data.SentAt = &e.SentAt
+			}
+			event.Type = events.TypeUpload
+			event.Data, _ = json.Marshal(data)
+		default:
+			continue
+		}
+		h.events.Publish(event)
+	}
+
+	for _, id := range devices {
+		uptime, avgUpload, err := h.store.GetStats(ctx, id)
+		if err != nil {
+			h.logger.ErrorContext(ctx, "failed to read stats for event stream", "device_id", id, "error", err)
+			continue
+		}
+		data, _ := json.Marshal(StatsEvent{DeviceID: id, Uptime: uptime, AvgUploadTime: formatDuration(avgUpload)})
+		h.events.Publish(events.Event{Type: events.TypeStats, DeviceID: id, Metadata: metadata[id], Data: data})
+	}
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"device-fleet-monitoring/internal/events"
+	"device-fleet-monitoring/internal/storage"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// sseMessage is one Server-Sent Events message
+type sseMessage struct {
+	id, event, data string
+}
+
+// sseStream reads messages from an event stream response
+type sseStream struct {
+	resp   *http.Response
+	reader *bufio.Reader
+}
+
+// openStream connects to an event stream, resuming after lastEventID if set
+func openStream(t *testing.T, url, lastEventID string) *sseStream {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	s := &sseStream{resp: resp, reader: bufio.NewReader(resp.Body)}
+	t.Cleanup(s.close)
+	return s
+}
+
+// next returns the next message, skipping comments
+func (s *sseStream) next(t *testing.T) sseMessage {
+	t.Helper()
+	var m sseMessage
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if m != (sseMessage{}) {
+				return m
+			}
+			continue
+		}
+		field, value, _ := strings.Cut(line, ": ")
+		switch field {
+		case "id":
+			m.id = value
+		case "event":
+			m.event = value
+		case "data":
+			m.data = value
+		}
+	}
+}
+
+// close disconnects from the stream
+func (s *sseStream) close() {
+	s.resp.Body.Close()
+}
+
+func TestHandleEvents_StreamsAndResumes(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore(nil)
+	store.ReconcileDevices(ctx, []storage.DeviceInfo{
+		{ID: "cam-1", Metadata: storage.DeviceMetadata{Site: "lab"}},
+		{ID: "cam-2", Metadata: storage.DeviceMetadata{Site: "depot"}},
+	})
+	handlers := NewHandlers(store, WithEvents(events.NewBroker(events.BrokerConfig{})), WithLogger(slog.New(slog.DiscardHandler)))
+	// Registered first so it runs after the streams are closed
+	server := httptest.NewServer(http.HandlerFunc(handlers.HandleEvents))
+	t.Cleanup(server.Close)
+	post := func(handler http.HandlerFunc, path, body string) {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		if w.Code >= 300 {
+			t.Fatalf("POST %s: %d %s", path, w.Code, w.Body.String())
+		}
+	}
+
+	stream := openStream(t, server.URL+"?site=lab", "")
+	if start := stream.next(t); start.id == "" || start.event != "" {
+		t.Fatalf("expected the stream to start with the latest event ID, got %+v", start)
+	}
+
+	post(handlers.HandleHeartbeat, "/api/v1/devices/cam-2/heartbeat", `{"sent_at":"2024-01-15T10:00:00Z"}`)
+	post(handlers.HandleHeartbeat, "/api/v1/devices/cam-1/heartbeat", `{"sent_at":"2024-01-15T10:00:00Z"}`)
+	heartbeat, stats := stream.next(t), stream.next(t)
+	if heartbeat.event != "heartbeat" || heartbeat.data != `{"device_id":"cam-1","sent_at":"2024-01-15T10:00:00Z"}` {
+		t.Errorf("unexpected heartbeat event %+v", heartbeat)
+	}
+	if stats.event != "stats" || stats.data != `{"device_id":"cam-1","uptime":100,"avg_upload_time":"0s"}` {
+		t.Errorf("unexpected stats event %+v", stats)
+	}
+	stream.close()
+
+	// Events accepted while disconnected are replayed on reconnection
+	post(handlers.HandleIngest, "/api/v1/ingest", `[{"device_id":"cam-1","type":"stats","upload_time":2000000000},{"device_id":"cam-2","type":"stats","upload_time":1}]`)
+	resumed := openStream(t, server.URL+"?site=lab", stats.id)
+	upload, stats := resumed.next(t), resumed.next(t)
+	if upload.event != "upload" || upload.data != `{"device_id":"cam-1","upload_time":"2s"}` {
+		t.Errorf("unexpected upload event %+v", upload)
+	}
+	if stats.event != "stats" || stats.data != `{"device_id":"cam-1","uptime":100,"avg_upload_time":"2s"}` {
+		t.Errorf("unexpected stats event %+v", stats)
+	}
+
+	// An ID that isn't kept, as from before a restart, resets the client
+	reset := openStream(t, server.URL, "1").next(t)
+	if reset.event != "reset" || reset.id == "" {
+		t.Errorf("expected a reset event, got %+v", reset)
+	}
+}
+
+func TestHandleEvents_InvalidQuery(t *testing.T) {
+	handlers := NewHandlers(&mockStore{}, WithEvents(events.NewBroker(events.BrokerConfig{})), WithLogger(slog.New(slog.DiscardHandler)))
+	for _, tt := range []struct{ query, lastEventID string }{
+		{"?site=", ""},
+		{"", "latest"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/events"+tt.query, nil)
+		if tt.lastEventID != "" {
+			req.Header.Set("Last-Event-ID", tt.lastEventID)
+		}
+		w := httptest.NewRecorder()
+		handlers.HandleEvents(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q %q: expected 400, got %d", tt.query, tt.lastEventID, w.Code)
+		}
+	}
+}
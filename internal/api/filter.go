@@ -0,0 +1,33 @@
+package api
+
+import (
+	"context"
+	"device-fleet-monitoring/internal/storage"
+)
+
+// EventFilter vets an event that passed validation before it is stored,
+// returning the reason it is rejected or "" to admit it. Middleware uses
+// filters for checks that depend on each event rather than on the request,
+// such as binding cross-device events to the caller's credentials.
+type EventFilter func(event storage.Event) string
+
+// filterKey is the context key of the request's event filters
+type filterKey struct{}
+
+// WithEventFilter returns a copy of ctx in which ingest handlers also run
+// filter, after any filters ctx already carries
+func WithEventFilter(ctx context.Context, filter EventFilter) context.Context {
+	filters, _ := ctx.Value(filterKey{}).([]EventFilter)
+	return context.WithValue(ctx, filterKey{}, append(filters[:len(filters):len(filters)], filter))
+}
+
+// filterEvent returns the reason the first filter in ctx rejects event, or ""
+func filterEvent(ctx context.Context, event storage.Event) string {
+	filters, _ := ctx.Value(filterKey{}).([]EventFilter)
+	for _, filter := range filters {
+		if reason := filter(event); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
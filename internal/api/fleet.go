@@ -0,0 +1,145 @@
+package api
+
+import (
+	"device-fleet-monitoring/internal/core"
+	"device-fleet-monitoring/internal/storage"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// HandleFleetStats handles GET /fleet/stats
+func (h *Handlers) HandleFleetStats(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	// Parse optional uptime threshold, defaulting to the configured one
+	threshold := h.uptimeThreshold
+	if value := query.Get("uptime_threshold"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed < 0 || parsed > 100 {
+			writeError(w, r, http.StatusBadRequest, "uptime_threshold must be a number between 0 and 100")
+			h.logger.WarnContext(r.Context(), "invalid uptime_threshold", "endpoint", "/fleet/stats", "value", value)
+			return
+		}
+		threshold = parsed
+	}
+
+	// Parse optional metadata filters and grouping
+	filter, err := parseMetadataFilter(query)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		h.logger.WarnContext(r.Context(), "invalid metadata filter", "endpoint", "/fleet/stats", "error", err)
+		return
+	}
+	groupBy := query.Get("group_by")
+	if groupBy != "" && !storage.IsMetadataKey(groupBy) {
+		writeError(w, r, http.StatusBadRequest, "group_by must be one of type, site, model, firmware, tag, label.<name>")
+		h.logger.WarnContext(r.Context(), "invalid group_by", "endpoint", "/fleet/stats", "value", groupBy)
+		return
+	}
+
+	// Scan every device, one device lock at a time
+	total := newFleetAggregate(threshold)
+	groups := make(map[string]*fleetAggregate)
+	err = h.store.ScanDevices(r.Context(), func(d storage.DeviceSummary) bool {
+		if !filter.matches(d.Metadata) {
+			return true
+		}
+		total.add(d)
+		if groupBy == "" {
+			return true
+		}
+
+		// A device with several tags counts towards each of their groups
+		keys := d.Metadata.Values(groupBy)
+		if len(keys) == 0 {
+			keys = []string{""}
+		}
+		for _, key := range keys {
+			group, ok := groups[key]
+			if !ok {
+				group = newFleetAggregate(threshold)
+				groups[key] = group
+			}
+			group.add(d)
+		}
+		return true
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "internal server error")
+		h.logger.ErrorContext(r.Context(), "internal error", "endpoint", "/fleet/stats", "error", err)
+		return
+	}
+
+	resp := FleetStatsResponse{
+		FleetStats:      total.stats(),
+		UptimeThreshold: threshold,
+		GroupBy:         groupBy,
+	}
+	if groupBy != "" {
+		resp.Groups = make([]FleetGroupStats, 0, len(groups))
+		for key, group := range groups {
+			resp.Groups = append(resp.Groups, FleetGroupStats{Key: key, FleetStats: group.stats()})
+		}
+		sort.Slice(resp.Groups, func(i, j int) bool { return resp.Groups[i].Key < resp.Groups[j].Key })
+	}
+
+	// Return 200 with JSON response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+	h.logger.InfoContext(r.Context(), "request completed", "method", "GET", "endpoint", "/fleet/stats", "devices", resp.Devices, "status", 200)
+}
+
+// fleetAggregate accumulates fleet statistics over a set of devices
+type fleetAggregate struct {
+	threshold float64
+	counts    FleetStats
+	uptimes   []float64
+	uploads   *core.QuantileSketch
+}
+
+// newFleetAggregate creates an empty aggregate counting devices below threshold
+func newFleetAggregate(threshold float64) *fleetAggregate {
+	return &fleetAggregate{threshold: threshold, uploads: core.NewQuantileSketch()}
+}
+
+// add includes one device; decommissioned devices are only counted
+func (a *fleetAggregate) add(d storage.DeviceSummary) {
+	if d.Decommissioned {
+		a.counts.Decommissioned++
+		return
+	}
+	a.counts.Devices++
+	if d.NeverSeen() {
+		a.counts.NeverSeen++
+	} else {
+		a.uptimes = append(a.uptimes, d.Uptime)
+		if d.Uptime < a.threshold {
+			a.counts.BelowThreshold++
+		}
+	}
+	a.uploads.Merge(d.Uploads)
+}
+
+// stats computes the aggregate's statistics
+func (a *fleetAggregate) stats() FleetStats {
+	stats := a.counts
+
+	// Uptime statistics cover devices that have reported at least once
+	stats.ReportingDevices = len(a.uptimes)
+	stats.MeanUptime, stats.MedianUptime = core.CalculateMeanMedian(a.uptimes)
+
+	// Upload statistics are merged across every upload in the set
+	dist := a.uploads.Distribution()
+	stats.UploadCount = dist.Count
+	stats.AvgUploadTime = formatDuration(core.CalculateAverageUpload(dist.Sum, dist.Count))
+	stats.MinUploadTime = formatDuration(dist.Min)
+	stats.MaxUploadTime = formatDuration(dist.Max)
+	stats.P50UploadTime = formatDuration(dist.P50)
+	stats.P90UploadTime = formatDuration(dist.P90)
+	stats.P95UploadTime = formatDuration(dist.P95)
+	stats.P99UploadTime = formatDuration(dist.P99)
+	return stats
+}
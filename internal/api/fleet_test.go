@@ -0,0 +1,162 @@
+package api
+
+import (
+	"context"
+	"device-fleet-monitoring/internal/storage"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seedFleet records heartbeats and uploads for a small fleet:
+// dev-a 100% uptime, dev-b 50% uptime, dev-c never seen
+func seedFleet(t *testing.T) storage.Store {
+	t.Helper()
+	store := storage.NewMemoryStore([]string{"dev-a", "dev-b", "dev-c"})
+	ctx := context.Background()
+
+	for minute := int64(0); minute <= 10; minute++ {
+		store.AddHeartbeat(ctx, "dev-a", time.Unix(minute*60, 0))
+		if minute%2 == 0 {
+			store.AddHeartbeat(ctx, "dev-b", time.Unix(minute*60, 0))
+		}
+	}
+	// dev-b: 6 minutes over a 10 minute span = 60%; dev-a: 11 over 10 = 110%
+	store.AddUpload(ctx, "dev-a", time.Unix(60, 0), int(1*time.Second))
+	store.AddUpload(ctx, "dev-a", time.Unix(120, 0), int(3*time.Second))
+	store.AddUpload(ctx, "dev-b", time.Unix(60, 0), int(8*time.Second))
+	return store
+}
+
+// TestHandleFleetStats_Success tests fleet aggregates over a real store
+func TestHandleFleetStats_Success(t *testing.T) {
+	handlers := NewHandlers(seedFleet(t))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/fleet/stats", nil)
+	w := httptest.NewRecorder()
+
+	handlers.HandleFleetStats(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	var resp FleetStatsResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.Devices != 3 || resp.ReportingDevices != 2 || resp.NeverSeen != 1 {
+		t.Errorf("devices/reporting/never_seen = %d/%d/%d, want 3/2/1", resp.Devices, resp.ReportingDevices, resp.NeverSeen)
+	}
+	if resp.MeanUptime != 85 || resp.MedianUptime != 85 {
+		t.Errorf("mean/median uptime = %v/%v, want 85/85", resp.MeanUptime, resp.MedianUptime)
+	}
+	if resp.UptimeThreshold != DefaultUptimeThreshold || resp.BelowThreshold != 1 {
+		t.Errorf("threshold/below = %v/%d, want %v/1", resp.UptimeThreshold, resp.BelowThreshold, DefaultUptimeThreshold)
+	}
+	if resp.UploadCount != 3 || resp.AvgUploadTime != "4s" || resp.MinUploadTime != "1s" || resp.MaxUploadTime != "8s" {
+		t.Errorf("unexpected upload stats %+v", resp)
+	}
+}
+
+// TestHandleFleetStats_Threshold tests the uptime_threshold query parameter
+func TestHandleFleetStats_Threshold(t *testing.T) {
+	handlers := NewHandlers(seedFleet(t), WithUptimeThreshold(50))
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantBelow  int
+	}{
+		{query: "", wantStatus: http.StatusOK, wantBelow: 0},
+		{query: "?uptime_threshold=120", wantStatus: http.StatusBadRequest},
+		{query: "?uptime_threshold=abc", wantStatus: http.StatusBadRequest},
+		{query: "?uptime_threshold=100", wantStatus: http.StatusOK, wantBelow: 1},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/fleet/stats"+tt.query, nil)
+		w := httptest.NewRecorder()
+
+		handlers.HandleFleetStats(w, req)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("%q: expected status %d, got %d", tt.query, tt.wantStatus, w.Code)
+			continue
+		}
+		if tt.wantStatus != http.StatusOK {
+			continue
+		}
+		var resp FleetStatsResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		if resp.BelowThreshold != tt.wantBelow {
+			t.Errorf("%q: below_threshold = %d, want %d", tt.query, resp.BelowThreshold, tt.wantBelow)
+		}
+	}
+}
+
+// labelFleet attaches registry metadata to the devices of seedFleet
+func labelFleet(t *testing.T, store storage.Store) {
+	t.Helper()
+	_, _, err := store.ReconcileDevices(context.Background(), []storage.DeviceInfo{
+		{ID: "dev-a", Metadata: storage.DeviceMetadata{Type: "camera", Site: "s1", Tags: []string{"outdoor", "ptz"}}},
+		{ID: "dev-b", Metadata: storage.DeviceMetadata{Type: "camera", Site: "s2", Tags: []string{"outdoor"}}},
+		{ID: "dev-c", Metadata: storage.DeviceMetadata{Type: "switch", Labels: map[string]string{"rack": "r1"}}},
+	})
+	if err != nil {
+		t.Fatalf("ReconcileDevices failed: %v", err)
+	}
+}
+
+// TestHandleFleetStats_MetadataFiltersAndGroups tests metadata filters and group_by
+func TestHandleFleetStats_MetadataFiltersAndGroups(t *testing.T) {
+	store := seedFleet(t)
+	labelFleet(t, store)
+	handlers := NewHandlers(store)
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantTotal  int
+		wantGroups string // key:devices pairs
+	}{
+		{query: "?type=camera", wantStatus: http.StatusOK, wantTotal: 2},
+		{query: "?type=camera&site=s2", wantStatus: http.StatusOK, wantTotal: 1},
+		{query: "?tag=ptz", wantStatus: http.StatusOK, wantTotal: 1},
+		{query: "?label.rack=r1", wantStatus: http.StatusOK, wantTotal: 1},
+		{query: "?group_by=type", wantStatus: http.StatusOK, wantTotal: 3, wantGroups: "camera:2 switch:1"},
+		{query: "?group_by=tag", wantStatus: http.StatusOK, wantTotal: 3, wantGroups: ":1 outdoor:2 ptz:1"},
+		{query: "?group_by=label.rack&type=camera", wantStatus: http.StatusOK, wantTotal: 2, wantGroups: ":2"},
+		{query: "?group_by=color", wantStatus: http.StatusBadRequest},
+		{query: "?site=", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/fleet/stats"+tt.query, nil)
+		w := httptest.NewRecorder()
+
+		handlers.HandleFleetStats(w, req)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("%q: expected status %d, got %d", tt.query, tt.wantStatus, w.Code)
+			continue
+		}
+		if tt.wantStatus != http.StatusOK {
+			continue
+		}
+		var resp FleetStatsResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		if resp.Devices != tt.wantTotal {
+			t.Errorf("%q: devices = %d, want %d", tt.query, resp.Devices, tt.wantTotal)
+		}
+		var groups []string
+		for _, g := range resp.Groups {
+			groups = append(groups, fmt.Sprintf("%s:%d", g.Key, g.Devices))
+		}
+		if got := strings.Join(groups, " "); got != tt.wantGroups {
+			t.Errorf("%q: groups = %q, want %q", tt.query, got, tt.wantGroups)
+		}
+	}
+}
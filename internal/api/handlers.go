@@ -2,139 +2,304 @@ package api
 
 import (
 	"bytes"
+	"context"
+	"device-fleet-monitoring/internal/alerting"
+	"device-fleet-monitoring/internal/core"
+	"device-fleet-monitoring/internal/events"
+	"device-fleet-monitoring/internal/notify"
+	"device-fleet-monitoring/internal/requestid"
 	"device-fleet-monitoring/internal/storage"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
 	"time"
 )
 
+// DefaultMaxBodyBytes is the body size limit of single-event requests when none is configured
+const DefaultMaxBodyBytes int64 = 64 << 10
+
+// DefaultUptimeThreshold is the fleet uptime percentage below which a device is counted as degraded
+const DefaultUptimeThreshold = 95.0
+
 // Handlers holds dependencies for HTTP handlers
 type Handlers struct {
-	store storage.Store
+	store           storage.Store
+	uptimeThreshold float64
+	maxBatchItems   int
+	maxBatchBytes   int64
+	maxBodyBytes    int64
+	ingest          IngestRecorder
+	alerts          *alerting.Engine
+	webhooks        *notify.Dispatcher
+	events          *events.Broker
+	streams         streamSet
+	logger          *slog.Logger
+}
+
+// IngestRecorder receives the number of accepted and rejected events per ingest endpoint
+type IngestRecorder interface {
+	RecordIngest(endpoint string, accepted, rejected int)
+}
+
+// nopRecorder discards ingest counts
+type nopRecorder struct{}
+
+func (nopRecorder) RecordIngest(endpoint string, accepted, rejected int) {}
+
+// Option configures optional Handlers behavior
+type Option func(*Handlers)
+
+// WithUptimeThreshold sets the default uptime percentage used by fleet queries
+func WithUptimeThreshold(threshold float64) Option {
+	return func(h *Handlers) {
+		h.uptimeThreshold = threshold
+	}
+}
+
+// WithBatchLimits sets the maximum number of items and body size accepted by batch endpoints
+func WithBatchLimits(maxItems int, maxBytes int64) Option {
+	return func(h *Handlers) {
+		h.maxBatchItems = maxItems
+		h.maxBatchBytes = maxBytes
+	}
+}
+
+// WithMaxBodyBytes sets the body size limit of single-event requests
+func WithMaxBodyBytes(maxBytes int64) Option {
+	return func(h *Handlers) {
+		h.maxBodyBytes = maxBytes
+	}
+}
+
+// WithIngestRecorder reports accepted and rejected events to recorder
+func WithIngestRecorder(recorder IngestRecorder) Option {
+	return func(h *Handlers) {
+		h.ingest = recorder
+	}
+}
+
+// WithAlerts serves the alerts of engine on GET /alerts
+func WithAlerts(engine *alerting.Engine) Option {
+	return func(h *Handlers) {
+		h.alerts = engine
+	}
+}
+
+// WithWebhooks serves the delivery status and dead letters of dispatcher on /webhooks
+func WithWebhooks(dispatcher *notify.Dispatcher) Option {
+	return func(h *Handlers) {
+		h.webhooks = dispatcher
+	}
+}
+
+// WithEvents publishes accepted heartbeats, uploads and stats to broker
+// and streams them on GET /events
+func WithEvents(broker *events.Broker) Option {
+	return func(h *Handlers) {
+		h.events = broker
+	}
+}
+
+// WithLogger sets the logger used for all handler logging
+func WithLogger(logger *slog.Logger) Option {
+	return func(h *Handlers) {
+		h.logger = logger
+	}
 }
 
 // NewHandlers creates a new Handlers instance with the given store
-func NewHandlers(store storage.Store) *Handlers {
-	return &Handlers{
-		store: store,
+func NewHandlers(store storage.Store, opts ...Option) *Handlers {
+	h := &Handlers{
+		store:           store,
+		uptimeThreshold: DefaultUptimeThreshold,
+		maxBatchItems:   DefaultMaxBatchItems,
+		maxBatchBytes:   DefaultMaxBatchBytes,
+		maxBodyBytes:    DefaultMaxBodyBytes,
+		ingest:          nopRecorder{},
+		logger:          slog.Default(),
 	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
 // HandleHeartbeat handles POST /devices/{device_id}/heartbeat
 func (h *Handlers) HandleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	// Count the event as rejected unless it is stored
+	accepted := 0
+	defer func() { h.ingest.RecordIngest("/heartbeat", accepted, 1-accepted) }()
+
 	// Parse device_id from URL path
-	deviceID := extractDeviceID(r.URL.Path, "/api/v1/devices/", "/heartbeat")
+	deviceID := extractDeviceID(r, "/api/v1/devices/", "/heartbeat")
 	if deviceID == "" {
-		writeError(w, http.StatusBadRequest, "invalid device_id in path")
-		log.Printf("ERROR: invalid device_id in path, endpoint=/heartbeat")
+		writeError(w, r, http.StatusBadRequest, "invalid device_id in path")
+		h.logger.WarnContext(r.Context(), "invalid device_id in path", "endpoint", "/heartbeat")
 		return
 	}
 
 	// Parse and validate JSON body
-	bodyBytes, _ := io.ReadAll(r.Body)
-	log.Printf("DEBUG: raw request body, device_id=%s, endpoint=/heartbeat, body=%s", deviceID, string(bodyBytes))
+	bodyBytes, ok := h.readBody(w, r, deviceID, "/heartbeat")
+	if !ok {
+		return
+	}
 	
 	var req HeartbeatRequest
 	if err := json.NewDecoder(bytes.NewReader(bodyBytes)).Decode(&req); err != nil {
-		writeError(w, http.StatusBadRequest, "invalid JSON payload")
-		log.Printf("ERROR: failed to decode JSON, device_id=%s, endpoint=/heartbeat, error=%v", deviceID, err)
+		writeError(w, r, http.StatusBadRequest, "invalid JSON payload")
+		h.logger.WarnContext(r.Context(), "failed to decode JSON", "device_id", deviceID, "endpoint", "/heartbeat", "error", err)
 		return
 	}
 
 	// Validate sent_at is valid (time.Time zero value check)
 	if req.SentAt.IsZero() {
-		writeError(w, http.StatusBadRequest, "invalid sent_at timestamp")
-		log.Printf("ERROR: invalid sent_at timestamp, device_id=%s, endpoint=/heartbeat", deviceID)
+		writeError(w, r, http.StatusBadRequest, "invalid sent_at timestamp")
+		h.logger.WarnContext(r.Context(), "invalid sent_at timestamp", "device_id", deviceID, "endpoint", "/heartbeat")
 		return
 	}
 
 	// Call store.AddHeartbeat
 	if err := h.store.AddHeartbeat(r.Context(), deviceID, req.SentAt.Time); err != nil {
 		if errors.Is(err, storage.ErrDeviceNotFound) {
-			writeError(w, http.StatusNotFound, "device not found")
-			log.Printf("ERROR: device not found, device_id=%s, endpoint=/heartbeat, error=%v", deviceID, err)
+			writeError(w, r, http.StatusNotFound, "device not found")
+			h.logger.WarnContext(r.Context(), "device not found", "device_id", deviceID, "endpoint", "/heartbeat", "error", err)
+			return
+		}
+		if errors.Is(err, storage.ErrDeviceDecommissioned) {
+			writeError(w, r, http.StatusGone, "device decommissioned")
+			h.logger.WarnContext(r.Context(), "device decommissioned", "device_id", deviceID, "endpoint", "/heartbeat", "error", err)
 			return
 		}
-		writeError(w, http.StatusInternalServerError, "internal server error")
-		log.Printf("ERROR: internal error, device_id=%s, endpoint=/heartbeat, error=%v", deviceID, err)
+		writeError(w, r, http.StatusInternalServerError, "internal server error")
+		h.logger.ErrorContext(r.Context(), "internal error", "device_id", deviceID, "endpoint", "/heartbeat", "error", err)
 		return
 	}
 
 	// Return 204 on success
+	accepted = 1
+	h.publishEvents(r.Context(), []storage.Event{{DeviceID: deviceID, Kind: storage.EventHeartbeat, SentAt: req.SentAt.Time}})
 	w.WriteHeader(http.StatusNoContent)
-	log.Printf("INFO: request completed, method=POST, path=/devices/%s/heartbeat, device_id=%s, status=204", deviceID, deviceID)
+	h.logger.InfoContext(r.Context(), "request completed", "method", "POST", "endpoint", "/heartbeat", "device_id", deviceID, "status", 204)
+}
+
+// RecordHeartbeat stores a heartbeat that arrived outside the HTTP API,
+// such as over UDP, counting it under endpoint and publishing it to event
+// streams like a posted one. Store errors are returned for the caller to
+// report.
+func (h *Handlers) RecordHeartbeat(ctx context.Context, endpoint, deviceID string, sentAt time.Time) error {
+	if err := h.store.AddHeartbeat(ctx, deviceID, sentAt); err != nil {
+		h.ingest.RecordIngest(endpoint, 0, 1)
+		return err
+	}
+	h.ingest.RecordIngest(endpoint, 1, 0)
+	h.publishEvents(ctx, []storage.Event{{DeviceID: deviceID, Kind: storage.EventHeartbeat, SentAt: sentAt}})
+	return nil
 }
 
 // HandleStatsPost handles POST /devices/{device_id}/stats
 func (h *Handlers) HandleStatsPost(w http.ResponseWriter, r *http.Request) {
+	// Count the event as rejected unless it is stored
+	accepted := 0
+	defer func() { h.ingest.RecordIngest("/stats", accepted, 1-accepted) }()
+
 	// Parse device_id from URL path
-	deviceID := extractDeviceID(r.URL.Path, "/api/v1/devices/", "/stats")
+	deviceID := extractDeviceID(r, "/api/v1/devices/", "/stats")
 	if deviceID == "" {
-		writeError(w, http.StatusBadRequest, "invalid device_id in path")
-		log.Printf("ERROR: invalid device_id in path, endpoint=/stats")
+		writeError(w, r, http.StatusBadRequest, "invalid device_id in path")
+		h.logger.WarnContext(r.Context(), "invalid device_id in path", "endpoint", "/stats")
 		return
 	}
 
 	// Parse and validate JSON body
-	bodyBytes, _ := io.ReadAll(r.Body)
-	log.Printf("DEBUG: raw request body, device_id=%s, endpoint=/stats, body=%s", deviceID, string(bodyBytes))
+	bodyBytes, ok := h.readBody(w, r, deviceID, "/stats")
+	if !ok {
+		return
+	}
 	
 	var req StatsPostRequest
 	decoder := json.NewDecoder(bytes.NewReader(bodyBytes))
 	if err := decoder.Decode(&req); err != nil {
-		writeError(w, http.StatusBadRequest, "invalid JSON payload")
-		log.Printf("ERROR: failed to decode JSON, device_id=%s, endpoint=/stats, error=%v", deviceID, err)
+		writeError(w, r, http.StatusBadRequest, "invalid JSON payload")
+		h.logger.WarnContext(r.Context(), "failed to decode JSON", "device_id", deviceID, "endpoint", "/stats", "error", err)
 		return
 	}
 
 	// Validate upload_time >= 0
 	if req.UploadTime < 0 {
-		writeError(w, http.StatusBadRequest, "upload_time must be non-negative")
-		log.Printf("ERROR: negative upload_time, device_id=%s, endpoint=/stats, upload_time=%d", deviceID, req.UploadTime)
+		writeError(w, r, http.StatusBadRequest, "upload_time must be non-negative")
+		h.logger.WarnContext(r.Context(), "negative upload_time", "device_id", deviceID, "endpoint", "/stats", "upload_time", req.UploadTime)
 		return
 	}
 
 	// Call store.AddUpload
 	if err := h.store.AddUpload(r.Context(), deviceID, req.SentAt.Time, req.UploadTime); err != nil{
 		if errors.Is(err, storage.ErrDeviceNotFound) {
-			writeError(w, http.StatusNotFound, "device not found")
-			log.Printf("ERROR: device not found, device_id=%s, endpoint=/stats, error=%v", deviceID, err)
+			writeError(w, r, http.StatusNotFound, "device not found")
+			h.logger.WarnContext(r.Context(), "device not found", "device_id", deviceID, "endpoint", "/stats", "error", err)
+			return
+		}
+		if errors.Is(err, storage.ErrDeviceDecommissioned) {
+			writeError(w, r, http.StatusGone, "device decommissioned")
+			h.logger.WarnContext(r.Context(), "device decommissioned", "device_id", deviceID, "endpoint", "/stats", "error", err)
 			return
 		}
-		writeError(w, http.StatusInternalServerError, "internal server error")
-		log.Printf("ERROR: internal error, device_id=%s, endpoint=/stats, error=%v", deviceID, err)
+		writeError(w, r, http.StatusInternalServerError, "internal server error")
+		h.logger.ErrorContext(r.Context(), "internal error", "device_id", deviceID, "endpoint", "/stats", "error", err)
 		return
 	}
 
 	// Return 204 on success
+	accepted = 1
+	h.publishEvents(r.Context(), []storage.Event{{DeviceID: deviceID, Kind: storage.EventUpload, SentAt: req.SentAt.Time, UploadTime: req.UploadTime}})
 	w.WriteHeader(http.StatusNoContent)
-	log.Printf("INFO: request completed, method=POST, path=/devices/%s/stats, device_id=%s, status=204", deviceID, deviceID)
+	h.logger.InfoContext(r.Context(), "request completed", "method", "POST", "endpoint", "/stats", "device_id", deviceID, "status", 204)
 }
 
 // HandleStatsGet handles GET /devices/{device_id}/stats
 func (h *Handlers) HandleStatsGet(w http.ResponseWriter, r *http.Request) {
 	// Parse device_id from URL path
-	deviceID := extractDeviceID(r.URL.Path, "/api/v1/devices/", "/stats")
+	deviceID := extractDeviceID(r, "/api/v1/devices/", "/stats")
 	if deviceID == "" {
-		writeError(w, http.StatusBadRequest, "invalid device_id in path")
-		log.Printf("ERROR: invalid device_id in path, endpoint=/stats")
+		writeError(w, r, http.StatusBadRequest, "invalid device_id in path")
+		h.logger.WarnContext(r.Context(), "invalid device_id in path", "endpoint", "/stats")
 		return
 	}
 
-	// Call store.GetStats
-	uptime, avgUpload, err := h.store.GetStats(r.Context(), deviceID)
+	// Parse optional time window (?from=...&to=...)
+	from, to, err := parseWindow(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		h.logger.WarnContext(r.Context(), "invalid stats window", "device_id", deviceID, "endpoint", "/stats", "error", err)
+		return
+	}
+
+	// Call store.GetStats, or GetStatsWindow when a window was requested
+	var uptime, avgUpload float64
+	if from.IsZero() && to.IsZero() {
+		uptime, avgUpload, err = h.store.GetStats(r.Context(), deviceID)
+	} else {
+		uptime, avgUpload, err = h.store.GetStatsWindow(r.Context(), deviceID, from, to)
+	}
+	var dist core.Distribution
+	if err == nil {
+		dist, err = h.store.GetUploadDistribution(r.Context(), deviceID, from, to)
+	}
+	var metadata storage.DeviceMetadata
+	if err == nil {
+		metadata, err = h.store.GetMetadata(r.Context(), deviceID)
+	}
 	if err != nil {
 		if errors.Is(err, storage.ErrDeviceNotFound) {
-			writeError(w, http.StatusNotFound, "device not found")
-			log.Printf("ERROR: device not found, device_id=%s, endpoint=/stats, error=%v", deviceID, err)
+			writeError(w, r, http.StatusNotFound, "device not found")
+			h.logger.WarnContext(r.Context(), "device not found", "device_id", deviceID, "endpoint", "/stats", "error", err)
 			return
 		}
-		writeError(w, http.StatusInternalServerError, "internal server error")
-		log.Printf("ERROR: internal error, device_id=%s, endpoint=/stats, error=%v", deviceID, err)
+		writeError(w, r, http.StatusInternalServerError, "internal server error")
+		h.logger.ErrorContext(r.Context(), "internal error", "device_id", deviceID, "endpoint", "/stats", "error", err)
 		return
 	}
 
@@ -147,28 +312,107 @@ func (h *Handlers) HandleStatsGet(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(StatsGetResponse{
 		Uptime:        uptime,
 		AvgUploadTime: avgUploadTimeStr,
+		UploadCount:   dist.Count,
+		MinUploadTime: formatDuration(dist.Min),
+		MaxUploadTime: formatDuration(dist.Max),
+		P50UploadTime: formatDuration(dist.P50),
+		P90UploadTime: formatDuration(dist.P90),
+		P95UploadTime: formatDuration(dist.P95),
+		P99UploadTime: formatDuration(dist.P99),
+		Metadata:      newDeviceMetadata(metadata),
 	})
-	log.Printf("INFO: request completed, method=GET, path=/devices/%s/stats, device_id=%s, status=200", deviceID, deviceID)
+	h.logger.InfoContext(r.Context(), "request completed", "method", "GET", "endpoint", "/stats", "device_id", deviceID, "status", 200)
 }
 
-// extractDeviceID extracts device_id from URL path
+// readBody reads a single-event request body up to the configured limit,
+// writing an error response and returning false if it is too large or unreadable
+func (h *Handlers) readBody(w http.ResponseWriter, r *http.Request, deviceID, endpoint string) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.maxBodyBytes))
+	if err != nil {
+		var maxBytes *http.MaxBytesError
+		if errors.As(err, &maxBytes) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", h.maxBodyBytes))
+		} else {
+			writeError(w, r, http.StatusBadRequest, "failed to read request body")
+		}
+		h.logger.WarnContext(r.Context(), "failed to read request body", "device_id", deviceID, "endpoint", endpoint, "error", err)
+		return nil, false
+	}
+	h.logBody(r, deviceID, endpoint, body)
+	return body, true
+}
+
+// maxLoggedBodyBytes caps how much of a raw request body is logged
+const maxLoggedBodyBytes = 1024
+
+// logBody logs a raw request body at debug level, truncated to maxLoggedBodyBytes
+func (h *Handlers) logBody(r *http.Request, deviceID, endpoint string, body []byte) {
+	if !h.logger.Enabled(r.Context(), slog.LevelDebug) {
+		return
+	}
+	size := len(body)
+	if size > maxLoggedBodyBytes {
+		body = body[:maxLoggedBodyBytes]
+	}
+	h.logger.DebugContext(r.Context(), "raw request body",
+		"device_id", deviceID,
+		"endpoint", endpoint,
+		"body", string(body),
+		"body_bytes", size,
+		"truncated", size > maxLoggedBodyBytes,
+	)
+}
+
+// parseWindow reads the optional from and to query parameters.
+// Either may be omitted to leave that side of the window unbounded.
+func parseWindow(r *http.Request) (from, to time.Time, err error) {
+	query := r.URL.Query()
+	if value := query.Get("from"); value != "" {
+		if from, err = ParseFlexTime(value); err != nil {
+			return time.Time{}, time.Time{}, errors.New("invalid from timestamp")
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if to, err = ParseFlexTime(value); err != nil {
+			return time.Time{}, time.Time{}, errors.New("invalid to timestamp")
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && from.After(to) {
+		return time.Time{}, time.Time{}, errors.New("from must not be after to")
+	}
+	return from, to, nil
+}
+
+// extractDeviceID returns the {device_id} wildcard of the matched route.
+// Handlers called without a pattern mux fall back to the path between prefix
+// and suffix, which must be a single segment.
 // Example: /devices/abc-123/heartbeat -> abc-123
-func extractDeviceID(path, prefix, suffix string) string {
+func extractDeviceID(r *http.Request, prefix, suffix string) string {
+	if id := r.PathValue("device_id"); id != "" {
+		return id
+	}
+	path := r.URL.Path
 	if !strings.HasPrefix(path, prefix) {
 		return ""
 	}
 	path = strings.TrimPrefix(path, prefix)
-	if suffix != "" && strings.HasSuffix(path, suffix) {
+	if suffix != "" {
+		if !strings.HasSuffix(path, suffix) {
+			return ""
+		}
 		path = strings.TrimSuffix(path, suffix)
 	}
+	if strings.Contains(path, "/") {
+		return ""
+	}
 	return path
 }
 
-// writeError writes a JSON error response
-func writeError(w http.ResponseWriter, status int, message string) {
+// writeError writes a JSON error response carrying the request's ID
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(ErrorResponse{Msg: message})
+	json.NewEncoder(w).Encode(ErrorResponse{Msg: message, RequestID: requestid.FromContext(r.Context())})
 }
 
 // formatDuration formats a float64 (nanoseconds) as a Go duration string
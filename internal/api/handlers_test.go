@@ -3,19 +3,31 @@ package api
 import (
 	"bytes"
 	"context"
+	"device-fleet-monitoring/internal/core"
 	"device-fleet-monitoring/internal/storage"
 	"encoding/json"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
 
 // mockStore is a mock implementation of storage.Store for testing
 type mockStore struct {
-	addHeartbeatFunc func(ctx context.Context, deviceID string, sentAt time.Time) error
-	addUploadFunc    func(ctx context.Context, deviceID string, sentAt time.Time, uploadTime int) error
-	getStatsFunc     func(ctx context.Context, deviceID string) (float64, float64, error)
+	addHeartbeatFunc   func(ctx context.Context, deviceID string, sentAt time.Time) error
+	addUploadFunc      func(ctx context.Context, deviceID string, sentAt time.Time, uploadTime int) error
+	addEventsFunc      func(ctx context.Context, events []storage.Event) ([]error, error)
+	getStatsFunc       func(ctx context.Context, deviceID string) (float64, float64, error)
+	getStatsWindowFunc func(ctx context.Context, deviceID string, from, to time.Time) (float64, float64, error)
+	getUploadDistFunc  func(ctx context.Context, deviceID string, from, to time.Time) (core.Distribution, error)
+	scanDevicesFunc    func(ctx context.Context, fn func(storage.DeviceSummary) bool) error
+	registerFunc       func(ctx context.Context, deviceIDs []string) ([]string, error)
+	decommissionFunc   func(ctx context.Context, deviceID string, purge bool) error
+	reconcileFunc      func(ctx context.Context, devices []storage.DeviceInfo) ([]string, []string, error)
+	getMetadataFunc    func(ctx context.Context, deviceID string) (storage.DeviceMetadata, error)
+	usageFunc          func(ctx context.Context) (storage.Usage, error)
 }
 
 func (m *mockStore) AddHeartbeat(ctx context.Context, deviceID string, sentAt time.Time) error {
@@ -32,6 +44,13 @@ func (m *mockStore) AddUpload(ctx context.Context, deviceID string, sentAt time.
 	return nil
 }
 
+func (m *mockStore) AddEvents(ctx context.Context, events []storage.Event) ([]error, error) {
+	if m.addEventsFunc != nil {
+		return m.addEventsFunc(ctx, events)
+	}
+	return make([]error, len(events)), nil
+}
+
 func (m *mockStore) GetStats(ctx context.Context, deviceID string) (float64, float64, error) {
 	if m.getStatsFunc != nil {
 		return m.getStatsFunc(ctx, deviceID)
@@ -39,6 +58,62 @@ func (m *mockStore) GetStats(ctx context.Context, deviceID string) (float64, flo
 	return 0, 0, nil
 }
 
+func (m *mockStore) GetStatsWindow(ctx context.Context, deviceID string, from, to time.Time) (float64, float64, error) {
+	if m.getStatsWindowFunc != nil {
+		return m.getStatsWindowFunc(ctx, deviceID, from, to)
+	}
+	return 0, 0, nil
+}
+
+func (m *mockStore) GetUploadDistribution(ctx context.Context, deviceID string, from, to time.Time) (core.Distribution, error) {
+	if m.getUploadDistFunc != nil {
+		return m.getUploadDistFunc(ctx, deviceID, from, to)
+	}
+	return core.Distribution{}, nil
+}
+
+func (m *mockStore) ScanDevices(ctx context.Context, fn func(storage.DeviceSummary) bool) error {
+	if m.scanDevicesFunc != nil {
+		return m.scanDevicesFunc(ctx, fn)
+	}
+	return nil
+}
+
+func (m *mockStore) RegisterDevices(ctx context.Context, deviceIDs []string) ([]string, error) {
+	if m.registerFunc != nil {
+		return m.registerFunc(ctx, deviceIDs)
+	}
+	return deviceIDs, nil
+}
+
+func (m *mockStore) DecommissionDevice(ctx context.Context, deviceID string, purge bool) error {
+	if m.decommissionFunc != nil {
+		return m.decommissionFunc(ctx, deviceID, purge)
+	}
+	return nil
+}
+
+func (m *mockStore) ReconcileDevices(ctx context.Context, devices []storage.DeviceInfo) ([]string, []string, error) {
+	if m.reconcileFunc != nil {
+		return m.reconcileFunc(ctx, devices)
+	}
+	return nil, nil, nil
+}
+
+func (m *mockStore) Usage(ctx context.Context) (storage.Usage, error) {
+	if m.usageFunc != nil {
+		return m.usageFunc(ctx)
+	}
+	return storage.Usage{}, nil
+}
+
+func (m *mockStore) GetMetadata(ctx context.Context, deviceID string) (storage.DeviceMetadata, error) {
+	if m.getMetadataFunc != nil {
+		return m.getMetadataFunc(ctx, deviceID)
+	}
+	return storage.DeviceMetadata{}, nil
+}
+
 // TestHandleHeartbeat_Success tests successful heartbeat recording
 func TestHandleHeartbeat_Success(t *testing.T) {
 	store := &mockStore{
@@ -90,6 +165,34 @@ func TestHandleHeartbeat_DeviceNotFound(t *testing.T) {
 	}
 }
 
+// TestHandleHeartbeat_Decommissioned tests 410 response for a retired device
+func TestHandleHeartbeat_Decommissioned(t *testing.T) {
+	store := &mockStore{
+		addHeartbeatFunc: func(ctx context.Context, deviceID string, sentAt time.Time) error {
+			return storage.ErrDeviceDecommissioned
+		},
+	}
+	handlers := NewHandlers(store)
+
+	reqBody := `{"sent_at":"2024-01-01T12:00:00Z"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/devices/retired-device/heartbeat", bytes.NewBufferString(reqBody))
+	w := httptest.NewRecorder()
+
+	handlers.HandleHeartbeat(w, req)
+
+	if w.Code != http.StatusGone {
+		t.Errorf("expected status 410, got %d", w.Code)
+	}
+
+	var errResp ErrorResponse
+	if err := json.NewDecoder(w.Body).Decode(&errResp); err != nil {
+		t.Fatalf("failed to decode error response: %v", err)
+	}
+	if errResp.Msg != "device decommissioned" {
+		t.Errorf("expected error message 'device decommissioned', got '%s'", errResp.Msg)
+	}
+}
+
 // TestHandleHeartbeat_MalformedJSON tests 400 response for invalid JSON
 func TestHandleHeartbeat_MalformedJSON(t *testing.T) {
 	store := &mockStore{}
@@ -122,6 +225,70 @@ func TestHandleHeartbeat_InvalidSentAt(t *testing.T) {
 	}
 }
 
+// TestHandleHeartbeat_BodyLogging tests that raw bodies are logged only at debug level, truncated
+func TestHandleHeartbeat_BodyLogging(t *testing.T) {
+	var buf bytes.Buffer
+	level := new(slog.LevelVar)
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: level}))
+	handlers := NewHandlers(&mockStore{}, WithLogger(logger))
+
+	reqBody := `{"sent_at":"2024-01-01T12:00:00Z","padding":"` + strings.Repeat("x", 2*maxLoggedBodyBytes) + `"}`
+	send := func() {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/devices/test-device/heartbeat", strings.NewReader(reqBody))
+		handlers.HandleHeartbeat(httptest.NewRecorder(), req)
+	}
+
+	send()
+	if strings.Contains(buf.String(), "raw request body") {
+		t.Fatalf("raw body logged at info level: %s", buf.String())
+	}
+
+	level.Set(slog.LevelDebug)
+	buf.Reset()
+	send()
+	var record struct {
+		Msg       string `json:"msg"`
+		DeviceID  string `json:"device_id"`
+		Body      string `json:"body"`
+		BodyBytes int    `json:"body_bytes"`
+		Truncated bool   `json:"truncated"`
+	}
+	if err := json.NewDecoder(&buf).Decode(&record); err != nil {
+		t.Fatalf("failed to decode log record: %v", err)
+	}
+	if record.Msg != "raw request body" || record.DeviceID != "test-device" {
+		t.Errorf("unexpected first record %+v", record)
+	}
+	if len(record.Body) != maxLoggedBodyBytes || record.BodyBytes != len(reqBody) || !record.Truncated {
+		t.Errorf("body not capped: len=%d body_bytes=%d truncated=%t", len(record.Body), record.BodyBytes, record.Truncated)
+	}
+}
+
+// TestHandleHeartbeat_BodyTooLarge tests 413 response for bodies over the configured limit
+func TestHandleHeartbeat_BodyTooLarge(t *testing.T) {
+	called := false
+	store := &mockStore{
+		addHeartbeatFunc: func(ctx context.Context, deviceID string, sentAt time.Time) error {
+			called = true
+			return nil
+		},
+	}
+	handlers := NewHandlers(store, WithMaxBodyBytes(32))
+
+	reqBody := `{"sent_at":"2024-01-01T12:00:00Z","padding":"xxxxxxxx"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/devices/test-device/heartbeat", bytes.NewBufferString(reqBody))
+	w := httptest.NewRecorder()
+
+	handlers.HandleHeartbeat(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status 413, got %d", w.Code)
+	}
+	if called {
+		t.Error("expected oversized heartbeat not to be stored")
+	}
+}
+
 // TestHandleStatsPost_Success tests successful stats recording
 func TestHandleStatsPost_Success(t *testing.T) {
 	store := &mockStore{
@@ -208,6 +375,25 @@ func TestHandleStatsPost_InvalidSentAt(t *testing.T) {
 	}
 }
 
+// TestHandleStatsPost_ZeroSentAt tests that the simulator's zero sent_at is still accepted
+func TestHandleStatsPost_ZeroSentAt(t *testing.T) {
+	store := storage.NewMemoryStore([]string{"test-device"})
+	handlers := NewHandlers(store)
+
+	reqBody := `{"sent_at":"0001-01-01T00:00:00Z","upload_time":1500}`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/devices/test-device/stats", bytes.NewBufferString(reqBody))
+	w := httptest.NewRecorder()
+
+	handlers.HandleStatsPost(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected status 204, got %d", w.Code)
+	}
+	if _, avg, _ := store.GetStats(context.Background(), "test-device"); avg != 1500 {
+		t.Errorf("expected the upload in the lifetime average, got %v", avg)
+	}
+}
+
 // TestHandleStatsGet_Success tests successful stats retrieval
 func TestHandleStatsGet_Success(t *testing.T) {
 	store := &mockStore{
@@ -244,6 +430,47 @@ func TestHandleStatsGet_Success(t *testing.T) {
 	}
 }
 
+// TestHandleStatsGet_Distribution tests that upload percentiles are formatted as durations
+func TestHandleStatsGet_Distribution(t *testing.T) {
+	store := &mockStore{
+		getUploadDistFunc: func(ctx context.Context, deviceID string, from, to time.Time) (core.Distribution, error) {
+			return core.Distribution{
+				Count: 4,
+				Min:   float64(time.Second),
+				Max:   float64(10 * time.Minute),
+				P50:   float64(90 * time.Second),
+				P90:   float64(5 * time.Minute),
+				P95:   float64(6 * time.Minute),
+				P99:   float64(9 * time.Minute),
+			}, nil
+		},
+	}
+	handlers := NewHandlers(store)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/devices/test-device/stats", nil)
+	w := httptest.NewRecorder()
+
+	handlers.HandleStatsGet(w, req)
+
+	var resp StatsGetResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	want := StatsGetResponse{
+		AvgUploadTime: "0s",
+		UploadCount:   4,
+		MinUploadTime: "1s",
+		MaxUploadTime: "10m0s",
+		P50UploadTime: "1m30s",
+		P90UploadTime: "5m0s",
+		P95UploadTime: "6m0s",
+		P99UploadTime: "9m0s",
+	}
+	if resp != want {
+		t.Errorf("got %+v, want %+v", resp, want)
+	}
+}
+
 // TestHandleStatsGet_DeviceNotFound tests 404 response for unknown device
 func TestHandleStatsGet_DeviceNotFound(t *testing.T) {
 	store := &mockStore{
@@ -263,6 +490,80 @@ func TestHandleStatsGet_DeviceNotFound(t *testing.T) {
 	}
 }
 
+// TestHandleStatsGet_Metadata tests that registry metadata is returned when set
+func TestHandleStatsGet_Metadata(t *testing.T) {
+	store := &mockStore{
+		getMetadataFunc: func(ctx context.Context, deviceID string) (storage.DeviceMetadata, error) {
+			return storage.DeviceMetadata{Type: "camera", Labels: map[string]string{"rack": "r7"}}, nil
+		},
+	}
+	handlers := NewHandlers(store)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/devices/test-device/stats", nil)
+	w := httptest.NewRecorder()
+
+	handlers.HandleStatsGet(w, req)
+
+	var resp StatsGetResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.Metadata == nil || resp.Metadata.Type != "camera" || resp.Metadata.Labels["rack"] != "r7" {
+		t.Errorf("unexpected metadata %+v", resp.Metadata)
+	}
+}
+
+// TestHandleStatsGet_Window tests that from/to select the windowed query
+func TestHandleStatsGet_Window(t *testing.T) {
+	wantFrom := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	wantTo := time.Unix(1704117600, 0) // 2024-01-01T14:00:00Z
+	store := &mockStore{
+		getStatsFunc: func(ctx context.Context, deviceID string) (float64, float64, error) {
+			t.Error("expected GetStatsWindow, got GetStats")
+			return 0, 0, nil
+		},
+		getStatsWindowFunc: func(ctx context.Context, deviceID string, from, to time.Time) (float64, float64, error) {
+			if !from.Equal(wantFrom) || !to.Equal(wantTo) {
+				t.Errorf("expected window %v..%v, got %v..%v", wantFrom, wantTo, from, to)
+			}
+			return 50, 1000, nil
+		},
+	}
+	handlers := NewHandlers(store)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/devices/test-device/stats?from=2024-01-01T12:00:00Z&to=1704117600", nil)
+	w := httptest.NewRecorder()
+
+	handlers.HandleStatsGet(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	var resp StatsGetResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.Uptime != 50 || resp.AvgUploadTime != "1µs" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+// TestHandleStatsGet_InvalidWindow tests 400 responses for bad from/to values
+func TestHandleStatsGet_InvalidWindow(t *testing.T) {
+	handlers := NewHandlers(&mockStore{})
+
+	for _, query := range []string{"from=yesterday", "to=2024-13-01T00:00:00Z", "from=1704117600&to=1704110400"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/devices/test-device/stats?"+query, nil)
+		w := httptest.NewRecorder()
+
+		handlers.HandleStatsGet(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, w.Code)
+		}
+	}
+}
+
 // TestIntegration_HeartbeatThenGetStats tests that heartbeat affects stats
 func TestIntegration_HeartbeatThenGetStats(t *testing.T) {
 	// Use real memory store for integration test
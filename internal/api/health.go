@@ -0,0 +1,22 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// HandleHealth handles GET /healthz, reporting the devices the store
+// currently accepts events for
+func (h *Handlers) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	usage, err := h.store.Usage(r.Context())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "internal server error")
+		h.logger.ErrorContext(r.Context(), "internal error", "endpoint", "/healthz", "error", err)
+		return
+	}
+
+	// Return 200 with JSON response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(HealthResponse{Status: "ok", Devices: usage.ActiveDevices})
+}
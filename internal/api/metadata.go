@@ -0,0 +1,75 @@
+package api
+
+import (
+	"device-fleet-monitoring/internal/storage"
+	"errors"
+	"net/url"
+	"sort"
+)
+
+// metadataTerm requires a metadata key to have a given value
+type metadataTerm struct {
+	key   string
+	value string
+}
+
+// metadataFilter matches devices whose metadata satisfies every term
+type metadataFilter []metadataTerm
+
+// parseMetadataFilter reads type, site, model, firmware, tag and label.<name>
+// query parameters. Repeating a parameter requires all of its values, which
+// is only satisfiable for tags.
+func parseMetadataFilter(values url.Values) (metadataFilter, error) {
+	var filter metadataFilter
+	for key, vals := range values {
+		if !storage.IsMetadataKey(key) {
+			continue
+		}
+		for _, value := range vals {
+			if value == "" {
+				return nil, errors.New(key + " filter must not be empty")
+			}
+			filter = append(filter, metadataTerm{key: key, value: value})
+		}
+	}
+	// Map iteration order is random; keep the filter deterministic
+	sort.Slice(filter, func(i, j int) bool {
+		if filter[i].key != filter[j].key {
+			return filter[i].key < filter[j].key
+		}
+		return filter[i].value < filter[j].value
+	})
+	return filter, nil
+}
+
+// matches reports whether md satisfies every term
+func (f metadataFilter) matches(md storage.DeviceMetadata) bool {
+	for _, term := range f {
+		found := false
+		for _, value := range md.Values(term.key) {
+			if value == term.value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// newDeviceMetadata converts registry metadata to its response form, or nil if unset
+func newDeviceMetadata(md storage.DeviceMetadata) *DeviceMetadata {
+	if md.IsZero() {
+		return nil
+	}
+	return &DeviceMetadata{
+		Type:     md.Type,
+		Site:     md.Site,
+		Model:    md.Model,
+		Firmware: md.Firmware,
+		Tags:     md.Tags,
+		Labels:   md.Labels,
+	}
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"time"
 )
 
@@ -34,6 +35,22 @@ func (ft *FlexTime) UnmarshalJSON(b []byte) error {
 	return fmt.Errorf("sent_at must be either Unix timestamp or RFC3339 string")
 }
 
+// ParseFlexTime parses a timestamp outside of JSON, such as a query parameter,
+// with the same rules as FlexTime: an integer is a Unix timestamp and anything
+// else must be an RFC3339 string
+func ParseFlexTime(value string) (time.Time, error) {
+	raw := []byte(value)
+	if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+		raw, _ = json.Marshal(value)
+	}
+
+	var ft FlexTime
+	if err := ft.UnmarshalJSON(raw); err != nil {
+		return time.Time{}, err
+	}
+	return ft.Time, nil
+}
+
 // HeartbeatRequest represents the payload for POST /devices/{device_id}/heartbeat
 type HeartbeatRequest struct {
 	SentAt FlexTime `json:"sent_at"`
@@ -45,13 +62,221 @@ type StatsPostRequest struct {
 	UploadTime int      `json:"upload_time"`
 }
 
+// HeartbeatEvent is the data of a heartbeat event on GET /events
+type HeartbeatEvent struct {
+	DeviceID string    `json:"device_id"`
+	SentAt   time.Time `json:"sent_at"`
+}
+
+// UploadEvent is the data of an upload event on GET /events
+type UploadEvent struct {
+	DeviceID   string     `json:"device_id"`
+	SentAt     *time.Time `json:"sent_at,omitempty"`
+	UploadTime string     `json:"upload_time"` // Formatted like avg_upload_time
+}
+
+// StatsEvent is the data of a stats event on GET /events: the device's
+// stats after the heartbeats or uploads just accepted
+type StatsEvent struct {
+	DeviceID      string  `json:"device_id"`
+	Uptime        float64 `json:"uptime"`
+	AvgUploadTime string  `json:"avg_upload_time"`
+}
+
+// IngestEvent represents one item of the request body for POST /ingest
+type IngestEvent struct {
+	DeviceID   string   `json:"device_id"`
+	Type       string   `json:"type"` // heartbeat or stats
+	SentAt     FlexTime `json:"sent_at"`
+	UploadTime int      `json:"upload_time"` // stats only
+}
+
+// StreamMessage is one message a device sends on GET /devices/{device_id}/stream:
+// a HeartbeatRequest, or a StatsPostRequest when upload_time is present
+type StreamMessage struct {
+	SentAt     FlexTime `json:"sent_at"`
+	UploadTime *int     `json:"upload_time"`
+}
+
+// StreamAck answers each StreamMessage, in order
+type StreamAck struct {
+	Seq    int    `json:"seq"`    // Position of the message on the connection, from 1
+	Status string `json:"status"` // accepted or rejected
+	Reason string `json:"reason,omitempty"`
+}
+
+// BatchResponse represents the response for batch ingestion endpoints
+type BatchResponse struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Results  []BatchItemResult `json:"results"`
+}
+
+// BatchItemResult represents the outcome of one batch item
+type BatchItemResult struct {
+	Index  int    `json:"index"`
+	Status string `json:"status"` // accepted or rejected
+	Reason string `json:"reason,omitempty"`
+}
+
 // StatsGetResponse represents the response for GET /devices/{device_id}/stats
 type StatsGetResponse struct {
 	Uptime        float64 `json:"uptime"`
 	AvgUploadTime string  `json:"avg_upload_time"`
+
+	// Upload time distribution, formatted like avg_upload_time
+	UploadCount   int64  `json:"upload_count"`
+	MinUploadTime string `json:"min_upload_time"`
+	MaxUploadTime string `json:"max_upload_time"`
+	P50UploadTime string `json:"p50_upload_time"`
+	P90UploadTime string `json:"p90_upload_time"`
+	P95UploadTime string `json:"p95_upload_time"`
+	P99UploadTime string `json:"p99_upload_time"`
+
+	Metadata *DeviceMetadata `json:"metadata,omitempty"`
+}
+
+// DeviceMetadata represents a device's registry metadata
+type DeviceMetadata struct {
+	Type     string            `json:"type,omitempty"`
+	Site     string            `json:"site,omitempty"`
+	Model    string            `json:"model,omitempty"`
+	Firmware string            `json:"firmware,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// DeviceListItem represents one device in the response for GET /devices
+type DeviceListItem struct {
+	DeviceID      string     `json:"device_id"`
+	Uptime        float64    `json:"uptime"`
+	AvgUploadTime string     `json:"avg_upload_time"`
+	UploadCount   int64      `json:"upload_count"`
+	FirstSeen     *time.Time `json:"first_seen"`
+	LastSeen      *time.Time `json:"last_seen"`
+
+	Decommissioned bool            `json:"decommissioned,omitempty"`
+	Metadata       *DeviceMetadata `json:"metadata,omitempty"`
+}
+
+// DeviceListResponse represents the response for GET /devices
+type DeviceListResponse struct {
+	Devices    []DeviceListItem `json:"devices"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+// FleetStatsResponse represents the response for GET /fleet/stats
+type FleetStatsResponse struct {
+	FleetStats
+	UptimeThreshold float64 `json:"uptime_threshold"`
+
+	// Per-group statistics when group_by is set
+	GroupBy string            `json:"group_by,omitempty"`
+	Groups  []FleetGroupStats `json:"groups,omitempty"`
+}
+
+// FleetGroupStats represents the statistics of one group in FleetStatsResponse
+type FleetGroupStats struct {
+	Key string `json:"key"` // Empty for devices without a value for the group_by key
+	FleetStats
+}
+
+// FleetStats represents aggregates over a set of devices
+type FleetStats struct {
+	Devices          int `json:"devices"` // Active devices; every other field covers only these
+	ReportingDevices int `json:"reporting_devices"`
+	NeverSeen        int `json:"never_seen"`
+	Decommissioned   int `json:"decommissioned"`
+
+	// Uptime across reporting devices
+	MeanUptime     float64 `json:"mean_uptime"`
+	MedianUptime   float64 `json:"median_uptime"`
+	BelowThreshold int     `json:"below_threshold"`
+
+	// Upload times merged across all devices, formatted like avg_upload_time
+	UploadCount   int64  `json:"upload_count"`
+	AvgUploadTime string `json:"avg_upload_time"`
+	MinUploadTime string `json:"min_upload_time"`
+	MaxUploadTime string `json:"max_upload_time"`
+	P50UploadTime string `json:"p50_upload_time"`
+	P90UploadTime string `json:"p90_upload_time"`
+	P95UploadTime string `json:"p95_upload_time"`
+	P99UploadTime string `json:"p99_upload_time"`
+}
+
+// RegisterDevicesRequest represents the request body for POST /devices.
+// Either a single device_id or a list of device_ids may be given.
+type RegisterDevicesRequest struct {
+	DeviceID  string   `json:"device_id,omitempty"`
+	DeviceIDs []string `json:"device_ids,omitempty"`
+}
+
+// RegisterDevicesResponse represents the response for POST /devices
+type RegisterDevicesResponse struct {
+	Registered []string `json:"registered"` // Newly added or reactivated
+	Existing   []string `json:"existing"`   // Already registered and active
+}
+
+// AlertItem represents one pending or firing alert in the response for GET /alerts
+type AlertItem struct {
+	Rule      string     `json:"rule"`
+	Kind      string     `json:"kind"`
+	DeviceID  string     `json:"device_id"`
+	State     string     `json:"state"` // pending or firing
+	Value     float64    `json:"value"`
+	Threshold float64    `json:"threshold"`
+	Unit      string     `json:"unit"` // percent or seconds
+	Since     time.Time  `json:"since"`
+	FiredAt   *time.Time `json:"fired_at,omitempty"`
+}
+
+// AlertListResponse represents the response for GET /alerts
+type AlertListResponse struct {
+	Alerts      []AlertItem `json:"alerts"`
+	EvaluatedAt *time.Time  `json:"evaluated_at"` // Null until rules were first evaluated
+}
+
+// WebhookEndpointStatus represents one endpoint in the response for GET /webhooks
+type WebhookEndpointStatus struct {
+	Name           string     `json:"name"`
+	Queued         int        `json:"queued"`
+	Delivered      uint64     `json:"delivered"`
+	FailedAttempts uint64     `json:"failed_attempts"`
+	DeadLettered   uint64     `json:"dead_lettered"`
+	LastDelivery   *time.Time `json:"last_delivery"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastErrorAt    *time.Time `json:"last_error_at,omitempty"`
+}
+
+// WebhookStatusResponse represents the response for GET /webhooks
+type WebhookStatusResponse struct {
+	Endpoints []WebhookEndpointStatus `json:"endpoints"`
+}
+
+// DeadLetter represents one undelivered webhook in the response for GET /webhooks/dead-letters
+type DeadLetter struct {
+	ID       string          `json:"id"`
+	Endpoint string          `json:"endpoint"`
+	Type     string          `json:"type"`
+	Payload  json.RawMessage `json:"payload"` // The body that was sent
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	FailedAt time.Time       `json:"failed_at"`
+}
+
+// DeadLettersResponse represents the response for GET /webhooks/dead-letters
+type DeadLettersResponse struct {
+	DeadLetters []DeadLetter `json:"dead_letters"`
+}
+
+// HealthResponse represents the response for GET /healthz
+type HealthResponse struct {
+	Status  string `json:"status"`
+	Devices int    `json:"devices"` // Devices accepting events
 }
 
 // ErrorResponse represents error responses for all endpoints
 type ErrorResponse struct {
-	Msg string `json:"msg"`
+	Msg       string `json:"msg"`
+	RequestID string `json:"request_id,omitempty"` // Matches the X-Request-ID response header
 }
@@ -0,0 +1,19 @@
+package api
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// OpenAPISpec is the OpenAPI 3.1 description of the HTTP API. Tests in
+// internal/platform check it against every route and response.
+//
+//go:embed openapi.json
+var OpenAPISpec []byte
+
+// HandleOpenAPI handles GET /openapi.json
+func HandleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(OpenAPISpec)
+}
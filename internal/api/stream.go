@@ -0,0 +1,223 @@
+package api
+
+import (
+	"device-fleet-monitoring/internal/storage"
+	"device-fleet-monitoring/internal/websocket"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Device stream timing
+const (
+	streamPingInterval = 30 * time.Second // Pings keep idle connections and proxies alive
+	streamReadTimeout  = 90 * time.Second // Longest silence, pongs included, before a stream is dropped
+	streamWriteTimeout = 10 * time.Second // Longest a device may take to accept one frame
+)
+
+// streamSet tracks open device streams so shutdown can close them; hijacked
+// connections are invisible to the HTTP server's graceful shutdown
+type streamSet struct {
+	mu     sync.Mutex
+	conns  map[*websocket.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// add registers conn, or reports false once the set is closed
+func (s *streamSet) add(conn *websocket.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[*websocket.Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+// remove unregisters conn once its handler is done with it
+func (s *streamSet) remove(conn *websocket.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+	s.wg.Done()
+}
+
+// CloseStreams ends every device stream with a going-away close frame and
+// waits for their handlers to return; later upgrades are refused
+func (h *Handlers) CloseStreams() {
+	h.streams.mu.Lock()
+	h.streams.closed = true
+	for conn := range h.streams.conns {
+		conn.WriteClose(websocket.CloseGoingAway, "server shutting down")
+		conn.Close()
+	}
+	h.streams.mu.Unlock()
+	h.streams.wg.Wait()
+}
+
+// HandleDeviceStream handles GET /devices/{device_id}/stream, a WebSocket
+// over which a device sends heartbeats and stats and gets an ack for each
+func (h *Handlers) HandleDeviceStream(w http.ResponseWriter, r *http.Request) {
+	// Parse device_id from URL path
+	deviceID := extractDeviceID(r, "/api/v1/devices/", "/stream")
+	if deviceID == "" {
+		writeError(w, r, http.StatusBadRequest, "invalid device_id in path")
+		h.logger.WarnContext(r.Context(), "invalid device_id in path", "endpoint", "/stream")
+		return
+	}
+
+	// Validate the handshake before touching the store
+	if err := websocket.CheckHandshake(r); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, websocket.ErrUnsupportedVersion) {
+			w.Header().Set("Sec-WebSocket-Version", "13")
+			status = http.StatusUpgradeRequired
+		}
+		writeError(w, r, status, err.Error())
+		h.logger.WarnContext(r.Context(), "invalid websocket handshake", "device_id", deviceID, "endpoint", "/stream", "error", err)
+		return
+	}
+	if _, err := h.store.GetMetadata(r.Context(), deviceID); err != nil {
+		if errors.Is(err, storage.ErrDeviceNotFound) {
+			writeError(w, r, http.StatusNotFound, "device not found")
+			h.logger.WarnContext(r.Context(), "device not found", "device_id", deviceID, "endpoint", "/stream", "error", err)
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, "internal server error")
+		h.logger.ErrorContext(r.Context(), "internal error", "device_id", deviceID, "endpoint", "/stream", "error", err)
+		return
+	}
+
+	conn, err := websocket.Upgrade(w, r, websocket.Config{
+		MaxMessageSize: h.maxBodyBytes,
+		ReadTimeout:    streamReadTimeout,
+		WriteTimeout:   streamWriteTimeout,
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "websocket upgrade failed")
+		h.logger.ErrorContext(r.Context(), "websocket upgrade failed", "device_id", deviceID, "endpoint", "/stream", "error", err)
+		return
+	}
+	defer conn.Close()
+	if !h.streams.add(conn) {
+		conn.WriteClose(websocket.CloseGoingAway, "server shutting down")
+		return
+	}
+	defer h.streams.remove(conn)
+
+	// Ping until the stream ends
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(streamPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if conn.WritePing() != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	accepted, rejected := 0, 0
+	var endErr error
+	for seq := 1; ; seq++ {
+		op, data, err := conn.ReadMessage()
+		if err != nil {
+			endErr = err
+			break
+		}
+		if op != websocket.OpText {
+			conn.WriteClose(websocket.CloseUnsupportedData, "messages must be JSON text")
+			endErr = errors.New("binary message")
+			break
+		}
+
+		ack, storeErr := h.applyStreamMessage(r, deviceID, seq, data)
+		if ack.Status == itemAccepted {
+			accepted++
+		} else {
+			rejected++
+		}
+		payload, _ := json.Marshal(ack)
+		if err := conn.WriteMessage(websocket.OpText, payload); err != nil {
+			endErr = err
+			break
+		}
+
+		// Nothing more can be stored for a device that is gone
+		if errors.Is(storeErr, storage.ErrDeviceNotFound) || errors.Is(storeErr, storage.ErrDeviceDecommissioned) {
+			conn.WriteClose(websocket.ClosePolicyViolation, ack.Reason)
+			endErr = storeErr
+			break
+		}
+	}
+
+	// A device closing normally or going away is not worth a reason
+	attrs := []any{"method", "GET", "endpoint", "/stream", "device_id", deviceID, "accepted", accepted, "rejected", rejected, "status", 101}
+	var closeErr *websocket.CloseError
+	if endErr != nil && !(errors.As(endErr, &closeErr) && (closeErr.Code == websocket.CloseNormal || closeErr.Code == websocket.CloseGoingAway)) {
+		attrs = append(attrs, "reason", endErr.Error())
+	}
+	h.logger.InfoContext(r.Context(), "request completed", attrs...)
+}
+
+// applyStreamMessage validates one stream message like POST /heartbeat or
+// POST /stats and stores it, returning its ack and any store error
+func (h *Handlers) applyStreamMessage(r *http.Request, deviceID string, seq int, data []byte) (StreamAck, error) {
+	h.logBody(r, deviceID, "/stream", data)
+	reject := func(reason string) StreamAck {
+		h.ingest.RecordIngest("/stream", 0, 1)
+		return StreamAck{Seq: seq, Status: itemRejected, Reason: reason}
+	}
+
+	var msg StreamMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return reject("invalid JSON payload"), nil
+	}
+	event := storage.Event{DeviceID: deviceID, SentAt: msg.SentAt.Time}
+	if msg.UploadTime == nil {
+		if msg.SentAt.IsZero() {
+			return reject("invalid sent_at timestamp"), nil
+		}
+		event.Kind = storage.EventHeartbeat
+	} else {
+		if *msg.UploadTime < 0 {
+			return reject("upload_time must be non-negative"), nil
+		}
+		event.Kind, event.UploadTime = storage.EventUpload, *msg.UploadTime
+	}
+	// Filters such as rate limits apply per message, not per stream
+	if reason := filterEvent(r.Context(), event); reason != "" {
+		return reject(reason), nil
+	}
+
+	var err error
+	if event.Kind == storage.EventHeartbeat {
+		err = h.store.AddHeartbeat(r.Context(), deviceID, event.SentAt)
+	} else {
+		err = h.store.AddUpload(r.Context(), deviceID, event.SentAt, event.UploadTime)
+	}
+	if err != nil {
+		reason := rejectReason(err)
+		if reason == "internal error" {
+			h.logger.ErrorContext(r.Context(), "internal error", "device_id", deviceID, "endpoint", "/stream", "error", err)
+		}
+		return reject(reason), err
+	}
+
+	h.ingest.RecordIngest("/stream", 1, 0)
+	h.publishEvents(r.Context(), []storage.Event{event})
+	return StreamAck{Seq: seq, Status: itemAccepted}, nil
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"context"
+	"device-fleet-monitoring/internal/storage"
+	"device-fleet-monitoring/internal/websocket"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialStream opens the stream of deviceID on a test server
+func dialStream(t *testing.T, server *httptest.Server, deviceID string) (*websocket.Conn, error) {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/v1/devices/" + deviceID + "/stream"
+	conn, err := websocket.Dial(url, nil, websocket.Config{ReadTimeout: 5 * time.Second})
+	if err == nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, err
+}
+
+// send writes a message and reads its ack
+func send(t *testing.T, conn *websocket.Conn, message string) StreamAck {
+	t.Helper()
+	if err := conn.WriteMessage(websocket.OpText, []byte(message)); err != nil {
+		t.Fatalf("writing %s: %v", message, err)
+	}
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("reading ack of %s: %v", message, err)
+	}
+	var ack StreamAck
+	if err := json.Unmarshal(data, &ack); err != nil {
+		t.Fatalf("invalid ack %s: %v", data, err)
+	}
+	return ack
+}
+
+// expectClose reads until the server closes the stream with code
+func expectClose(t *testing.T, conn *websocket.Conn, code int) {
+	t.Helper()
+	var closeErr *websocket.CloseError
+	if _, _, err := conn.ReadMessage(); !errors.As(err, &closeErr) || closeErr.Code != code {
+		t.Errorf("expected close %d, got %v", code, err)
+	}
+}
+
+func TestHandleDeviceStream_AcksMessages(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore([]string{"cam-1", "cam-2"})
+	handlers := NewHandlers(store, WithLogger(slog.New(slog.DiscardHandler)))
+	server := httptest.NewServer(http.HandlerFunc(handlers.HandleDeviceStream))
+	t.Cleanup(server.Close)
+
+	if _, err := dialStream(t, server, "cam-9"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected an unknown device to get 404, got %v", err)
+	}
+
+	conn, err := dialStream(t, server, "cam-1")
+	if err != nil {
+		t.Fatalf("dialing stream: %v", err)
+	}
+	tests := []struct {
+		message string
+		want    StreamAck
+	}{
+		{`{"sent_at":"2024-01-15T10:00:00Z"}`, StreamAck{Seq: 1, Status: itemAccepted}},
+		{`{"sent_at":"2024-01-15T10:01:00Z","upload_time":2000000000}`, StreamAck{Seq: 2, Status: itemAccepted}},
+		{`{"upload_time":-1}`, StreamAck{Seq: 3, Status: itemRejected, Reason: "upload_time must be non-negative"}},
+		{`{}`, StreamAck{Seq: 4, Status: itemRejected, Reason: "invalid sent_at timestamp"}},
+		{`not json`, StreamAck{Seq: 5, Status: itemRejected, Reason: "invalid JSON payload"}},
+	}
+	for _, tt := range tests {
+		if ack := send(t, conn, tt.message); ack != tt.want {
+			t.Errorf("%s: expected %+v, got %+v", tt.message, tt.want, ack)
+		}
+	}
+	if _, avgUpload, err := store.GetStats(ctx, "cam-1"); err != nil || avgUpload != 2e9 {
+		t.Errorf("expected the upload to be stored, got %v %v", avgUpload, err)
+	}
+
+	// A decommissioned device gets its rejection, then the stream ends
+	store.DecommissionDevice(ctx, "cam-1", false)
+	if ack := send(t, conn, `{"sent_at":"2024-01-15T10:02:00Z"}`); ack.Status != itemRejected || ack.Reason != "device decommissioned" {
+		t.Errorf("expected a decommissioned rejection, got %+v", ack)
+	}
+	expectClose(t, conn, websocket.ClosePolicyViolation)
+
+	// Binary messages are refused
+	binary, err := dialStream(t, server, "cam-2")
+	if err != nil {
+		t.Fatalf("dialing stream: %v", err)
+	}
+	binary.WriteMessage(websocket.OpBinary, []byte{1})
+	expectClose(t, binary, websocket.CloseUnsupportedData)
+}
+
+func TestHandlers_CloseStreams(t *testing.T) {
+	handlers := NewHandlers(storage.NewMemoryStore([]string{"cam-1"}), WithLogger(slog.New(slog.DiscardHandler)))
+	server := httptest.NewServer(http.HandlerFunc(handlers.HandleDeviceStream))
+	t.Cleanup(server.Close)
+
+	conn, err := dialStream(t, server, "cam-1")
+	if err != nil {
+		t.Fatalf("dialing stream: %v", err)
+	}
+	// The ack proves the stream is registered before shutdown starts
+	send(t, conn, `{"sent_at":"2024-01-15T10:00:00Z"}`)
+
+	handlers.CloseStreams()
+	expectClose(t, conn, websocket.CloseGoingAway)
+	late, err := dialStream(t, server, "cam-1")
+	if err != nil {
+		t.Fatalf("dialing stream: %v", err)
+	}
+	expectClose(t, late, websocket.CloseGoingAway)
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"device-fleet-monitoring/internal/notify"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// HandleWebhookStatus handles GET /webhooks
+func (h *Handlers) HandleWebhookStatus(w http.ResponseWriter, r *http.Request) {
+	resp := WebhookStatusResponse{Endpoints: []WebhookEndpointStatus{}}
+	if h.webhooks != nil {
+		for _, s := range h.webhooks.Status() {
+			resp.Endpoints = append(resp.Endpoints, WebhookEndpointStatus{
+				Name:           s.Name,
+				Queued:         s.Queued,
+				Delivered:      s.Delivered,
+				FailedAttempts: s.FailedAttempts,
+				DeadLettered:   s.DeadLettered,
+				LastDelivery:   optionalTime(s.LastDelivery),
+				LastError:      s.LastError,
+				LastErrorAt:    optionalTime(s.LastErrorAt),
+			})
+		}
+	}
+
+	// Return 200 with JSON response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+	h.logger.InfoContext(r.Context(), "request completed", "method", "GET", "endpoint", "/webhooks", "count", len(resp.Endpoints), "status", 200)
+}
+
+// HandleDeadLetters handles GET /webhooks/dead-letters
+func (h *Handlers) HandleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	resp := DeadLettersResponse{DeadLetters: []DeadLetter{}}
+	if h.webhooks != nil {
+		for _, letter := range h.webhooks.DeadLetters() {
+			resp.DeadLetters = append(resp.DeadLetters, DeadLetter{
+				ID:       letter.ID,
+				Endpoint: letter.Endpoint,
+				Type:     letter.Type,
+				Payload:  letter.Payload,
+				Attempts: letter.Attempts,
+				Error:    letter.Error,
+				FailedAt: letter.At,
+			})
+		}
+	}
+
+	// Return 200 with JSON response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+	h.logger.InfoContext(r.Context(), "request completed", "method", "GET", "endpoint", "/webhooks/dead-letters", "count", len(resp.DeadLetters), "status", 200)
+}
+
+// HandleDeadLetterRetry handles POST /webhooks/dead-letters/{id}/retry
+func (h *Handlers) HandleDeadLetterRetry(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	err := notify.ErrDeadLetterNotFound
+	if h.webhooks != nil {
+		err = h.webhooks.Retry(id)
+	}
+	switch {
+	case errors.Is(err, notify.ErrDeadLetterNotFound):
+		writeError(w, r, http.StatusNotFound, "dead letter not found")
+		h.logger.WarnContext(r.Context(), "dead letter not found", "endpoint", "/webhooks/dead-letters", "delivery_id", id)
+		return
+	case errors.Is(err, notify.ErrQueueFull):
+		writeError(w, r, http.StatusServiceUnavailable, "endpoint queue is full")
+		h.logger.WarnContext(r.Context(), "endpoint queue is full", "endpoint", "/webhooks/dead-letters", "delivery_id", id)
+		return
+	case err != nil:
+		writeError(w, r, http.StatusInternalServerError, "internal server error")
+		h.logger.ErrorContext(r.Context(), "internal error", "endpoint", "/webhooks/dead-letters", "delivery_id", id, "error", err)
+		return
+	}
+
+	// Return 202; delivery happens in the background
+	w.WriteHeader(http.StatusAccepted)
+	h.logger.InfoContext(r.Context(), "request completed", "method", "POST", "endpoint", "/webhooks/dead-letters", "delivery_id", id, "status", 202)
+}
+
+// optionalTime returns nil for the zero time
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,299 @@
+// Package auth verifies device credentials on ingest requests and operator
+// tokens on everything else.
+//
+// Devices authenticate with their own secret, either sent directly as
+// "Authorization: Bearer <secret>" or used as the key of an HMAC-SHA256
+// signature over the request:
+//
+//	X-Timestamp: <unix seconds>
+//	X-Signature: hex(HMAC-SHA256(secret, timestamp + "\n" + method + "\n" + path + "\n" + body))
+//
+// Signed requests are rejected if their timestamp is outside the allowed
+// clock skew or if the same signature was already accepted.
+//
+// UDP heartbeats carry no headers; they are signed the same way with
+// DatagramMethod as the method, the device ID as the path and no body.
+//
+// Operators authenticate with "Authorization: Bearer <token>"; each token
+// carries a set of scopes.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request headers of a signed device request
+const (
+	TimestampHeader = "X-Timestamp"
+	SignatureHeader = "X-Signature"
+)
+
+// DatagramMethod takes the place of the HTTP method in UDP heartbeat signatures
+const DatagramMethod = "UDP"
+
+// DefaultClockSkew is how far a signed request's timestamp may be from the server clock
+const DefaultClockSkew = 5 * time.Minute
+
+// Scope grants an operator token access to a group of endpoints
+type Scope string
+
+// Operator scopes
+const (
+	ScopeRead   Scope = "read"   // Device stats, listings, fleet stats and metrics
+	ScopeIngest Scope = "ingest" // Cross-device batch ingestion
+	ScopeAdmin  Scope = "admin"  // Device registration, decommissioning and log level
+)
+
+// ParseScope validates a scope name
+func ParseScope(name string) (Scope, error) {
+	switch scope := Scope(name); scope {
+	case ScopeRead, ScopeIngest, ScopeAdmin:
+		return scope, nil
+	}
+	return "", fmt.Errorf("unknown scope %q (want read, ingest or admin)", name)
+}
+
+// Authentication errors. ErrUnauthenticated and its wrappers map to 401,
+// ErrForbidden to 403.
+var (
+	ErrUnauthenticated = errors.New("missing or invalid credentials")
+	ErrReplayed        = fmt.Errorf("%w: signature already used", ErrUnauthenticated)
+	ErrClockSkew       = fmt.Errorf("%w: timestamp outside allowed clock skew", ErrUnauthenticated)
+	ErrForbidden       = errors.New("token lacks required scope")
+)
+
+// OperatorToken is a bearer token with the scopes it grants
+type OperatorToken struct {
+	Name   string // Identifies the token in logs; never the token itself
+	Token  string
+	Scopes []Scope
+}
+
+// Config holds configuration for Authenticator
+type Config struct {
+	// DeviceSecrets maps device IDs to their secrets. Nil disables device
+	// authentication; an empty map rejects every device.
+	DeviceSecrets map[string]string
+
+	// OperatorTokens are the accepted operator tokens. Nil disables operator
+	// authentication.
+	OperatorTokens []OperatorToken
+
+	ClockSkew time.Duration    // Defaults to DefaultClockSkew
+	Now       func() time.Time // Defaults to time.Now
+}
+
+// operator is an operator token as held by Authenticator
+type operator struct {
+	name   string
+	scopes map[Scope]bool
+}
+
+// Authenticator verifies device and operator credentials. Credentials can
+// be replaced at runtime with SetDeviceSecrets and SetOperatorTokens.
+type Authenticator struct {
+	skew time.Duration
+	now  func() time.Time
+
+	mu        sync.RWMutex
+	secrets   map[string][]byte
+	operators map[[sha256.Size]byte]operator // Keyed by token hash so lookups don't leak timing
+
+	replayMu  sync.Mutex
+	seen      map[string]time.Time // Accepted signatures and when they can be forgotten
+	lastSweep time.Time
+}
+
+// NewAuthenticator creates an Authenticator from config
+func NewAuthenticator(config Config) *Authenticator {
+	a := &Authenticator{
+		skew: config.ClockSkew,
+		now:  config.Now,
+		seen: make(map[string]time.Time),
+	}
+	if a.skew <= 0 {
+		a.skew = DefaultClockSkew
+	}
+	if a.now == nil {
+		a.now = time.Now
+	}
+	a.SetDeviceSecrets(config.DeviceSecrets)
+	a.SetOperatorTokens(config.OperatorTokens)
+	return a
+}
+
+// SetDeviceSecrets replaces the device secrets; nil disables device authentication
+func (a *Authenticator) SetDeviceSecrets(secrets map[string]string) {
+	var keyed map[string][]byte
+	if secrets != nil {
+		keyed = make(map[string][]byte, len(secrets))
+		for id, secret := range secrets {
+			keyed[id] = []byte(secret)
+		}
+	}
+	a.mu.Lock()
+	a.secrets = keyed
+	a.mu.Unlock()
+}
+
+// SetOperatorTokens replaces the operator tokens; nil disables operator authentication
+func (a *Authenticator) SetOperatorTokens(tokens []OperatorToken) {
+	var operators map[[sha256.Size]byte]operator
+	if tokens != nil {
+		operators = make(map[[sha256.Size]byte]operator, len(tokens))
+		for _, token := range tokens {
+			scopes := make(map[Scope]bool, len(token.Scopes))
+			for _, scope := range token.Scopes {
+				scopes[scope] = true
+			}
+			operators[sha256.Sum256([]byte(token.Token))] = operator{name: token.Name, scopes: scopes}
+		}
+	}
+	a.mu.Lock()
+	a.operators = operators
+	a.mu.Unlock()
+}
+
+// DeviceAuthEnabled reports whether ingest requests must carry device credentials
+func (a *Authenticator) DeviceAuthEnabled() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.secrets != nil
+}
+
+// OperatorAuthEnabled reports whether operator endpoints require a token
+func (a *Authenticator) OperatorAuthEnabled() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.operators != nil
+}
+
+// VerifyDevice checks that r carries valid credentials for deviceID. body is
+// the full request body, which signed requests cover.
+func (a *Authenticator) VerifyDevice(r *http.Request, deviceID string, body []byte) error {
+	// Unknown devices fail the same way as bad credentials
+	a.mu.RLock()
+	secret, ok := a.secrets[deviceID]
+	a.mu.RUnlock()
+
+	if token, isBearer := bearerToken(r); isBearer {
+		if !ok || !hmac.Equal([]byte(token), secret) {
+			return ErrUnauthenticated
+		}
+		return nil
+	}
+
+	signature := r.Header.Get(SignatureHeader)
+	timestamp := r.Header.Get(TimestampHeader)
+	if signature == "" || timestamp == "" {
+		return ErrUnauthenticated
+	}
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrUnauthenticated
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return ErrUnauthenticated
+	}
+	if !ok || !hmac.Equal(got, Sign(secret, timestamp, r.Method, r.URL.Path, body)) {
+		return ErrUnauthenticated
+	}
+	return a.checkFresh(deviceID, sent, got)
+}
+
+// VerifyDatagram checks the signature of a UDP heartbeat from deviceID
+// stamped with timestamp, in unix seconds. The same clock skew and replay
+// checks as for signed requests apply.
+func (a *Authenticator) VerifyDatagram(deviceID string, timestamp int64, signature []byte) error {
+	a.mu.RLock()
+	secret, ok := a.secrets[deviceID]
+	a.mu.RUnlock()
+
+	want := Sign(secret, strconv.FormatInt(timestamp, 10), DatagramMethod, deviceID, nil)
+	if !ok || !hmac.Equal(signature, want) {
+		return ErrUnauthenticated
+	}
+	return a.checkFresh(deviceID, timestamp, signature)
+}
+
+// checkFresh rejects a valid signature whose timestamp, in unix seconds, is
+// outside the clock skew or which was already accepted
+func (a *Authenticator) checkFresh(deviceID string, timestamp int64, signature []byte) error {
+	now := a.now()
+	sentAt := time.Unix(timestamp, 0)
+	if sentAt.Before(now.Add(-a.skew)) || sentAt.After(now.Add(a.skew)) {
+		return ErrClockSkew
+	}
+	// Key on the decoded signature so re-encoding it can't bypass the check
+	return a.remember(deviceID+":"+hex.EncodeToString(signature), sentAt.Add(a.skew), now)
+}
+
+// VerifyOperator checks that r carries an operator token granting scope,
+// returning the token's name for logging
+func (a *Authenticator) VerifyOperator(r *http.Request, scope Scope) (string, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return "", ErrUnauthenticated
+	}
+
+	a.mu.RLock()
+	op, ok := a.operators[sha256.Sum256([]byte(token))]
+	a.mu.RUnlock()
+	if !ok {
+		return "", ErrUnauthenticated
+	}
+	if !op.scopes[scope] {
+		return op.name, ErrForbidden
+	}
+	return op.name, nil
+}
+
+// remember records an accepted signature until it expires, failing if it
+// was seen before. Expired entries are swept at most once per skew window.
+func (a *Authenticator) remember(key string, expires, now time.Time) error {
+	a.replayMu.Lock()
+	defer a.replayMu.Unlock()
+
+	if now.Sub(a.lastSweep) >= a.skew {
+		for k, exp := range a.seen {
+			if !exp.After(now) {
+				delete(a.seen, k)
+			}
+		}
+		a.lastSweep = now
+	}
+
+	if exp, ok := a.seen[key]; ok && exp.After(now) {
+		return ErrReplayed
+	}
+	a.seen[key] = expires
+	return nil
+}
+
+// Sign computes the HMAC-SHA256 signature of a device request
+func Sign(secret []byte, timestamp, method, path string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "\n" + method + "\n" + path + "\n"))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
@@ -0,0 +1,211 @@
+package auth
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedRequest builds a device request signed with secret at timestamp
+func signedRequest(secret, path, body string, timestamp int64) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	ts := fmt.Sprint(timestamp)
+	req.Header.Set(TimestampHeader, ts)
+	req.Header.Set(SignatureHeader, hex.EncodeToString(Sign([]byte(secret), ts, http.MethodPost, path, []byte(body))))
+	return req
+}
+
+func TestVerifyDevice(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	a := NewAuthenticator(Config{
+		DeviceSecrets: map[string]string{"cam-1": "s3cret", "cam-2": "other"},
+		ClockSkew:     time.Minute,
+		Now:           func() time.Time { return now },
+	})
+	path := "/api/v1/devices/cam-1/heartbeat"
+	body := `{"sent_at":60}`
+
+	bearer := func(token string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		return req
+	}
+	tampered := signedRequest("s3cret", path, body, now.Unix())
+	tampered.Header.Set(TimestampHeader, fmt.Sprint(now.Unix()+1))
+
+	tests := []struct {
+		name     string
+		req      *http.Request
+		deviceID string
+		body     string
+		wantErr  error
+	}{
+		{name: "bearer", req: bearer("s3cret"), deviceID: "cam-1"},
+		{name: "bearer for another device", req: bearer("other"), deviceID: "cam-1", wantErr: ErrUnauthenticated},
+		{name: "bearer for unknown device", req: bearer("s3cret"), deviceID: "cam-9", wantErr: ErrUnauthenticated},
+		{name: "no credentials", req: httptest.NewRequest(http.MethodPost, path, nil), deviceID: "cam-1", wantErr: ErrUnauthenticated},
+		{name: "signed", req: signedRequest("s3cret", path, body, now.Unix()), deviceID: "cam-1", body: body},
+		{name: "signed within skew", req: signedRequest("s3cret", path, body, now.Unix()-50), deviceID: "cam-1", body: body},
+		{name: "signed body differs", req: signedRequest("s3cret", path, body, now.Unix()-1), deviceID: "cam-1", body: `{"sent_at":61}`, wantErr: ErrUnauthenticated},
+		{name: "signed timestamp changed", req: tampered, deviceID: "cam-1", body: body, wantErr: ErrUnauthenticated},
+		{name: "signed too old", req: signedRequest("s3cret", path, body, now.Unix()-61), deviceID: "cam-1", body: body, wantErr: ErrClockSkew},
+		{name: "signed in the future", req: signedRequest("s3cret", path, body, now.Unix()+61), deviceID: "cam-1", body: body, wantErr: ErrClockSkew},
+		{name: "signed with wrong secret", req: signedRequest("other", path, body, now.Unix()-2), deviceID: "cam-1", body: body, wantErr: ErrUnauthenticated},
+	}
+	for _, tt := range tests {
+		err := a.VerifyDevice(tt.req, tt.deviceID, []byte(tt.body))
+		if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestVerifyDevice_RejectsReplays(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	a := NewAuthenticator(Config{
+		DeviceSecrets: map[string]string{"cam-1": "s3cret"},
+		ClockSkew:     time.Minute,
+		Now:           func() time.Time { return now },
+	})
+	path := "/api/v1/devices/cam-1/heartbeat"
+	body := []byte(`{"sent_at":60}`)
+
+	if err := a.VerifyDevice(signedRequest("s3cret", path, string(body), now.Unix()), "cam-1", body); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if err := a.VerifyDevice(signedRequest("s3cret", path, string(body), now.Unix()), "cam-1", body); !errors.Is(err, ErrReplayed) {
+		t.Errorf("replay: got %v, want ErrReplayed", err)
+	}
+
+	// Re-encoding the signature in upper case is still the same signature
+	upper := signedRequest("s3cret", path, string(body), now.Unix())
+	upper.Header.Set(SignatureHeader, strings.ToUpper(upper.Header.Get(SignatureHeader)))
+	if err := a.VerifyDevice(upper, "cam-1", body); !errors.Is(err, ErrReplayed) {
+		t.Errorf("re-encoded replay: got %v, want ErrReplayed", err)
+	}
+
+	// Once the original falls outside the window it fails on skew instead, and
+	// the remembered signature can be swept
+	now = now.Add(2 * time.Minute)
+	if err := a.VerifyDevice(signedRequest("s3cret", path, string(body), now.Unix()), "cam-1", body); err != nil {
+		t.Errorf("fresh request after window: %v", err)
+	}
+	if len(a.seen) != 1 {
+		t.Errorf("expected expired signatures to be swept, %d remembered", len(a.seen))
+	}
+}
+
+func TestVerifyDatagram(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	a := NewAuthenticator(Config{
+		DeviceSecrets: map[string]string{"cam-1": "s3cret"},
+		ClockSkew:     time.Minute,
+		Now:           func() time.Time { return now },
+	})
+	sign := func(secret, deviceID string, timestamp int64) []byte {
+		return Sign([]byte(secret), fmt.Sprint(timestamp), DatagramMethod, deviceID, nil)
+	}
+
+	tests := []struct {
+		name      string
+		deviceID  string
+		timestamp int64
+		signature []byte
+		wantErr   error
+	}{
+		{"signed", "cam-1", now.Unix(), sign("s3cret", "cam-1", now.Unix()), nil},
+		{"replayed", "cam-1", now.Unix(), sign("s3cret", "cam-1", now.Unix()), ErrReplayed},
+		{"timestamp changed", "cam-1", now.Unix() - 1, sign("s3cret", "cam-1", now.Unix()), ErrUnauthenticated},
+		{"wrong secret", "cam-1", now.Unix() - 2, sign("other", "cam-1", now.Unix()-2), ErrUnauthenticated},
+		{"unknown device", "cam-9", now.Unix(), sign("s3cret", "cam-9", now.Unix()), ErrUnauthenticated},
+		{"unsigned", "cam-1", now.Unix() - 3, nil, ErrUnauthenticated},
+		{"too old", "cam-1", now.Unix() - 61, sign("s3cret", "cam-1", now.Unix()-61), ErrClockSkew},
+	}
+	for _, tt := range tests {
+		err := a.VerifyDatagram(tt.deviceID, tt.timestamp, tt.signature)
+		if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// A request signature over the same fields is not a datagram signature
+	request := Sign([]byte("s3cret"), fmt.Sprint(now.Unix()-4), http.MethodPost, "cam-1", nil)
+	if err := a.VerifyDatagram("cam-1", now.Unix()-4, request); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("request signature: got %v, want ErrUnauthenticated", err)
+	}
+}
+
+func TestVerifyOperator(t *testing.T) {
+	a := NewAuthenticator(Config{OperatorTokens: []OperatorToken{
+		{Name: "dashboard", Token: "read-token", Scopes: []Scope{ScopeRead}},
+		{Name: "ops", Token: "admin-token", Scopes: []Scope{ScopeRead, ScopeAdmin}},
+	}})
+
+	tests := []struct {
+		header  string
+		scope   Scope
+		want    string
+		wantErr error
+	}{
+		{header: "Bearer read-token", scope: ScopeRead, want: "dashboard"},
+		{header: "bearer admin-token", scope: ScopeAdmin, want: "ops"},
+		{header: "Bearer read-token", scope: ScopeAdmin, want: "dashboard", wantErr: ErrForbidden},
+		{header: "Bearer admin-token", scope: ScopeIngest, want: "ops", wantErr: ErrForbidden},
+		{header: "Bearer nope", scope: ScopeRead, wantErr: ErrUnauthenticated},
+		{header: "Basic cmVhZC10b2tlbg==", scope: ScopeRead, wantErr: ErrUnauthenticated},
+		{header: "", scope: ScopeRead, wantErr: ErrUnauthenticated},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/devices", nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		name, err := a.VerifyOperator(req, tt.scope)
+		if name != tt.want || !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+			t.Errorf("%q %s: got %q, %v; want %q, %v", tt.header, tt.scope, name, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseCredentialFiles(t *testing.T) {
+	secrets, err := ParseDeviceSecrets(strings.NewReader("secret,device_id\ns1,cam-1\n\n s2 ,cam-2\n"))
+	if err != nil {
+		t.Fatalf("ParseDeviceSecrets: %v", err)
+	}
+	if len(secrets) != 2 || secrets["cam-1"] != "s1" || secrets["cam-2"] != "s2" {
+		t.Errorf("unexpected secrets %v", secrets)
+	}
+
+	tokens, err := ParseOperatorTokens(strings.NewReader("name,token,scopes\ndash,t1,read\nops,t2,read; admin\nnone,t3,\n"))
+	if err != nil {
+		t.Fatalf("ParseOperatorTokens: %v", err)
+	}
+	if fmt.Sprint(tokens) != "[{dash t1 [read]} {ops t2 [read admin]} {none t3 []}]" {
+		t.Errorf("unexpected tokens %v", tokens)
+	}
+
+	for _, input := range []string{
+		"device_id\ncam-1\n",
+		"device_id,secret\ncam-1,\n",
+		"device_id,secret\ncam-1,a\ncam-1,b\n",
+	} {
+		if _, err := ParseDeviceSecrets(strings.NewReader(input)); err == nil {
+			t.Errorf("ParseDeviceSecrets(%q): expected an error", input)
+		}
+	}
+	for _, input := range []string{
+		"name,token\nx,t\n",
+		"name,token,scopes\nx,t,write\n",
+		"name,token,scopes\nx,t,read\ny,t,read\n",
+		"name,token,scopes\n,t,read\n",
+	} {
+		if _, err := ParseOperatorTokens(strings.NewReader(input)); err == nil {
+			t.Errorf("ParseOperatorTokens(%q): expected an error", input)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// scopeSeparator splits the scopes column of an operator tokens file
+const scopeSeparator = ";"
+
+// LoadDeviceSecrets reads device secrets from a CSV file with the columns
+// device_id and secret
+func LoadDeviceSecrets(filename string) (map[string]string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	return ParseDeviceSecrets(bytes.NewReader(data))
+}
+
+// ParseDeviceSecrets reads device secrets from CSV content with the columns
+// device_id and secret, in any order. Every row needs both values.
+func ParseDeviceSecrets(r io.Reader) (map[string]string, error) {
+	rows, err := readTable(r, "device_id", "secret")
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make(map[string]string, len(rows))
+	for _, row := range rows {
+		id, secret := row.values["device_id"], row.values["secret"]
+		if id == "" || secret == "" {
+			return nil, fmt.Errorf("line %d: device_id and secret must not be empty", row.line)
+		}
+		if _, ok := secrets[id]; ok {
+			return nil, fmt.Errorf("line %d: duplicate device_id %q", row.line, id)
+		}
+		secrets[id] = secret
+	}
+	return secrets, nil
+}
+
+// LoadOperatorTokens reads operator tokens from a CSV file with the columns
+// name, token and scopes
+func LoadOperatorTokens(filename string) ([]OperatorToken, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	return ParseOperatorTokens(bytes.NewReader(data))
+}
+
+// ParseOperatorTokens reads operator tokens from CSV content with the
+// columns name, token and scopes, in any order. Scopes are separated by ";".
+func ParseOperatorTokens(r io.Reader) ([]OperatorToken, error) {
+	rows, err := readTable(r, "name", "token", "scopes")
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make([]OperatorToken, 0, len(rows))
+	seen := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		token := OperatorToken{Name: row.values["name"], Token: row.values["token"]}
+		if token.Name == "" || token.Token == "" {
+			return nil, fmt.Errorf("line %d: name and token must not be empty", row.line)
+		}
+		if seen[token.Token] {
+			return nil, fmt.Errorf("line %d: duplicate token for %q", row.line, token.Name)
+		}
+		seen[token.Token] = true
+
+		for _, name := range strings.Split(row.values["scopes"], scopeSeparator) {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			scope, err := ParseScope(name)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", row.line, err)
+			}
+			token.Scopes = append(token.Scopes, scope)
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// tableRow is one non-blank CSV row keyed by column name
+type tableRow struct {
+	line   int
+	values map[string]string
+}
+
+// readTable parses CSV content whose header must name each of columns,
+// returning every non-blank row with values trimmed
+func readTable(r io.Reader, columns ...string) ([]tableRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("CSV file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CSV: %w", err)
+	}
+
+	positions := make(map[string]int, len(columns))
+	for i, name := range header {
+		positions[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, column := range columns {
+		if _, ok := positions[column]; !ok {
+			return nil, fmt.Errorf("CSV must have '%s' column header", column)
+		}
+	}
+
+	var rows []tableRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CSV: %w", err)
+		}
+
+		line, _ := reader.FieldPos(0)
+		row := tableRow{line: line, values: make(map[string]string, len(columns))}
+		blank := true
+		for _, column := range columns {
+			if i := positions[column]; i < len(record) {
+				row.values[column] = strings.TrimSpace(record[i])
+				blank = blank && row.values[column] == ""
+			}
+		}
+		if !blank {
+			rows = append(rows, row)
+		}
+	}
+}
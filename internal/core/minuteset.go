@@ -0,0 +1,396 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sort"
+)
+
+const (
+	// Each container covers 4096 consecutive minutes (~2.8 days)
+	containerBits = 12
+	containerSize = 1 << containerBits
+	containerMask = containerSize - 1
+
+	// A full bitmap container is 64 words (512 bytes), the same size as an
+	// array container holding 256 uint16 offsets, so convert at that point
+	bitmapWords  = containerSize / 64
+	arrayMaxSize = bitmapWords * 4
+)
+
+// errInvalidMinuteSet reports malformed MinuteSet binary data
+var errInvalidMinuteSet = errors.New("invalid minute set encoding")
+
+// MinuteSet is a compact set of Unix minute buckets.
+// Minutes are grouped into fixed-size containers in the style of roaring
+// bitmaps: sparse containers hold sorted 16-bit offsets and dense ones switch
+// to a 4096-bit bitmap, so a device online for most of a day costs a few
+// hundred bytes instead of one map entry per minute.
+// The zero value is an empty set ready to use. MinuteSet is not safe for
+// concurrent use.
+type MinuteSet struct {
+	containers []minuteContainer // Sorted by key
+	count      int
+}
+
+// minuteContainer holds the minutes sharing the same high bits
+type minuteContainer struct {
+	key    int64    // minute >> containerBits
+	n      int      // Number of minutes in the container
+	array  []uint16 // Sorted offsets while sparse
+	bitmap []uint64 // Offset bitmap once dense
+}
+
+// NewMinuteSet creates an empty MinuteSet
+func NewMinuteSet() *MinuteSet {
+	return &MinuteSet{}
+}
+
+// Add inserts a minute and reports whether it was not already present
+func (s *MinuteSet) Add(minute int64) bool {
+	key, offset := minute>>containerBits, uint16(minute&containerMask)
+
+	i := s.search(key)
+	if i == len(s.containers) || s.containers[i].key != key {
+		// Heartbeats arrive mostly in order, so this is usually an append
+		s.containers = append(s.containers, minuteContainer{})
+		copy(s.containers[i+1:], s.containers[i:])
+		s.containers[i] = minuteContainer{key: key}
+	}
+
+	if !s.containers[i].add(offset) {
+		return false
+	}
+	s.count++
+	return true
+}
+
+// Contains reports whether a minute is in the set
+func (s *MinuteSet) Contains(minute int64) bool {
+	key, offset := minute>>containerBits, uint16(minute&containerMask)
+	i := s.search(key)
+	if i == len(s.containers) || s.containers[i].key != key {
+		return false
+	}
+	return s.containers[i].contains(offset)
+}
+
+// Len returns the number of minutes in the set
+func (s *MinuteSet) Len() int {
+	if s == nil {
+		return 0
+	}
+	return s.count
+}
+
+// CountRange returns the number of minutes m in the set with from <= m <= to
+func (s *MinuteSet) CountRange(from, to int64) int {
+	if s == nil || from > to {
+		return 0
+	}
+
+	fromKey, toKey := from>>containerBits, to>>containerBits
+	total := 0
+	for i := s.search(fromKey); i < len(s.containers) && s.containers[i].key <= toKey; i++ {
+		c := &s.containers[i]
+		lo, hi := uint16(0), uint16(containerMask)
+		if c.key == fromKey {
+			lo = uint16(from & containerMask)
+		}
+		if c.key == toKey {
+			hi = uint16(to & containerMask)
+		}
+		if lo == 0 && hi == containerMask {
+			total += c.n
+		} else {
+			total += c.countRange(lo, hi)
+		}
+	}
+	return total
+}
+
+// Bounds returns the smallest and largest minutes m in the set with
+// from <= m <= to, and false when there are none
+func (s *MinuteSet) Bounds(from, to int64) (first, last int64, ok bool) {
+	if s == nil || from > to {
+		return 0, 0, false
+	}
+
+	s.Range(from, to, func(minute int64) bool {
+		first, ok = minute, true
+		return false
+	})
+	if !ok {
+		return 0, 0, false
+	}
+
+	// Walk containers backwards to find the last minute without a full scan
+	fromKey, toKey := from>>containerBits, to>>containerBits
+	for i := s.search(toKey+1) - 1; i >= 0 && s.containers[i].key >= fromKey; i-- {
+		c := &s.containers[i]
+		base := c.key << containerBits
+		found := false
+		c.each(func(offset uint16) bool {
+			minute := base + int64(offset)
+			if minute >= from && minute <= to {
+				last, found = minute, true
+			}
+			return minute <= to
+		})
+		if found {
+			return first, last, true
+		}
+	}
+	return first, first, true
+}
+
+// Range calls fn for each minute m in the set with from <= m <= to in
+// ascending order, stopping early if fn returns false
+func (s *MinuteSet) Range(from, to int64, fn func(minute int64) bool) {
+	if s == nil || from > to {
+		return
+	}
+
+	toKey := to >> containerBits
+	for i := s.search(from >> containerBits); i < len(s.containers) && s.containers[i].key <= toKey; i++ {
+		c := &s.containers[i]
+		base := c.key << containerBits
+		stop := false
+		c.each(func(offset uint16) bool {
+			minute := base + int64(offset)
+			if minute < from {
+				return true
+			}
+			if minute > to || !fn(minute) {
+				stop = true
+				return false
+			}
+			return true
+		})
+		if stop {
+			return
+		}
+	}
+}
+
+// Each calls fn for every minute in the set in ascending order, stopping
+// early if fn returns false
+func (s *MinuteSet) Each(fn func(minute int64) bool) {
+	if s == nil {
+		return
+	}
+	for i := range s.containers {
+		c := &s.containers[i]
+		base := c.key << containerBits
+		stop := false
+		c.each(func(offset uint16) bool {
+			if !fn(base + int64(offset)) {
+				stop = true
+				return false
+			}
+			return true
+		})
+		if stop {
+			return
+		}
+	}
+}
+
+// SizeBytes estimates the heap memory held by the set
+func (s *MinuteSet) SizeBytes() int {
+	if s == nil {
+		return 0
+	}
+	size := cap(s.containers) * 64 // minuteContainer: key, n and two slice headers
+	for i := range s.containers {
+		size += cap(s.containers[i].array)*2 + cap(s.containers[i].bitmap)*8
+	}
+	return size
+}
+
+// MarshalBinary encodes the set as a container count followed by each
+// container's key, cardinality, kind and payload
+func (s *MinuteSet) MarshalBinary() ([]byte, error) {
+	buf := binary.AppendUvarint(nil, uint64(len(s.containers)))
+	for i := range s.containers {
+		c := &s.containers[i]
+		buf = binary.AppendVarint(buf, c.key)
+		buf = binary.AppendUvarint(buf, uint64(c.n))
+		if c.bitmap != nil {
+			buf = append(buf, 1)
+			for _, word := range c.bitmap {
+				buf = binary.LittleEndian.AppendUint64(buf, word)
+			}
+		} else {
+			buf = append(buf, 0)
+			for _, offset := range c.array {
+				buf = binary.LittleEndian.AppendUint16(buf, offset)
+			}
+		}
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes data produced by MarshalBinary, replacing the set's contents
+func (s *MinuteSet) UnmarshalBinary(data []byte) error {
+	count, n := binary.Uvarint(data)
+	if n <= 0 || count > uint64(len(data)) {
+		return errInvalidMinuteSet
+	}
+	data = data[n:]
+
+	containers := make([]minuteContainer, 0, count)
+	total := 0
+	for i := uint64(0); i < count; i++ {
+		key, n := binary.Varint(data)
+		if n <= 0 {
+			return errInvalidMinuteSet
+		}
+		data = data[n:]
+		size, n := binary.Uvarint(data)
+		if n <= 0 || size == 0 || size > containerSize || len(data) < n+1 {
+			return errInvalidMinuteSet
+		}
+		data = data[n:]
+		kind := data[0]
+		data = data[1:]
+
+		c := minuteContainer{key: key, n: int(size)}
+		switch kind {
+		case 0:
+			if size > arrayMaxSize || len(data) < int(size)*2 {
+				return errInvalidMinuteSet
+			}
+			c.array = make([]uint16, size)
+			for j := range c.array {
+				c.array[j] = binary.LittleEndian.Uint16(data[j*2:])
+			}
+			data = data[size*2:]
+		case 1:
+			if len(data) < bitmapWords*8 {
+				return errInvalidMinuteSet
+			}
+			c.bitmap = make([]uint64, bitmapWords)
+			for j := range c.bitmap {
+				c.bitmap[j] = binary.LittleEndian.Uint64(data[j*8:])
+			}
+			data = data[bitmapWords*8:]
+		default:
+			return errInvalidMinuteSet
+		}
+		if len(containers) > 0 && containers[len(containers)-1].key >= key {
+			return errInvalidMinuteSet
+		}
+		containers = append(containers, c)
+		total += c.n
+	}
+	if len(data) != 0 {
+		return errInvalidMinuteSet
+	}
+
+	s.containers = containers
+	s.count = total
+	return nil
+}
+
+// search returns the index of the first container with key >= key
+func (s *MinuteSet) search(key int64) int {
+	n := len(s.containers)
+	if n > 0 && s.containers[n-1].key < key {
+		return n
+	}
+	if n > 0 && s.containers[n-1].key == key {
+		return n - 1
+	}
+	return sort.Search(n, func(i int) bool { return s.containers[i].key >= key })
+}
+
+// add inserts an offset and reports whether it was not already present
+func (c *minuteContainer) add(offset uint16) bool {
+	if c.bitmap != nil {
+		word, bit := offset/64, uint64(1)<<(offset%64)
+		if c.bitmap[word]&bit != 0 {
+			return false
+		}
+		c.bitmap[word] |= bit
+		c.n++
+		return true
+	}
+
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= offset })
+	if i < len(c.array) && c.array[i] == offset {
+		return false
+	}
+	if len(c.array) >= arrayMaxSize {
+		c.toBitmap()
+		return c.add(offset)
+	}
+	c.array = append(c.array, 0)
+	copy(c.array[i+1:], c.array[i:])
+	c.array[i] = offset
+	c.n++
+	return true
+}
+
+// contains reports whether an offset is present
+func (c *minuteContainer) contains(offset uint16) bool {
+	if c.bitmap != nil {
+		return c.bitmap[offset/64]&(uint64(1)<<(offset%64)) != 0
+	}
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= offset })
+	return i < len(c.array) && c.array[i] == offset
+}
+
+// countRange counts offsets o with lo <= o <= hi
+func (c *minuteContainer) countRange(lo, hi uint16) int {
+	if c.bitmap == nil {
+		start := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= lo })
+		end := sort.Search(len(c.array), func(i int) bool { return c.array[i] > hi })
+		return end - start
+	}
+
+	total := 0
+	loWord, hiWord := lo/64, hi/64
+	for w := loWord; w <= hiWord; w++ {
+		word := c.bitmap[w]
+		if w == loWord {
+			word &= ^uint64(0) << (lo % 64)
+		}
+		if w == hiWord {
+			word &= ^uint64(0) >> (63 - hi%64)
+		}
+		total += bits.OnesCount64(word)
+	}
+	return total
+}
+
+// each calls fn for every offset in ascending order until it returns false
+func (c *minuteContainer) each(fn func(offset uint16) bool) {
+	if c.bitmap == nil {
+		for _, offset := range c.array {
+			if !fn(offset) {
+				return
+			}
+		}
+		return
+	}
+	for w, word := range c.bitmap {
+		for word != 0 {
+			bit := bits.TrailingZeros64(word)
+			if !fn(uint16(w*64 + bit)) {
+				return
+			}
+			word &= word - 1
+		}
+	}
+}
+
+// toBitmap converts a sparse container to its bitmap form
+func (c *minuteContainer) toBitmap() {
+	c.bitmap = make([]uint64, bitmapWords)
+	for _, offset := range c.array {
+		c.bitmap[offset/64] |= uint64(1) << (offset % 64)
+	}
+	c.array = nil
+}
@@ -0,0 +1,257 @@
+package core
+
+import (
+	"math/rand"
+	"runtime"
+	"sort"
+	"testing"
+)
+
+func TestMinuteSet_MatchesMap(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	set := NewMinuteSet()
+	ref := make(map[int64]struct{})
+
+	// Mix of dense runs (bitmap containers), sparse points (array containers)
+	// and negative minutes
+	for i := 0; i < 20000; i++ {
+		var minute int64
+		switch i % 3 {
+		case 0:
+			minute = int64(rng.Intn(5000))
+		case 1:
+			minute = int64(rng.Intn(1_000_000))
+		default:
+			minute = -int64(rng.Intn(10000))
+		}
+		_, existed := ref[minute]
+		ref[minute] = struct{}{}
+		if added := set.Add(minute); added == existed {
+			t.Fatalf("Add(%d) = %v, want %v", minute, added, !existed)
+		}
+	}
+
+	if set.Len() != len(ref) {
+		t.Fatalf("Len() = %d, want %d", set.Len(), len(ref))
+	}
+	for minute := range ref {
+		if !set.Contains(minute) {
+			t.Fatalf("Contains(%d) = false", minute)
+		}
+	}
+
+	sorted := make([]int64, 0, len(ref))
+	for minute := range ref {
+		sorted = append(sorted, minute)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var iterated []int64
+	set.Each(func(minute int64) bool {
+		iterated = append(iterated, minute)
+		return true
+	})
+	if len(iterated) != len(sorted) {
+		t.Fatalf("Each visited %d minutes, want %d", len(iterated), len(sorted))
+	}
+	for i := range sorted {
+		if iterated[i] != sorted[i] {
+			t.Fatalf("Each order mismatch at %d: got %d, want %d", i, iterated[i], sorted[i])
+		}
+	}
+
+	for i := 0; i < 500; i++ {
+		from := int64(rng.Intn(1_020_000)) - 20000
+		to := from + int64(rng.Intn(200_000))
+		want, wantFirst, wantLast := 0, int64(0), int64(0)
+		for _, minute := range sorted {
+			if minute >= from && minute <= to {
+				if want == 0 {
+					wantFirst = minute
+				}
+				wantLast = minute
+				want++
+			}
+		}
+		if got := set.CountRange(from, to); got != want {
+			t.Fatalf("CountRange(%d, %d) = %d, want %d", from, to, got, want)
+		}
+		first, last, ok := set.Bounds(from, to)
+		if ok != (want > 0) || (ok && (first != wantFirst || last != wantLast)) {
+			t.Fatalf("Bounds(%d, %d) = %d, %d, %v, want %d, %d, %v", from, to, first, last, ok, wantFirst, wantLast, want > 0)
+		}
+	}
+}
+
+func TestMinuteSet_BinaryRoundTrip(t *testing.T) {
+	set := NewMinuteSet()
+	for i := int64(0); i < 10300; i++ {
+		if i%3 != 0 || i < 5000 {
+			set.Add(i - 300)
+		}
+	}
+	set.Add(1 << 40)
+
+	data, err := set.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+
+	var decoded MinuteSet
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary failed: %v", err)
+	}
+	if decoded.Len() != set.Len() {
+		t.Fatalf("decoded Len() = %d, want %d", decoded.Len(), set.Len())
+	}
+	set.Each(func(minute int64) bool {
+		if !decoded.Contains(minute) {
+			t.Fatalf("decoded set missing minute %d", minute)
+		}
+		return true
+	})
+
+	if err := decoded.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Error("expected error for truncated data")
+	}
+}
+
+// The benchmarks below compare the MinuteSet with the map[int64]struct{} it
+// replaced for a synthetic fleet load: 30 days of minute buckets per device at
+// ~99% uptime. Memory is measured on a sample of devices and extrapolated to
+// a 10k-device fleet, since the map variant needs ~10GB at full scale.
+
+const (
+	benchDays         = 30
+	benchMinutes      = benchDays * 24 * 60
+	benchSampleFleet  = 50
+	benchTargetFleet  = 10_000
+	benchOfflineEvery = 100 // Skip 1 in 100 minutes for ~99% uptime
+)
+
+// benchMinuteStream returns the heartbeat minutes for one device
+func benchMinuteStream(device int) []int64 {
+	start := int64(28_000_000) // Around 2023, in Unix minutes
+	minutes := make([]int64, 0, benchMinutes)
+	for m := 0; m < benchMinutes; m++ {
+		if (m+device)%benchOfflineEvery == 0 {
+			continue
+		}
+		minutes = append(minutes, start+int64(m))
+	}
+	return minutes
+}
+
+// heapInUse returns live heap bytes after a full collection
+func heapInUse() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+func BenchmarkFleetMemory_MinuteSet(b *testing.B) {
+	streams := make([][]int64, benchSampleFleet)
+	for d := range streams {
+		streams[d] = benchMinuteStream(d)
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		before := heapInUse()
+		sets := make([]*MinuteSet, benchSampleFleet)
+		for d, stream := range streams {
+			sets[d] = NewMinuteSet()
+			for _, minute := range stream {
+				sets[d].Add(minute)
+			}
+		}
+		perDevice := float64(heapInUse()-before) / benchSampleFleet
+		b.ReportMetric(perDevice, "B/device")
+		b.ReportMetric(perDevice*benchTargetFleet/(1<<20), "MB/10k-devices")
+		runtime.KeepAlive(sets)
+	}
+}
+
+func BenchmarkFleetMemory_Map(b *testing.B) {
+	streams := make([][]int64, benchSampleFleet)
+	for d := range streams {
+		streams[d] = benchMinuteStream(d)
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		before := heapInUse()
+		sets := make([]map[int64]struct{}, benchSampleFleet)
+		for d, stream := range streams {
+			sets[d] = make(map[int64]struct{})
+			for _, minute := range stream {
+				sets[d][minute] = struct{}{}
+			}
+		}
+		perDevice := float64(heapInUse()-before) / benchSampleFleet
+		b.ReportMetric(perDevice, "B/device")
+		b.ReportMetric(perDevice*benchTargetFleet/(1<<20), "MB/10k-devices")
+		runtime.KeepAlive(sets)
+	}
+}
+
+func BenchmarkAdd_MinuteSet(b *testing.B) {
+	stream := benchMinuteStream(0)
+	b.ResetTimer()
+
+	set := NewMinuteSet()
+	for i := 0; i < b.N; i++ {
+		if i%len(stream) == 0 {
+			set = NewMinuteSet()
+		}
+		set.Add(stream[i%len(stream)])
+	}
+}
+
+func BenchmarkAdd_Map(b *testing.B) {
+	stream := benchMinuteStream(0)
+	b.ResetTimer()
+
+	set := make(map[int64]struct{})
+	for i := 0; i < b.N; i++ {
+		if i%len(stream) == 0 {
+			set = make(map[int64]struct{})
+		}
+		set[stream[i%len(stream)]] = struct{}{}
+	}
+}
+
+func BenchmarkCountRange_MinuteSet(b *testing.B) {
+	stream := benchMinuteStream(0)
+	set := NewMinuteSet()
+	for _, minute := range stream {
+		set.Add(minute)
+	}
+	from, to := stream[0]+1440, stream[0]+8*1440 // One week
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		set.CountRange(from, to)
+	}
+}
+
+func BenchmarkCountRange_Map(b *testing.B) {
+	stream := benchMinuteStream(0)
+	set := make(map[int64]struct{})
+	for _, minute := range stream {
+		set[minute] = struct{}{}
+	}
+	from, to := stream[0]+1440, stream[0]+8*1440 // One week
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		count := 0
+		for minute := range set {
+			if minute >= from && minute <= to {
+				count++
+			}
+		}
+		_ = count
+	}
+}
@@ -0,0 +1,332 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+const (
+	// DefaultSketchAccuracy is the relative accuracy of quantile estimates
+	DefaultSketchAccuracy = 0.01
+
+	// DefaultSketchBins bounds sketch memory. At 1% accuracy, 2048 bins span
+	// values from 1ns to over 100 days, so collapsing never happens for
+	// realistic upload times.
+	DefaultSketchBins = 2048
+)
+
+// ErrIncompatibleSketch reports a merge between sketches with different accuracy
+var ErrIncompatibleSketch = errors.New("incompatible sketch accuracy")
+
+// errInvalidSketch reports malformed QuantileSketch binary data
+var errInvalidSketch = errors.New("invalid quantile sketch encoding")
+
+// QuantileSketch is a mergeable quantile estimator in the style of DDSketch.
+// Positive values are counted in logarithmically sized bins so that every
+// quantile estimate is within the configured relative accuracy of the exact
+// value: for accuracy a, the estimate v' of a true quantile v satisfies
+// |v' - v| <= a * v. Zero (and negative) values are counted exactly.
+// Memory is bounded by the bin limit; if values ever span more bins than
+// that, the lowest bins are collapsed together and only quantiles falling in
+// the collapsed range lose the accuracy guarantee.
+// QuantileSketch is not safe for concurrent use.
+type QuantileSketch struct {
+	accuracy float64
+	gamma    float64
+	logGamma float64
+	maxBins  int
+
+	bins   []uint64 // bins[i] counts values with index offset+i
+	offset int
+
+	zeroCount uint64
+	count     uint64
+	sum       float64
+	min       float64
+	max       float64
+}
+
+// Distribution summarizes a set of values
+type Distribution struct {
+	Count int64
+	Sum   float64
+	Min   float64
+	Max   float64
+	P50   float64
+	P90   float64
+	P95   float64
+	P99   float64
+}
+
+// NewQuantileSketch creates a sketch with the default accuracy and bin limit
+func NewQuantileSketch() *QuantileSketch {
+	return NewQuantileSketchWithAccuracy(DefaultSketchAccuracy, DefaultSketchBins)
+}
+
+// NewQuantileSketchWithAccuracy creates a sketch with the given relative
+// accuracy (0 < accuracy < 1) and maximum number of bins
+func NewQuantileSketchWithAccuracy(accuracy float64, maxBins int) *QuantileSketch {
+	gamma := (1 + accuracy) / (1 - accuracy)
+	return &QuantileSketch{
+		accuracy: accuracy,
+		gamma:    gamma,
+		logGamma: math.Log(gamma),
+		maxBins:  maxBins,
+	}
+}
+
+// Add records a value
+func (s *QuantileSketch) Add(value float64) {
+	s.addCount(value, 1)
+}
+
+// Count returns the number of recorded values
+func (s *QuantileSketch) Count() int64 {
+	return int64(s.count)
+}
+
+// Quantile returns an estimate of the q-th quantile (0 <= q <= 1), or 0 when empty.
+// The quantile is the value at rank floor(q * (count - 1)) in sorted order.
+func (s *QuantileSketch) Quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	if q <= 0 {
+		return s.min
+	}
+	if q >= 1 {
+		return s.max
+	}
+
+	rank := uint64(q * float64(s.count-1))
+	if rank < s.zeroCount {
+		return math.Max(s.min, 0)
+	}
+
+	seen := s.zeroCount
+	for i, n := range s.bins {
+		seen += n
+		if seen > rank {
+			return s.clamp(s.binValue(s.offset + i))
+		}
+	}
+	return s.max
+}
+
+// Distribution returns count, sum, min, max and the standard percentiles
+func (s *QuantileSketch) Distribution() Distribution {
+	if s.count == 0 {
+		return Distribution{}
+	}
+	return Distribution{
+		Count: int64(s.count),
+		Sum:   s.sum,
+		Min:   s.min,
+		Max:   s.max,
+		P50:   s.Quantile(0.50),
+		P90:   s.Quantile(0.90),
+		P95:   s.Quantile(0.95),
+		P99:   s.Quantile(0.99),
+	}
+}
+
+// Merge adds every value recorded in other to s
+func (s *QuantileSketch) Merge(other *QuantileSketch) error {
+	if other == nil || other.count == 0 {
+		return nil
+	}
+	if s.accuracy != other.accuracy {
+		return ErrIncompatibleSketch
+	}
+
+	if s.count == 0 || other.min < s.min {
+		s.min = other.min
+	}
+	if s.count == 0 || other.max > s.max {
+		s.max = other.max
+	}
+	s.count += other.count
+	s.sum += other.sum
+	s.zeroCount += other.zeroCount
+	for i, n := range other.bins {
+		if n > 0 {
+			s.addToBin(other.offset+i, n)
+		}
+	}
+	return nil
+}
+
+// Clone returns an independent copy of the sketch
+func (s *QuantileSketch) Clone() *QuantileSketch {
+	clone := *s
+	clone.bins = append([]uint64(nil), s.bins...)
+	return &clone
+}
+
+// SizeBytes estimates the heap memory held by the sketch
+func (s *QuantileSketch) SizeBytes() int {
+	return 96 + cap(s.bins)*8
+}
+
+// MarshalBinary encodes the sketch's accuracy, bin limit, summary values
+// and bins, so that a restored sketch answers exactly like the original
+func (s *QuantileSketch) MarshalBinary() ([]byte, error) {
+	buf := binary.LittleEndian.AppendUint64(nil, math.Float64bits(s.accuracy))
+	buf = binary.AppendUvarint(buf, uint64(s.maxBins))
+	buf = binary.AppendUvarint(buf, s.count)
+	buf = binary.AppendUvarint(buf, s.zeroCount)
+	for _, v := range []float64{s.sum, s.min, s.max} {
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(v))
+	}
+	buf = binary.AppendVarint(buf, int64(s.offset))
+	buf = binary.AppendUvarint(buf, uint64(len(s.bins)))
+	for _, n := range s.bins {
+		buf = binary.AppendUvarint(buf, n)
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes data produced by MarshalBinary, replacing the sketch's contents
+func (s *QuantileSketch) UnmarshalBinary(data []byte) error {
+	if len(data) < 8 {
+		return errInvalidSketch
+	}
+	accuracy := math.Float64frombits(binary.LittleEndian.Uint64(data))
+	if !(accuracy > 0 && accuracy < 1) {
+		return errInvalidSketch
+	}
+	data = data[8:]
+
+	var header [3]uint64 // maxBins, count, zeroCount
+	for i := range header {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errInvalidSketch
+		}
+		header[i], data = v, data[n:]
+	}
+	if header[0] == 0 || header[0] > math.MaxInt32 || header[2] > header[1] || len(data) < 24 {
+		return errInvalidSketch
+	}
+	var summary [3]float64 // sum, min, max
+	for i := range summary {
+		summary[i] = math.Float64frombits(binary.LittleEndian.Uint64(data))
+		data = data[8:]
+	}
+	offset, n := binary.Varint(data)
+	if n <= 0 || offset < math.MinInt32 || offset > math.MaxInt32 {
+		return errInvalidSketch
+	}
+	data = data[n:]
+	binCount, n := binary.Uvarint(data)
+	if n <= 0 || binCount > header[0] || binCount > uint64(len(data)) {
+		return errInvalidSketch
+	}
+	data = data[n:]
+
+	restored := NewQuantileSketchWithAccuracy(accuracy, int(header[0]))
+	restored.count, restored.zeroCount = header[1], header[2]
+	restored.sum, restored.min, restored.max = summary[0], summary[1], summary[2]
+	restored.offset = int(offset)
+	total := restored.zeroCount
+	if binCount > 0 {
+		restored.bins = make([]uint64, binCount)
+	}
+	for i := range restored.bins {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errInvalidSketch
+		}
+		restored.bins[i], data = v, data[n:]
+		total += v
+	}
+	if len(data) != 0 || total != restored.count {
+		return errInvalidSketch
+	}
+	*s = *restored
+	return nil
+}
+
+// addCount records n copies of value
+func (s *QuantileSketch) addCount(value float64, n uint64) {
+	if s.count == 0 || value < s.min {
+		s.min = value
+	}
+	if s.count == 0 || value > s.max {
+		s.max = value
+	}
+	s.count += n
+	s.sum += value * float64(n)
+
+	if value <= 0 {
+		s.zeroCount += n
+		return
+	}
+	s.addToBin(s.index(value), n)
+}
+
+// addToBin adds n to the bin with the given index, growing or collapsing bins as needed
+func (s *QuantileSketch) addToBin(index int, n uint64) {
+	if len(s.bins) == 0 {
+		s.bins = make([]uint64, 1, 16)
+		s.offset = index
+	}
+
+	// Grow downwards
+	if index < s.offset {
+		lowest := s.offset + len(s.bins) - s.maxBins
+		if index < lowest {
+			index = lowest // Collapse into the lowest retained bin
+		}
+		if index < s.offset {
+			grown := make([]uint64, s.offset-index+len(s.bins))
+			copy(grown[s.offset-index:], s.bins)
+			s.bins = grown
+			s.offset = index
+		}
+	}
+
+	// Grow upwards, collapsing the lowest bins if the span exceeds the limit
+	if top := index - s.offset + 1; top > len(s.bins) {
+		if top > s.maxBins {
+			shift := top - s.maxBins
+			if shift >= len(s.bins) {
+				total := uint64(0)
+				for _, c := range s.bins {
+					total += c
+				}
+				s.bins = make([]uint64, 1, 16)
+				s.bins[0] = total
+			} else {
+				for _, c := range s.bins[:shift] {
+					s.bins[shift] += c
+				}
+				s.bins = append(s.bins[:0], s.bins[shift:]...)
+			}
+			s.offset += shift
+			top = index - s.offset + 1
+		}
+		for len(s.bins) < top {
+			s.bins = append(s.bins, 0)
+		}
+	}
+
+	s.bins[index-s.offset] += n
+}
+
+// index returns the bin index for a positive value
+func (s *QuantileSketch) index(value float64) int {
+	return int(math.Ceil(math.Log(value) / s.logGamma))
+}
+
+// binValue returns the representative value of a bin, within the relative
+// accuracy of every value the bin can hold
+func (s *QuantileSketch) binValue(index int) float64 {
+	return 2 * math.Pow(s.gamma, float64(index)) / (s.gamma + 1)
+}
+
+// clamp limits an estimate to the observed range
+func (s *QuantileSketch) clamp(value float64) float64 {
+	return math.Min(math.Max(value, s.min), s.max)
+}
@@ -0,0 +1,164 @@
+package core
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// exactQuantile returns the value at rank floor(q * (n - 1)), matching QuantileSketch.Quantile
+func exactQuantile(sorted []float64, q float64) float64 {
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+func TestQuantileSketch_RelativeAccuracy(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+
+	distributions := map[string]func() float64{
+		// Upload times around 3 minutes with a long tail, in nanoseconds
+		"lognormal": func() float64 { return math.Exp(rng.NormFloat64()*0.8 + math.Log(180e9)) },
+		"uniform":   func() float64 { return rng.Float64() * 600e9 },
+		"bimodal": func() float64 {
+			if rng.Intn(10) == 0 {
+				return 900e9 + rng.Float64()*100e9
+			}
+			return 1e9 + rng.Float64()*5e9
+		},
+	}
+
+	for name, next := range distributions {
+		t.Run(name, func(t *testing.T) {
+			sketch := NewQuantileSketch()
+			values := make([]float64, 20000)
+			for i := range values {
+				values[i] = next()
+				sketch.Add(values[i])
+			}
+			sort.Float64s(values)
+
+			for _, q := range []float64{0.01, 0.25, 0.5, 0.9, 0.95, 0.99, 0.999} {
+				want := exactQuantile(values, q)
+				got := sketch.Quantile(q)
+				if relErr := math.Abs(got-want) / want; relErr > DefaultSketchAccuracy {
+					t.Errorf("q=%v: got %v, exact %v, relative error %.4f > %.2f", q, got, want, relErr, DefaultSketchAccuracy)
+				}
+			}
+
+			dist := sketch.Distribution()
+			if dist.Count != int64(len(values)) || dist.Min != values[0] || dist.Max != values[len(values)-1] {
+				t.Errorf("count/min/max = %d/%v/%v, want %d/%v/%v", dist.Count, dist.Min, dist.Max, len(values), values[0], values[len(values)-1])
+			}
+		})
+	}
+}
+
+func TestQuantileSketch_Merge(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	a, b, all := NewQuantileSketch(), NewQuantileSketch(), NewQuantileSketch()
+	var values []float64
+	for i := 0; i < 5000; i++ {
+		va := rng.ExpFloat64() * 1e9
+		vb := rng.ExpFloat64()*1e11 + 1e6
+		a.Add(va)
+		b.Add(vb)
+		all.Add(va)
+		all.Add(vb)
+		values = append(values, va, vb)
+	}
+	sort.Float64s(values)
+
+	if err := a.Merge(b); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	for _, q := range []float64{0.1, 0.5, 0.9, 0.99} {
+		if got, want := a.Quantile(q), all.Quantile(q); got != want {
+			t.Errorf("q=%v: merged %v, direct %v", q, got, want)
+		}
+		want := exactQuantile(values, q)
+		if relErr := math.Abs(a.Quantile(q)-want) / want; relErr > DefaultSketchAccuracy {
+			t.Errorf("q=%v: relative error %.4f after merge", q, relErr)
+		}
+	}
+
+	other := NewQuantileSketchWithAccuracy(0.05, 100)
+	other.Add(1)
+	if err := a.Merge(other); err != ErrIncompatibleSketch {
+		t.Errorf("expected ErrIncompatibleSketch, got %v", err)
+	}
+}
+
+func TestQuantileSketch_EdgeCases(t *testing.T) {
+	sketch := NewQuantileSketch()
+	if got := sketch.Distribution(); got != (Distribution{}) {
+		t.Errorf("empty distribution = %+v", got)
+	}
+
+	// Zero upload times are counted exactly
+	for i := 0; i < 60; i++ {
+		sketch.Add(0)
+	}
+	for i := 0; i < 40; i++ {
+		sketch.Add(1000)
+	}
+	if got := sketch.Quantile(0.5); got != 0 {
+		t.Errorf("p50 = %v, want 0", got)
+	}
+	if got := sketch.Quantile(0.99); got != 1000 {
+		t.Errorf("p99 = %v, want 1000 (clamped to max)", got)
+	}
+}
+
+func TestQuantileSketch_BoundedBins(t *testing.T) {
+	sketch := NewQuantileSketchWithAccuracy(0.01, 64)
+	for exp := 0; exp < 300; exp++ {
+		sketch.Add(math.Pow(1.1, float64(exp)))
+	}
+	if len(sketch.bins) > 64 {
+		t.Fatalf("sketch holds %d bins, limit 64", len(sketch.bins))
+	}
+	if sketch.Count() != 300 {
+		t.Errorf("Count() = %d, want 300", sketch.Count())
+	}
+
+	// The top of the distribution keeps full accuracy
+	want := math.Pow(1.1, 296) // Rank floor(0.99 * 299)
+	if relErr := math.Abs(sketch.Quantile(0.99)-want) / want; relErr > 0.01 {
+		t.Errorf("p99 relative error %.4f after collapsing", relErr)
+	}
+}
+
+func TestQuantileSketch_MarshalBinary(t *testing.T) {
+	sketch := NewQuantileSketchWithAccuracy(0.02, 512)
+	rng := rand.New(rand.NewSource(7))
+	for i := 0; i < 1000; i++ {
+		sketch.Add(rng.ExpFloat64() * 1e9)
+	}
+	sketch.Add(0)
+
+	for _, original := range []*QuantileSketch{NewQuantileSketch(), sketch} {
+		data, err := original.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary: %v", err)
+		}
+		restored := NewQuantileSketch()
+		if err := restored.UnmarshalBinary(data); err != nil {
+			t.Fatalf("UnmarshalBinary: %v", err)
+		}
+		if restored.Distribution() != original.Distribution() {
+			t.Errorf("restored %+v, want %+v", restored.Distribution(), original.Distribution())
+		}
+
+		// Restored sketches keep their accuracy, so they still merge
+		if err := restored.Merge(original); err != nil || restored.Count() != 2*original.Count() {
+			t.Errorf("merging into the restored sketch: %v, count %d", err, restored.Count())
+		}
+	}
+
+	data, _ := sketch.MarshalBinary()
+	for _, bad := range [][]byte{nil, data[:8], data[:len(data)-1], append(data, 0)} {
+		if err := NewQuantileSketch().UnmarshalBinary(bad); err == nil {
+			t.Errorf("expected %d bytes to be rejected", len(bad))
+		}
+	}
+}
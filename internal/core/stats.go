@@ -1,23 +1,50 @@
 package core
 
+import (
+	"math"
+	"sort"
+)
+
 // CalculateUptime computes uptime percentage from minute bucket data.
 // Returns the percentage of minutes with heartbeats within the observation window.
 // Edge cases:
 // - No heartbeats: returns 0.0
 // - Single minute: returns 100.0 (device was online for entire observed window)
 // - Multiple minutes: returns (observed minutes / total window) * 100
-func CalculateUptime(minutes map[int64]struct{}, firstMinute, lastMinute int64) float64 {
-	if len(minutes) == 0 {
+func CalculateUptime(minutes *MinuteSet, firstMinute, lastMinute int64) float64 {
+	if minutes.Len() == 0 {
 		return 0.0
 	}
 	if firstMinute == lastMinute {
 		return 100.0
 	}
-	observedMinutes := int64(len(minutes))
+	observedMinutes := int64(minutes.Len())
 	totalWindow := lastMinute - firstMinute // Number of minutes between first and last
 	return (float64(observedMinutes) / float64(totalWindow)) * 100.0
 }
 
+// CalculateWindowUptime computes the percentage of minutes between
+// fromMinute and toMinute (inclusive) that have a heartbeat.
+// The window starts no earlier than the first heartbeat, since the device
+// wasn't expected before then, and ends no later than nowMinute, or the last
+// heartbeat if a device clock runs ahead. Silent minutes at either end of
+// what remains count as downtime, so a device that stopped reporting loses
+// uptime. The result is capped at 100.
+func CalculateWindowUptime(minutes *MinuteSet, fromMinute, toMinute, nowMinute int64) float64 {
+	firstMinute, lastMinute, ok := minutes.Bounds(math.MinInt64, math.MaxInt64)
+	if !ok {
+		return 0.0
+	}
+	start := max(fromMinute, firstMinute)
+	end := min(toMinute, max(nowMinute, lastMinute))
+	if end < start {
+		return 0.0
+	}
+	observedMinutes := int64(minutes.CountRange(start, end))
+	totalWindow := end - start + 1 // Both ends included
+	return min((float64(observedMinutes)/float64(totalWindow))*100.0, 100.0)
+}
+
 // CalculateAverageUpload computes the average upload time from sum and count.
 // Returns 0.0 if no uploads have been recorded.
 func CalculateAverageUpload(uploadSum float64, uploadCount int64) float64 {
@@ -26,3 +53,26 @@ func CalculateAverageUpload(uploadSum float64, uploadCount int64) float64 {
 	}
 	return uploadSum / float64(uploadCount)
 }
+
+// CalculateMeanMedian computes the arithmetic mean and median of values.
+// Returns 0.0 for both if values is empty. values is sorted in place.
+func CalculateMeanMedian(values []float64) (mean, median float64) {
+	if len(values) == 0 {
+		return 0.0, 0.0
+	}
+
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	mean = sum / float64(len(values))
+
+	sort.Float64s(values)
+	mid := len(values) / 2
+	if len(values)%2 == 0 {
+		median = (values[mid-1] + values[mid]) / 2
+	} else {
+		median = values[mid]
+	}
+	return mean, median
+}
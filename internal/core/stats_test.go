@@ -1,55 +1,56 @@
 package core
 
 import (
+	"math"
 	"testing"
 )
 
 func TestCalculateUptime(t *testing.T) {
 	tests := []struct {
 		name        string
-		minutes     map[int64]struct{}
+		minutes     []int64
 		firstMinute int64
 		lastMinute  int64
 		want        float64
 	}{
 		{
 			name:        "no heartbeats",
-			minutes:     map[int64]struct{}{},
+			minutes:     []int64{},
 			firstMinute: 0,
 			lastMinute:  0,
 			want:        0.0,
 		},
 		{
 			name:        "single minute",
-			minutes:     map[int64]struct{}{100: {}},
+			minutes:     []int64{100},
 			firstMinute: 100,
 			lastMinute:  100,
 			want:        100.0,
 		},
 		{
 			name:        "consecutive minutes - 100% uptime",
-			minutes:     map[int64]struct{}{0: {}, 1: {}, 2: {}},
+			minutes:     []int64{0, 1, 2},
 			firstMinute: 0,
 			lastMinute:  2,
 			want:        150.0, // 3 minutes / 2 span = 150%
 		},
 		{
 			name:        "sparse minutes - 75% uptime",
-			minutes:     map[int64]struct{}{0: {}, 2: {}, 4: {}},
+			minutes:     []int64{0, 2, 4},
 			firstMinute: 0,
 			lastMinute:  4,
 			want:        75.0, // 3 minutes / 4 span = 75%
 		},
 		{
 			name:        "sparse minutes - 75% uptime",
-			minutes:     map[int64]struct{}{10: {}, 12: {}, 14: {}},
+			minutes:     []int64{10, 12, 14},
 			firstMinute: 10,
 			lastMinute:  14,
 			want:        75.0, // 3 minutes / 4 span = 75%
 		},
 		{
 			name:        "two minutes at edges",
-			minutes:     map[int64]struct{}{0: {}, 10: {}},
+			minutes:     []int64{0, 10},
 			firstMinute: 0,
 			lastMinute:  10,
 			want:        20.0, // 2 minutes / 10 span = 20%
@@ -58,7 +59,11 @@ func TestCalculateUptime(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := CalculateUptime(tt.minutes, tt.firstMinute, tt.lastMinute)
+			set := NewMinuteSet()
+			for _, minute := range tt.minutes {
+				set.Add(minute)
+			}
+			got := CalculateUptime(set, tt.firstMinute, tt.lastMinute)
 			if got != tt.want {
 				t.Errorf("CalculateUptime() = %v, want %v", got, tt.want)
 			}
@@ -114,3 +119,65 @@ func TestCalculateAverageUpload(t *testing.T) {
 		})
 	}
 }
+
+func TestCalculateWindowUptime(t *testing.T) {
+	set := NewMinuteSet()
+	for _, minute := range []int64{0, 1, 2, 4, 10, 12, 14} {
+		set.Add(minute)
+	}
+
+	tests := []struct {
+		name          string
+		from, to, now int64
+		want          float64
+	}{
+		{name: "whole range", from: 0, to: 14, now: 14, want: 700.0 / 15},           // 7 minutes / 15 span
+		{name: "window inside", from: 8, to: 20, now: 14, want: 300.0 / 7},          // 3 minutes / 7 span, ending now
+		{name: "single minute in window", from: 3, to: 9, now: 14, want: 100.0 / 7}, // only minute 4
+		{name: "empty window", from: 5, to: 9, now: 14, want: 0.0},
+		{name: "clamped to first heartbeat", from: -100, to: 1, now: 14, want: 100.0},
+		{name: "trailing outage", from: 10, to: 29, now: 29, want: 15.0},   // 3 minutes / 20 span
+		{name: "clamped to now", from: 10, to: 1000, now: 19, want: 30.0},  // 3 minutes / 10 span
+		{name: "clock ahead of now", from: 10, to: 20, now: 5, want: 60.0}, // ends at the last heartbeat
+		{name: "before first heartbeat", from: -10, to: -1, now: 14, want: 0.0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := CalculateWindowUptime(set, tt.from, tt.to, tt.now)
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("CalculateWindowUptime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Consecutive minutes never exceed 100
+	full := NewMinuteSet()
+	full.Add(0)
+	full.Add(1)
+	if got := CalculateWindowUptime(full, 0, 1, 1); got != 100.0 {
+		t.Errorf("CalculateWindowUptime() = %v, want 100", got)
+	}
+}
+
+func TestCalculateMeanMedian(t *testing.T) {
+	tests := []struct {
+		name       string
+		values     []float64
+		wantMean   float64
+		wantMedian float64
+	}{
+		{name: "empty", values: nil, wantMean: 0, wantMedian: 0},
+		{name: "odd count", values: []float64{100, 50, 90}, wantMean: 80, wantMedian: 90},
+		{name: "even count", values: []float64{100, 40, 90, 70}, wantMean: 75, wantMedian: 80},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mean, median := CalculateMeanMedian(tt.values)
+			if mean != tt.wantMean || median != tt.wantMedian {
+				t.Errorf("CalculateMeanMedian() = %v, %v, want %v, %v", mean, median, tt.wantMean, tt.wantMedian)
+			}
+		})
+	}
+}
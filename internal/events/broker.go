@@ -0,0 +1,216 @@
+// Package events fans accepted telemetry out to live subscribers, keeping a
+// bounded history so a reconnecting subscriber can resume where it left off
+package events
+
+import (
+	"device-fleet-monitoring/internal/storage"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Defaults for BrokerConfig fields left zero
+const (
+	DefaultBufferSize      = 1024
+	DefaultSubscriberQueue = 256
+)
+
+// Event types published by the API handlers
+const (
+	TypeHeartbeat = "heartbeat" // A heartbeat was stored
+	TypeUpload    = "upload"    // An upload report was stored
+	TypeStats     = "stats"     // A device's stats after its heartbeats or uploads were stored
+)
+
+// Reasons a subscription ends, reported by Subscription.Err
+var (
+	ErrSlowConsumer = errors.New("subscriber fell behind")
+	ErrClosed       = errors.New("broker closed")
+)
+
+// Event is one published event
+type Event struct {
+	ID       uint64 // Assigned by Publish, increasing
+	Type     string
+	DeviceID string
+	Metadata storage.DeviceMetadata // The device's metadata when published, for filtering
+	Data     json.RawMessage
+}
+
+// Filter selects the events a subscriber receives. It runs while publishing,
+// so it must be fast and must not call back into the Broker.
+type Filter func(Event) bool
+
+// BrokerConfig holds configuration for a Broker
+type BrokerConfig struct {
+	// BufferSize bounds the published events kept for resuming. Defaults to
+	// DefaultBufferSize.
+	BufferSize int
+
+	// SubscriberQueue bounds the events waiting for each subscriber; a
+	// subscriber whose queue is full is dropped rather than delaying
+	// publishers. Defaults to DefaultSubscriberQueue.
+	SubscriberQueue int
+}
+
+// Broker publishes events to subscribers without ever blocking on them
+type Broker struct {
+	config BrokerConfig
+
+	mu          sync.Mutex
+	buffer      []Event // Ring of the latest events; buffer[head] is the oldest once full
+	head        int
+	lastID      uint64
+	subscribers map[*Subscription]struct{}
+	closed      bool
+}
+
+// Subscription receives the events matching its filter until it ends
+type Subscription struct {
+	broker *Broker
+	filter Filter
+	events chan Event
+	err    error // Set under broker.mu before events is closed
+}
+
+// NewBroker creates a Broker, applying defaults to zero configuration fields
+func NewBroker(config BrokerConfig) *Broker {
+	if config.BufferSize <= 0 {
+		config.BufferSize = DefaultBufferSize
+	}
+	if config.SubscriberQueue <= 0 {
+		config.SubscriberQueue = DefaultSubscriberQueue
+	}
+	return &Broker{
+		config: config,
+		buffer: make([]Event, 0, config.BufferSize),
+		// Number events from the start time in microseconds, so that IDs
+		// a subscriber kept from an earlier process count as missed rather
+		// than matching different events
+		lastID:      uint64(time.Now().UnixMicro()),
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish assigns event the next ID, keeps it for resuming and queues it
+// for every matching subscriber. Subscribers that can't take it are dropped.
+func (b *Broker) Publish(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+
+	b.lastID++
+	event.ID = b.lastID
+	if len(b.buffer) < cap(b.buffer) {
+		b.buffer = append(b.buffer, event)
+	} else {
+		b.buffer[b.head] = event
+		b.head = (b.head + 1) % len(b.buffer)
+	}
+
+	for s := range b.subscribers {
+		if s.filter != nil && !s.filter(event) {
+			continue
+		}
+		select {
+		case s.events <- event:
+		default:
+			b.end(s, ErrSlowConsumer)
+		}
+	}
+}
+
+// Subscribe starts a subscription to the events published from now on.
+// It returns the ID of the latest event published before it.
+func (b *Broker) Subscribe(filter Filter) (*Subscription, uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.subscribe(filter), b.lastID
+}
+
+// Resume starts a subscription after the event lastID and returns the kept
+// events since then that match filter. It reports false, with no events,
+// if some of them are no longer kept or lastID was never published, as
+// after a restart; the subscriber has then missed events and receives
+// only those published from now on. It also returns the ID of the latest
+// event published before it.
+func (b *Broker) Resume(filter Filter, lastID uint64) (*Subscription, []Event, uint64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	oldest := b.lastID - uint64(len(b.buffer)) + 1
+	if lastID > b.lastID || lastID+1 < oldest {
+		return b.subscribe(filter), nil, b.lastID, false
+	}
+	var missed []Event
+	for i := range b.buffer {
+		event := b.buffer[(b.head+i)%len(b.buffer)]
+		if event.ID > lastID && (filter == nil || filter(event)) {
+			missed = append(missed, event)
+		}
+	}
+	return b.subscribe(filter), missed, b.lastID, true
+}
+
+// Subscribers returns the number of active subscriptions
+func (b *Broker) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers)
+}
+
+// Close ends every subscription and drops later events; subscriptions
+// started afterwards end immediately
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for s := range b.subscribers {
+		b.end(s, ErrClosed)
+	}
+}
+
+// subscribe registers a subscription. b.mu must be held.
+func (b *Broker) subscribe(filter Filter) *Subscription {
+	s := &Subscription{broker: b, filter: filter, events: make(chan Event, b.config.SubscriberQueue)}
+	if b.closed {
+		s.err = ErrClosed
+		close(s.events)
+		return s
+	}
+	b.subscribers[s] = struct{}{}
+	return s
+}
+
+// end removes a subscription and closes its channel. b.mu must be held.
+func (b *Broker) end(s *Subscription, err error) {
+	if _, ok := b.subscribers[s]; !ok {
+		return
+	}
+	delete(b.subscribers, s)
+	s.err = err
+	close(s.events)
+}
+
+// Events returns the subscription's events, closed when it ends
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Err returns why the subscription ended: ErrSlowConsumer, ErrClosed, or
+// nil if it is active or was cancelled
+func (s *Subscription) Err() error {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	return s.err
+}
+
+// Cancel ends the subscription
+func (s *Subscription) Cancel() {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	s.broker.end(s, nil)
+}
@@ -0,0 +1,98 @@
+package events
+
+import (
+	"fmt"
+	"testing"
+)
+
+// publish publishes n heartbeats of deviceID
+func publish(b *Broker, deviceID string, n int) {
+	for i := 0; i < n; i++ {
+		b.Publish(Event{Type: TypeHeartbeat, DeviceID: deviceID})
+	}
+}
+
+// ids returns the IDs of events relative to base
+func ids(events []Event, base uint64) string {
+	var out []uint64
+	for _, e := range events {
+		out = append(out, e.ID-base)
+	}
+	return fmt.Sprint(out)
+}
+
+func TestBroker_FiltersAndResumes(t *testing.T) {
+	b := NewBroker(BrokerConfig{BufferSize: 4})
+	cam1 := func(e Event) bool { return e.DeviceID == "cam-1" }
+	sub, base := b.Subscribe(cam1)
+	defer sub.Cancel()
+
+	publish(b, "cam-1", 1)
+	publish(b, "cam-2", 1)
+	publish(b, "cam-1", 1)
+	if got := ids([]Event{<-sub.Events(), <-sub.Events()}, base); got != "[1 3]" {
+		t.Errorf("expected only cam-1 events, got %s", got)
+	}
+
+	// Everything after 1 is still kept
+	resumed, missed, latest, complete := b.Resume(cam1, base+1)
+	resumed.Cancel()
+	if !complete || ids(missed, base) != "[3]" || latest != base+3 {
+		t.Errorf("unexpected resume: %v %s %d", complete, ids(missed, base), latest-base)
+	}
+
+	// Events 1 and 2 have left the buffer of 4
+	publish(b, "cam-1", 3)
+	if _, missed, _, complete := b.Resume(nil, base+2); !complete || ids(missed, base) != "[3 4 5 6]" {
+		t.Errorf("expected events 3 to 6, got %v %s", complete, ids(missed, base))
+	}
+	if _, missed, _, complete := b.Resume(nil, base+1); complete || missed != nil {
+		t.Errorf("expected a gap after event 1, got %v %s", complete, ids(missed, base))
+	}
+	// An ID from an earlier process is either too old or never published
+	if _, _, _, complete := b.Resume(nil, 7); complete {
+		t.Error("expected an ID before the broker started to be incomplete")
+	}
+	if _, _, _, complete := b.Resume(nil, base+7); complete {
+		t.Error("expected an unpublished ID to be incomplete")
+	}
+}
+
+func TestBroker_DropsSlowSubscribers(t *testing.T) {
+	b := NewBroker(BrokerConfig{SubscriberQueue: 2})
+	slow, _ := b.Subscribe(nil)
+	fast, _ := b.Subscribe(nil)
+	other, _ := b.Subscribe(func(e Event) bool { return e.DeviceID == "cam-2" })
+
+	publish(b, "cam-1", 2)
+	<-fast.Events()
+	<-fast.Events()
+	publish(b, "cam-1", 1)
+
+	// The slow subscriber keeps what it had queued, then ends
+	n := 0
+	for range slow.Events() {
+		n++
+	}
+	if n != 2 || slow.Err() != ErrSlowConsumer {
+		t.Errorf("expected 2 events and ErrSlowConsumer, got %d and %v", n, slow.Err())
+	}
+	if b.Subscribers() != 2 || fast.Err() != nil {
+		t.Errorf("expected the other subscribers to stay, got %d", b.Subscribers())
+	}
+
+	b.Close()
+	if _, open := <-fast.Events(); open {
+		// The third event is still queued
+		if _, open := <-fast.Events(); open {
+			t.Error("expected Close to end subscriptions")
+		}
+	}
+	if _, open := <-other.Events(); open || other.Err() != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", other.Err())
+	}
+	late, _ := b.Subscribe(nil)
+	if _, open := <-late.Events(); open || late.Err() != ErrClosed {
+		t.Error("expected subscriptions after Close to end immediately")
+	}
+}
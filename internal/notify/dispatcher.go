@@ -0,0 +1,511 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"device-fleet-monitoring/internal/alerting"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Defaults for DispatcherConfig fields left zero
+const (
+	DefaultQueueSize       = 1000
+	DefaultMaxAttempts     = 8
+	DefaultMinBackoff      = time.Second
+	DefaultMaxBackoff      = 5 * time.Minute
+	DefaultTimeout         = 10 * time.Second
+	DefaultFlushTimeout    = 10 * time.Second
+	DefaultDeadLetterLimit = 1000
+)
+
+// Headers set on every delivery. The signature is the hex HMAC-SHA256 of
+// the timestamp, a newline and the body, keyed with the endpoint's secret.
+const (
+	HeaderID        = "X-Webhook-ID"
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// Errors returned by Retry
+var (
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+	ErrQueueFull          = errors.New("endpoint queue is full")
+)
+
+// Payload is the JSON body of a delivery
+type Payload struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	DeviceID  string    `json:"device_id"`
+	Rule      string    `json:"rule,omitempty"`
+	Kind      string    `json:"kind,omitempty"`
+	Value     *float64  `json:"value,omitempty"`
+	Threshold *float64  `json:"threshold,omitempty"`
+	Unit      string    `json:"unit,omitempty"`
+	Since     time.Time `json:"since"` // When the breach was first seen, or the device's first heartbeat minute
+	At        time.Time `json:"at"`
+}
+
+// DeadLetter is a delivery that was given up on
+type DeadLetter struct {
+	ID       string
+	Endpoint string
+	Type     string
+	Payload  json.RawMessage
+	Attempts int
+	Error    string // Why the last attempt failed
+	At       time.Time
+}
+
+// EndpointStatus are the delivery counters of one endpoint
+type EndpointStatus struct {
+	Name           string
+	Queued         int    // Deliveries waiting, not counting one in progress
+	Delivered      uint64 // Deliveries acknowledged with a 2xx response
+	FailedAttempts uint64 // Attempts that failed, whether or not retried
+	DeadLettered   uint64 // Deliveries given up on
+	LastDelivery   time.Time
+	LastError      string
+	LastErrorAt    time.Time
+}
+
+// DispatcherConfig holds configuration for a Dispatcher
+type DispatcherConfig struct {
+	Endpoints []Endpoint
+
+	// QueueSize bounds the deliveries waiting per endpoint; events for a
+	// full queue are dead-lettered. Defaults to DefaultQueueSize.
+	QueueSize int
+
+	// MaxAttempts bounds the attempts per delivery. Retries wait MinBackoff,
+	// doubling up to MaxBackoff, with jitter. Defaults to DefaultMaxAttempts,
+	// DefaultMinBackoff and DefaultMaxBackoff.
+	MaxAttempts int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+
+	// Timeout bounds each attempt. Defaults to DefaultTimeout.
+	Timeout time.Duration
+
+	// FlushTimeout bounds the final attempts made once Run is cancelled.
+	// Defaults to DefaultFlushTimeout.
+	FlushTimeout time.Duration
+
+	// DeadLetterLimit bounds the dead letters kept; the oldest are dropped
+	// first. Defaults to DefaultDeadLetterLimit.
+	DeadLetterLimit int
+
+	Client *http.Client // Defaults to a client without redirects
+	Logger *slog.Logger
+	Now    func() time.Time // Defaults to time.Now
+}
+
+// Dispatcher delivers alerting events to webhook endpoints. Each endpoint
+// has its own queue and worker, so a slow or failing receiver only delays
+// its own deliveries. Deliveries to one endpoint are made in order.
+type Dispatcher struct {
+	config    DispatcherConfig
+	endpoints []*endpoint
+
+	mu          sync.Mutex
+	deadLetters []DeadLetter // Oldest first
+}
+
+// endpoint is an Endpoint with its queue and counters
+type endpoint struct {
+	Endpoint
+	queue chan delivery
+
+	mu             sync.Mutex
+	delivered      uint64
+	failedAttempts uint64
+	deadLettered   uint64
+	lastDelivery   time.Time
+	lastError      string
+	lastErrorAt    time.Time
+}
+
+// delivery is one payload bound for one endpoint
+type delivery struct {
+	id        string
+	eventType string
+	body      []byte
+}
+
+// NewDispatcher creates a dispatcher for config. Nothing is delivered until Run.
+func NewDispatcher(config DispatcherConfig) *Dispatcher {
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultQueueSize
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = DefaultMaxAttempts
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = DefaultMinBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = DefaultMaxBackoff
+	}
+	config.MaxBackoff = max(config.MaxBackoff, config.MinBackoff)
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.FlushTimeout <= 0 {
+		config.FlushTimeout = DefaultFlushTimeout
+	}
+	if config.DeadLetterLimit <= 0 {
+		config.DeadLetterLimit = DefaultDeadLetterLimit
+	}
+	if config.Client == nil {
+		// A redirect would resend the signed body to wherever it points
+		config.Client = &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+
+	d := &Dispatcher{config: config}
+	for _, e := range config.Endpoints {
+		d.endpoints = append(d.endpoints, &endpoint{Endpoint: e, queue: make(chan delivery, config.QueueSize)})
+	}
+	return d
+}
+
+// Notify queues event for every endpoint that accepts its type. It never
+// blocks; an event for a full queue is dead-lettered.
+func (d *Dispatcher) Notify(event alerting.Event) {
+	payload := newPayload(event)
+	for _, e := range d.endpoints {
+		if !e.accepts(payload.Type) {
+			continue
+		}
+		// Every endpoint gets its own delivery ID, so retries and dead letters are per endpoint
+		payload.ID = newID()
+		body, err := json.Marshal(payload)
+		if err != nil {
+			d.config.Logger.Error("failed to encode webhook payload",
+				"endpoint", e.Name,
+				"error", err)
+			continue
+		}
+		dl := delivery{id: payload.ID, eventType: payload.Type, body: body}
+		select {
+		case e.queue <- dl:
+		default:
+			d.deadLetter(e, dl, 0, ErrQueueFull.Error())
+		}
+	}
+}
+
+// Run delivers queued events until ctx is cancelled. It then flushes:
+// deliveries still queued or waiting to be retried get one last attempt
+// within FlushTimeout, and those that fail or don't fit in it are
+// dead-lettered rather than dropped silently.
+func (d *Dispatcher) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, e := range d.endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case dl := <-e.queue:
+					if attempts, done := d.deliver(ctx, e, dl); !done {
+						d.flush(ctx, e, &pending{delivery: dl, attempts: attempts})
+						return
+					}
+				case <-ctx.Done():
+					d.flush(ctx, e, nil)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// pending is a delivery interrupted by cancellation after some attempts
+type pending struct {
+	delivery
+	attempts int
+}
+
+// flush makes a last attempt of interrupted, if any, and of every delivery
+// left in e's queue until FlushTimeout passes, dead-lettering the rest
+func (d *Dispatcher) flush(ctx context.Context, e *endpoint, interrupted *pending) {
+	flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), d.config.FlushTimeout)
+	defer cancel()
+
+	attempt := func(dl delivery, attempts int) {
+		if flushCtx.Err() != nil {
+			d.deadLetter(e, dl, attempts, "dispatcher stopped before delivery")
+			return
+		}
+		if _, err := d.send(flushCtx, e, dl); err != nil {
+			d.recordFailure(e, err)
+			d.deadLetter(e, dl, attempts+1, err.Error())
+			return
+		}
+		d.recordDelivery(e)
+	}
+	if interrupted != nil {
+		attempt(interrupted.delivery, interrupted.attempts)
+	}
+	for {
+		select {
+		case dl := <-e.queue:
+			attempt(dl, 0)
+		default:
+			return
+		}
+	}
+}
+
+// Status returns the counters of every endpoint in configuration order
+func (d *Dispatcher) Status() []EndpointStatus {
+	statuses := make([]EndpointStatus, 0, len(d.endpoints))
+	for _, e := range d.endpoints {
+		e.mu.Lock()
+		statuses = append(statuses, EndpointStatus{
+			Name:           e.Name,
+			Queued:         len(e.queue),
+			Delivered:      e.delivered,
+			FailedAttempts: e.failedAttempts,
+			DeadLettered:   e.deadLettered,
+			LastDelivery:   e.lastDelivery,
+			LastError:      e.lastError,
+			LastErrorAt:    e.lastErrorAt,
+		})
+		e.mu.Unlock()
+	}
+	return statuses
+}
+
+// DeadLetters returns the dead letters, oldest first
+func (d *Dispatcher) DeadLetters() []DeadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]DeadLetter(nil), d.deadLetters...)
+}
+
+// Retry queues a dead letter for delivery again with a fresh set of attempts
+func (d *Dispatcher) Retry(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, letter := range d.deadLetters {
+		if letter.ID != id {
+			continue
+		}
+		for _, e := range d.endpoints {
+			if e.Name != letter.Endpoint {
+				continue
+			}
+			select {
+			case e.queue <- delivery{id: letter.ID, eventType: letter.Type, body: letter.Payload}:
+			default:
+				return ErrQueueFull
+			}
+			d.deadLetters = append(d.deadLetters[:i], d.deadLetters[i+1:]...)
+			return nil
+		}
+	}
+	return ErrDeadLetterNotFound
+}
+
+// deliver attempts dl until it is acknowledged, fails permanently or runs
+// out of attempts, and reports it done. If ctx is cancelled first it returns
+// the attempts that completed and false.
+func (d *Dispatcher) deliver(ctx context.Context, e *endpoint, dl delivery) (int, bool) {
+	for attempt := 1; ; attempt++ {
+		retryAfter, err := d.send(ctx, e, dl)
+		if err == nil {
+			d.recordDelivery(e)
+			return attempt, true
+		}
+		if ctx.Err() != nil {
+			return attempt - 1, false // Cut short rather than answered
+		}
+		d.recordFailure(e, err)
+
+		var permanent *permanentError
+		if errors.As(err, &permanent) || attempt >= d.config.MaxAttempts {
+			d.deadLetter(e, dl, attempt, err.Error())
+			return attempt, true
+		}
+
+		wait := max(d.backoff(attempt), retryAfter)
+		d.config.Logger.Warn("webhook delivery failed, retrying",
+			"endpoint", e.Name,
+			"delivery_id", dl.id,
+			"attempt", attempt,
+			"retry_in", wait,
+			"error", err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, false
+		}
+	}
+}
+
+// recordDelivery counts an acknowledged delivery to e
+func (d *Dispatcher) recordDelivery(e *endpoint) {
+	e.mu.Lock()
+	e.delivered++
+	e.lastDelivery = d.config.Now()
+	e.mu.Unlock()
+}
+
+// recordFailure counts a failed attempt to e
+func (d *Dispatcher) recordFailure(e *endpoint, err error) {
+	e.mu.Lock()
+	e.failedAttempts++
+	e.lastError, e.lastErrorAt = err.Error(), d.config.Now()
+	e.mu.Unlock()
+}
+
+// permanentError is a response that retrying won't change
+type permanentError struct {
+	status int
+}
+
+func (e *permanentError) Error() string {
+	return fmt.Sprintf("endpoint responded %d", e.status)
+}
+
+// send makes one signed attempt of dl. A failed attempt may return how long
+// the endpoint asked to wait before retrying.
+func (d *Dispatcher) send(ctx context.Context, e *endpoint, dl delivery) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.config.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.URL, bytes.NewReader(dl.body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(d.config.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderID, dl.id)
+	req.Header.Set(HeaderEvent, dl.eventType)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, Sign(e.Secret, timestamp, dl.body))
+
+	resp, err := d.config.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	// Drain a little so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return 0, nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		var retryAfter time.Duration
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			retryAfter = min(time.Duration(seconds)*time.Second, d.config.MaxBackoff)
+		}
+		return retryAfter, fmt.Errorf("endpoint responded %d", resp.StatusCode)
+	default:
+		return 0, &permanentError{status: resp.StatusCode}
+	}
+}
+
+// backoff is the wait after the given failed attempt: MinBackoff doubled per
+// attempt up to MaxBackoff, of which a random half is taken off so that
+// endpoints recovering together aren't retried in lockstep
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	wait := d.config.MaxBackoff
+	if attempt-1 < 32 {
+		wait = min(d.config.MinBackoff<<(attempt-1), d.config.MaxBackoff)
+	}
+	if wait <= 0 {
+		wait = d.config.MaxBackoff
+	}
+	return wait/2 + mathrand.N(wait/2+1)
+}
+
+// deadLetter records that dl was given up on after attempts
+func (d *Dispatcher) deadLetter(e *endpoint, dl delivery, attempts int, reason string) {
+	e.mu.Lock()
+	e.deadLettered++
+	e.mu.Unlock()
+
+	d.mu.Lock()
+	if len(d.deadLetters) >= d.config.DeadLetterLimit {
+		d.deadLetters = d.deadLetters[1:]
+	}
+	d.deadLetters = append(d.deadLetters, DeadLetter{
+		ID:       dl.id,
+		Endpoint: e.Name,
+		Type:     dl.eventType,
+		Payload:  dl.body,
+		Attempts: attempts,
+		Error:    reason,
+		At:       d.config.Now(),
+	})
+	d.mu.Unlock()
+
+	d.config.Logger.Error("webhook delivery failed, moved to dead letters",
+		"endpoint", e.Name,
+		"delivery_id", dl.id,
+		"attempts", attempts,
+		"error", reason)
+}
+
+// Sign returns the signature of a delivery body sent at timestamp
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newPayload converts an alerting event to a delivery payload without an ID
+func newPayload(event alerting.Event) Payload {
+	payload := Payload{DeviceID: event.DeviceID, Since: event.Since, At: event.At}
+	switch {
+	case event.State == alerting.StateFirstSeen:
+		payload.Type = EventFirstSeen
+		return payload
+	case event.State == alerting.StateResolved:
+		payload.Type = EventRecovered
+	case event.Kind == alerting.KindOffline:
+		payload.Type = EventOffline
+	default:
+		payload.Type = EventThresholdBreached
+	}
+	value, threshold := event.Value, event.Threshold
+	payload.Rule, payload.Kind, payload.Unit = event.Rule, string(event.Kind), event.Kind.Unit()
+	payload.Value, payload.Threshold = &value, &threshold
+	return payload
+}
+
+// newID returns a random delivery ID
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
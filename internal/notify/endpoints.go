@@ -0,0 +1,127 @@
+// Package notify delivers device events to webhook endpoints as signed JSON,
+// retrying failed deliveries with exponential backoff and keeping those that
+// give up in a dead-letter list
+package notify
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// eventSeparator splits the events column of a webhooks file
+const eventSeparator = ";"
+
+// Event types delivered to webhooks
+const (
+	EventFirstSeen         = "first_seen"         // A device sent its first heartbeat
+	EventOffline           = "offline"            // An offline alert rule fired
+	EventRecovered         = "recovered"          // A firing alert resolved
+	EventThresholdBreached = "threshold_breached" // An uptime or upload alert rule fired
+)
+
+// Endpoint is a webhook receiver
+type Endpoint struct {
+	Name   string
+	URL    string
+	Secret string   // Signs every delivery
+	Events []string // Event types delivered; all when empty
+}
+
+// accepts reports whether the endpoint takes events of eventType
+func (e Endpoint) accepts(eventType string) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, t := range e.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadEndpoints reads webhook endpoints from a CSV file, see ParseEndpoints
+func LoadEndpoints(filename string) ([]Endpoint, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	return ParseEndpoints(bytes.NewReader(data))
+}
+
+// ParseEndpoints reads webhook endpoints from CSV content with the columns
+// name, url and secret, and optionally events, in any order. Events lists
+// the event types to deliver separated by ";"; empty delivers all of them.
+func ParseEndpoints(r io.Reader) ([]Endpoint, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("CSV file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CSV: %w", err)
+	}
+
+	positions := make(map[string]int, len(header))
+	for i, name := range header {
+		positions[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, column := range []string{"name", "url", "secret"} {
+		if _, ok := positions[column]; !ok {
+			return nil, fmt.Errorf("CSV must have '%s' column header", column)
+		}
+	}
+	field := func(record []string, column string) string {
+		if i, ok := positions[column]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var endpoints []Endpoint
+	seen := make(map[string]bool)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return endpoints, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CSV: %w", err)
+		}
+		if strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue
+		}
+
+		line, _ := reader.FieldPos(0)
+		endpoint := Endpoint{Name: field(record, "name"), URL: field(record, "url"), Secret: field(record, "secret")}
+		if endpoint.Name == "" || endpoint.Secret == "" {
+			return nil, fmt.Errorf("line %d: name and secret must not be empty", line)
+		}
+		if u, err := url.Parse(endpoint.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("line %d: url must be an absolute http or https URL, got %q", line, endpoint.URL)
+		}
+		if seen[endpoint.Name] {
+			return nil, fmt.Errorf("line %d: duplicate name %q", line, endpoint.Name)
+		}
+		seen[endpoint.Name] = true
+
+		for _, event := range strings.Split(field(record, "events"), eventSeparator) {
+			if event = strings.TrimSpace(event); event == "" {
+				continue
+			}
+			switch event {
+			case EventFirstSeen, EventOffline, EventRecovered, EventThresholdBreached:
+			default:
+				return nil, fmt.Errorf("line %d: unknown event %q, must be one of first_seen, offline, recovered, threshold_breached", line, event)
+			}
+			endpoint.Events = append(endpoint.Events, event)
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+}
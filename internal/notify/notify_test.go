@@ -0,0 +1,304 @@
+package notify
+
+import (
+	"context"
+	"device-fleet-monitoring/internal/alerting"
+	"device-fleet-monitoring/internal/storage"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver is a webhook endpoint that verifies signatures and answers with
+// the queued statuses, then 204
+type receiver struct {
+	t      *testing.T
+	secret string
+
+	mu       sync.Mutex
+	statuses []int
+	payloads []Payload
+	attempts int
+}
+
+func newReceiver(t *testing.T, secret string, statuses ...int) (*receiver, *httptest.Server) {
+	r := &receiver{t: t, secret: secret, statuses: statuses}
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return r, server
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	if got := req.Header.Get(HeaderSignature); got != Sign(r.secret, req.Header.Get(HeaderTimestamp), body) {
+		r.t.Errorf("bad signature %q", got)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attempts++
+	if len(r.statuses) > 0 {
+		status := r.statuses[0]
+		r.statuses = r.statuses[1:]
+		w.WriteHeader(status)
+		return
+	}
+	var payload Payload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		r.t.Errorf("bad payload %s: %v", body, err)
+	}
+	if payload.ID != req.Header.Get(HeaderID) || payload.Type != req.Header.Get(HeaderEvent) {
+		r.t.Errorf("headers don't match payload %s", body)
+	}
+	r.payloads = append(r.payloads, payload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// received returns the types and devices of the payloads received, as type/device
+func (r *receiver) received() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []string
+	for _, p := range r.payloads {
+		out = append(out, p.Type+"/"+p.DeviceID)
+	}
+	return out
+}
+
+// startDispatcher runs a dispatcher with fast retries until the test ends
+func startDispatcher(t *testing.T, config DispatcherConfig) *Dispatcher {
+	config.MinBackoff = time.Millisecond
+	config.MaxBackoff = 4 * time.Millisecond
+	config.Logger = slog.New(slog.DiscardHandler)
+	d := NewDispatcher(config)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return d
+}
+
+// waitFor polls cond until it holds or a deadline passes
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestParseEndpoints(t *testing.T) {
+	endpoints, err := ParseEndpoints(strings.NewReader("url,name,secret,events\n" +
+		"https://pager.example/hook,pager,s1,offline; recovered\n" +
+		"\n" +
+		"http://chat.example/hook,chat,s2,\n"))
+	if err != nil {
+		t.Fatalf("ParseEndpoints failed: %v", err)
+	}
+	if len(endpoints) != 2 || endpoints[0].Name != "pager" || len(endpoints[0].Events) != 2 || endpoints[1].Events != nil {
+		t.Errorf("unexpected endpoints %+v", endpoints)
+	}
+	if endpoints[0].accepts(EventFirstSeen) || !endpoints[0].accepts(EventRecovered) || !endpoints[1].accepts(EventFirstSeen) {
+		t.Error("unexpected event filtering")
+	}
+
+	invalid := []string{
+		"",
+		"name,url\na,http://x\n",
+		"name,url,secret\na,http://x,\n",
+		"name,url,secret\na,ftp://x,s\n",
+		"name,url,secret\na,/hook,s\n",
+		"name,url,secret,events\na,http://x,s,exploded\n",
+		"name,url,secret\na,http://x,s\na,http://y,s\n",
+	}
+	for _, input := range invalid {
+		if _, err := ParseEndpoints(strings.NewReader(input)); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestDispatcher_DeliversAlertingEvents(t *testing.T) {
+	ctx := context.Background()
+	pager, pagerServer := newReceiver(t, "pager-secret")
+	chat, chatServer := newReceiver(t, "chat-secret")
+	d := startDispatcher(t, DispatcherConfig{Endpoints: []Endpoint{
+		{Name: "pager", URL: pagerServer.URL, Secret: "pager-secret", Events: []string{EventOffline, EventRecovered}},
+		{Name: "chat", URL: chatServer.URL, Secret: "chat-secret"},
+	}})
+
+	store := storage.NewMemoryStore([]string{"cam-1", "cam-2"})
+	now := time.Unix(1700000000, 0)
+	engine := alerting.NewEngine(alerting.EngineConfig{
+		Store: store,
+		Rules: []alerting.Rule{
+			{Name: "offline", Kind: alerting.KindOffline, Threshold: 600, Resolve: 600},
+			{Name: "slow", Kind: alerting.KindAvgUploadAbove, Threshold: 30, Resolve: 30, Window: time.Hour},
+		},
+		Notifiers: []alerting.Notifier{d},
+		Logger:    slog.New(slog.DiscardHandler),
+		Now:       func() time.Time { return now },
+	})
+	store.AddHeartbeat(ctx, "cam-1", now)
+	engine.Evaluate(ctx)
+
+	store.AddHeartbeat(ctx, "cam-2", now)
+	store.AddUpload(ctx, "cam-2", now, int(time.Minute))
+	now = now.Add(11 * time.Minute)
+	engine.Evaluate(ctx)
+	store.AddHeartbeat(ctx, "cam-1", now)
+	engine.Evaluate(ctx)
+
+	want := "first_seen/cam-2 offline/cam-1 offline/cam-2 threshold_breached/cam-2 recovered/cam-1"
+	waitFor(t, "chat deliveries", func() bool { return strings.Join(chat.received(), " ") == want })
+	waitFor(t, "pager deliveries", func() bool {
+		return strings.Join(pager.received(), " ") == "offline/cam-1 offline/cam-2 recovered/cam-1"
+	})
+
+	chat.mu.Lock()
+	breach := chat.payloads[3]
+	chat.mu.Unlock()
+	if breach.Rule != "slow" || breach.Kind != "avg_upload_above" || *breach.Value != 60 || *breach.Threshold != 30 || breach.Unit != "seconds" {
+		t.Errorf("unexpected threshold payload %+v", breach)
+	}
+
+	// Deliveries are counted once the receiver's response is read
+	waitFor(t, "delivery counts", func() bool {
+		status := d.Status()
+		return status[0].Delivered == 3 && status[1].Delivered == 5
+	})
+	if status := d.Status(); status[1].FailedAttempts != 0 {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestDispatcher_RetriesAndDeadLetters(t *testing.T) {
+	flaky, flakyServer := newReceiver(t, "s", http.StatusInternalServerError, http.StatusTooManyRequests)
+	gone, goneServer := newReceiver(t, "s", http.StatusGone)
+	down, downServer := newReceiver(t, "s", 503, 503, 503)
+	d := startDispatcher(t, DispatcherConfig{
+		MaxAttempts: 3,
+		Endpoints: []Endpoint{
+			{Name: "flaky", URL: flakyServer.URL, Secret: "s"},
+			{Name: "gone", URL: goneServer.URL, Secret: "s"},
+			{Name: "down", URL: downServer.URL, Secret: "s"},
+		},
+	})
+	d.Notify(alerting.Event{DeviceID: "cam-1", State: alerting.StateFirstSeen})
+
+	waitFor(t, "deliveries", func() bool {
+		s := d.Status()
+		return s[0].Delivered == 1 && s[1].DeadLettered == 1 && s[2].DeadLettered == 1
+	})
+	if flaky.attempts != 3 || gone.attempts != 1 || down.attempts != 3 {
+		t.Errorf("expected retries on 5xx and 429 only, got attempts %d %d %d", flaky.attempts, gone.attempts, down.attempts)
+	}
+	status := d.Status()
+	if status[0].FailedAttempts != 2 || status[2].LastError != "endpoint responded 503" {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	letters := d.DeadLetters()
+	if len(letters) != 2 || letters[0].Endpoint != "gone" || letters[0].Attempts != 1 || letters[1].Endpoint != "down" || letters[1].Attempts != 3 {
+		t.Fatalf("unexpected dead letters %+v", letters)
+	}
+
+	// The receiver is back; a retried dead letter is delivered as it was
+	if err := d.Retry(letters[1].ID); err != nil {
+		t.Fatalf("Retry failed: %v", err)
+	}
+	waitFor(t, "redelivery", func() bool { return len(down.received()) == 1 })
+	down.mu.Lock()
+	redelivered := down.payloads[0].ID
+	down.mu.Unlock()
+	if redelivered != letters[1].ID {
+		t.Errorf("expected the dead letter's delivery ID %s, got %s", letters[1].ID, redelivered)
+	}
+	if len(d.DeadLetters()) != 1 {
+		t.Error("expected a retried dead letter to be removed")
+	}
+	if err := d.Retry(letters[1].ID); err != ErrDeadLetterNotFound {
+		t.Errorf("expected ErrDeadLetterNotFound, got %v", err)
+	}
+}
+
+func TestDispatcher_FullQueueDeadLetters(t *testing.T) {
+	// Not running, so nothing leaves the queue
+	d := NewDispatcher(DispatcherConfig{
+		QueueSize:       1,
+		DeadLetterLimit: 2,
+		Endpoints:       []Endpoint{{Name: "hook", URL: "http://127.0.0.1:1", Secret: "s"}},
+		Logger:          slog.New(slog.DiscardHandler),
+	})
+	for _, id := range []string{"cam-1", "cam-2", "cam-3", "cam-4"} {
+		d.Notify(alerting.Event{DeviceID: id, State: alerting.StateFirstSeen})
+	}
+
+	letters := d.DeadLetters()
+	if len(letters) != 2 || letters[0].Error != ErrQueueFull.Error() || !strings.Contains(string(letters[1].Payload), `"cam-4"`) {
+		t.Errorf("expected the two newest events to be dead-lettered, got %+v", letters)
+	}
+	if s := d.Status(); s[0].Queued != 1 || s[0].DeadLettered != 3 {
+		t.Errorf("unexpected status %+v", s)
+	}
+	if err := d.Retry(letters[0].ID); err != ErrQueueFull {
+		t.Errorf("expected ErrQueueFull, got %v", err)
+	}
+}
+
+func TestDispatcher_FlushesOnStop(t *testing.T) {
+	recovering, recoveringServer := newReceiver(t, "s", http.StatusServiceUnavailable)
+	_, downServer := newReceiver(t, "s", 503, 503, 503, 503)
+	// Retries wait longer than the test, so stopping finds both endpoints backing off
+	d := NewDispatcher(DispatcherConfig{
+		MinBackoff: time.Hour,
+		MaxBackoff: time.Hour,
+		Endpoints: []Endpoint{
+			{Name: "recovering", URL: recoveringServer.URL, Secret: "s"},
+			{Name: "down", URL: downServer.URL, Secret: "s"},
+		},
+		Logger: slog.New(slog.DiscardHandler),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+
+	d.Notify(alerting.Event{DeviceID: "cam-1", State: alerting.StateFirstSeen})
+	waitFor(t, "first attempts", func() bool {
+		s := d.Status()
+		return s[0].FailedAttempts == 1 && s[1].FailedAttempts == 1
+	})
+	d.Notify(alerting.Event{DeviceID: "cam-2", State: alerting.StateFirstSeen})
+	cancel()
+	<-done
+
+	// Interrupted and queued deliveries get a last attempt rather than being dropped
+	if got := strings.Join(recovering.received(), " "); got != "first_seen/cam-1 first_seen/cam-2" {
+		t.Errorf("expected both deliveries flushed, got %q", got)
+	}
+	letters := d.DeadLetters()
+	if len(letters) != 2 || letters[0].Attempts != 2 || letters[1].Attempts != 1 || letters[1].Error != "endpoint responded 503" {
+		t.Errorf("expected both undeliverable events dead-lettered, got %+v", letters)
+	}
+	if s := d.Status(); s[0].Delivered != 2 || s[0].Queued != 0 || s[1].Queued != 0 {
+		t.Errorf("unexpected status %+v", s)
+	}
+}
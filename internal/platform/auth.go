@@ -0,0 +1,178 @@
+package platform
+
+import (
+	"bytes"
+	"device-fleet-monitoring/internal/api"
+	"device-fleet-monitoring/internal/auth"
+	"device-fleet-monitoring/internal/requestid"
+	"device-fleet-monitoring/internal/storage"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+)
+
+// authGuard wraps handlers with device or operator authentication. With no
+// Authenticator, or with one side of it disabled, handlers are left open.
+type authGuard struct {
+	auth              *auth.Authenticator
+	logger            *Logger
+	maxBodyBytes      int64
+	requireClientCert bool
+}
+
+// device requires a client certificate for, and the secret of, the device
+// named in the request path, each only when configured
+func (g authGuard) device(next http.Handler) http.Handler {
+	if g.auth != nil {
+		next = g.deviceSecret(next)
+	}
+	if g.requireClientCert {
+		next = g.deviceCert(next)
+	}
+	return next
+}
+
+// deviceCert requires a verified client certificate whose common name or a
+// DNS subject alternative name is the device ID in the path
+func (g authGuard) deviceCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deviceID := deviceIDFromPath(r)
+		identities := clientCertIdentities(r)
+		if identities == nil {
+			writeJSONError(w, r, http.StatusUnauthorized, "client certificate required")
+			g.logger.WarnContext(r.Context(), "missing client certificate", "device_id", deviceID, "path", r.URL.Path)
+			return
+		}
+		for _, identity := range identities {
+			if identity == deviceID {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		writeJSONError(w, r, http.StatusForbidden, "client certificate does not match device")
+		g.logger.WarnContext(r.Context(), "client certificate does not match device", "device_id", deviceID, "path", r.URL.Path, "identities", identities)
+	})
+}
+
+// deviceSecret requires the secret of the device named in the request path.
+// The body is read up front because signatures cover it, then handed on.
+func (g authGuard) deviceSecret(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !g.auth.DeviceAuthEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		deviceID := deviceIDFromPath(r)
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, g.maxBodyBytes))
+		if err != nil {
+			var maxBytes *http.MaxBytesError
+			if errors.As(err, &maxBytes) {
+				writeJSONError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", g.maxBodyBytes))
+			} else {
+				writeJSONError(w, r, http.StatusBadRequest, "failed to read request body")
+			}
+			g.logger.WarnContext(r.Context(), "failed to read request body", "device_id", deviceID, "error", err)
+			return
+		}
+
+		if err := g.auth.VerifyDevice(r, deviceID, body); err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="devices"`)
+			writeJSONError(w, r, http.StatusUnauthorized, "unauthorized")
+			g.logger.WarnContext(r.Context(), "device authentication failed", "device_id", deviceID, "path", r.URL.Path, "error", err)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// operator requires an operator token granting scope
+func (g authGuard) operator(scope auth.Scope, next http.Handler) http.Handler {
+	if g.auth == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !g.auth.OperatorAuthEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		name, err := g.auth.VerifyOperator(r, scope)
+		if errors.Is(err, auth.ErrForbidden) {
+			writeJSONError(w, r, http.StatusForbidden, fmt.Sprintf("token lacks %s scope", scope))
+			g.logger.WarnContext(r.Context(), "operator not authorized", "operator", name, "scope", scope, "path", r.URL.Path)
+			return
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="operators"`)
+			writeJSONError(w, r, http.StatusUnauthorized, "unauthorized")
+			g.logger.WarnContext(r.Context(), "operator authentication failed", "scope", scope, "path", r.URL.Path, "error", err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ingest guards cross-device ingestion, whose events carry no device
+// credentials, with an operator token granting the ingest scope. With device
+// authentication on and operator tokens off there is no one to trust with
+// every device's data, so it is refused rather than left open. When client
+// certificates are required, each event must also be for the certificate's
+// device.
+func (g authGuard) ingest(next http.Handler) http.Handler {
+	if g.requireClientCert {
+		next = g.ingestCert(next)
+	}
+	if g.auth == nil {
+		return next
+	}
+	operator := g.operator(auth.ScopeIngest, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if g.auth.DeviceAuthEnabled() && !g.auth.OperatorAuthEnabled() {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="operators"`)
+			writeJSONError(w, r, http.StatusUnauthorized, "ingest requires operator tokens while device authentication is enabled")
+			g.logger.WarnContext(r.Context(), "ingest refused without operator tokens", "path", r.URL.Path)
+			return
+		}
+		operator.ServeHTTP(w, r)
+	})
+}
+
+// ingestCert requires a verified client certificate and rejects every
+// event for a device other than one the certificate names, as deviceCert
+// does for the device in the path
+func (g authGuard) ingestCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identities := clientCertIdentities(r)
+		if identities == nil {
+			writeJSONError(w, r, http.StatusUnauthorized, "client certificate required")
+			g.logger.WarnContext(r.Context(), "missing client certificate", "path", r.URL.Path)
+			return
+		}
+		ctx := api.WithEventFilter(r.Context(), func(event storage.Event) string {
+			if slices.Contains(identities, event.DeviceID) {
+				return ""
+			}
+			g.logger.WarnContext(r.Context(), "client certificate does not match device", "device_id", event.DeviceID, "path", r.URL.Path, "identities", identities)
+			return "client certificate does not match device"
+		})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// deviceIDFromPath returns the {device_id} wildcard of the matched route
+func deviceIDFromPath(r *http.Request) string {
+	return r.PathValue("device_id")
+}
+
+// writeJSONError writes an error response in the API's format
+func writeJSONError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(api.ErrorResponse{Msg: message, RequestID: requestid.FromContext(r.Context())})
+}
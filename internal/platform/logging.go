@@ -1,46 +1,106 @@
 package platform
 
 import (
+	"device-fleet-monitoring/internal/requestid"
+	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net/http"
 	"os"
-	"strings"
 )
 
-// Logger provides structured logging with key-value pairs
+// LogFormat selects how log records are encoded
+type LogFormat string
+
+// Supported log formats
+const (
+	FormatLogfmt LogFormat = "logfmt" // key=value pairs, one record per line
+	FormatJSON   LogFormat = "json"   // One JSON object per line
+)
+
+// ParseLogFormat validates a log format name
+func ParseLogFormat(name string) (LogFormat, error) {
+	switch format := LogFormat(name); format {
+	case FormatLogfmt, FormatJSON:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown log format %q (want logfmt or json)", name)
+}
+
+// LoggerConfig holds configuration for Logger
+type LoggerConfig struct {
+	Output io.Writer  // Destination of all records; defaults to os.Stdout
+	Format LogFormat  // Defaults to FormatLogfmt
+	Level  slog.Level // Minimum level logged; adjustable at runtime with SetLevel
+}
+
+// Logger provides leveled, structured logging with key-value pairs. It
+// embeds *slog.Logger, so Debug, Info, Warn and Error take a message
+// followed by alternating keys and values.
 type Logger struct {
-	infoLogger  *log.Logger
-	errorLogger *log.Logger
+	*slog.Logger
+	level *slog.LevelVar
 }
 
 // NewLogger creates a new Logger instance
-func NewLogger() *Logger {
-	return &Logger{
-		infoLogger:  log.New(os.Stdout, "INFO: ", log.LstdFlags),
-		errorLogger: log.New(os.Stderr, "ERROR: ", log.LstdFlags),
+func NewLogger(config LoggerConfig) *Logger {
+	output := config.Output
+	if output == nil {
+		output = os.Stdout
 	}
+
+	level := new(slog.LevelVar)
+	level.Set(config.Level)
+	options := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if config.Format == FormatJSON {
+		handler = slog.NewJSONHandler(output, options)
+	} else {
+		handler = slog.NewTextHandler(output, options)
+	}
+
+	// Records logged with a request context carry its request_id
+	handler = requestid.NewHandler(handler)
+	return &Logger{Logger: slog.New(handler), level: level}
 }
 
-// Info logs an informational message with structured key-value pairs
-func (l *Logger) Info(msg string, keysAndValues ...interface{}) {
-	l.infoLogger.Println(formatMessage(msg, keysAndValues...))
+// Level returns the current minimum level
+func (l *Logger) Level() slog.Level {
+	return l.level.Level()
 }
 
-// Error logs an error message with structured key-value pairs
-func (l *Logger) Error(msg string, keysAndValues ...interface{}) {
-	l.errorLogger.Println(formatMessage(msg, keysAndValues...))
+// SetLevel changes the minimum level of this logger and every logger derived from it
+func (l *Logger) SetLevel(level slog.Level) {
+	l.level.Set(level)
 }
 
-// formatMessage formats a message with key-value pairs
-func formatMessage(msg string, keysAndValues ...interface{}) string {
-	var sb strings.Builder
-	sb.WriteString(msg)
-	
-	for i := 0; i < len(keysAndValues); i += 2 {
-		if i+1 < len(keysAndValues) {
-			sb.WriteString(fmt.Sprintf("\n  %v=%v", keysAndValues[i], keysAndValues[i+1]))
+// logLevelRequest is the body of PUT /admin/log-level and its response
+type logLevelRequest struct {
+	Level string `json:"level"`
+}
+
+// HandleLogLevel handles GET and PUT /admin/log-level
+func (l *Logger) HandleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req logLevelRequest
+		var level slog.Level
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || level.UnmarshalText([]byte(req.Level)) != nil {
+			writeJSONError(w, r, http.StatusBadRequest, "level must be one of debug, info, warn, error")
+			return
 		}
+		previous := l.Level()
+		l.SetLevel(level)
+		l.Warn("log level changed", "from", previous.String(), "to", level.String())
+	default:
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
 	}
-	
-	return sb.String()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(logLevelRequest{Level: l.Level().String()})
 }
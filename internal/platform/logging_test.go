@@ -0,0 +1,79 @@
+package platform
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLogger_Formats(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(LoggerConfig{Output: &buf, Format: FormatJSON})
+	logger.Debug("hidden")
+	logger.Info("request completed", "device_id", "cam-1", "status", 204)
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected one JSON record, got %q: %v", buf.String(), err)
+	}
+	if record["level"] != "INFO" || record["msg"] != "request completed" || record["device_id"] != "cam-1" || record["status"] != float64(204) {
+		t.Errorf("unexpected record %v", record)
+	}
+
+	buf.Reset()
+	logger = NewLogger(LoggerConfig{Output: &buf, Format: FormatLogfmt, Level: slog.LevelWarn})
+	logger.Info("hidden")
+	logger.Warn("device not found", "device_id", "cam 1")
+	if got := buf.String(); !strings.Contains(got, `level=WARN msg="device not found" device_id="cam 1"`) || strings.Contains(got, "hidden") {
+		t.Errorf("unexpected logfmt output %q", got)
+	}
+
+	if _, err := ParseLogFormat("xml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestLogger_HandleLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(LoggerConfig{Output: &buf})
+
+	tests := []struct {
+		method     string
+		body       string
+		wantStatus int
+		wantLevel  string
+	}{
+		{method: http.MethodGet, wantStatus: http.StatusOK, wantLevel: "INFO"},
+		{method: http.MethodPut, body: `{"level":"debug"}`, wantStatus: http.StatusOK, wantLevel: "DEBUG"},
+		{method: http.MethodPut, body: `{"level":"loud"}`, wantStatus: http.StatusBadRequest},
+		{method: http.MethodPut, body: `{"level":"WARN"}`, wantStatus: http.StatusOK, wantLevel: "WARN"},
+		{method: http.MethodPost, wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		logger.HandleLogLevel(w, httptest.NewRequest(tt.method, "/admin/log-level", strings.NewReader(tt.body)))
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s %s: expected status %d, got %d", tt.method, tt.body, tt.wantStatus, w.Code)
+			continue
+		}
+		if tt.wantLevel == "" {
+			continue
+		}
+		var resp logLevelRequest
+		json.NewDecoder(w.Body).Decode(&resp)
+		if resp.Level != tt.wantLevel {
+			t.Errorf("%s %s: level = %q, want %q", tt.method, tt.body, resp.Level, tt.wantLevel)
+		}
+	}
+
+	// Derived loggers share the level
+	buf.Reset()
+	logger.With("component", "x").Info("hidden")
+	if buf.Len() != 0 {
+		t.Errorf("expected info to be filtered at warn level, got %q", buf.String())
+	}
+}
@@ -0,0 +1,361 @@
+package platform
+
+import (
+	"bufio"
+	"context"
+	"device-fleet-monitoring/internal/storage"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsContentType is the Prometheus text exposition format, version 0.0.4
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the request latency histogram
+var DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// MetricsConfig holds configuration for Metrics
+type MetricsConfig struct {
+	Store     storage.Store // Source of store size gauges and per-device gauges
+	PerDevice bool          // Export uptime and average upload gauges for every device
+
+	RateLimiter *RateLimiter // Optional; source of rate limiter counters
+}
+
+// Metrics collects request, ingest and UDP heartbeat counters and renders them, together
+// with gauges read from the store at scrape time, in the Prometheus text
+// exposition format
+type Metrics struct {
+	store     storage.Store
+	perDevice bool
+	limiter   *RateLimiter
+
+	mu       sync.Mutex
+	requests map[requestKey]*requestStats
+	ingest   map[ingestKey]uint64
+	udp      map[string]uint64 // Datagrams by result
+}
+
+// requestKey identifies one request series
+type requestKey struct {
+	route  string
+	method string
+	status int
+}
+
+// requestStats is a request counter with its latency histogram
+type requestStats struct {
+	buckets []uint64 // Non-cumulative counts per DefaultLatencyBuckets bound
+	count   uint64
+	sum     float64
+}
+
+// ingestKey identifies one ingest counter
+type ingestKey struct {
+	endpoint string
+	result   string
+}
+
+// NewMetrics creates an empty Metrics instance
+func NewMetrics(config MetricsConfig) *Metrics {
+	return &Metrics{
+		store:     config.Store,
+		perDevice: config.PerDevice,
+		limiter:   config.RateLimiter,
+		requests:  make(map[requestKey]*requestStats),
+		ingest:    make(map[ingestKey]uint64),
+		udp:       make(map[string]uint64),
+	}
+}
+
+// ObserveRequest records a completed request against its route template
+func (m *Metrics) ObserveRequest(route, method string, status int, duration time.Duration) {
+	seconds := duration.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := requestKey{route: route, method: method, status: status}
+	stats, ok := m.requests[key]
+	if !ok {
+		stats = &requestStats{buckets: make([]uint64, len(DefaultLatencyBuckets))}
+		m.requests[key] = stats
+	}
+	stats.count++
+	stats.sum += seconds
+	if i := sort.SearchFloat64s(DefaultLatencyBuckets, seconds); i < len(stats.buckets) {
+		stats.buckets[i]++
+	}
+}
+
+// RecordIngest counts accepted and rejected events for an ingest endpoint
+func (m *Metrics) RecordIngest(endpoint string, accepted, rejected int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ingest[ingestKey{endpoint: endpoint, result: "accepted"}] += uint64(accepted)
+	m.ingest[ingestKey{endpoint: endpoint, result: "rejected"}] += uint64(rejected)
+}
+
+// RecordUDP counts a UDP heartbeat datagram by its result
+func (m *Metrics) RecordUDP(result string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.udp[result]++
+}
+
+// ServeHTTP handles GET /metrics
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Read the store first so a failure can still produce an error status
+	var usage storage.Usage
+	if m.store != nil {
+		var err error
+		if usage, err = m.store.Usage(r.Context()); err != nil {
+			http.Error(w, "failed to read store usage", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", metricsContentType)
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	bw := bufio.NewWriter(w)
+	m.writeRequests(bw)
+	m.writeIngest(bw)
+	m.writeUDP(bw)
+	if m.limiter != nil {
+		writeRateLimits(bw, m.limiter.Stats())
+	}
+	if m.store != nil {
+		writeUsage(bw, usage)
+		if m.perDevice {
+			m.writeDevices(r.Context(), bw)
+		}
+	}
+	bw.Flush()
+}
+
+// writeRequests writes the request counter and latency histogram families
+func (m *Metrics) writeRequests(w *bufio.Writer) {
+	m.mu.Lock()
+	keys := make([]requestKey, 0, len(m.requests))
+	snapshot := make(map[requestKey]requestStats, len(m.requests))
+	for key, stats := range m.requests {
+		keys = append(keys, key)
+		snapshot[key] = requestStats{buckets: append([]uint64(nil), stats.buckets...), count: stats.count, sum: stats.sum}
+	}
+	m.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+
+	writeHeader(w, "fleet_http_requests_total", "counter", "Total HTTP requests by route, method and status.")
+	for _, key := range keys {
+		writeSample(w, "fleet_http_requests_total", requestLabels(key), float64(snapshot[key].count))
+	}
+
+	writeHeader(w, "fleet_http_request_duration_seconds", "histogram", "HTTP request latency by route, method and status.")
+	for _, key := range keys {
+		stats := snapshot[key]
+		labels := requestLabels(key)
+
+		var cumulative uint64
+		for i, bound := range DefaultLatencyBuckets {
+			cumulative += stats.buckets[i]
+			writeSample(w, "fleet_http_request_duration_seconds_bucket", append(labels, "le", formatFloat(bound)), float64(cumulative))
+		}
+		writeSample(w, "fleet_http_request_duration_seconds_bucket", append(labels, "le", "+Inf"), float64(stats.count))
+		writeSample(w, "fleet_http_request_duration_seconds_sum", labels, stats.sum)
+		writeSample(w, "fleet_http_request_duration_seconds_count", labels, float64(stats.count))
+	}
+}
+
+// requestLabels returns the label pairs of a request series
+func requestLabels(key requestKey) []string {
+	// Leave room for the le label so appends don't share a backing array
+	labels := make([]string, 0, 8)
+	return append(labels, "route", key.route, "method", key.method, "status", strconv.Itoa(key.status))
+}
+
+// writeIngest writes the ingest event counter family
+func (m *Metrics) writeIngest(w *bufio.Writer) {
+	m.mu.Lock()
+	keys := make([]ingestKey, 0, len(m.ingest))
+	counts := make(map[ingestKey]uint64, len(m.ingest))
+	for key, count := range m.ingest {
+		keys = append(keys, key)
+		counts[key] = count
+	}
+	m.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].endpoint != keys[j].endpoint {
+			return keys[i].endpoint < keys[j].endpoint
+		}
+		return keys[i].result < keys[j].result
+	})
+
+	writeHeader(w, "fleet_ingest_events_total", "counter", "Heartbeat and upload events received by endpoint and result.")
+	for _, key := range keys {
+		writeSample(w, "fleet_ingest_events_total", []string{"endpoint", key.endpoint, "result", key.result}, float64(counts[key]))
+	}
+}
+
+// writeUDP writes the UDP heartbeat counter family
+func (m *Metrics) writeUDP(w *bufio.Writer) {
+	m.mu.Lock()
+	results := make([]string, 0, len(m.udp))
+	counts := make(map[string]uint64, len(m.udp))
+	for result, count := range m.udp {
+		results = append(results, result)
+		counts[result] = count
+	}
+	m.mu.Unlock()
+	if len(results) == 0 {
+		return // No listener, or nothing received yet
+	}
+
+	sort.Strings(results)
+	writeHeader(w, "fleet_udp_packets_total", "counter", "UDP heartbeat datagrams received by result.")
+	for _, result := range results {
+		writeSample(w, "fleet_udp_packets_total", []string{"result", result}, float64(counts[result]))
+	}
+}
+
+// writeRateLimits writes the rate limiter counters and bucket gauges
+func writeRateLimits(w *bufio.Writer, stats []RateLimitStats) {
+	writeHeader(w, "fleet_ratelimit_requests_total", "counter", "Requests checked against a rate limit by limit and result.")
+	for _, s := range stats {
+		writeSample(w, "fleet_ratelimit_requests_total", []string{"limit", s.Limit, "result", "allowed"}, float64(s.Allowed))
+		writeSample(w, "fleet_ratelimit_requests_total", []string{"limit", s.Limit, "result", "limited"}, float64(s.Limited))
+		writeSample(w, "fleet_ratelimit_requests_total", []string{"limit", s.Limit, "result", "overflow"}, float64(s.Overflow))
+	}
+	writeHeader(w, "fleet_ratelimit_keys", "gauge", "Token buckets currently held by limit.")
+	for _, s := range stats {
+		writeSample(w, "fleet_ratelimit_keys", []string{"limit", s.Limit}, float64(s.Keys))
+	}
+	writeHeader(w, "fleet_ratelimit_evictions_total", "counter", "Idle token buckets evicted by limit.")
+	for _, s := range stats {
+		writeSample(w, "fleet_ratelimit_evictions_total", []string{"limit", s.Limit}, float64(s.Evicted))
+	}
+}
+
+// writeUsage writes the store size gauges
+func writeUsage(w *bufio.Writer, usage storage.Usage) {
+	writeHeader(w, "fleet_store_devices", "gauge", "Registered devices, including decommissioned ones.")
+	writeSample(w, "fleet_store_devices", nil, float64(usage.Devices))
+	writeHeader(w, "fleet_store_active_devices", "gauge", "Devices accepting heartbeats and uploads.")
+	writeSample(w, "fleet_store_active_devices", nil, float64(usage.ActiveDevices))
+	writeHeader(w, "fleet_store_minute_buckets", "gauge", "Distinct heartbeat minutes held across all devices.")
+	writeSample(w, "fleet_store_minute_buckets", nil, float64(usage.MinuteBuckets))
+	writeHeader(w, "fleet_store_upload_samples", "gauge", "Upload samples retained for windowed queries.")
+	writeSample(w, "fleet_store_upload_samples", nil, float64(usage.UploadSamples))
+	writeHeader(w, "fleet_store_memory_bytes", "gauge", "Estimated heap memory held by device aggregates.")
+	writeSample(w, "fleet_store_memory_bytes", nil, float64(usage.EstimatedBytes))
+}
+
+// writeDevices writes per-device uptime and average upload gauges for active devices
+func (m *Metrics) writeDevices(ctx context.Context, w *bufio.Writer) {
+	var uptimes, uploads []storage.DeviceSummary
+	err := m.store.ScanDevices(ctx, func(d storage.DeviceSummary) bool {
+		if d.Decommissioned {
+			return true
+		}
+		uptimes = append(uptimes, d)
+		if d.UploadCount > 0 {
+			uploads = append(uploads, d)
+		}
+		return true
+	})
+	if err != nil {
+		// Headers are already sent; omit the per-device families
+		return
+	}
+
+	// Families must not interleave, so each is written in full
+	writeHeader(w, "fleet_device_uptime_percent", "gauge", "Lifetime uptime percentage per device.")
+	for _, d := range uptimes {
+		writeSample(w, "fleet_device_uptime_percent", []string{"device_id", d.ID}, d.Uptime)
+	}
+	writeHeader(w, "fleet_device_avg_upload_seconds", "gauge", "Average upload time per device.")
+	for _, d := range uploads {
+		writeSample(w, "fleet_device_avg_upload_seconds", []string{"device_id", d.ID}, d.AvgUpload/float64(time.Second))
+	}
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric family
+func writeHeader(w *bufio.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(help), name, kind)
+}
+
+// writeSample writes one sample line; labels alternate names and values
+func writeSample(w *bufio.Writer, name string, labels []string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(labels[i])
+			w.WriteString(`="`)
+			w.WriteString(escapeLabelValue(labels[i+1]))
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+// formatFloat formats a sample value as the exposition format expects
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// escapeHelp escapes backslashes and newlines in HELP text
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+// escapeLabelValue escapes backslashes, newlines and double quotes in a label value
+func escapeLabelValue(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,464 @@
+package platform
+
+import (
+	"context"
+	"device-fleet-monitoring/internal/api"
+	"device-fleet-monitoring/internal/storage"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sample is one parsed exposition line
+type sample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// family is a parsed metric family
+type family struct {
+	kind    string
+	samples []sample
+}
+
+var metricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// parseExposition parses and validates Prometheus text format 0.0.4: every
+// family has HELP and TYPE before its samples, families don't interleave,
+// series are unique and histograms have cumulative buckets ending in +Inf
+// that agree with their _count.
+func parseExposition(text string) (map[string]*family, error) {
+	families := make(map[string]*family)
+	helps := make(map[string]bool)
+	series := make(map[string]bool)
+	var current string
+
+	if !strings.HasSuffix(text, "\n") {
+		return nil, errors.New("output must end with a newline")
+	}
+	for n, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		lineErr := func(format string, args ...interface{}) error {
+			return fmt.Errorf("line %d %q: %s", n+1, line, fmt.Sprintf(format, args...))
+		}
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) < 3 || (fields[1] != "HELP" && fields[1] != "TYPE") {
+				continue // Plain comment
+			}
+			name := fields[2]
+			if !metricName.MatchString(name) {
+				return nil, lineErr("invalid metric name")
+			}
+			if fields[1] == "HELP" {
+				if helps[name] {
+					return nil, lineErr("duplicate HELP")
+				}
+				helps[name] = true
+				continue
+			}
+			if len(fields) != 4 {
+				return nil, lineErr("missing type")
+			}
+			switch fields[3] {
+			case "counter", "gauge", "histogram", "summary", "untyped":
+			default:
+				return nil, lineErr("unknown type")
+			}
+			if _, ok := families[name]; ok {
+				return nil, lineErr("duplicate TYPE or interleaved family")
+			}
+			families[name] = &family{kind: fields[3]}
+			current = name
+			continue
+		}
+
+		s, err := parseSample(line)
+		if err != nil {
+			return nil, lineErr("%v", err)
+		}
+		f := families[current]
+		if f == nil || familyName(s.name, f.kind) != current {
+			return nil, lineErr("sample outside its family's TYPE block")
+		}
+		key := s.name + fmt.Sprint(sortedLabels(s.labels))
+		if series[key] {
+			return nil, lineErr("duplicate series")
+		}
+		series[key] = true
+		f.samples = append(f.samples, s)
+	}
+
+	for name, f := range families {
+		if !helps[name] {
+			return nil, fmt.Errorf("%s: missing HELP", name)
+		}
+		if f.kind == "histogram" {
+			if err := checkHistogram(name, f); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return families, nil
+}
+
+// parseSample parses `name{label="value",...} value`
+func parseSample(line string) (sample, error) {
+	s := sample{labels: make(map[string]string)}
+	end := strings.IndexAny(line, "{ ")
+	if end < 0 {
+		return s, errors.New("missing value")
+	}
+	s.name = line[:end]
+	if !metricName.MatchString(s.name) {
+		return s, errors.New("invalid metric name")
+	}
+	rest := line[end:]
+
+	if strings.HasPrefix(rest, "{") {
+		rest = rest[1:]
+		for !strings.HasPrefix(rest, "}") {
+			eq := strings.Index(rest, `="`)
+			if eq < 0 {
+				return s, errors.New("malformed label")
+			}
+			name := rest[:eq]
+			if !labelName.MatchString(name) {
+				return s, fmt.Errorf("invalid label name %q", name)
+			}
+			if _, ok := s.labels[name]; ok {
+				return s, fmt.Errorf("duplicate label %q", name)
+			}
+			rest = rest[eq+2:]
+
+			var value strings.Builder
+			closed := false
+			for i := 0; i < len(rest); i++ {
+				c := rest[i]
+				if c == '"' {
+					rest = rest[i+1:]
+					closed = true
+					break
+				}
+				if c != '\\' {
+					value.WriteByte(c)
+					continue
+				}
+				if i+1 == len(rest) {
+					return s, errors.New("dangling escape")
+				}
+				i++
+				switch rest[i] {
+				case '\\':
+					value.WriteByte('\\')
+				case '"':
+					value.WriteByte('"')
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					return s, fmt.Errorf("invalid escape \\%c", rest[i])
+				}
+			}
+			if !closed {
+				return s, errors.New("unterminated label value")
+			}
+			s.labels[name] = value.String()
+			rest = strings.TrimPrefix(rest, ",")
+		}
+		rest = rest[1:]
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 || !strings.HasPrefix(rest, " ") {
+		return s, errors.New("expected a value and optional timestamp")
+	}
+	value, err := parseValue(fields[0])
+	if err != nil {
+		return s, err
+	}
+	s.value = value
+	return s, nil
+}
+
+// parseValue parses a sample value, including +Inf, -Inf and NaN
+func parseValue(v string) (float64, error) {
+	switch v {
+	case "+Inf":
+		return math.Inf(1), nil
+	case "-Inf":
+		return math.Inf(-1), nil
+	case "NaN":
+		return math.NaN(), nil
+	}
+	return strconv.ParseFloat(v, 64)
+}
+
+// familyName returns the family a sample belongs to
+func familyName(name, kind string) string {
+	if kind == "histogram" {
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if strings.HasSuffix(name, suffix) {
+				return strings.TrimSuffix(name, suffix)
+			}
+		}
+	}
+	return name
+}
+
+// sortedLabels returns labels as sorted name=value pairs, optionally without some names
+func sortedLabels(labels map[string]string, without ...string) []string {
+	var pairs []string
+	for name, value := range labels {
+		if contains(without, name) {
+			continue
+		}
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHistogram validates the bucket series of every histogram child
+func checkHistogram(name string, f *family) error {
+	type child struct {
+		lastLE, lastCount float64
+		inf, count        float64
+		hasInf, hasCount  bool
+		hasSum            bool
+	}
+	children := make(map[string]*child)
+	get := func(s sample) *child {
+		key := fmt.Sprint(sortedLabels(s.labels, "le"))
+		c, ok := children[key]
+		if !ok {
+			c = &child{lastLE: math.Inf(-1)}
+			children[key] = c
+		}
+		return c
+	}
+
+	for _, s := range f.samples {
+		c := get(s)
+		switch s.name {
+		case name + "_bucket":
+			le, ok := s.labels["le"]
+			if !ok {
+				return fmt.Errorf("%s: bucket without le", name)
+			}
+			bound, err := parseValue(le)
+			if err != nil || bound <= c.lastLE {
+				return fmt.Errorf("%s: buckets must have increasing le, got %q", name, le)
+			}
+			if s.value < c.lastCount {
+				return fmt.Errorf("%s: bucket counts must be cumulative", name)
+			}
+			c.lastLE, c.lastCount = bound, s.value
+			if math.IsInf(bound, 1) {
+				c.inf, c.hasInf = s.value, true
+			}
+		case name + "_count":
+			c.count, c.hasCount = s.value, true
+		case name + "_sum":
+			c.hasSum = true
+		}
+	}
+	for key, c := range children {
+		if !c.hasInf || !c.hasCount || !c.hasSum {
+			return fmt.Errorf("%s%s: missing +Inf bucket, _sum or _count", name, key)
+		}
+		if c.inf != c.count {
+			return fmt.Errorf("%s%s: +Inf bucket %v != count %v", name, key, c.inf, c.count)
+		}
+	}
+	return nil
+}
+
+// value returns the sample of a family with exactly the given labels
+func (f *family) value(name string, labels ...string) (float64, bool) {
+	want := make(map[string]string)
+	for i := 0; i+1 < len(labels); i += 2 {
+		want[labels[i]] = labels[i+1]
+	}
+	for _, s := range f.samples {
+		if s.name == name && fmt.Sprint(sortedLabels(s.labels)) == fmt.Sprint(sortedLabels(want)) {
+			return s.value, true
+		}
+	}
+	return 0, false
+}
+
+func TestParseExposition_RejectsInvalidOutput(t *testing.T) {
+	header := "# HELP m help\n# TYPE m counter\n"
+	hist := "# HELP h help\n# TYPE h histogram\n"
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{name: "no type", input: "m 1\n"},
+		{name: "bad value", input: header + "m one\n"},
+		{name: "bad escape", input: header + `m{a="\t"} 1` + "\n"},
+		{name: "unterminated label", input: header + `m{a="x} 1` + "\n"},
+		{name: "duplicate series", input: header + "m 1\nm 2\n"},
+		{name: "missing help", input: "# TYPE m counter\nm 1\n"},
+		{name: "no trailing newline", input: header + "m 1"},
+		{name: "non-cumulative buckets", input: hist + "h_bucket{le=\"1\"} 2\nh_bucket{le=\"+Inf\"} 1\nh_sum 1\nh_count 1\n"},
+		{name: "inf differs from count", input: hist + "h_bucket{le=\"+Inf\"} 2\nh_sum 1\nh_count 1\n"},
+	}
+	for _, tt := range tests {
+		if _, err := parseExposition(tt.input); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+
+	if _, err := parseExposition(header + `m{a="q\"b\\n\n"} 1.5e+06` + "\n"); err != nil {
+		t.Errorf("valid input rejected: %v", err)
+	}
+}
+
+// scrape fetches /metrics through router and validates the output
+func scrape(t *testing.T, router http.Handler) map[string]*family {
+	t.Helper()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if got := w.Header().Get("Content-Type"); got != metricsContentType {
+		t.Errorf("Content-Type = %q, want %q", got, metricsContentType)
+	}
+	families, err := parseExposition(w.Body.String())
+	if err != nil {
+		t.Fatalf("invalid exposition: %v\n%s", err, w.Body.String())
+	}
+	return families
+}
+
+func TestMetrics_Exposition(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore([]string{"cam-1", `odd"id\`, "gone"})
+	store.AddHeartbeat(ctx, "cam-1", time.Unix(0, 0))
+	store.AddHeartbeat(ctx, "cam-1", time.Unix(60, 0))
+	store.AddUpload(ctx, "cam-1", time.Unix(60, 0), int(2*time.Second))
+	store.DecommissionDevice(ctx, "gone", false)
+
+	metrics := NewMetrics(MetricsConfig{Store: store, PerDevice: true})
+	logger := NewLogger(LoggerConfig{Output: io.Discard})
+	handlers := api.NewHandlers(store, api.WithIngestRecorder(metrics), api.WithLogger(logger.Logger))
+	router := NewRouter(RouterConfig{Handlers: handlers, Logger: logger, Metrics: metrics})
+
+	requests := []struct{ method, path, body string }{
+		{http.MethodPost, "/api/v1/devices/cam-1/heartbeat", `{"sent_at":120}`},
+		{http.MethodPost, "/api/v1/devices/unknown/heartbeat", `{"sent_at":120}`},
+		{http.MethodPost, "/api/v1/devices/gone/heartbeat", `{"sent_at":120}`},
+		{http.MethodPost, "/api/v1/ingest", `[{"device_id":"cam-1","type":"stats","sent_at":120,"upload_time":1},{"type":"reboot"}]`},
+		{http.MethodGet, "/api/v1/devices/cam-1/stats", ""},
+	}
+	for _, req := range requests {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(req.method, req.path, strings.NewReader(req.body)))
+	}
+	metrics.RecordUDP(udpAccepted)
+	metrics.RecordUDP(udpMalformed)
+	metrics.RecordUDP(udpMalformed)
+
+	families := scrape(t, router)
+	checks := []struct {
+		family, name string
+		labels       []string
+		want         float64
+	}{
+		{"fleet_http_requests_total", "fleet_http_requests_total", []string{"route", "/api/v1/devices/{id}/heartbeat", "method", "POST", "status", "204"}, 1},
+		{"fleet_http_requests_total", "fleet_http_requests_total", []string{"route", "/api/v1/devices/{id}/heartbeat", "method", "POST", "status", "404"}, 1},
+		{"fleet_http_requests_total", "fleet_http_requests_total", []string{"route", "/api/v1/devices/{id}/heartbeat", "method", "POST", "status", "410"}, 1},
+		{"fleet_http_request_duration_seconds", "fleet_http_request_duration_seconds_count", []string{"route", "/api/v1/ingest", "method", "POST", "status", "200"}, 1},
+		{"fleet_http_request_duration_seconds", "fleet_http_request_duration_seconds_bucket", []string{"route", "/api/v1/devices/{id}/stats", "method", "GET", "status", "200", "le", "+Inf"}, 1},
+		{"fleet_ingest_events_total", "fleet_ingest_events_total", []string{"endpoint", "/heartbeat", "result", "accepted"}, 1},
+		{"fleet_ingest_events_total", "fleet_ingest_events_total", []string{"endpoint", "/heartbeat", "result", "rejected"}, 2},
+		{"fleet_ingest_events_total", "fleet_ingest_events_total", []string{"endpoint", "/ingest", "result", "accepted"}, 1},
+		{"fleet_ingest_events_total", "fleet_ingest_events_total", []string{"endpoint", "/ingest", "result", "rejected"}, 1},
+		{"fleet_udp_packets_total", "fleet_udp_packets_total", []string{"result", "accepted"}, 1},
+		{"fleet_udp_packets_total", "fleet_udp_packets_total", []string{"result", "malformed"}, 2},
+		{"fleet_store_devices", "fleet_store_devices", nil, 3},
+		{"fleet_store_active_devices", "fleet_store_active_devices", nil, 2},
+		{"fleet_store_minute_buckets", "fleet_store_minute_buckets", nil, 3},
+		{"fleet_store_upload_samples", "fleet_store_upload_samples", nil, 2},
+		{"fleet_device_uptime_percent", "fleet_device_uptime_percent", []string{"device_id", "cam-1"}, 150},
+		{"fleet_device_uptime_percent", "fleet_device_uptime_percent", []string{"device_id", `odd"id\`}, 0},
+		{"fleet_device_avg_upload_seconds", "fleet_device_avg_upload_seconds", []string{"device_id", "cam-1"}, 1.0000000005},
+	}
+	for _, c := range checks {
+		f := families[c.family]
+		if f == nil {
+			t.Errorf("missing family %s", c.family)
+			continue
+		}
+		if got, ok := f.value(c.name, c.labels...); !ok || math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("%s%v = %v (found %t), want %v", c.name, c.labels, got, ok, c.want)
+		}
+	}
+
+	if v, _ := families["fleet_store_memory_bytes"].value("fleet_store_memory_bytes"); v <= 0 {
+		t.Errorf("expected a positive memory estimate, got %v", v)
+	}
+	if _, ok := families["fleet_device_uptime_percent"].value("fleet_device_uptime_percent", "device_id", "gone"); ok {
+		t.Error("decommissioned devices should not export per-device gauges")
+	}
+}
+
+func TestMetrics_PerDeviceDisabled(t *testing.T) {
+	store := storage.NewMemoryStore([]string{"cam-1"})
+	metrics := NewMetrics(MetricsConfig{Store: store})
+	router := NewRouter(RouterConfig{Handlers: api.NewHandlers(store), Logger: NewLogger(LoggerConfig{Output: io.Discard}), Metrics: metrics})
+
+	families := scrape(t, router)
+	if families["fleet_device_uptime_percent"] != nil || families["fleet_device_avg_upload_seconds"] != nil {
+		t.Error("per-device gauges should be disabled by default")
+	}
+	if families["fleet_store_devices"] == nil {
+		t.Error("missing store gauges")
+	}
+}
+
+func TestMetrics_LatencyBuckets(t *testing.T) {
+	metrics := NewMetrics(MetricsConfig{})
+	metrics.ObserveRequest("/r", http.MethodGet, 200, 5*time.Millisecond)
+	metrics.ObserveRequest("/r", http.MethodGet, 200, 300*time.Millisecond)
+	metrics.ObserveRequest("/r", http.MethodGet, 200, time.Minute)
+
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	families, err := parseExposition(w.Body.String())
+	if err != nil {
+		t.Fatalf("invalid exposition: %v\n%s", err, w.Body.String())
+	}
+
+	f := families["fleet_http_request_duration_seconds"]
+	for le, want := range map[string]float64{"0.005": 1, "0.25": 1, "0.5": 2, "10": 2, "+Inf": 3} {
+		got, _ := f.value("fleet_http_request_duration_seconds_bucket", "route", "/r", "method", "GET", "status", "200", "le", le)
+		if got != want {
+			t.Errorf("bucket le=%s = %v, want %v", le, got, want)
+		}
+	}
+}
@@ -0,0 +1,579 @@
+package platform
+
+import (
+	"bytes"
+	"context"
+	"device-fleet-monitoring/internal/alerting"
+	"device-fleet-monitoring/internal/api"
+	"device-fleet-monitoring/internal/auth"
+	"device-fleet-monitoring/internal/events"
+	"device-fleet-monitoring/internal/notify"
+	"device-fleet-monitoring/internal/storage"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openAPISpec is the parsed embedded spec with a JSON Schema subset
+// validator: $ref, type, properties, required, additionalProperties, items,
+// enum, oneOf, minimum, maximum and the date-time format
+type openAPISpec struct {
+	doc  map[string]interface{}
+	used map[string]bool // Component schemas reached while validating
+}
+
+func loadOpenAPISpec(t *testing.T) *openAPISpec {
+	t.Helper()
+	var doc map[string]interface{}
+	if err := json.Unmarshal(api.OpenAPISpec, &doc); err != nil {
+		t.Fatalf("embedded spec is not JSON: %v", err)
+	}
+	if doc["openapi"] != "3.1.0" {
+		t.Fatalf("openapi = %v, want 3.1.0", doc["openapi"])
+	}
+	return &openAPISpec{doc: doc, used: make(map[string]bool)}
+}
+
+// lookup follows a local JSON pointer such as #/components/schemas/Name
+func (s *openAPISpec) lookup(ref string) (map[string]interface{}, error) {
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("unsupported $ref %q", ref)
+	}
+	var node interface{} = s.doc
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unresolved $ref %q", ref)
+		}
+		if node, ok = m[part]; !ok {
+			return nil, fmt.Errorf("unresolved $ref %q", ref)
+		}
+	}
+	m, ok := node.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("$ref %q is not an object", ref)
+	}
+	if strings.HasPrefix(ref, "#/components/schemas/") {
+		s.used[strings.TrimPrefix(ref, "#/components/schemas/")] = true
+	}
+	return m, nil
+}
+
+// resolve returns node, or the object its $ref points to
+func (s *openAPISpec) resolve(node map[string]interface{}) (map[string]interface{}, error) {
+	if ref, ok := node["$ref"].(string); ok {
+		return s.lookup(ref)
+	}
+	return node, nil
+}
+
+// validate checks a value decoded with json.Decoder.UseNumber against schema
+func (s *openAPISpec) validate(schema map[string]interface{}, value interface{}, path string) error {
+	schema, err := s.resolve(schema)
+	if err != nil {
+		return err
+	}
+
+	if options, ok := schema["oneOf"].([]interface{}); ok {
+		matched := 0
+		for _, option := range options {
+			if s.validate(option.(map[string]interface{}), value, path) == nil {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return fmt.Errorf("%s: %v matches %d oneOf schemas, want 1", path, value, matched)
+		}
+	}
+
+	if types := schemaTypes(schema["type"]); len(types) > 0 && !contains(types, jsonType(value)) {
+		if !(jsonType(value) == "integer" && contains(types, "number")) {
+			return fmt.Errorf("%s: %s is not of type %v", path, jsonType(value), types)
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if fmt.Sprint(e) == fmt.Sprint(value) {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", path, value, enum)
+		}
+	}
+
+	switch v := value.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		if min, ok := schema["minimum"].(float64); ok && f < min {
+			return fmt.Errorf("%s: %v is below the minimum %v", path, f, min)
+		}
+		if max, ok := schema["maximum"].(float64); ok && f > max {
+			return fmt.Errorf("%s: %v is above the maximum %v", path, f, max)
+		}
+	case string:
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, v); err != nil {
+				return fmt.Errorf("%s: %q is not a date-time", path, v)
+			}
+		}
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := s.validate(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if _, ok := v[name.(string)]; !ok {
+					return fmt.Errorf("%s: missing required property %q", path, name)
+				}
+			}
+		}
+		for name, field := range v {
+			if property, ok := properties[name].(map[string]interface{}); ok {
+				if err := s.validate(property, field, path+"."+name); err != nil {
+					return err
+				}
+				continue
+			}
+			switch additional := schema["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					return fmt.Errorf("%s: property %q is not in the schema", path, name)
+				}
+			case map[string]interface{}:
+				if err := s.validate(additional, field, path+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// schemaTypes returns the type keyword as a list
+func schemaTypes(t interface{}) []string {
+	switch t := t.(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		types := make([]string, len(t))
+		for i, name := range t {
+			types[i] = name.(string)
+		}
+		return types
+	}
+	return nil
+}
+
+// jsonType returns the JSON Schema type of a decoded value
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+// specPath converts a route pattern such as "POST /api/v1/devices/{device_id}"
+// to its spec method and path
+func specPath(pattern string) (string, string) {
+	method, path, _ := strings.Cut(pattern, " ")
+	return strings.ToLower(method), path
+}
+
+// pathParam matches a {name} path template parameter after regexp.QuoteMeta
+var pathParam = regexp.MustCompile(`\\\{[a-z_]+\\\}`)
+
+// operation finds the operation of method on path, matching {name}
+// templates against the concrete path
+func (s *openAPISpec) operation(method, path string) (string, map[string]interface{}) {
+	paths := s.doc["paths"].(map[string]interface{})
+	for template, item := range paths {
+		pattern := "^" + pathParam.ReplaceAllString(regexp.QuoteMeta(template), `[^/]+`) + "$"
+		if !regexp.MustCompile(pattern).MatchString(path) {
+			continue
+		}
+		if op, ok := item.(map[string]interface{})[strings.ToLower(method)].(map[string]interface{}); ok {
+			return template, op
+		}
+	}
+	return "", nil
+}
+
+// decode parses a JSON body, preserving the integer/number distinction
+func decode(body []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var value interface{}
+	err := dec.Decode(&value)
+	return value, err
+}
+
+// checkRequest validates a JSON request body against the operation
+func (s *openAPISpec) checkRequest(op map[string]interface{}, body string) error {
+	requestBody, ok := op["requestBody"].(map[string]interface{})
+	if !ok {
+		if body != "" {
+			return fmt.Errorf("operation takes no request body")
+		}
+		return nil
+	}
+	schema := requestBody["content"].(map[string]interface{})["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+	value, err := decode([]byte(body))
+	if err != nil {
+		return fmt.Errorf("request body is not JSON: %v", err)
+	}
+	return s.validate(schema, value, "request")
+}
+
+// checkResponse validates a response against the operation's documented
+// responses, or against ErrorResponse if op is nil
+func (s *openAPISpec) checkResponse(op map[string]interface{}, w *httptest.ResponseRecorder) error {
+	mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+
+	var schema map[string]interface{}
+	if op == nil {
+		if mediaType != "application/json" {
+			return fmt.Errorf("Content-Type %q is not JSON", mediaType)
+		}
+		schema = map[string]interface{}{"$ref": "#/components/schemas/ErrorResponse"}
+	} else {
+		responses := op["responses"].(map[string]interface{})
+		documented, ok := responses[fmt.Sprint(w.Code)].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("status %d is not documented", w.Code)
+		}
+		documented, err := s.resolve(documented)
+		if err != nil {
+			return err
+		}
+		content, ok := documented["content"].(map[string]interface{})
+		if !ok {
+			if w.Body.Len() > 0 {
+				return fmt.Errorf("status %d is documented without a body, got %q", w.Code, w.Body.String())
+			}
+			return nil
+		}
+		media, ok := content[mediaType].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Content-Type %q is not documented for status %d", mediaType, w.Code)
+		}
+		if mediaType != "application/json" {
+			return nil
+		}
+		schema = media["schema"].(map[string]interface{})
+
+		if headers, ok := documented["headers"].(map[string]interface{}); ok {
+			for name := range headers {
+				if w.Header().Get(name) == "" {
+					return fmt.Errorf("documented header %s is missing", name)
+				}
+			}
+		}
+	}
+
+	value, err := decode(w.Body.Bytes())
+	if err != nil {
+		return fmt.Errorf("response body is not JSON: %v", err)
+	}
+	return s.validate(schema, value, "response")
+}
+
+func TestOpenAPI_MatchesRouter(t *testing.T) {
+	spec := loadOpenAPISpec(t)
+
+	ctx := context.Background()
+	store := storage.NewMemoryStore(nil)
+	store.ReconcileDevices(ctx, []storage.DeviceInfo{
+		{ID: "cam-1", Metadata: storage.DeviceMetadata{Type: "camera", Site: "lab", Tags: []string{"outdoor"}, Labels: map[string]string{"rack": "r7"}}},
+		{ID: "cam-2"},
+		{ID: "cam-3"},
+	})
+	store.AddHeartbeat(ctx, "cam-1", time.Unix(0, 0))
+	store.AddUpload(ctx, "cam-1", time.Unix(0, 0), int(3*time.Second))
+	store.DecommissionDevice(ctx, "cam-3", false)
+
+	authenticator := auth.NewAuthenticator(auth.Config{
+		DeviceSecrets: map[string]string{"cam-1": "s3cret", "cam-3": "s3cret3"},
+		OperatorTokens: []auth.OperatorToken{
+			{Name: "ops", Token: "ops-token", Scopes: []auth.Scope{auth.ScopeRead, auth.ScopeIngest, auth.ScopeAdmin}},
+			{Name: "dashboard", Token: "read-token", Scopes: []auth.Scope{auth.ScopeRead}},
+		},
+	})
+	clock := newFakeClock()
+	alerts := alerting.NewEngine(alerting.EngineConfig{
+		Store:  store,
+		Rules:  []alerting.Rule{{Name: "offline", Kind: alerting.KindOffline, Threshold: 60, Resolve: 60}},
+		Logger: slog.New(slog.DiscardHandler),
+		Now:    clock.Now,
+	})
+	if err := alerts.Evaluate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// One delivered webhook and one dead letter, dropped because the queue was full
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer receiver.Close()
+	webhooks := notify.NewDispatcher(notify.DispatcherConfig{
+		QueueSize: 1,
+		Endpoints: []notify.Endpoint{{Name: "pager", URL: receiver.URL, Secret: "s3cret"}},
+		Logger:    slog.New(slog.DiscardHandler),
+	})
+	webhooks.Notify(alerting.Event{DeviceID: "cam-1", State: alerting.StateFirstSeen})
+	webhooks.Notify(alerting.Event{Rule: "offline", Kind: alerting.KindOffline, DeviceID: "cam-1", State: alerting.StateFiring, Value: 90, Threshold: 60})
+	webhooksCtx, stopWebhooks := context.WithCancel(ctx)
+	defer stopWebhooks()
+	go webhooks.Run(webhooksCtx)
+	for webhooks.Status()[0].Delivered == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	deadLetter := webhooks.DeadLetters()[0].ID
+
+	metrics := NewMetrics(MetricsConfig{Store: store})
+	readiness := &Readiness{}
+	readiness.SetReady(true)
+	logger := NewLogger(LoggerConfig{Output: io.Discard})
+	config := RouterConfig{
+		Handlers:     api.NewHandlers(store, api.WithLogger(logger.Logger), api.WithBatchLimits(2, 1024), api.WithAlerts(alerts), api.WithWebhooks(webhooks), api.WithEvents(events.NewBroker(events.BrokerConfig{}))),
+		Logger:       logger,
+		Metrics:      metrics,
+		Readiness:    readiness,
+		Auth:         authenticator,
+		MaxBodyBytes: 1024,
+		RateLimiter:  NewRateLimiter(RateLimitConfig{Stats: RateLimit{Rate: 1, Burst: 2}, Now: clock.Now}),
+	}
+	router := NewRouter(config)
+
+	device := "Bearer s3cret"
+	ops := "Bearer ops-token"
+	tests := []struct {
+		method     string
+		path       string
+		body       string
+		auth       string
+		ndjson     bool
+		wantStatus int
+	}{
+		{http.MethodPost, "/api/v1/devices/cam-1/heartbeat", `{"sent_at":"2024-04-02T16:00:00Z"}`, device, false, http.StatusNoContent},
+		{http.MethodPost, "/api/v1/devices/cam-1/heartbeat", `{"sent_at":60}`, device, false, http.StatusNoContent},
+		{http.MethodPost, "/api/v1/devices/cam-1/heartbeat", `{"sent_at":"yesterday"}`, device, false, http.StatusBadRequest},
+		{http.MethodPost, "/api/v1/devices/cam-1/heartbeat", `{"sent_at":60}`, "", false, http.StatusUnauthorized},
+		{http.MethodPost, "/api/v1/devices/cam-1/heartbeat", `{"sent_at":"` + strings.Repeat("x", 2048) + `"}`, device, false, http.StatusRequestEntityTooLarge},
+		{http.MethodPost, "/api/v1/devices/cam-3/heartbeat", `{"sent_at":60}`, "Bearer s3cret3", false, http.StatusGone},
+		{http.MethodPost, "/api/v1/devices/cam-1/heartbeats:batch", `[{"sent_at":60},{"sent_at":"bad"}]`, device, false, http.StatusOK},
+		{http.MethodPost, "/api/v1/devices/cam-1/heartbeats:batch", "{\"sent_at\":60}\n{\"sent_at\":120}\n", device, true, http.StatusOK},
+		{http.MethodPost, "/api/v1/devices/cam-1/heartbeats:batch", `[{"sent_at":60},{"sent_at":60},{"sent_at":60}]`, device, false, http.StatusRequestEntityTooLarge},
+		{http.MethodPost, "/api/v1/devices/cam-1/stats", `{"sent_at":60,"upload_time":2000000000}`, device, false, http.StatusNoContent},
+		{http.MethodPost, "/api/v1/devices/cam-1/stats", `{"sent_at":60,"upload_time":-1}`, device, false, http.StatusBadRequest},
+		{http.MethodPost, "/api/v1/devices/cam-1/stats", `{"sent_at":60,"upload_time":1}`, device, false, http.StatusTooManyRequests},
+		{http.MethodGet, "/api/v1/devices/cam-1/stream", "", device, false, http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/devices/cam-1/stream", "", "", false, http.StatusUnauthorized},
+		{http.MethodGet, "/api/v1/devices/cam-1/stats", "", ops, false, http.StatusOK},
+		{http.MethodGet, "/api/v1/devices/cam-1/stats?from=0&to=3600", "", "Bearer read-token", false, http.StatusOK},
+		{http.MethodGet, "/api/v1/devices/cam-9/stats", "", ops, false, http.StatusNotFound},
+		{http.MethodGet, "/api/v1/devices/cam-1/stats?from=soon", "", ops, false, http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/devices/cam%201/stats", "", ops, false, http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/devices", "", ops, false, http.StatusOK},
+		{http.MethodGet, "/api/v1/devices?limit=1&status=all&sort=uptime&order=desc", "", ops, false, http.StatusOK},
+		{http.MethodGet, "/api/v1/devices?limit=0", "", ops, false, http.StatusBadRequest},
+		{http.MethodPost, "/api/v1/devices", `{"device_ids":["cam-4"]}`, ops, false, http.StatusCreated},
+		{http.MethodPost, "/api/v1/devices", `{"device_id":"cam-4"}`, ops, false, http.StatusOK},
+		{http.MethodPost, "/api/v1/devices", `{"device_id":"cam-5"}`, "Bearer read-token", false, http.StatusForbidden},
+		{http.MethodDelete, "/api/v1/devices/cam-4?purge=true", "", ops, false, http.StatusNoContent},
+		{http.MethodDelete, "/api/v1/devices/cam-9", "", ops, false, http.StatusNotFound},
+		{http.MethodPost, "/api/v1/ingest", `[{"device_id":"cam-1","type":"heartbeat","sent_at":120},{"device_id":"cam-2","type":"stats","sent_at":120,"upload_time":5}]`, ops, false, http.StatusOK},
+		{http.MethodPost, "/api/v1/ingest", `[{"device_id":"cam-9","type":"heartbeat","sent_at":120}]`, ops, false, http.StatusOK},
+		{http.MethodPost, "/api/v1/ingest", `{"device_id":"cam-1"}`, ops, false, http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/fleet/stats", "", ops, false, http.StatusOK},
+		{http.MethodGet, "/api/v1/fleet/stats?group_by=label.rack&site=lab", "", ops, false, http.StatusOK},
+		{http.MethodGet, "/api/v1/fleet/stats?uptime_threshold=101", "", ops, false, http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/alerts", "", ops, false, http.StatusOK},
+		{http.MethodGet, "/api/v1/alerts?state=firing&device_id=cam-1", "", ops, false, http.StatusOK},
+		{http.MethodGet, "/api/v1/alerts?state=resolved", "", ops, false, http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/events", "", ops, false, http.StatusOK},
+		{http.MethodGet, "/api/v1/events?device_id=cam-1&device_id=cam-2&site=lab", "", "Bearer read-token", false, http.StatusOK},
+		{http.MethodGet, "/api/v1/events?site=", "", ops, false, http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/webhooks", "", ops, false, http.StatusOK},
+		{http.MethodGet, "/api/v1/webhooks/dead-letters", "", ops, false, http.StatusOK},
+		{http.MethodPost, "/api/v1/webhooks/dead-letters/" + deadLetter + "/retry", "", "Bearer read-token", false, http.StatusForbidden},
+		{http.MethodPost, "/api/v1/webhooks/dead-letters/" + deadLetter + "/retry", "", ops, false, http.StatusAccepted},
+		{http.MethodPost, "/api/v1/webhooks/dead-letters/" + deadLetter + "/retry", "", ops, false, http.StatusNotFound},
+		{http.MethodGet, "/api/v1/openapi.json", "", "", false, http.StatusOK},
+		{http.MethodGet, "/healthz", "", "", false, http.StatusOK},
+		{http.MethodGet, "/readyz", "", "", false, http.StatusOK},
+		{http.MethodGet, "/metrics", "", ops, false, http.StatusOK},
+		{http.MethodGet, "/metrics", "", "", false, http.StatusUnauthorized},
+		{http.MethodGet, "/admin/log-level", "", ops, false, http.StatusOK},
+		{http.MethodPut, "/admin/log-level", `{"level":"debug"}`, ops, false, http.StatusOK},
+		{http.MethodPut, "/admin/log-level", `{"level":"loud"}`, ops, false, http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/devices/a/b/heartbeat", "", ops, false, http.StatusNotFound},
+		{http.MethodPatch, "/api/v1/devices", "", ops, false, http.StatusMethodNotAllowed},
+	}
+
+	exercised := make(map[string]bool)
+	for _, tt := range tests {
+		name := tt.method + " " + tt.path
+		if len(name) > 80 {
+			name = name[:80]
+		}
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		if tt.ndjson {
+			req.Header.Set("Content-Type", "application/x-ndjson")
+		}
+		if strings.HasPrefix(tt.path, "/api/v1/events") {
+			// Event streams run until the client leaves; leave before it starts
+			ctx, cancel := context.WithCancel(req.Context())
+			cancel()
+			req = req.WithContext(ctx)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: expected status %d, got %d: %s", name, tt.wantStatus, w.Code, w.Body.String())
+			continue
+		}
+
+		template, op := spec.operation(tt.method, req.URL.Path)
+		if op == nil {
+			// Only the mux's own 404 and 405 may fall outside the spec
+			if w.Code != http.StatusNotFound && w.Code != http.StatusMethodNotAllowed {
+				t.Errorf("%s: no operation in the spec", name)
+				continue
+			}
+		} else {
+			exercised[strings.ToUpper(tt.method)+" "+template] = true
+			// Accepted requests must match the request schema; batches may
+			// also be accepted with rejected items
+			var batch api.BatchResponse
+			json.Unmarshal(w.Body.Bytes(), &batch)
+			if w.Code < 300 && !tt.ndjson && batch.Rejected == 0 {
+				if err := spec.checkRequest(op, tt.body); err != nil {
+					t.Errorf("%s: %v", name, err)
+				}
+			}
+		}
+		if err := spec.checkResponse(op, w); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	// Every route is described and exercised, and the spec describes nothing else
+	var routePatterns []string
+	for _, r := range routes(config) {
+		method, path := specPath(r.pattern)
+		routePatterns = append(routePatterns, strings.ToUpper(method)+" "+path)
+		if !exercised[strings.ToUpper(method)+" "+path] {
+			t.Errorf("route %s is not exercised against the spec", r.pattern)
+		}
+	}
+	for path, item := range spec.doc["paths"].(map[string]interface{}) {
+		for method := range item.(map[string]interface{}) {
+			if method == "parameters" {
+				continue
+			}
+			if pattern := strings.ToUpper(method) + " " + path; !contains(routePatterns, pattern) {
+				t.Errorf("spec operation %s has no route", pattern)
+			}
+		}
+	}
+
+	for _, name := range []string{"HeartbeatRequest", "StatsPostRequest", "StatsGetResponse", "ErrorResponse", "BatchResponse", "DeviceListResponse", "DeviceMetadata", "FleetStatsResponse", "FleetGroupStats", "RegisterDevicesResponse", "AlertListResponse", "AlertItem", "WebhookStatusResponse", "DeadLettersResponse", "WebhookPayload"} {
+		if !spec.used[name] {
+			t.Errorf("schema %s was never validated against", name)
+		}
+	}
+}
+
+func TestOpenAPI_RefsResolve(t *testing.T) {
+	spec := loadOpenAPISpec(t)
+	var refs []string
+	var walk func(node interface{})
+	walk = func(node interface{}) {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			if ref, ok := n["$ref"].(string); ok {
+				refs = append(refs, ref)
+			}
+			for _, child := range n {
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range n {
+				walk(child)
+			}
+		}
+	}
+	walk(spec.doc)
+	sort.Strings(refs)
+	for _, ref := range refs {
+		if _, err := spec.lookup(ref); err != nil {
+			t.Error(err)
+		}
+	}
+	if len(refs) == 0 {
+		t.Error("expected the spec to use $ref")
+	}
+}
+
+func TestOpenAPI_ValidatorDetectsDrift(t *testing.T) {
+	spec := loadOpenAPISpec(t)
+	statsResponse := map[string]interface{}{"$ref": "#/components/schemas/StatsGetResponse"}
+	valid := `{"uptime":99.5,"avg_upload_time":"1s","upload_count":1,"min_upload_time":"1s","max_upload_time":"1s",` +
+		`"p50_upload_time":"1s","p90_upload_time":"1s","p95_upload_time":"1s","p99_upload_time":"1s"}`
+
+	tests := []struct {
+		name    string
+		schema  map[string]interface{}
+		body    string
+		wantErr bool
+	}{
+		{"valid", statsResponse, valid, false},
+		{"unknown field", statsResponse, strings.TrimSuffix(valid, "}") + `,"p999_upload_time":"1s"}`, true},
+		{"missing field", statsResponse, `{"uptime":99.5}`, true},
+		{"wrong type", statsResponse, strings.Replace(valid, `"upload_count":1`, `"upload_count":"1"`, 1), true},
+		{"fractional integer", statsResponse, strings.Replace(valid, `"upload_count":1`, `"upload_count":1.5`, 1), true},
+		{"sent_at as timestamp", map[string]interface{}{"$ref": "#/components/schemas/HeartbeatRequest"}, `{"sent_at":60}`, false},
+		{"sent_at as object", map[string]interface{}{"$ref": "#/components/schemas/HeartbeatRequest"}, `{"sent_at":{}}`, true},
+		{"error without msg", map[string]interface{}{"$ref": "#/components/schemas/ErrorResponse"}, `{"request_id":"x"}`, true},
+	}
+	for _, tt := range tests {
+		value, err := decode([]byte(tt.body))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err := spec.validate(tt.schema, value, "body"); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validate error = %v, want error %t", tt.name, err, tt.wantErr)
+		}
+	}
+}
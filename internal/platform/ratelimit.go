@@ -0,0 +1,332 @@
+package platform
+
+import (
+	"device-fleet-monitoring/internal/api"
+	"device-fleet-monitoring/internal/storage"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultRateLimitMaxKeys bounds the number of buckets held per limit
+const DefaultRateLimitMaxKeys = 100000
+
+// RateLimit is a token bucket: Rate tokens are added per second up to
+// Burst, and each request takes one
+type RateLimit struct {
+	Rate  float64 // Requests per second; zero disables the limit
+	Burst int     // Bucket capacity; defaults to Rate rounded up, at least 1
+}
+
+// RateLimitConfig holds configuration for RateLimiter. Each limit keeps a
+// bucket per key; limits left zero are not enforced.
+type RateLimitConfig struct {
+	Heartbeat RateLimit // Per device, on heartbeat and batch heartbeat posts and each ingested heartbeat
+	Stats     RateLimit // Per device, on stats posts and each ingested upload report
+	Read      RateLimit // Per client IP, on GET API endpoints
+	ClientIP  RateLimit // Per client IP, on every ingest endpoint, before authentication
+
+	// MaxKeys bounds the buckets held per limit. Idle buckets are evicted;
+	// while the bound is reached, requests with new keys are rejected.
+	// Defaults to DefaultRateLimitMaxKeys.
+	MaxKeys int
+
+	Now func() time.Time // Defaults to time.Now
+}
+
+// RateLimiter enforces the limits of RateLimitConfig. A nil *RateLimiter
+// enforces nothing.
+type RateLimiter struct {
+	heartbeat *bucketSet
+	stats     *bucketSet
+	read      *bucketSet
+	clientIP  *bucketSet
+	now       func() time.Time
+}
+
+// RateLimitStats are the counters of one limit
+type RateLimitStats struct {
+	Limit    string // heartbeat, stats, read or client_ip
+	Allowed  uint64 // Requests let through
+	Limited  uint64 // Requests rejected because their bucket was empty
+	Overflow uint64 // Requests rejected because MaxKeys buckets were in use
+	Evicted  uint64 // Idle buckets dropped
+	Keys     int    // Buckets currently held
+}
+
+// NewRateLimiter creates a RateLimiter from config
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	if config.MaxKeys <= 0 {
+		config.MaxKeys = DefaultRateLimitMaxKeys
+	}
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+	return &RateLimiter{
+		heartbeat: newBucketSet("heartbeat", config.Heartbeat, config.MaxKeys),
+		stats:     newBucketSet("stats", config.Stats, config.MaxKeys),
+		read:      newBucketSet("read", config.Read, config.MaxKeys),
+		clientIP:  newBucketSet("client_ip", config.ClientIP, config.MaxKeys),
+		now:       config.Now,
+	}
+}
+
+// Stats returns the counters of every enforced limit
+func (l *RateLimiter) Stats() []RateLimitStats {
+	if l == nil {
+		return nil
+	}
+	var stats []RateLimitStats
+	for _, set := range []*bucketSet{l.clientIP, l.heartbeat, l.read, l.stats} {
+		if set != nil {
+			stats = append(stats, set.stats())
+		}
+	}
+	return stats
+}
+
+// heartbeatLimit applies the heartbeat limit per device in the request path
+func (l *RateLimiter) heartbeatLimit(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return l.limit(l.heartbeat, deviceKey, next)
+}
+
+// statsLimit applies the stats limit per device in the request path
+func (l *RateLimiter) statsLimit(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return l.limit(l.stats, deviceKey, next)
+}
+
+// readLimit applies the read limit per client IP
+func (l *RateLimiter) readLimit(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return l.limit(l.read, clientIPKey, next)
+}
+
+// clientIPLimit applies the client IP limit
+func (l *RateLimiter) clientIPLimit(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return l.limit(l.clientIP, clientIPKey, next)
+}
+
+// eventLimit applies the heartbeat or stats limit to each event of a batch
+// or stream, rejecting the events whose device's bucket is empty rather
+// than the whole request
+func (l *RateLimiter) eventLimit(next http.Handler) http.Handler {
+	if l == nil || (l.heartbeat == nil && l.stats == nil) {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(api.WithEventFilter(r.Context(), l.filterEvent)))
+	})
+}
+
+// filterEvent takes a token for event from its device's heartbeat or stats
+// bucket, as an api.EventFilter
+func (l *RateLimiter) filterEvent(event storage.Event) string {
+	allowed := true
+	switch event.Kind {
+	case storage.EventHeartbeat:
+		allowed = l.allowHeartbeat(event.DeviceID)
+	case storage.EventUpload:
+		allowed = l.allowStats(event.DeviceID)
+	}
+	if !allowed {
+		return "rate limit exceeded"
+	}
+	return ""
+}
+
+// limit takes a token from the bucket of key(r) in set before calling next,
+// answering 429 with Retry-After when none is left
+func (l *RateLimiter) limit(set *bucketSet, key func(*http.Request) string, next http.Handler) http.Handler {
+	if set == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		retryAfter, ok := set.take(key(r), l.now())
+		if !ok {
+			// Whole seconds, rounded up so a client retrying on time succeeds
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeJSONError(w, r, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowClientIP takes a token from the client IP bucket of addr, a host and
+// port, for ingest that doesn't arrive as an HTTP request
+func (l *RateLimiter) allowClientIP(addr string) bool {
+	if l == nil || l.clientIP == nil {
+		return true
+	}
+	_, ok := l.clientIP.take(ipKey(addr), l.now())
+	return ok
+}
+
+// allowHeartbeat takes a token from the heartbeat bucket of deviceID, for
+// heartbeats that don't arrive as an HTTP request
+func (l *RateLimiter) allowHeartbeat(deviceID string) bool {
+	if l == nil || l.heartbeat == nil {
+		return true
+	}
+	_, ok := l.heartbeat.take(deviceID, l.now())
+	return ok
+}
+
+// allowStats takes a token from the stats bucket of deviceID, for upload
+// reports that don't arrive as an HTTP request
+func (l *RateLimiter) allowStats(deviceID string) bool {
+	if l == nil || l.stats == nil {
+		return true
+	}
+	_, ok := l.stats.take(deviceID, l.now())
+	return ok
+}
+
+// deviceKey keys a request by the device ID in its path
+func deviceKey(r *http.Request) string {
+	return deviceIDFromPath(r)
+}
+
+// clientIPKey keys a request by its remote address
+func clientIPKey(r *http.Request) string {
+	return ipKey(r.RemoteAddr)
+}
+
+// ipKey keys a host and port by the host's IP. IPv6 clients are keyed by
+// their /64 network, which a single host can otherwise cycle through.
+func ipKey(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip.To4() == nil {
+		ip = ip.Mask(net.CIDRMask(64, 128))
+	}
+	return ip.String()
+}
+
+// bucket is the state of one key's token bucket
+type bucket struct {
+	tokens float64
+	last   time.Time // When tokens was last brought up to date
+}
+
+// bucketSet holds the token buckets of one limit
+type bucketSet struct {
+	name    string
+	rate    float64
+	burst   float64
+	maxKeys int
+
+	// idle is how long a bucket takes to refill completely. A bucket idle
+	// that long is indistinguishable from a new one, so it can be dropped.
+	idle time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	allowed   uint64
+	limited   uint64
+	overflow  uint64
+	evicted   uint64
+}
+
+// newBucketSet returns nil if limit is disabled
+func newBucketSet(name string, limit RateLimit, maxKeys int) *bucketSet {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	burst := float64(limit.Burst)
+	if burst <= 0 {
+		burst = math.Max(1, math.Ceil(limit.Rate))
+	}
+	return &bucketSet{
+		name:    name,
+		rate:    limit.Rate,
+		burst:   burst,
+		maxKeys: maxKeys,
+		idle:    time.Duration(burst / limit.Rate * float64(time.Second)),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// take removes a token from key's bucket. If none is available it returns
+// false and how long until one will be.
+func (s *bucketSet) take(key string, now time.Time) (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		if len(s.buckets) >= s.maxKeys {
+			s.overflow++
+			return s.idle, false
+		}
+		b = &bucket{tokens: s.burst, last: now}
+		s.buckets[key] = b
+	}
+
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(s.burst, b.tokens+elapsed.Seconds()*s.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		s.limited++
+		return time.Duration((1 - b.tokens) / s.rate * float64(time.Second)), false
+	}
+	b.tokens--
+	s.allowed++
+	return 0, true
+}
+
+// sweep evicts buckets that have refilled completely. It scans at most once
+// per refill period, bounded to between a second and a minute, or once a
+// second while the key bound is reached.
+func (s *bucketSet) sweep(now time.Time) {
+	interval := min(max(s.idle, time.Second), time.Minute)
+	since := now.Sub(s.lastSweep)
+	if since < interval && (len(s.buckets) < s.maxKeys || since < time.Second) {
+		return
+	}
+	for key, b := range s.buckets {
+		if now.Sub(b.last) >= s.idle {
+			delete(s.buckets, key)
+			s.evicted++
+		}
+	}
+	s.lastSweep = now
+}
+
+// stats returns the set's counters
+func (s *bucketSet) stats() RateLimitStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return RateLimitStats{
+		Limit:    s.name,
+		Allowed:  s.allowed,
+		Limited:  s.limited,
+		Overflow: s.overflow,
+		Evicted:  s.evicted,
+		Keys:     len(s.buckets),
+	}
+}
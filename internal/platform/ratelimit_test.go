@@ -0,0 +1,321 @@
+package platform
+
+import (
+	"device-fleet-monitoring/internal/api"
+	"device-fleet-monitoring/internal/storage"
+	"device-fleet-monitoring/internal/websocket"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock is a settable time source
+type fakeClock struct {
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1700000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestRateLimiter_TakeAndRefill(t *testing.T) {
+	clock := newFakeClock()
+	set := newBucketSet("heartbeat", RateLimit{Rate: 2, Burst: 3}, 10)
+
+	for i := 0; i < 3; i++ {
+		if _, ok := set.take("cam-1", clock.Now()); !ok {
+			t.Fatalf("request %d within burst was limited", i+1)
+		}
+	}
+	retryAfter, ok := set.take("cam-1", clock.Now())
+	if ok {
+		t.Fatal("expected the request after the burst to be limited")
+	}
+	if retryAfter != 500*time.Millisecond {
+		t.Errorf("retry after = %v, want 500ms", retryAfter)
+	}
+	if _, ok := set.take("cam-2", clock.Now()); !ok {
+		t.Error("another key should have its own bucket")
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	if _, ok := set.take("cam-1", clock.Now()); !ok {
+		t.Error("expected a token after refilling")
+	}
+	if _, ok := set.take("cam-1", clock.Now()); ok {
+		t.Error("expected the refilled token to be used up")
+	}
+
+	stats := set.stats()
+	if stats.Allowed != 5 || stats.Limited != 2 || stats.Keys != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestRateLimiter_EvictsIdleKeysAndBoundsMemory(t *testing.T) {
+	clock := newFakeClock()
+	// Buckets refill completely, and become evictable, after 2s
+	set := newBucketSet("read", RateLimit{Rate: 1, Burst: 2}, 2)
+
+	set.take("10.0.0.1", clock.Now())
+	set.take("10.0.0.2", clock.Now())
+	if retryAfter, ok := set.take("10.0.0.3", clock.Now()); ok || retryAfter <= 0 {
+		t.Errorf("expected a new key beyond MaxKeys to be rejected with a retry delay, got %v %v", retryAfter, ok)
+	}
+
+	clock.Advance(time.Second)
+	set.take("10.0.0.2", clock.Now())
+	clock.Advance(time.Second)
+	// 10.0.0.1 has been idle for 2s and is dropped; 10.0.0.2 only for 1s
+	if _, ok := set.take("10.0.0.3", clock.Now()); !ok {
+		t.Error("expected the new key to fit after evicting an idle one")
+	}
+
+	stats := set.stats()
+	if stats.Keys != 2 || stats.Evicted != 1 || stats.Overflow != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestClientIPKey(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		want       string
+	}{
+		{"192.0.2.7:5000", "192.0.2.7"},
+		{"[2001:db8:1:2:aaaa::1]:5000", "2001:db8:1:2::"},
+		{"[2001:db8:1:2:bbbb::9]:6000", "2001:db8:1:2::"},
+		{"pipe", "pipe"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if got := clientIPKey(r); got != tt.want {
+			t.Errorf("clientIPKey(%q) = %q, want %q", tt.remoteAddr, got, tt.want)
+		}
+	}
+}
+
+func TestRouter_RateLimits(t *testing.T) {
+	clock := newFakeClock()
+	store := storage.NewMemoryStore([]string{"cam-1", "cam-2", "cam-3"})
+	limiter := NewRateLimiter(RateLimitConfig{
+		Heartbeat: RateLimit{Rate: 1, Burst: 2},
+		Read:      RateLimit{Rate: 1},
+		ClientIP:  RateLimit{Rate: 1, Burst: 3},
+		Now:       clock.Now,
+	})
+	metrics := NewMetrics(MetricsConfig{RateLimiter: limiter})
+	logger := NewLogger(LoggerConfig{Output: io.Discard})
+	router := NewRouter(RouterConfig{
+		Handlers:    api.NewHandlers(store, api.WithLogger(logger.Logger)),
+		Logger:      logger,
+		Metrics:     metrics,
+		RateLimiter: limiter,
+	})
+
+	send := func(method, path, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(`{"sent_at":60,"upload_time":1}`))
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	steps := []struct {
+		name       string
+		method     string
+		path       string
+		remoteAddr string
+		wantStatus int
+	}{
+		{"heartbeat within burst", http.MethodPost, "/api/v1/devices/cam-1/heartbeat", "10.0.0.1:1", http.StatusNoContent},
+		{"heartbeat within burst", http.MethodPost, "/api/v1/devices/cam-1/heartbeat", "10.0.0.2:1", http.StatusNoContent},
+		{"device over its limit from another IP", http.MethodPost, "/api/v1/devices/cam-1/heartbeat", "10.0.0.3:1", http.StatusTooManyRequests},
+		{"other device", http.MethodPost, "/api/v1/devices/cam-2/heartbeat", "10.0.0.1:1", http.StatusNoContent},
+		{"stats posts have their own limit", http.MethodPost, "/api/v1/devices/cam-1/stats", "10.0.0.1:1", http.StatusNoContent},
+		{"client IP over its limit", http.MethodPost, "/api/v1/devices/cam-3/heartbeat", "10.0.0.1:1", http.StatusTooManyRequests},
+		{"read", http.MethodGet, "/api/v1/fleet/stats", "10.0.0.1:1", http.StatusOK},
+		{"read over its limit", http.MethodGet, "/api/v1/devices", "10.0.0.1:1", http.StatusTooManyRequests},
+		{"read from another IP", http.MethodGet, "/api/v1/devices/cam-1/stats", "10.0.0.2:1", http.StatusOK},
+	}
+	for _, step := range steps {
+		w := send(step.method, step.path, step.remoteAddr)
+		if w.Code != step.wantStatus {
+			t.Errorf("%s: expected status %d, got %d", step.name, step.wantStatus, w.Code)
+			continue
+		}
+		if w.Code != http.StatusTooManyRequests {
+			continue
+		}
+		if got := w.Header().Get("Retry-After"); got != "1" {
+			t.Errorf("%s: Retry-After = %q, want 1", step.name, got)
+		}
+		var errResp api.ErrorResponse
+		if err := json.NewDecoder(w.Body).Decode(&errResp); err != nil || errResp.RequestID == "" {
+			t.Errorf("%s: expected a JSON error with a request ID, got %v %+v", step.name, err, errResp)
+		}
+	}
+
+	clock.Advance(time.Second)
+	if w := send(http.MethodPost, "/api/v1/devices/cam-1/heartbeat", "10.0.0.3:1"); w.Code != http.StatusNoContent {
+		t.Errorf("expected the device to be allowed again after refilling, got %d", w.Code)
+	}
+
+	families := scrape(t, router)
+	checks := []struct {
+		name   string
+		labels []string
+		want   float64
+	}{
+		{"fleet_ratelimit_requests_total", []string{"limit", "heartbeat", "result", "allowed"}, 4},
+		{"fleet_ratelimit_requests_total", []string{"limit", "heartbeat", "result", "limited"}, 1},
+		{"fleet_ratelimit_requests_total", []string{"limit", "client_ip", "result", "limited"}, 1},
+		{"fleet_ratelimit_requests_total", []string{"limit", "read", "result", "limited"}, 1},
+		{"fleet_ratelimit_keys", []string{"limit", "heartbeat"}, 2},
+		{"fleet_ratelimit_evictions_total", []string{"limit", "read"}, 0},
+	}
+	for _, c := range checks {
+		if got, ok := families[c.name].value(c.name, c.labels...); !ok || got != c.want {
+			t.Errorf("%s%v = %v (found %t), want %v", c.name, c.labels, got, ok, c.want)
+		}
+	}
+	if _, ok := families["fleet_ratelimit_keys"].value("fleet_ratelimit_keys", "limit", "stats"); ok {
+		t.Error("disabled limits should not be exported")
+	}
+}
+
+func TestRouter_IngestRateLimitsPerItem(t *testing.T) {
+	store := storage.NewMemoryStore([]string{"cam-1", "cam-2"})
+	limiter := NewRateLimiter(RateLimitConfig{
+		Heartbeat: RateLimit{Rate: 1, Burst: 1},
+		Stats:     RateLimit{Rate: 1, Burst: 1},
+		Now:       newFakeClock().Now,
+	})
+	logger := NewLogger(LoggerConfig{Output: io.Discard})
+	router := NewRouter(RouterConfig{
+		Handlers:    api.NewHandlers(store, api.WithLogger(logger.Logger)),
+		Logger:      logger,
+		RateLimiter: limiter,
+	})
+
+	// The posted heartbeat uses up cam-1's heartbeat bucket
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/v1/devices/cam-1/heartbeat", strings.NewReader(`{"sent_at":60}`)))
+
+	body := `[{"device_id":"cam-1","type":"heartbeat","sent_at":120},
+		{"device_id":"cam-2","type":"heartbeat","sent_at":120},
+		{"device_id":"cam-2","type":"heartbeat","sent_at":180},
+		{"device_id":"cam-1","type":"stats","sent_at":120,"upload_time":1},
+		{"device_id":"cam-1","type":"stats","sent_at":180,"upload_time":1}]`
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/ingest", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	var resp api.BatchResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	wantLimited := []bool{true, false, true, false, true}
+	for i, result := range resp.Results {
+		if limited := result.Reason == "rate limit exceeded"; limited != wantLimited[i] {
+			t.Errorf("item %d: expected limited %t, got %+v", i, wantLimited[i], result)
+		}
+	}
+	if resp.Accepted != 2 {
+		t.Errorf("expected 2 accepted items, got %d", resp.Accepted)
+	}
+}
+
+func TestRouter_HeartbeatBatchRateLimitsPerItem(t *testing.T) {
+	store := storage.NewMemoryStore([]string{"cam-1"})
+	limiter := NewRateLimiter(RateLimitConfig{
+		Heartbeat: RateLimit{Rate: 1, Burst: 2},
+		Now:       newFakeClock().Now,
+	})
+	logger := NewLogger(LoggerConfig{Output: io.Discard})
+	router := NewRouter(RouterConfig{
+		Handlers:    api.NewHandlers(store, api.WithLogger(logger.Logger)),
+		Logger:      logger,
+		RateLimiter: limiter,
+	})
+
+	// One batch can't spend more heartbeats than the device's bucket holds
+	body := `[{"sent_at":60},{"sent_at":120},{"sent_at":180},{"sent_at":240}]`
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/devices/cam-1/heartbeats:batch", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	var resp api.BatchResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	wantLimited := []bool{false, false, true, true}
+	for i, result := range resp.Results {
+		if limited := result.Reason == "rate limit exceeded"; limited != wantLimited[i] {
+			t.Errorf("item %d: expected limited %t, got %+v", i, wantLimited[i], result)
+		}
+	}
+	if resp.Accepted != 2 {
+		t.Errorf("expected 2 accepted items, got %d", resp.Accepted)
+	}
+}
+
+func TestRouter_StreamRateLimitsPerMessage(t *testing.T) {
+	store := storage.NewMemoryStore([]string{"cam-1"})
+	limiter := NewRateLimiter(RateLimitConfig{
+		Heartbeat: RateLimit{Rate: 1, Burst: 2},
+		Stats:     RateLimit{Rate: 1, Burst: 1},
+		Now:       newFakeClock().Now,
+	})
+	logger := NewLogger(LoggerConfig{Output: io.Discard})
+	server := httptest.NewServer(NewRouter(RouterConfig{
+		Handlers:    api.NewHandlers(store, api.WithLogger(logger.Logger)),
+		Logger:      logger,
+		RateLimiter: limiter,
+	}))
+	t.Cleanup(server.Close)
+
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/v1/devices/cam-1/stream", nil, websocket.Config{ReadTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("dialing stream: %v", err)
+	}
+	defer conn.Close()
+
+	// Connecting takes no token; the third heartbeat and second upload are over
+	messages := []struct {
+		message     string
+		wantLimited bool
+	}{
+		{`{"sent_at":60}`, false},
+		{`{"sent_at":120}`, false},
+		{`{"sent_at":180}`, true},
+		{`{"sent_at":180,"upload_time":1}`, false},
+		{`{"sent_at":240,"upload_time":1}`, true},
+	}
+	for _, m := range messages {
+		conn.WriteMessage(websocket.OpText, []byte(m.message))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("%s: reading ack: %v", m.message, err)
+		}
+		var ack api.StreamAck
+		json.Unmarshal(data, &ack)
+		if limited := ack.Reason == "rate limit exceeded"; limited != m.wantLimited {
+			t.Errorf("%s: expected limited %t, got %+v", m.message, m.wantLimited, ack)
+		}
+	}
+}
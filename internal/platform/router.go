@@ -1,78 +1,236 @@
 package platform
 
 import (
+	"bufio"
 	"device-fleet-monitoring/internal/api"
-	"encoding/json"
+	"device-fleet-monitoring/internal/auth"
+	"device-fleet-monitoring/internal/requestid"
+	"net"
 	"net/http"
+	"regexp"
+	"strings"
 	"time"
 )
 
+// DefaultDeviceIDPattern is the device IDs accepted in request paths: up to
+// 128 letters, digits, dots, underscores, colons and hyphens, starting with a
+// letter or digit
+const DefaultDeviceIDPattern = `^[A-Za-z0-9][A-Za-z0-9._:-]{0,127}$`
+
 // RouterConfig holds configuration for the router
 type RouterConfig struct {
-	Handlers    *api.Handlers
-	Logger      *Logger
-	DeviceCount int
+	Handlers  *api.Handlers
+	Logger    *Logger
+	Metrics   *Metrics   // Optional; enables GET /metrics when set
+	Readiness *Readiness // Optional; enables GET /readyz when set
+
+	// Auth, when set, requires device credentials on device ingest endpoints
+	// and operator tokens elsewhere. MaxBodyBytes bounds the body read to
+	// verify a device signature.
+	Auth         *auth.Authenticator
+	MaxBodyBytes int64
+
+	// RequireClientCert requires device ingest requests to present a verified
+	// client certificate naming the device in the path. The server must
+	// verify client certificates, see CertReloader.
+	RequireClientCert bool
+
+	// RateLimiter, when set, limits ingest per client IP before
+	// authentication and per device after it, and reads per client IP
+	RateLimiter *RateLimiter
+
+	// DeviceIDPattern validates the {device_id} path segment; requests for
+	// IDs that don't match get 400. Defaults to DefaultDeviceIDPattern.
+	DeviceIDPattern *regexp.Regexp
 }
 
-// NewRouter creates and configures an HTTP router with middleware
+// NewRouter creates and configures an HTTP router with middleware. Routes
+// are method and wildcard patterns; unmatched paths get a JSON 404 and
+// unsupported methods a JSON 405 with an Allow header.
 func NewRouter(config RouterConfig) http.Handler {
 	mux := http.NewServeMux()
+	for _, r := range routes(config) {
+		mux.Handle(r.pattern, r.handler)
+	}
+
+	// Assign every request an ID before any handler or log line sees it
+	return requestIDMiddleware(jsonMuxErrors(mux))
+}
+
+// route is one entry of the route table
+type route struct {
+	pattern string // Method and path pattern, e.g. "POST /api/v1/ingest"
+	handler http.Handler
+}
+
+// routes returns the route table of config, each handler wrapped in its middleware
+func routes(config RouterConfig) []route {
+	var table []route
+	deviceIDPattern := config.DeviceIDPattern
+	if deviceIDPattern == nil {
+		deviceIDPattern = regexp.MustCompile(DefaultDeviceIDPattern)
+	}
+
+	// Wrap handlers with logging middleware, recording metrics under each route
+	// template, outside authentication so rejected requests are logged and counted
+	guard := authGuard{
+		auth:              config.Auth,
+		logger:            config.Logger,
+		maxBodyBytes:      config.MaxBodyBytes,
+		requireClientCert: config.RequireClientCert,
+	}
+	limits := config.RateLimiter
+	handle := func(pattern, template string, next http.Handler) {
+		if strings.Contains(pattern, "{device_id}") {
+			next = validDeviceID(deviceIDPattern, next)
+		}
+		table = append(table, route{pattern, loggingMiddleware(config.Logger, config.Metrics, template, next)})
+	}
 
-	// Wrap handlers with logging middleware
-	heartbeatHandler := loggingMiddleware(config.Logger, http.HandlerFunc(config.Handlers.HandleHeartbeat))
-	statsPostHandler := loggingMiddleware(config.Logger, http.HandlerFunc(config.Handlers.HandleStatsPost))
-	statsGetHandler := loggingMiddleware(config.Logger, http.HandlerFunc(config.Handlers.HandleStatsGet))
+	// Device ingest, limited per client IP before authentication and per device
+	// after it; batches and streams are limited per event rather than per request
+	handle("POST /api/v1/devices/{device_id}/heartbeat", "/api/v1/devices/{id}/heartbeat",
+		limits.clientIPLimit(guard.device(limits.heartbeatLimit(http.HandlerFunc(config.Handlers.HandleHeartbeat)))))
+	handle("POST /api/v1/devices/{device_id}/heartbeats:batch", "/api/v1/devices/{id}/heartbeats:batch",
+		limits.clientIPLimit(guard.device(limits.eventLimit(http.HandlerFunc(config.Handlers.HandleHeartbeatBatch)))))
+	handle("POST /api/v1/devices/{device_id}/stats", "/api/v1/devices/{id}/stats",
+		limits.clientIPLimit(guard.device(limits.statsLimit(http.HandlerFunc(config.Handlers.HandleStatsPost)))))
+	handle("GET /api/v1/devices/{device_id}/stream", "/api/v1/devices/{id}/stream",
+		limits.clientIPLimit(guard.device(limits.eventLimit(http.HandlerFunc(config.Handlers.HandleDeviceStream)))))
+
+	// Cross-device batch ingestion
+	handle("POST /api/v1/ingest", "/api/v1/ingest",
+		limits.clientIPLimit(guard.ingest(limits.eventLimit(http.HandlerFunc(config.Handlers.HandleIngest)))))
+
+	// Reads
+	handle("GET /api/v1/devices/{device_id}/stats", "/api/v1/devices/{id}/stats",
+		limits.readLimit(guard.operator(auth.ScopeRead, http.HandlerFunc(config.Handlers.HandleStatsGet))))
+	handle("GET /api/v1/devices", "/api/v1/devices",
+		limits.readLimit(guard.operator(auth.ScopeRead, http.HandlerFunc(config.Handlers.HandleDeviceList))))
+	handle("GET /api/v1/fleet/stats", "/api/v1/fleet/stats",
+		limits.readLimit(guard.operator(auth.ScopeRead, http.HandlerFunc(config.Handlers.HandleFleetStats))))
+	handle("GET /api/v1/alerts", "/api/v1/alerts",
+		limits.readLimit(guard.operator(auth.ScopeRead, http.HandlerFunc(config.Handlers.HandleAlerts))))
+	handle("GET /api/v1/events", "/api/v1/events",
+		limits.readLimit(guard.operator(auth.ScopeRead, http.HandlerFunc(config.Handlers.HandleEvents))))
+	handle("GET /api/v1/webhooks", "/api/v1/webhooks",
+		limits.readLimit(guard.operator(auth.ScopeRead, http.HandlerFunc(config.Handlers.HandleWebhookStatus))))
+	handle("GET /api/v1/webhooks/dead-letters", "/api/v1/webhooks/dead-letters",
+		limits.readLimit(guard.operator(auth.ScopeRead, http.HandlerFunc(config.Handlers.HandleDeadLetters))))
+
+	// Device registration and decommissioning
+	handle("POST /api/v1/devices", "/api/v1/devices",
+		guard.operator(auth.ScopeAdmin, http.HandlerFunc(config.Handlers.HandleDeviceRegister)))
+	handle("DELETE /api/v1/devices/{device_id}", "/api/v1/devices/{id}",
+		guard.operator(auth.ScopeAdmin, http.HandlerFunc(config.Handlers.HandleDeviceDecommission)))
+
+	// Webhook redelivery
+	handle("POST /api/v1/webhooks/dead-letters/{id}/retry", "/api/v1/webhooks/dead-letters/{id}/retry",
+		guard.operator(auth.ScopeAdmin, http.HandlerFunc(config.Handlers.HandleDeadLetterRetry)))
+
+	// Runtime log level adjustment
+	logLevelHandler := guard.operator(auth.ScopeAdmin, http.HandlerFunc(config.Logger.HandleLogLevel))
+	handle("GET /admin/log-level", "/admin/log-level", logLevelHandler)
+	handle("PUT /admin/log-level", "/admin/log-level", logLevelHandler)
+
+	// API description
+	table = append(table, route{"GET /api/v1/openapi.json", http.HandlerFunc(api.HandleOpenAPI)})
+
+	// Health check endpoint
+	table = append(table, route{"GET /healthz", http.HandlerFunc(config.Handlers.HandleHealth)})
+
+	// Readiness endpoint; unlike /healthz it fails while starting or draining
+	if config.Readiness != nil {
+		table = append(table, route{"GET /readyz", config.Readiness})
+	}
+
+	// Prometheus scrape endpoint
+	if config.Metrics != nil {
+		table = append(table, route{"GET /metrics", guard.operator(auth.ScopeRead, config.Metrics)})
+	}
+	return table
+}
 
-	// Register API endpoints with /api/v1 prefix
-	mux.Handle("/api/v1/devices/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Route based on method and path suffix
-		if r.URL.Path == "/api/v1/devices/" {
-			http.NotFound(w, r)
+// validDeviceID rejects requests whose {device_id} wildcard doesn't match pattern
+func validDeviceID(pattern *regexp.Regexp, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !pattern.MatchString(r.PathValue("device_id")) {
+			writeJSONError(w, r, http.StatusBadRequest, "invalid device id")
 			return
 		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-		// Check if path ends with /heartbeat
-		if len(r.URL.Path) > len("/heartbeat") && r.URL.Path[len(r.URL.Path)-len("/heartbeat"):] == "/heartbeat" {
-			if r.Method == http.MethodPost {
-				heartbeatHandler.ServeHTTP(w, r)
-				return
-			}
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// jsonMuxErrors serves mux, replacing its plain-text 404 and 405 responses
+// with JSON errors. The Allow header of a 405 is kept.
+func jsonMuxErrors(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler, pattern := mux.Handler(r)
+		if pattern != "" {
+			// Matched, or a redirect to the cleaned path
+			mux.ServeHTTP(w, r)
 			return
 		}
 
-		// Check if path ends with /stats
-		if len(r.URL.Path) > len("/stats") && r.URL.Path[len(r.URL.Path)-len("/stats"):] == "/stats" {
-			if r.Method == http.MethodPost {
-				statsPostHandler.ServeHTTP(w, r)
-				return
-			}
-			if r.Method == http.MethodGet {
-				statsGetHandler.ServeHTTP(w, r)
-				return
-			}
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		// Run the mux's own handler only to learn its status and headers
+		probe := &statusRecorder{header: make(http.Header)}
+		handler.ServeHTTP(probe, r)
+		if allow := probe.header.Get("Allow"); allow != "" {
+			w.Header().Set("Allow", allow)
+		}
+		status := probe.status
+		if status == http.StatusMethodNotAllowed {
+			writeJSONError(w, r, status, "method not allowed")
 			return
 		}
+		writeJSONError(w, r, http.StatusNotFound, "not found")
+	})
+}
 
-		http.NotFound(w, r)
-	}))
+// statusRecorder is a ResponseWriter that keeps the status and headers and
+// discards the body
+type statusRecorder struct {
+	header http.Header
+	status int
+}
 
-	// Health check endpoint
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"status":  "ok",
-			"devices": config.DeviceCount,
-		})
-	})
+// Header returns the recorded headers
+func (s *statusRecorder) Header() http.Header {
+	return s.header
+}
 
-	return mux
+// Write discards b
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return len(b), nil
 }
 
-// loggingMiddleware logs HTTP requests and responses
-func loggingMiddleware(logger *Logger, next http.Handler) http.Handler {
+// WriteHeader records the first status written
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+}
+
+// requestIDMiddleware accepts a valid X-Request-ID from the client or
+// generates one, stores it in the request context and echoes it in the response
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestid.Header)
+		if !requestid.Valid(id) {
+			id = requestid.New()
+		}
+		w.Header().Set(requestid.Header, id)
+		next.ServeHTTP(w, r.WithContext(requestid.NewContext(r.Context(), id)))
+	})
+}
+
+// loggingMiddleware logs HTTP requests and responses and, when metrics is
+// set, records them under route so per-device paths share one series
+func loggingMiddleware(logger *Logger, metrics *Metrics, route string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
@@ -84,7 +242,10 @@ func loggingMiddleware(logger *Logger, next http.Handler) http.Handler {
 
 		// Log request completion
 		duration := time.Since(start)
-		logger.Info("request completed",
+		if metrics != nil {
+			metrics.ObserveRequest(route, r.Method, wrapped.statusCode, duration)
+		}
+		logger.InfoContext(r.Context(), "request completed",
 			"method", r.Method,
 			"path", r.URL.Path,
 			"status", wrapped.statusCode,
@@ -104,3 +265,19 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.statusCode = code
 	rw.ResponseWriter.WriteHeader(code)
 }
+
+// Unwrap returns the wrapped ResponseWriter, so http.ResponseController can
+// flush streamed responses and adjust their deadlines
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// Hijack takes over the connection for a protocol upgrade, recording it as
+// 101 Switching Protocols since the response is then written by the handler
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := http.NewResponseController(rw.ResponseWriter).Hijack()
+	if err == nil {
+		rw.statusCode = http.StatusSwitchingProtocols
+	}
+	return conn, buf, err
+}
@@ -0,0 +1,309 @@
+package platform
+
+import (
+	"bytes"
+	"context"
+	"device-fleet-monitoring/internal/api"
+	"device-fleet-monitoring/internal/auth"
+	"device-fleet-monitoring/internal/requestid"
+	"device-fleet-monitoring/internal/storage"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRouter creates a router over a memory store whose handlers and
+// middleware share one JSON logger writing to buf
+func newTestRouter(buf *bytes.Buffer, deviceIDs ...string) http.Handler {
+	logger := NewLogger(LoggerConfig{Output: buf, Format: FormatJSON, Level: slog.LevelDebug})
+	handlers := api.NewHandlers(storage.NewMemoryStore(deviceIDs), api.WithLogger(logger.Logger))
+	return NewRouter(RouterConfig{Handlers: handlers, Logger: logger})
+}
+
+// logRecords decodes every JSON log record written to buf
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var records []map[string]interface{}
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var record map[string]interface{}
+		if err := dec.Decode(&record); err != nil {
+			t.Fatalf("invalid log record: %v", err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestRequestID_PropagatesEndToEnd(t *testing.T) {
+	var buf bytes.Buffer
+	router := newTestRouter(&buf, "cam-1")
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/devices/unknown/heartbeat", strings.NewReader(`{"sent_at":60}`))
+	req.Header.Set(requestid.Header, "trace-42")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d", w.Code)
+	}
+	if got := w.Header().Get(requestid.Header); got != "trace-42" {
+		t.Errorf("response header = %q, want trace-42", got)
+	}
+	var errResp api.ErrorResponse
+	if err := json.NewDecoder(w.Body).Decode(&errResp); err != nil {
+		t.Fatalf("failed to decode error response: %v", err)
+	}
+	if errResp.RequestID != "trace-42" {
+		t.Errorf("error body request_id = %q, want trace-42", errResp.RequestID)
+	}
+
+	// The raw body, the rejection and the middleware's completion line all carry the ID
+	records := logRecords(t, &buf)
+	msgs := make([]string, len(records))
+	for i, record := range records {
+		msgs[i], _ = record["msg"].(string)
+		if record["request_id"] != "trace-42" {
+			t.Errorf("log record %v missing request_id", record)
+		}
+	}
+	if got := strings.Join(msgs, ","); got != "raw request body,device not found,request completed" {
+		t.Errorf("unexpected log records %q", got)
+	}
+}
+
+func TestRequestID_GeneratedWhenMissingOrInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	router := newTestRouter(&buf, "cam-1")
+
+	seen := make(map[string]bool)
+	for _, header := range []string{"", "has space", strings.Repeat("x", 129)} {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/devices/cam-1/heartbeat", strings.NewReader(`{"sent_at":60}`))
+		if header != "" {
+			req.Header.Set(requestid.Header, header)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		id := w.Header().Get(requestid.Header)
+		if len(id) != 32 || id == header || seen[id] {
+			t.Errorf("header %q: expected a fresh generated ID, got %q", header, id)
+		}
+		seen[id] = true
+	}
+
+	for _, record := range logRecords(t, &buf) {
+		if id, _ := record["request_id"].(string); !seen[id] {
+			t.Errorf("log record %v does not carry a generated request_id", record)
+		}
+	}
+}
+
+func TestRouter_Authentication(t *testing.T) {
+	authenticator := auth.NewAuthenticator(auth.Config{
+		DeviceSecrets: map[string]string{"cam-1": "s3cret"},
+		OperatorTokens: []auth.OperatorToken{
+			{Name: "dashboard", Token: "read-token", Scopes: []auth.Scope{auth.ScopeRead}},
+			{Name: "ops", Token: "admin-token", Scopes: []auth.Scope{auth.ScopeAdmin}},
+		},
+	})
+	logger := NewLogger(LoggerConfig{Output: io.Discard})
+	handlers := api.NewHandlers(storage.NewMemoryStore([]string{"cam-1"}), api.WithLogger(logger.Logger))
+	router := NewRouter(RouterConfig{Handlers: handlers, Logger: logger, Auth: authenticator, MaxBodyBytes: 1024})
+
+	heartbeat := `{"sent_at":60}`
+	timestamp := fmt.Sprint(time.Now().Unix())
+	signature := hex.EncodeToString(auth.Sign([]byte("s3cret"), timestamp, http.MethodPost, "/api/v1/devices/cam-1/heartbeat", []byte(heartbeat)))
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		headers    map[string]string
+		wantStatus int
+	}{
+		{name: "heartbeat without credentials", method: http.MethodPost, path: "/api/v1/devices/cam-1/heartbeat", body: heartbeat, wantStatus: http.StatusUnauthorized},
+		{name: "heartbeat with device secret", method: http.MethodPost, path: "/api/v1/devices/cam-1/heartbeat", body: heartbeat,
+			headers: map[string]string{"Authorization": "Bearer s3cret"}, wantStatus: http.StatusNoContent},
+		{name: "heartbeat with operator token", method: http.MethodPost, path: "/api/v1/devices/cam-1/heartbeat", body: heartbeat,
+			headers: map[string]string{"Authorization": "Bearer admin-token"}, wantStatus: http.StatusUnauthorized},
+		{name: "signed heartbeat", method: http.MethodPost, path: "/api/v1/devices/cam-1/heartbeat", body: heartbeat,
+			headers: map[string]string{auth.TimestampHeader: timestamp, auth.SignatureHeader: signature}, wantStatus: http.StatusNoContent},
+		{name: "replayed heartbeat", method: http.MethodPost, path: "/api/v1/devices/cam-1/heartbeat", body: heartbeat,
+			headers: map[string]string{auth.TimestampHeader: timestamp, auth.SignatureHeader: signature}, wantStatus: http.StatusUnauthorized},
+		{name: "oversized signed body", method: http.MethodPost, path: "/api/v1/devices/cam-1/heartbeats:batch", body: strings.Repeat(" ", 2048),
+			headers: map[string]string{"Authorization": "Bearer s3cret"}, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "stats without token", method: http.MethodGet, path: "/api/v1/devices/cam-1/stats", wantStatus: http.StatusUnauthorized},
+		{name: "stats with read token", method: http.MethodGet, path: "/api/v1/devices/cam-1/stats",
+			headers: map[string]string{"Authorization": "Bearer read-token"}, wantStatus: http.StatusOK},
+		{name: "register with read token", method: http.MethodPost, path: "/api/v1/devices", body: `{"device_id":"cam-2"}`,
+			headers: map[string]string{"Authorization": "Bearer read-token"}, wantStatus: http.StatusForbidden},
+		{name: "register with admin token", method: http.MethodPost, path: "/api/v1/devices", body: `{"device_id":"cam-2"}`,
+			headers: map[string]string{"Authorization": "Bearer admin-token"}, wantStatus: http.StatusCreated},
+		{name: "ingest without ingest scope", method: http.MethodPost, path: "/api/v1/ingest", body: `[]`,
+			headers: map[string]string{"Authorization": "Bearer admin-token"}, wantStatus: http.StatusForbidden},
+		{name: "health stays open", method: http.MethodGet, path: "/healthz", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		for key, value := range tt.headers {
+			req.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: expected status %d, got %d (%s)", tt.name, tt.wantStatus, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRouter_IngestClosedWithoutOperatorTokens(t *testing.T) {
+	authenticator := auth.NewAuthenticator(auth.Config{DeviceSecrets: map[string]string{"cam-1": "s3cret"}})
+	logger := NewLogger(LoggerConfig{Output: io.Discard})
+	store := storage.NewMemoryStore([]string{"cam-1"})
+	handlers := api.NewHandlers(store, api.WithLogger(logger.Logger))
+	router := NewRouter(RouterConfig{Handlers: handlers, Logger: logger, Auth: authenticator, MaxBodyBytes: 1024})
+
+	// Not even the device's own secret vouches for a cross-device batch
+	for _, token := range []string{"", "s3cret"} {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/ingest", strings.NewReader(`[{"device_id":"cam-1","type":"heartbeat","sent_at":60}]`))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("token %q: expected 401 with WWW-Authenticate, got %d %s", token, w.Code, w.Body.String())
+		}
+	}
+	if uptime, _, _ := store.GetStats(context.Background(), "cam-1"); uptime != 0 {
+		t.Errorf("expected nothing stored, got uptime %v", uptime)
+	}
+}
+
+func TestRouter_HealthCountsCurrentDevices(t *testing.T) {
+	ctx := context.Background()
+	logger := NewLogger(LoggerConfig{Output: io.Discard})
+	store := storage.NewMemoryStore([]string{"cam-1", "cam-2"})
+	router := NewRouter(RouterConfig{Handlers: api.NewHandlers(store, api.WithLogger(logger.Logger)), Logger: logger})
+
+	// A registry reload retires cam-2 and adds cam-3 and cam-4
+	if _, _, err := store.ReconcileDevices(ctx, []storage.DeviceInfo{{ID: "cam-1"}, {ID: "cam-3"}, {ID: "cam-4"}}); err != nil {
+		t.Fatalf("ReconcileDevices failed: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	var resp api.HealthResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if w.Code != http.StatusOK || resp.Status != "ok" || resp.Devices != 3 {
+		t.Errorf("expected 200 with 3 devices, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRouter_Routes(t *testing.T) {
+	var buf bytes.Buffer
+	router := newTestRouter(&buf, "cam-1", "cam-2", "cam.3_x:y")
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantAllow  string // Expected Allow header of a 405
+		wantJSON   bool   // Error response must be an api.ErrorResponse
+	}{
+		{name: "heartbeat", method: http.MethodPost, path: "/api/v1/devices/cam-1/heartbeat", body: `{"sent_at":60}`, wantStatus: http.StatusNoContent},
+		{name: "heartbeat with punctuated id", method: http.MethodPost, path: "/api/v1/devices/cam.3_x:y/heartbeat", body: `{"sent_at":60}`, wantStatus: http.StatusNoContent},
+		{name: "heartbeat batch", method: http.MethodPost, path: "/api/v1/devices/cam-1/heartbeats:batch", body: `[{"sent_at":60}]`, wantStatus: http.StatusOK},
+		{name: "stats post", method: http.MethodPost, path: "/api/v1/devices/cam-1/stats", body: `{"sent_at":60,"upload_time":1}`, wantStatus: http.StatusNoContent},
+		{name: "stats get", method: http.MethodGet, path: "/api/v1/devices/cam-1/stats", wantStatus: http.StatusOK},
+		{name: "stats head", method: http.MethodHead, path: "/api/v1/devices/cam-1/stats", wantStatus: http.StatusOK},
+		{name: "device list", method: http.MethodGet, path: "/api/v1/devices", wantStatus: http.StatusOK},
+		{name: "register", method: http.MethodPost, path: "/api/v1/devices", body: `{"device_ids":["cam-4"]}`, wantStatus: http.StatusCreated},
+		{name: "decommission", method: http.MethodDelete, path: "/api/v1/devices/cam-2", wantStatus: http.StatusNoContent},
+		{name: "ingest", method: http.MethodPost, path: "/api/v1/ingest", body: `[]`, wantStatus: http.StatusOK},
+		{name: "fleet stats", method: http.MethodGet, path: "/api/v1/fleet/stats", wantStatus: http.StatusOK},
+		{name: "alerts without an engine", method: http.MethodGet, path: "/api/v1/alerts", wantStatus: http.StatusOK},
+		{name: "events without a broker", method: http.MethodGet, path: "/api/v1/events", wantStatus: http.StatusServiceUnavailable},
+		{name: "health", method: http.MethodGet, path: "/healthz", wantStatus: http.StatusOK},
+		{name: "log level", method: http.MethodGet, path: "/admin/log-level", wantStatus: http.StatusOK},
+
+		{name: "heartbeat wrong method", method: http.MethodGet, path: "/api/v1/devices/cam-1/heartbeat", wantStatus: http.StatusMethodNotAllowed, wantAllow: "POST", wantJSON: true},
+		{name: "stats wrong method", method: http.MethodPut, path: "/api/v1/devices/cam-1/stats", wantStatus: http.StatusMethodNotAllowed, wantAllow: "GET, HEAD, POST", wantJSON: true},
+		{name: "devices wrong method", method: http.MethodPatch, path: "/api/v1/devices", wantStatus: http.StatusMethodNotAllowed, wantAllow: "GET, HEAD, POST", wantJSON: true},
+		{name: "device wrong method", method: http.MethodGet, path: "/api/v1/devices/cam-1", wantStatus: http.StatusMethodNotAllowed, wantAllow: "DELETE", wantJSON: true},
+		{name: "ingest wrong method", method: http.MethodGet, path: "/api/v1/ingest", wantStatus: http.StatusMethodNotAllowed, wantAllow: "POST", wantJSON: true},
+		{name: "log level wrong method", method: http.MethodPost, path: "/admin/log-level", wantStatus: http.StatusMethodNotAllowed, wantAllow: "GET, HEAD, PUT", wantJSON: true},
+		{name: "health wrong method", method: http.MethodPost, path: "/healthz", wantStatus: http.StatusMethodNotAllowed, wantAllow: "GET, HEAD", wantJSON: true},
+
+		{name: "nested device path", method: http.MethodPost, path: "/api/v1/devices/a/b/c/heartbeat", body: `{"sent_at":60}`, wantStatus: http.StatusNotFound, wantJSON: true},
+		{name: "empty device id", method: http.MethodPost, path: "/api/v1/devices//heartbeat", wantStatus: http.StatusNotFound, wantJSON: true},
+		{name: "trailing slash", method: http.MethodGet, path: "/api/v1/devices/", wantStatus: http.StatusNotFound, wantJSON: true},
+		{name: "unknown action", method: http.MethodPost, path: "/api/v1/devices/cam-1/reboot", wantStatus: http.StatusNotFound, wantJSON: true},
+		{name: "unknown path", method: http.MethodGet, path: "/nope", wantStatus: http.StatusNotFound, wantJSON: true},
+		{name: "metrics not configured", method: http.MethodGet, path: "/metrics", wantStatus: http.StatusNotFound, wantJSON: true},
+
+		{name: "escaped slash in id", method: http.MethodPost, path: "/api/v1/devices/a%2Fb/heartbeat", body: `{"sent_at":60}`, wantStatus: http.StatusBadRequest, wantJSON: true},
+		{name: "space in id", method: http.MethodGet, path: "/api/v1/devices/cam%201/stats", wantStatus: http.StatusBadRequest, wantJSON: true},
+		{name: "leading dot in id", method: http.MethodDelete, path: "/api/v1/devices/.cam", wantStatus: http.StatusBadRequest, wantJSON: true},
+		{name: "overlong id", method: http.MethodGet, path: "/api/v1/devices/" + strings.Repeat("a", 129) + "/stats", wantStatus: http.StatusBadRequest, wantJSON: true},
+		{name: "unknown device", method: http.MethodPost, path: "/api/v1/devices/cam-9/heartbeat", body: `{"sent_at":60}`, wantStatus: http.StatusNotFound, wantJSON: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+			if !tt.wantJSON {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+			var errResp api.ErrorResponse
+			if err := json.NewDecoder(w.Body).Decode(&errResp); err != nil {
+				t.Fatalf("failed to decode error response: %v", err)
+			}
+			if errResp.Msg == "" || errResp.RequestID != w.Header().Get(requestid.Header) {
+				t.Errorf("unexpected error response %+v", errResp)
+			}
+		})
+	}
+}
+
+func TestRouter_DeviceIDPattern(t *testing.T) {
+	logger := NewLogger(LoggerConfig{Output: io.Discard})
+	handlers := api.NewHandlers(storage.NewMemoryStore([]string{"cam-1", "dev-1"}), api.WithLogger(logger.Logger))
+	router := NewRouter(RouterConfig{Handlers: handlers, Logger: logger, DeviceIDPattern: regexp.MustCompile(`^cam-[0-9]+$`)})
+
+	for path, want := range map[string]int{
+		"/api/v1/devices/cam-1/stats": http.StatusOK,
+		"/api/v1/devices/dev-1/stats": http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != want {
+			t.Errorf("GET %s: expected status %d, got %d", path, want, w.Code)
+		}
+	}
+}
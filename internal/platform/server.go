@@ -0,0 +1,185 @@
+package platform
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Server defaults used when a ServerConfig field is zero
+const (
+	DefaultReadTimeout       = 15 * time.Second
+	DefaultReadHeaderTimeout = 5 * time.Second
+	DefaultWriteTimeout      = 30 * time.Second
+	DefaultIdleTimeout       = 2 * time.Minute
+	DefaultMaxHeaderBytes    = 64 << 10
+	DefaultShutdownTimeout   = 30 * time.Second
+)
+
+// Readiness reports whether the server should receive traffic. It is
+// separate from liveness: a draining server is alive but not ready.
+type Readiness struct {
+	ready atomic.Bool
+}
+
+// SetReady marks the server ready or not ready
+func (r *Readiness) SetReady(ready bool) {
+	r.ready.Store(ready)
+}
+
+// Ready reports whether the server is ready
+func (r *Readiness) Ready() bool {
+	return r.ready.Load()
+}
+
+// ServeHTTP handles GET /readyz
+func (r *Readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	status, body := http.StatusOK, "ready"
+	if !r.Ready() {
+		status, body = http.StatusServiceUnavailable, "not ready"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"status": body})
+}
+
+// ServerConfig holds configuration for Server
+type ServerConfig struct {
+	Addr    string
+	Handler http.Handler
+	Logger  *Logger
+
+	ReadTimeout       time.Duration // Whole request, including the body
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration // Keep-alive connections
+	MaxHeaderBytes    int
+
+	// TLSConfig, when set, serves HTTPS; see CertReloader
+	TLSConfig *tls.Config
+
+	// Readiness is marked ready once the server accepts connections and not
+	// ready as soon as shutdown begins
+	Readiness *Readiness
+
+	// DrainDelay keeps serving, while reporting not ready, so load balancers
+	// stop routing before the listener closes
+	DrainDelay time.Duration
+
+	// ShutdownTimeout bounds how long in-flight requests may take to finish
+	ShutdownTimeout time.Duration
+
+	// OnShutdown, when set, is called as the listener closes to end
+	// long-lived requests, such as event streams, that would otherwise
+	// hold shutdown until ShutdownTimeout
+	OnShutdown func()
+}
+
+// Server is an HTTP server with timeouts and graceful shutdown
+type Server struct {
+	config ServerConfig
+	http   *http.Server
+}
+
+// NewServer creates a Server, applying defaults to zero configuration fields
+func NewServer(config ServerConfig) *Server {
+	if config.ReadTimeout == 0 {
+		config.ReadTimeout = DefaultReadTimeout
+	}
+	if config.ReadHeaderTimeout == 0 {
+		config.ReadHeaderTimeout = DefaultReadHeaderTimeout
+	}
+	if config.WriteTimeout == 0 {
+		config.WriteTimeout = DefaultWriteTimeout
+	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = DefaultIdleTimeout
+	}
+	if config.MaxHeaderBytes == 0 {
+		config.MaxHeaderBytes = DefaultMaxHeaderBytes
+	}
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = DefaultShutdownTimeout
+	}
+	if config.Readiness == nil {
+		config.Readiness = &Readiness{}
+	}
+
+	s := &Server{
+		config: config,
+		http: &http.Server{
+			Addr:              config.Addr,
+			Handler:           config.Handler,
+			ReadTimeout:       config.ReadTimeout,
+			ReadHeaderTimeout: config.ReadHeaderTimeout,
+			WriteTimeout:      config.WriteTimeout,
+			IdleTimeout:       config.IdleTimeout,
+			MaxHeaderBytes:    config.MaxHeaderBytes,
+			// Connection-level errors, such as failed TLS handshakes
+			ErrorLog: slog.NewLogLogger(config.Logger.Handler(), slog.LevelWarn),
+		},
+	}
+	if config.OnShutdown != nil {
+		s.http.RegisterOnShutdown(config.OnShutdown)
+	}
+	return s
+}
+
+// ListenAndServe listens on the configured address and serves until ctx is
+// cancelled, then shuts down gracefully
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.config.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, ln)
+}
+
+// Serve accepts connections on ln, over TLS if configured, until ctx is
+// cancelled. Shutdown then reports not ready, waits DrainDelay, stops
+// accepting connections and waits up to ShutdownTimeout for in-flight
+// requests. It returns nil after a clean drain and an error if serving failed or requests were cut off.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	if s.config.TLSConfig != nil {
+		ln = tls.NewListener(ln, s.config.TLSConfig)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.http.Serve(ln)
+	}()
+	s.config.Readiness.SetReady(true)
+
+	select {
+	case err := <-serveErr:
+		s.config.Readiness.SetReady(false)
+		return err
+	case <-ctx.Done():
+	}
+
+	s.config.Readiness.SetReady(false)
+	s.config.Logger.Info("shutting down server",
+		"drain_delay", s.config.DrainDelay,
+		"shutdown_timeout", s.config.ShutdownTimeout)
+	if s.config.DrainDelay > 0 {
+		time.Sleep(s.config.DrainDelay)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancel()
+	err := s.http.Shutdown(shutdownCtx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		// Drop whatever is still running rather than block exit
+		s.http.Close()
+	}
+	if serr := <-serveErr; !errors.Is(serr, http.ErrServerClosed) && err == nil {
+		err = serr
+	}
+	return err
+}
@@ -0,0 +1,121 @@
+package platform
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// noKeepAlive is a client whose connections close after each request, so no
+// idle or speculatively dialed connection can hold up shutdown
+var noKeepAlive = &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+func TestServer_GracefulShutdownDrainsInFlight(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.NewServeMux()
+	handler.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	readiness := &Readiness{}
+	handler.Handle("/readyz", readiness)
+	server := NewServer(ServerConfig{
+		Handler:         handler,
+		Logger:          NewLogger(LoggerConfig{Output: io.Discard}),
+		Readiness:       readiness,
+		ShutdownTimeout: 5 * time.Second,
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	base := "http://" + ln.Addr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.Serve(ctx, ln) }()
+
+	resp, err := noKeepAlive.Get(base + "/readyz")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected ready before shutdown, got %v %v", resp, err)
+	}
+	resp.Body.Close()
+
+	// Start a request, then shut down while it is in flight
+	slowStatus := make(chan int, 1)
+	go func() {
+		resp, err := noKeepAlive.Post(base+"/slow", "application/json", nil)
+		if err != nil {
+			slowStatus <- 0
+			return
+		}
+		resp.Body.Close()
+		slowStatus <- resp.StatusCode
+	}()
+	<-started
+	cancel()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for readiness.Ready() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if readiness.Ready() {
+		t.Fatal("expected not ready once shutdown begins")
+	}
+	select {
+	case err := <-serveErr:
+		t.Fatalf("Serve returned before the in-flight request finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if status := <-slowStatus; status != http.StatusNoContent {
+		t.Errorf("in-flight request status = %d, want 204", status)
+	}
+	if err := <-serveErr; err != nil {
+		t.Errorf("expected a clean shutdown, got %v", err)
+	}
+	if _, err := noKeepAlive.Get(base + "/readyz"); err == nil {
+		t.Error("expected new connections to be refused after shutdown")
+	}
+}
+
+func TestServer_ShutdownTimeoutCutsOffRequests(t *testing.T) {
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	})
+	server := NewServer(ServerConfig{
+		Handler:         handler,
+		Logger:          NewLogger(LoggerConfig{Output: io.Discard}),
+		ShutdownTimeout: 20 * time.Millisecond,
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.Serve(ctx, ln) }()
+
+	go noKeepAlive.Get("http://" + ln.Addr().String() + "/")
+	<-started
+	cancel()
+
+	select {
+	case err := <-serveErr:
+		if err == nil {
+			t.Error("expected an error when requests outlive the shutdown timeout")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after the shutdown timeout")
+	}
+}
@@ -0,0 +1,112 @@
+package platform
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// TLSConfig holds the certificate files used to serve HTTPS
+type TLSConfig struct {
+	CertFile     string // PEM server certificate chain
+	KeyFile      string // PEM private key of CertFile
+	ClientCAFile string // Optional PEM bundle; enables client certificate verification
+}
+
+// CertReloader serves the certificates from TLSConfig and can reload them
+// without a restart. New connections see a reload; established ones keep
+// the certificates they negotiated.
+type CertReloader struct {
+	config TLSConfig
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// NewCertReloader loads the certificates named by config
+func NewCertReloader(config TLSConfig) (*CertReloader, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("both a certificate and a key file are required")
+	}
+	c := &CertReloader{config: config}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload re-reads the certificate, key and client CA files. On error the
+// previously loaded certificates stay in use.
+func (c *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.config.CertFile, c.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load server certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if c.config.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.config.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA file %s", c.config.ClientCAFile)
+		}
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.clientCAs = clientCAs
+	c.mu.Unlock()
+	return nil
+}
+
+// ClientAuth reports whether client certificates are verified
+func (c *CertReloader) ClientAuth() bool {
+	return c.config.ClientCAFile != ""
+}
+
+// TLSConfig returns a server configuration that always uses the most
+// recently loaded certificates. Client certificates are requested and
+// verified when given, but not required at the handshake: routes decide
+// whether they need one.
+func (c *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*c.cert},
+			}
+			if c.clientCAs != nil {
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+				config.ClientCAs = c.clientCAs
+			}
+			return config, nil
+		},
+	}
+}
+
+// clientCertIdentities returns the names a verified client certificate
+// vouches for: its subject common name and DNS subject alternative names.
+// It returns nil if the request carries no verified certificate.
+func clientCertIdentities(r *http.Request) []string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	names := make([]string, 0, 1+len(leaf.DNSNames))
+	if leaf.Subject.CommonName != "" {
+		names = append(names, leaf.Subject.CommonName)
+	}
+	return append(names, leaf.DNSNames...)
+}
@@ -0,0 +1,273 @@
+package platform
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"device-fleet-monitoring/internal/api"
+	"device-fleet-monitoring/internal/storage"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA is a locally generated certificate authority
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+var serial int64
+
+// nextSerial returns a fresh certificate serial number
+func nextSerial() *big.Int {
+	serial++
+	return big.NewInt(serial)
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          nextSerial(),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create CA: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue creates a leaf certificate, returning it with PEM certificate and key
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) (tls.Certificate, []byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template.SerialNumber = nextSerial()
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("load key pair: %v", err)
+	}
+	return pair, certPEM, keyPEM
+}
+
+// serverCert issues a certificate for 127.0.0.1
+func (ca *testCA) serverCert(t *testing.T) ([]byte, []byte) {
+	_, certPEM, keyPEM := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "fleet-server"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return certPEM, keyPEM
+}
+
+// clientCert issues a client certificate with a common name and DNS names
+func (ca *testCA) clientCert(t *testing.T, cn string, dnsNames ...string) tls.Certificate {
+	pair, _, _ := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		DNSNames:    dnsNames,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return pair
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+// startTLSServer serves handler over TLS with certs until the test ends
+func startTLSServer(t *testing.T, certs *CertReloader, handler http.Handler) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := NewServer(ServerConfig{
+		Handler:   handler,
+		Logger:    NewLogger(LoggerConfig{Output: io.Discard}),
+		TLSConfig: certs.TLSConfig(),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.Serve(ctx, ln)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return "https://" + ln.Addr().String()
+}
+
+// tlsClient trusts serverCA and presents the given client certificates
+func tlsClient(serverCA *testCA, certs ...tls.Certificate) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.cert)
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certs},
+		DisableKeepAlives: true,
+	}}
+}
+
+func TestMutualTLS_BindsCertificateToDevice(t *testing.T) {
+	dir := t.TempDir()
+	serverCA := newTestCA(t, "server-ca")
+	deviceCA := newTestCA(t, "device-ca")
+	certPEM, keyPEM := serverCA.serverCert(t)
+	writeFile(t, filepath.Join(dir, "server.crt"), certPEM)
+	writeFile(t, filepath.Join(dir, "server.key"), keyPEM)
+	writeFile(t, filepath.Join(dir, "devices-ca.crt"), deviceCA.pem)
+
+	certs, err := NewCertReloader(TLSConfig{
+		CertFile:     filepath.Join(dir, "server.crt"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "devices-ca.crt"),
+	})
+	if err != nil {
+		t.Fatalf("NewCertReloader: %v", err)
+	}
+
+	logger := NewLogger(LoggerConfig{Output: io.Discard})
+	handlers := api.NewHandlers(storage.NewMemoryStore([]string{"cam-1", "cam-2"}), api.WithLogger(logger.Logger))
+	base := startTLSServer(t, certs, NewRouter(RouterConfig{Handlers: handlers, Logger: logger, RequireClientCert: certs.ClientAuth()}))
+
+	cam1 := tlsClient(serverCA, deviceCA.clientCert(t, "cam-1"))
+	cam2BySAN := tlsClient(serverCA, deviceCA.clientCert(t, "gateway", "cam-2"))
+	anonymous := tlsClient(serverCA)
+	// Clients only present certificates issued by a CA the server asks for
+	untrusted := tlsClient(serverCA, newTestCA(t, "rogue-ca").clientCert(t, "cam-1"))
+
+	tests := []struct {
+		name       string
+		client     *http.Client
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{name: "own device", client: cam1, method: http.MethodPost, path: "/api/v1/devices/cam-1/heartbeat", wantStatus: http.StatusNoContent},
+		{name: "other device", client: cam1, method: http.MethodPost, path: "/api/v1/devices/cam-2/stats", wantStatus: http.StatusForbidden},
+		{name: "DNS SAN", client: cam2BySAN, method: http.MethodPost, path: "/api/v1/devices/cam-2/heartbeat", wantStatus: http.StatusNoContent},
+		{name: "no certificate", client: anonymous, method: http.MethodPost, path: "/api/v1/devices/cam-1/heartbeat", wantStatus: http.StatusUnauthorized},
+		{name: "untrusted certificate", client: untrusted, method: http.MethodPost, path: "/api/v1/devices/cam-1/heartbeat", wantStatus: http.StatusUnauthorized},
+		{name: "read without certificate", client: anonymous, method: http.MethodGet, path: "/api/v1/devices/cam-1/stats", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, base+tt.path, strings.NewReader(`{"sent_at":60,"upload_time":1}`))
+		resp, err := tt.client.Do(req)
+		if err != nil {
+			t.Errorf("%s: request failed: %v", tt.name, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.wantStatus, resp.StatusCode)
+		}
+	}
+
+	// Batch ingestion only accepts events for the certificate's own device
+	ingest := func(client *http.Client) (int, api.BatchResponse) {
+		body := `[{"device_id":"cam-1","type":"heartbeat","sent_at":60},{"device_id":"cam-2","type":"heartbeat","sent_at":60}]`
+		resp, err := client.Post(base+"/api/v1/ingest", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("ingest failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var batch api.BatchResponse
+		json.NewDecoder(resp.Body).Decode(&batch)
+		return resp.StatusCode, batch
+	}
+	if status, _ := ingest(anonymous); status != http.StatusUnauthorized {
+		t.Errorf("ingest without certificate: expected status 401, got %d", status)
+	}
+	status, batch := ingest(cam1)
+	if status != http.StatusOK || batch.Accepted != 1 || batch.Results[1].Reason != "client certificate does not match device" {
+		t.Errorf("ingest as cam-1: expected cam-2's event rejected, got %d %+v", status, batch)
+	}
+}
+
+func TestCertReloader_Reload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	oldCA, newCA := newTestCA(t, "old-ca"), newTestCA(t, "new-ca")
+	certPEM, keyPEM := oldCA.serverCert(t)
+	writeFile(t, certFile, certPEM)
+	writeFile(t, keyFile, keyPEM)
+
+	certs, err := NewCertReloader(TLSConfig{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("NewCertReloader: %v", err)
+	}
+	base := startTLSServer(t, certs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	get := func(ca *testCA) error {
+		resp, err := tlsClient(ca).Get(base)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	if err := get(oldCA); err != nil {
+		t.Fatalf("expected the initial certificate: %v", err)
+	}
+
+	// A broken file is rejected and the current certificate stays in use
+	writeFile(t, certFile, []byte("not a certificate"))
+	if err := certs.Reload(); err == nil {
+		t.Error("expected reload of a broken certificate to fail")
+	}
+	if err := get(oldCA); err != nil {
+		t.Errorf("expected the previous certificate after a failed reload: %v", err)
+	}
+
+	certPEM, keyPEM = newCA.serverCert(t)
+	writeFile(t, certFile, certPEM)
+	writeFile(t, keyFile, keyPEM)
+	if err := certs.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if err := get(newCA); err != nil {
+		t.Errorf("expected the reloaded certificate: %v", err)
+	}
+	if err := get(oldCA); err == nil {
+		t.Error("expected the old certificate to be replaced")
+	}
+}
@@ -0,0 +1,223 @@
+package platform
+
+import (
+	"bytes"
+	"context"
+	"device-fleet-monitoring/internal/api"
+	"device-fleet-monitoring/internal/auth"
+	"device-fleet-monitoring/internal/storage"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// UDP heartbeat datagrams, for devices that can't afford an HTTP request
+// per heartbeat. A text datagram is
+//
+//	<device_id> <unix seconds>[ <hex signature>]
+//
+// with an optional trailing newline. A binary datagram is
+//
+//	0x01, device ID length, device ID, unix seconds as a big-endian int64[, signature]
+//
+// The signature is the 32-byte HMAC-SHA256 of auth.VerifyDatagram. Nothing
+// is ever sent back, so the listener can't be used to reflect traffic.
+const (
+	udpBinaryVersion = 0x01 // First byte of a binary datagram; text ones start with the device ID
+	udpSignatureSize = 32   // HMAC-SHA256
+	udpMaxDatagram   = 512  // Larger datagrams are malformed
+	udpEndpoint      = "udp"
+)
+
+// Datagram results counted by Metrics.RecordUDP
+const (
+	udpAccepted        = "accepted"        // Heartbeat stored
+	udpMalformed       = "malformed"       // Unparseable, or a device ID not matching the pattern
+	udpUnknown         = "unknown"         // Device not in the registry
+	udpUnauthenticated = "unauthenticated" // Missing or invalid signature, stale timestamp or replay
+	udpDecommissioned  = "decommissioned"  // Device no longer accepting heartbeats
+	udpLimited         = "limited"         // Dropped by the client IP or heartbeat rate limit
+	udpError           = "error"           // Store error
+)
+
+// UDPConfig holds configuration for UDPListener
+type UDPConfig struct {
+	Handlers *api.Handlers // Stores accepted heartbeats
+	Logger   *Logger
+	Metrics  *Metrics // Optional; counts datagrams by result
+
+	// Auth, when device authentication is enabled, requires every datagram
+	// to be signed with its device's secret
+	Auth *auth.Authenticator
+
+	// RateLimiter applies the client IP limit to each datagram's source
+	// and the heartbeat limit to its device, as for heartbeat posts
+	RateLimiter *RateLimiter
+
+	// DeviceIDPattern validates device IDs as in request paths. Defaults
+	// to DefaultDeviceIDPattern.
+	DeviceIDPattern *regexp.Regexp
+}
+
+// UDPListener receives heartbeat datagrams and records them through the
+// same handlers, registry and credentials as the HTTP API
+type UDPListener struct {
+	config  UDPConfig
+	pattern *regexp.Regexp
+}
+
+// heartbeatDatagram is a parsed datagram
+type heartbeatDatagram struct {
+	deviceID  string
+	timestamp int64 // Unix seconds
+	signature []byte
+}
+
+// NewUDPListener creates a UDPListener from config
+func NewUDPListener(config UDPConfig) *UDPListener {
+	pattern := config.DeviceIDPattern
+	if pattern == nil {
+		pattern = regexp.MustCompile(DefaultDeviceIDPattern)
+	}
+	return &UDPListener{config: config, pattern: pattern}
+}
+
+// Serve reads datagrams from conn until ctx is cancelled, then closes conn
+// and returns nil. Datagrams are handled one at a time; bursts queue in the
+// socket's receive buffer.
+func (l *UDPListener) Serve(ctx context.Context, conn net.PacketConn) error {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	defer conn.Close()
+
+	// A datagram being stored when ctx ends is still stored
+	recordCtx := context.WithoutCancel(ctx)
+	buf := make([]byte, udpMaxDatagram+1)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		l.handle(recordCtx, buf[:n], addr.String())
+	}
+}
+
+// handle validates, authenticates and records one datagram from addr
+func (l *UDPListener) handle(ctx context.Context, data []byte, addr string) {
+	logger := l.config.Logger
+	datagram, err := parseDatagram(data)
+	if err == nil && !l.pattern.MatchString(datagram.deviceID) {
+		err = fmt.Errorf("device_id %q does not match the device ID pattern", datagram.deviceID)
+	}
+	if err != nil {
+		l.count(udpMalformed)
+		logger.DebugContext(ctx, "malformed UDP heartbeat", "remote_addr", addr, "error", err)
+		return
+	}
+
+	deviceID := datagram.deviceID
+	if !l.config.RateLimiter.allowClientIP(addr) {
+		l.count(udpLimited)
+		logger.DebugContext(ctx, "UDP heartbeat rate limited", "device_id", deviceID, "remote_addr", addr, "limit", "client_ip")
+		return
+	}
+	if l.config.Auth != nil && l.config.Auth.DeviceAuthEnabled() {
+		if err := l.config.Auth.VerifyDatagram(deviceID, datagram.timestamp, datagram.signature); err != nil {
+			l.count(udpUnauthenticated)
+			logger.DebugContext(ctx, "unauthenticated UDP heartbeat", "device_id", deviceID, "remote_addr", addr, "error", err)
+			return
+		}
+	}
+	if !l.config.RateLimiter.allowHeartbeat(deviceID) {
+		l.count(udpLimited)
+		logger.DebugContext(ctx, "UDP heartbeat rate limited", "device_id", deviceID, "remote_addr", addr, "limit", "heartbeat")
+		return
+	}
+
+	err = l.config.Handlers.RecordHeartbeat(ctx, udpEndpoint, deviceID, time.Unix(datagram.timestamp, 0))
+	switch {
+	case err == nil:
+		l.count(udpAccepted)
+		logger.DebugContext(ctx, "accepted UDP heartbeat", "device_id", deviceID, "remote_addr", addr)
+	case errors.Is(err, storage.ErrDeviceNotFound):
+		l.count(udpUnknown)
+		logger.DebugContext(ctx, "UDP heartbeat from unknown device", "device_id", deviceID, "remote_addr", addr)
+	case errors.Is(err, storage.ErrDeviceDecommissioned):
+		l.count(udpDecommissioned)
+		logger.DebugContext(ctx, "UDP heartbeat from decommissioned device", "device_id", deviceID, "remote_addr", addr)
+	default:
+		l.count(udpError)
+		logger.ErrorContext(ctx, "internal error", "device_id", deviceID, "endpoint", udpEndpoint, "error", err)
+	}
+}
+
+// count records a datagram result when metrics are enabled
+func (l *UDPListener) count(result string) {
+	if l.config.Metrics != nil {
+		l.config.Metrics.RecordUDP(result)
+	}
+}
+
+// parseDatagram parses a text or binary heartbeat datagram
+func parseDatagram(data []byte) (heartbeatDatagram, error) {
+	if len(data) > udpMaxDatagram {
+		return heartbeatDatagram{}, fmt.Errorf("datagram exceeds %d bytes", udpMaxDatagram)
+	}
+	if len(data) > 0 && data[0] == udpBinaryVersion {
+		return parseBinaryDatagram(data[1:])
+	}
+	return parseTextDatagram(data)
+}
+
+// parseBinaryDatagram parses a binary datagram after its version byte
+func parseBinaryDatagram(data []byte) (heartbeatDatagram, error) {
+	if len(data) < 1 {
+		return heartbeatDatagram{}, errors.New("missing device ID length")
+	}
+	idLen := int(data[0])
+	data = data[1:]
+	if len(data) != idLen+8 && len(data) != idLen+8+udpSignatureSize {
+		return heartbeatDatagram{}, fmt.Errorf("binary datagram of %d bytes after a %d byte device ID", len(data), idLen)
+	}
+	datagram := heartbeatDatagram{
+		deviceID:  string(data[:idLen]),
+		timestamp: int64(binary.BigEndian.Uint64(data[idLen:])),
+	}
+	if rest := data[idLen+8:]; len(rest) > 0 {
+		datagram.signature = rest
+	}
+	if datagram.timestamp <= 0 {
+		return heartbeatDatagram{}, errors.New("timestamp must be positive")
+	}
+	return datagram, nil
+}
+
+// parseTextDatagram parses a text datagram
+func parseTextDatagram(data []byte) (heartbeatDatagram, error) {
+	data = bytes.TrimSuffix(bytes.TrimSuffix(data, []byte("\n")), []byte("\r"))
+	fields := bytes.Split(data, []byte(" "))
+	if len(fields) != 2 && len(fields) != 3 {
+		return heartbeatDatagram{}, errors.New("want device ID, timestamp and optional signature separated by spaces")
+	}
+	timestamp, err := strconv.ParseInt(string(fields[1]), 10, 64)
+	if err != nil || timestamp <= 0 {
+		return heartbeatDatagram{}, fmt.Errorf("invalid timestamp %q", fields[1])
+	}
+	datagram := heartbeatDatagram{deviceID: string(fields[0]), timestamp: timestamp}
+	if len(fields) == 3 {
+		signature, err := hex.DecodeString(string(fields[2]))
+		if err != nil || len(signature) != udpSignatureSize {
+			return heartbeatDatagram{}, errors.New("signature must be 64 hex digits")
+		}
+		datagram.signature = signature
+	}
+	return datagram, nil
+}
@@ -0,0 +1,130 @@
+package platform
+
+import (
+	"bytes"
+	"context"
+	"device-fleet-monitoring/internal/api"
+	"device-fleet-monitoring/internal/auth"
+	"device-fleet-monitoring/internal/storage"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+// textDatagram builds a text heartbeat, signed when secret is set
+func textDatagram(deviceID string, timestamp int64, secret string) []byte {
+	datagram := fmt.Sprintf("%s %d", deviceID, timestamp)
+	if secret != "" {
+		datagram += fmt.Sprintf(" %x", auth.Sign([]byte(secret), fmt.Sprint(timestamp), auth.DatagramMethod, deviceID, nil))
+	}
+	return []byte(datagram + "\n")
+}
+
+// binaryDatagram builds a binary heartbeat, signed when secret is set
+func binaryDatagram(deviceID string, timestamp int64, secret string) []byte {
+	datagram := append([]byte{udpBinaryVersion, byte(len(deviceID))}, deviceID...)
+	datagram = binary.BigEndian.AppendUint64(datagram, uint64(timestamp))
+	if secret != "" {
+		datagram = append(datagram, auth.Sign([]byte(secret), fmt.Sprint(timestamp), auth.DatagramMethod, deviceID, nil)...)
+	}
+	return datagram
+}
+
+// newTestUDPListener returns a listener recording into store, with metrics
+func newTestUDPListener(store storage.Store, config UDPConfig) (*UDPListener, *Metrics) {
+	metrics := NewMetrics(MetricsConfig{})
+	config.Handlers = api.NewHandlers(store, api.WithIngestRecorder(metrics), api.WithLogger(slog.New(slog.DiscardHandler)))
+	config.Logger = NewLogger(LoggerConfig{Output: &bytes.Buffer{}})
+	config.Metrics = metrics
+	return NewUDPListener(config), metrics
+}
+
+func TestUDPListener_ValidatesDatagrams(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore([]string{"cam-1", "cam-2"})
+	store.DecommissionDevice(ctx, "cam-2", false)
+	authenticator := auth.NewAuthenticator(auth.Config{
+		DeviceSecrets: map[string]string{"cam-1": "s3cret", "cam-2": "other", "cam-9": "unknown"},
+	})
+	listener, metrics := newTestUDPListener(store, UDPConfig{Auth: authenticator})
+
+	now := time.Now().Unix()
+	datagrams := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"signed text", textDatagram("cam-1", now, "s3cret"), udpAccepted},
+		{"signed binary", binaryDatagram("cam-1", now-60, "s3cret"), udpAccepted},
+		{"replayed", textDatagram("cam-1", now, "s3cret"), udpUnauthenticated},
+		{"unsigned", textDatagram("cam-1", now-1, ""), udpUnauthenticated},
+		{"stale", textDatagram("cam-1", now-3600, "s3cret"), udpUnauthenticated},
+		{"missing timestamp", []byte("cam-1"), udpMalformed},
+		{"invalid device ID", textDatagram("cam/1", now, "s3cret"), udpMalformed},
+		{"truncated binary", binaryDatagram("cam-1", now, "s3cret")[:20], udpMalformed},
+		{"unknown device", textDatagram("cam-9", now, "unknown"), udpUnknown},
+		{"decommissioned device", binaryDatagram("cam-2", now, "other"), udpDecommissioned},
+	}
+	want := make(map[string]uint64)
+	for _, d := range datagrams {
+		listener.handle(ctx, d.data, "192.0.2.1:5000")
+		want[d.want]++
+		if got := metrics.udp[d.want]; got != want[d.want] {
+			t.Errorf("%s: expected %s, counts are %v", d.name, d.want, metrics.udp)
+		}
+	}
+
+	// Stored heartbeats count as ingest like posted ones
+	if accepted := metrics.ingest[ingestKey{endpoint: udpEndpoint, result: "accepted"}]; accepted != 2 {
+		t.Errorf("expected 2 accepted udp ingest events, got %d", accepted)
+	}
+	if uptime, _, err := store.GetStats(ctx, "cam-1"); err != nil || uptime == 0 {
+		t.Errorf("expected cam-1 to have uptime, got %v %v", uptime, err)
+	}
+}
+
+func TestUDPListener_ServesAndLimits(t *testing.T) {
+	store := storage.NewMemoryStore([]string{"cam-1"})
+	limiter := NewRateLimiter(RateLimitConfig{Heartbeat: RateLimit{Rate: 0.001, Burst: 1}})
+	listener, metrics := newTestUDPListener(store, UDPConfig{RateLimiter: limiter})
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- listener.Serve(ctx, conn) }()
+
+	// Without device secrets unsigned datagrams are accepted
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	now := time.Now().Unix()
+	client.Write(textDatagram("cam-1", now, ""))
+	client.Write(binaryDatagram("cam-1", now, ""))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		metrics.mu.Lock()
+		accepted, limited := metrics.udp[udpAccepted], metrics.udp[udpLimited]
+		metrics.mu.Unlock()
+		if accepted == 1 && limited == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected one accepted and one limited datagram, got %d and %d", accepted, limited)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-served; err != nil {
+		t.Errorf("expected Serve to return nil on cancellation, got %v", err)
+	}
+}
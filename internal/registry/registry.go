@@ -0,0 +1,158 @@
+package registry
+
+import (
+	"bytes"
+	"device-fleet-monitoring/internal/storage"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Registry CSV columns with a dedicated metadata field. Any other column is
+// kept as a label named after its header.
+const (
+	columnDeviceID = "device_id"
+	columnType     = "type"
+	columnSite     = "site"
+	columnModel    = "model"
+	columnFirmware = "firmware"
+	columnTags     = "tags"
+)
+
+// tagSeparator splits the tags column into individual tags
+const tagSeparator = ";"
+
+// Load reads device entries from a registry CSV file
+func Load(filename string) ([]storage.DeviceInfo, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	return Parse(bytes.NewReader(data))
+}
+
+// Parse reads device entries from registry CSV content. The first row is a
+// header naming the columns in any order; it must include device_id. Rows
+// without a device ID are skipped, and a later row for the same ID replaces
+// an earlier one.
+func Parse(r io.Reader) ([]storage.DeviceInfo, error) {
+	// Parse CSV, allowing rows shorter than the header
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CSV: %w", err)
+	}
+
+	// Validate CSV has at least header row
+	if len(records) < 1 {
+		return nil, fmt.Errorf("CSV file is empty")
+	}
+
+	// Map header names to column positions
+	header := make([]string, len(records[0]))
+	idColumn := -1
+	seen := make(map[string]bool, len(header))
+	for i, name := range records[0] {
+		name = strings.TrimSpace(name)
+		if known := strings.ToLower(name); isKnownColumn(known) {
+			name = known
+		}
+		if name == "" || seen[name] {
+			return nil, fmt.Errorf("CSV header has an empty or duplicate column %q", name)
+		}
+		seen[name] = true
+		header[i] = name
+		if name == columnDeviceID {
+			idColumn = i
+		}
+	}
+	if idColumn < 0 {
+		return nil, fmt.Errorf("CSV must have 'device_id' column header")
+	}
+
+	// Extract devices (skip header row)
+	devices := make([]storage.DeviceInfo, 0, len(records)-1)
+	index := make(map[string]int, len(records)-1)
+	for _, record := range records[1:] {
+		if idColumn >= len(record) {
+			continue // Skip empty rows
+		}
+		deviceID := strings.TrimSpace(record[idColumn])
+		if deviceID == "" {
+			continue
+		}
+
+		info := storage.DeviceInfo{ID: deviceID, Metadata: parseMetadata(header, record)}
+		if i, ok := index[deviceID]; ok {
+			devices[i] = info
+			continue
+		}
+		index[deviceID] = len(devices)
+		devices = append(devices, info)
+	}
+
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("no device IDs found in CSV")
+	}
+
+	return devices, nil
+}
+
+// IDs returns the IDs of devices in order
+func IDs(devices []storage.DeviceInfo) []string {
+	ids := make([]string, len(devices))
+	for i, device := range devices {
+		ids[i] = device.ID
+	}
+	return ids
+}
+
+// parseMetadata reads the metadata columns of one row
+func parseMetadata(header, record []string) storage.DeviceMetadata {
+	var md storage.DeviceMetadata
+	for i, value := range record {
+		if i >= len(header) {
+			break
+		}
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		switch header[i] {
+		case columnDeviceID:
+		case columnType:
+			md.Type = value
+		case columnSite:
+			md.Site = value
+		case columnModel:
+			md.Model = value
+		case columnFirmware:
+			md.Firmware = value
+		case columnTags:
+			for _, tag := range strings.Split(value, tagSeparator) {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					md.Tags = append(md.Tags, tag)
+				}
+			}
+		default:
+			if md.Labels == nil {
+				md.Labels = make(map[string]string)
+			}
+			md.Labels[header[i]] = value
+		}
+	}
+	return md
+}
+
+// isKnownColumn reports whether a lower-cased header name has a dedicated field
+func isKnownColumn(name string) bool {
+	switch name {
+	case columnDeviceID, columnType, columnSite, columnModel, columnFirmware, columnTags:
+		return true
+	}
+	return false
+}
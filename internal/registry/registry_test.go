@@ -0,0 +1,149 @@
+package registry
+
+import (
+	"context"
+	"device-fleet-monitoring/internal/storage"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{input: "device_id\na\n\nb\n", want: []string{"a", "b"}},
+		{input: "device_id,site\na,x\nb,y\n", want: []string{"a", "b"}},
+		{input: "site,device_id\nx,a\ny,b\nz,a\n", want: []string{"a", "b"}},
+		{input: "device_id,site,Site\na,x,y\n", wantErr: true},
+		{input: "", wantErr: true},
+		{input: "id\na\n", wantErr: true},
+		{input: "device_id\n", wantErr: true},
+		{input: "device_id\n\"a\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := Parse(strings.NewReader(tt.input))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: got error %v, wantErr %t", tt.input, err, tt.wantErr)
+			continue
+		}
+		if err == nil && fmt.Sprint(IDs(got)) != fmt.Sprint(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestParse_Metadata(t *testing.T) {
+	input := "Site,device_id,type,model,firmware,tags,rack\n" +
+		"lab-1,cam-1,camera,X100,1.2.3, outdoor ;ptz;,r7\n" +
+		"lab-2,sw-1,switch\n"
+
+	devices, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("expected 2 devices, got %d", len(devices))
+	}
+
+	cam := devices[0].Metadata
+	if devices[0].ID != "cam-1" || cam.Type != "camera" || cam.Site != "lab-1" || cam.Model != "X100" || cam.Firmware != "1.2.3" {
+		t.Errorf("unexpected camera metadata %+v", devices[0])
+	}
+	if fmt.Sprint(cam.Tags) != "[outdoor ptz]" || cam.Labels["rack"] != "r7" {
+		t.Errorf("unexpected camera tags/labels %v %v", cam.Tags, cam.Labels)
+	}
+
+	sw := devices[1].Metadata
+	if devices[1].ID != "sw-1" || sw.Type != "switch" || sw.Site != "lab-2" || sw.Tags != nil || sw.Labels != nil {
+		t.Errorf("unexpected switch metadata %+v", devices[1])
+	}
+}
+
+// recorder collects the device lists passed to a ReconcileFunc
+type recorder struct {
+	calls chan []string
+}
+
+func newRecorder() *recorder {
+	return &recorder{calls: make(chan []string, 10)}
+}
+
+func (r *recorder) reconcile(ctx context.Context, devices []storage.DeviceInfo) ([]string, []string, error) {
+	r.calls <- IDs(devices)
+	return IDs(devices), nil, nil
+}
+
+// writeRegistry writes content to path with a modification time distinct from previous writes
+func writeRegistry(t *testing.T, path, content string, mtime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write registry: %v", err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatalf("set registry mtime: %v", err)
+	}
+}
+
+func TestWatcher_PollDetectsChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.csv")
+	writeRegistry(t, path, "device_id\na\n", time.Unix(1000, 0))
+
+	rec := newRecorder()
+	w := NewWatcher(WatcherConfig{Path: path, Reconcile: rec.reconcile, Logger: slog.New(slog.DiscardHandler)})
+	ctx := context.Background()
+
+	// Unchanged file, and a touch without a content change, are not reloaded
+	w.poll(ctx)
+	writeRegistry(t, path, "device_id\na\n", time.Unix(2000, 0))
+	w.poll(ctx)
+	if len(rec.calls) != 0 {
+		t.Fatalf("expected no reloads, got %d", len(rec.calls))
+	}
+
+	writeRegistry(t, path, "device_id\na\nb\n", time.Unix(3000, 0))
+	w.poll(ctx)
+	if got := <-rec.calls; fmt.Sprint(got) != "[a b]" {
+		t.Errorf("got %v, want [a b]", got)
+	}
+
+	// A broken file is skipped and the next good version still applies
+	writeRegistry(t, path, "id\na\n", time.Unix(4000, 0))
+	w.poll(ctx)
+	if len(rec.calls) != 0 {
+		t.Fatalf("expected failed parse not to reconcile")
+	}
+	writeRegistry(t, path, "device_id\nc\n", time.Unix(5000, 0))
+	w.poll(ctx)
+	if got := <-rec.calls; fmt.Sprint(got) != "[c]" {
+		t.Errorf("got %v, want [c]", got)
+	}
+}
+
+func TestWatcher_TriggerReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.csv")
+	writeRegistry(t, path, "device_id\na\n", time.Unix(1000, 0))
+
+	rec := newRecorder()
+	w := NewWatcher(WatcherConfig{Path: path, Reconcile: rec.reconcile, Logger: slog.New(slog.DiscardHandler)})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	// Polling is disabled, so only the trigger reloads, even without a change
+	w.Trigger()
+	select {
+	case got := <-rec.calls:
+		if fmt.Sprint(got) != "[a]" {
+			t.Errorf("got %v, want [a]", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for triggered reload")
+	}
+}
@@ -0,0 +1,171 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"device-fleet-monitoring/internal/storage"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultPollInterval is how often the registry file is checked for changes when none is configured
+const DefaultPollInterval = 10 * time.Second
+
+// ReconcileFunc applies a freshly loaded list of devices, reporting which
+// devices were added and which were retired. storage.Store.ReconcileDevices
+// satisfies it.
+type ReconcileFunc func(ctx context.Context, devices []storage.DeviceInfo) (added, retired []string, err error)
+
+// WatcherConfig holds configuration for a registry file watcher
+type WatcherConfig struct {
+	// Path is the registry CSV file to watch
+	Path string
+
+	// Interval is how often the file's modification time and size are
+	// polled. Zero disables polling, leaving only explicit reloads.
+	Interval time.Duration
+
+	// Reconcile is called with the devices of every successful reload
+	Reconcile ReconcileFunc
+
+	Logger *slog.Logger // Defaults to slog.Default()
+}
+
+// Watcher reloads a registry file when it changes or a reload is triggered.
+// A file that fails to parse is logged and leaves the current registry in place.
+type Watcher struct {
+	config  WatcherConfig
+	trigger chan struct{}
+
+	// State of the file as last observed, guarded by mu
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	hash    [sha256.Size]byte
+}
+
+// NewWatcher creates a watcher for config.Path. The file's current contents
+// are taken as already applied, so only later changes trigger a reload.
+func NewWatcher(config WatcherConfig) *Watcher {
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	w := &Watcher{
+		config:  config,
+		trigger: make(chan struct{}, 1),
+	}
+	if info, err := os.Stat(config.Path); err == nil {
+		w.modTime, w.size = info.ModTime(), info.Size()
+	}
+	if data, err := os.ReadFile(config.Path); err == nil {
+		w.hash = sha256.Sum256(data)
+	}
+	return w
+}
+
+// Trigger requests a reload from Run regardless of whether the file changed,
+// e.g. on SIGHUP. It never blocks; triggers that arrive during a reload are coalesced.
+func (w *Watcher) Trigger() {
+	select {
+	case w.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run polls the file and serves triggered reloads until ctx is cancelled
+func (w *Watcher) Run(ctx context.Context) {
+	var tick <-chan time.Time
+	if w.config.Interval > 0 {
+		ticker := time.NewTicker(w.config.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+			w.poll(ctx)
+		case <-w.trigger:
+			w.Reload(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// poll reloads the file if its modification time or size changed and its
+// contents hash differs from the last applied version
+func (w *Watcher) poll(ctx context.Context) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	info, err := os.Stat(w.config.Path)
+	if err != nil {
+		w.config.Logger.Error("failed to stat device registry",
+			"file", w.config.Path,
+			"error", err)
+		return
+	}
+	if info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return
+	}
+	w.modTime, w.size = info.ModTime(), info.Size()
+
+	data, err := os.ReadFile(w.config.Path)
+	if err != nil {
+		w.config.Logger.Error("failed to read device registry",
+			"file", w.config.Path,
+			"error", err)
+		return
+	}
+	if sha256.Sum256(data) == w.hash {
+		return // Touched but unchanged
+	}
+	w.apply(ctx, data)
+}
+
+// Reload loads and applies the file unconditionally
+func (w *Watcher) Reload(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	data, err := os.ReadFile(w.config.Path)
+	if err != nil {
+		w.config.Logger.Error("failed to read device registry",
+			"file", w.config.Path,
+			"error", err)
+		return err
+	}
+	return w.apply(ctx, data)
+}
+
+// apply parses data and reconciles the store with it, recording its hash on success
+func (w *Watcher) apply(ctx context.Context, data []byte) error {
+	devices, err := Parse(bytes.NewReader(data))
+	if err != nil {
+		w.config.Logger.Error("failed to reload device registry, keeping current registry",
+			"file", w.config.Path,
+			"error", err)
+		return err
+	}
+
+	added, retired, err := w.config.Reconcile(ctx, devices)
+	if err != nil {
+		w.config.Logger.Error("failed to reconcile device registry, keeping current registry",
+			"file", w.config.Path,
+			"error", err)
+		return fmt.Errorf("reconcile devices: %w", err)
+	}
+	w.hash = sha256.Sum256(data)
+
+	w.config.Logger.Info("reloaded device registry",
+		"file", w.config.Path,
+		"count", len(devices),
+		"added", len(added),
+		"retired", len(retired))
+	return nil
+}
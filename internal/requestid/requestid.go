@@ -0,0 +1,80 @@
+// Package requestid carries a per-request correlation ID through contexts
+// and adds it to log records.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+)
+
+// Header is the HTTP header a request ID is accepted from and echoed in
+const Header = "X-Request-ID"
+
+// maxLen bounds the length of a client-supplied request ID
+const maxLen = 128
+
+// contextKey is the context key of the request ID
+type contextKey struct{}
+
+// New generates a random 128-bit request ID
+func New() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Valid reports whether a client-supplied ID is safe to log and echo:
+// non-empty, at most 128 bytes, and only visible ASCII characters
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// NewContext returns a copy of ctx carrying id
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID carried by ctx, or "" if none
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// handler adds the request ID of the record's context as a request_id attribute
+type handler struct {
+	slog.Handler
+}
+
+// NewHandler wraps next so records logged with a request context include its
+// request_id. Records logged without a context, or outside a request, are unchanged.
+func NewHandler(next slog.Handler) slog.Handler {
+	return handler{Handler: next}
+}
+
+// Handle adds request_id before passing the record on
+func (h handler) Handle(ctx context.Context, record slog.Record) error {
+	if id := FromContext(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+// WithAttrs keeps derived handlers wrapped
+func (h handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return handler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup keeps derived handlers wrapped
+func (h handler) WithGroup(name string) slog.Handler {
+	return handler{Handler: h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,117 @@
+package requestid
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := New()
+		if len(id) != 32 || strings.Trim(id, "0123456789abcdef") != "" {
+			t.Fatalf("expected 32 lowercase hex characters, got %q", id)
+		}
+		if !Valid(id) {
+			t.Fatalf("generated ID %q is not valid", id)
+		}
+		if seen[id] {
+			t.Fatalf("duplicate ID %q", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		want bool
+	}{
+		{"generated", "4bf92f3577b34da6a3ce929d0e0e4736", true},
+		{"client format", "req-42:retry/1", true},
+		{"max length", strings.Repeat("a", maxLen), true},
+		{"empty", "", false},
+		{"too long", strings.Repeat("a", maxLen+1), false},
+		{"space", "req 42", false},
+		{"newline", "req\n42", false},
+		{"control character", "req\x0042", false},
+		{"non-ASCII", "req-42é", false},
+		{"delete", "req\x7f", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Valid(tt.id); got != tt.want {
+				t.Errorf("Valid(%q) = %t, want %t", tt.id, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContext(t *testing.T) {
+	if id := FromContext(context.Background()); id != "" {
+		t.Errorf("expected no ID in an empty context, got %q", id)
+	}
+
+	ctx := NewContext(context.Background(), "outer")
+	if id := FromContext(ctx); id != "outer" {
+		t.Errorf("expected %q, got %q", "outer", id)
+	}
+
+	// Derived contexts keep the ID, and a new one shadows it
+	derived, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if id := FromContext(derived); id != "outer" {
+		t.Errorf("expected %q in a derived context, got %q", "outer", id)
+	}
+	if id := FromContext(NewContext(derived, "inner")); id != "inner" {
+		t.Errorf("expected %q, got %q", "inner", id)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(NewHandler(slog.NewJSONHandler(&buf, nil)))
+	ctx := NewContext(context.Background(), "abc123")
+
+	tests := []struct {
+		name string
+		log  func()
+		want string // Expected request_id, "" for none
+	}{
+		{"with request context", func() { logger.InfoContext(ctx, "msg") }, "abc123"},
+		{"without context", func() { logger.Info("msg") }, ""},
+		{"with attrs", func() { logger.With("component", "api").InfoContext(ctx, "msg") }, "abc123"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			tt.log()
+			var record map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+				t.Fatalf("decode log record: %v", err)
+			}
+			id, _ := record["request_id"].(string)
+			if id != tt.want {
+				t.Errorf("request_id = %q, want %q", id, tt.want)
+			}
+		})
+	}
+
+	// Derived handlers stay wrapped, so the ID lands inside the group
+	buf.Reset()
+	logger.WithGroup("req").InfoContext(ctx, "msg")
+	var record struct {
+		Req map[string]interface{} `json:"req"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("decode log record: %v", err)
+	}
+	if id := record.Req["request_id"]; id != "abc123" {
+		t.Errorf("expected request_id in the group, got %s", buf.String())
+	}
+}
@@ -0,0 +1,381 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultRetainSnapshots is the number of snapshot generations kept when none is configured
+const DefaultRetainSnapshots = 2
+
+// FileStoreConfig holds configuration for the persistent store
+type FileStoreConfig struct {
+	// Dir holds write-ahead log segments and snapshots
+	Dir string
+
+	// SnapshotInterval is how often a snapshot is taken and old segments are
+	// compacted away. Zero disables periodic snapshots.
+	SnapshotInterval time.Duration
+
+	// UploadRetention is how long upload samples are kept for windowed
+	// queries, as for WithUploadRetention. Zero keeps every sample.
+	UploadRetention time.Duration
+
+	// RetainSnapshots is the number of snapshot generations to keep so that
+	// startup can fall back to an older one if the newest is corrupt
+	RetainSnapshots int
+}
+
+// fileStore implements the Store interface on top of memoryStore, persisting
+// every accepted event to a write-ahead log before it is applied in memory
+type fileStore struct {
+	*memoryStore
+	wal    *wal
+	config FileStoreConfig
+
+	// snapMu is held shared by writers and exclusively while a snapshot
+	// boundary is cut, so the snapshot matches the rotated log exactly
+	snapMu sync.RWMutex
+
+	// registryMu is held shared by event writes from the active check through
+	// the apply, and exclusively by registry changes, so an event is never
+	// logged before a decommission or retirement and applied after it.
+	// It is taken before snapMu.
+	registryMu sync.RWMutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewFileStore creates a store backed by a write-ahead log and snapshots in config.Dir.
+// The newest valid snapshot is loaded and only the log segments after it are
+// replayed. Runtime registrations, decommissions and the devices registry file
+// reloads added or retired are replayed like any other event, so devices
+// missing from deviceIDs keep their history; reconcile the store with the
+// registry file after opening it to retire them.
+func NewFileStore(config FileStoreConfig, deviceIDs []string) (*fileStore, error) {
+	if config.RetainSnapshots < 1 {
+		config.RetainSnapshots = DefaultRetainSnapshots
+	}
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create data directory: %w", err)
+	}
+
+	mem := NewMemoryStore(deviceIDs, WithUploadRetention(config.UploadRetention))
+	start, err := loadLatestSnapshot(config.Dir, mem, deviceIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := replayWAL(config.Dir, start, mem.applyRecord); err != nil {
+		return nil, fmt.Errorf("replay write-ahead log: %w", err)
+	}
+
+	w, err := openWAL(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &fileStore{
+		memoryStore: mem,
+		wal:         w,
+		config:      config,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go f.snapshotLoop()
+	return f, nil
+}
+
+// AddHeartbeat logs and records a heartbeat for a device at the given timestamp
+func (f *fileStore) AddHeartbeat(ctx context.Context, deviceID string, sentAt time.Time) error {
+	f.registryMu.RLock()
+	defer f.registryMu.RUnlock()
+
+	if err := f.checkActive(deviceID); err != nil {
+		return err
+	}
+
+	f.snapMu.RLock()
+	defer f.snapMu.RUnlock()
+
+	rec := walRecord{kind: recordHeartbeat, deviceID: deviceID, sentAt: sentAt}
+	if err := f.wal.append(rec); err != nil {
+		return fmt.Errorf("append heartbeat: %w", err)
+	}
+
+	return f.memoryStore.AddHeartbeat(ctx, deviceID, sentAt)
+}
+
+// AddUpload logs and records an upload time measurement for a device
+func (f *fileStore) AddUpload(ctx context.Context, deviceID string, sentAt time.Time, uploadTime int) error {
+	f.registryMu.RLock()
+	defer f.registryMu.RUnlock()
+
+	if err := f.checkActive(deviceID); err != nil {
+		return err
+	}
+
+	f.snapMu.RLock()
+	defer f.snapMu.RUnlock()
+
+	rec := walRecord{kind: recordUpload, deviceID: deviceID, sentAt: sentAt, value: int64(uploadTime)}
+	if err := f.wal.append(rec); err != nil {
+		return fmt.Errorf("append upload: %w", err)
+	}
+
+	return f.memoryStore.AddUpload(ctx, deviceID, sentAt, uploadTime)
+}
+
+// AddEvents logs a batch of heartbeats and uploads with a single append and
+// fsync, then records them. Events for unknown or retired devices are
+// rejected before anything is logged.
+func (f *fileStore) AddEvents(ctx context.Context, events []Event) ([]error, error) {
+	results := make([]error, len(events))
+	checked := make(map[string]error)
+	records := make([]walRecord, 0, len(events))
+	accepted := make([]Event, 0, len(events))
+	positions := make([]int, 0, len(events))
+
+	f.registryMu.RLock()
+	defer f.registryMu.RUnlock()
+
+	for i, event := range events {
+		err, ok := checked[event.DeviceID]
+		if !ok {
+			err = f.checkActive(event.DeviceID)
+			checked[event.DeviceID] = err
+		}
+
+		rec := walRecord{deviceID: event.DeviceID, sentAt: event.SentAt}
+		switch {
+		case err != nil:
+		case event.Kind == EventHeartbeat:
+			rec.kind = recordHeartbeat
+		case event.Kind == EventUpload:
+			rec.kind = recordUpload
+			rec.value = int64(event.UploadTime)
+		default:
+			err = fmt.Errorf("%w: unknown event kind %d", ErrInvalidInput, event.Kind)
+		}
+		if err != nil {
+			results[i] = err
+			continue
+		}
+
+		records = append(records, rec)
+		accepted = append(accepted, event)
+		positions = append(positions, i)
+	}
+	if len(records) == 0 {
+		return results, nil
+	}
+
+	f.snapMu.RLock()
+	defer f.snapMu.RUnlock()
+
+	if err := f.wal.append(records...); err != nil {
+		return nil, fmt.Errorf("append events: %w", err)
+	}
+
+	applied, err := f.memoryStore.AddEvents(ctx, accepted)
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range positions {
+		results[i] = applied[j]
+	}
+	return results, nil
+}
+
+// RegisterDevices logs and applies runtime device registrations
+func (f *fileStore) RegisterDevices(ctx context.Context, deviceIDs []string) ([]string, error) {
+	if err := validateDeviceIDs(deviceIDs); err != nil {
+		return nil, err
+	}
+
+	f.registryMu.Lock()
+	defer f.registryMu.Unlock()
+	f.snapMu.RLock()
+	defer f.snapMu.RUnlock()
+
+	// Registration is idempotent, so every ID is logged in one append
+	now := time.Now()
+	records := make([]walRecord, len(deviceIDs))
+	for i, id := range deviceIDs {
+		records[i] = walRecord{kind: recordRegister, deviceID: id, sentAt: now}
+	}
+	if err := f.wal.append(records...); err != nil {
+		return nil, fmt.Errorf("append registration: %w", err)
+	}
+
+	return f.memoryStore.RegisterDevices(ctx, deviceIDs)
+}
+
+// ReconcileDevices logs the devices a registry file reconciliation adds,
+// reactivates and retires, then applies it
+func (f *fileStore) ReconcileDevices(ctx context.Context, devices []DeviceInfo) (added, retired []string, err error) {
+	f.registryMu.Lock()
+	defer f.registryMu.Unlock()
+	f.snapMu.RLock()
+	defer f.snapMu.RUnlock()
+
+	return f.memoryStore.reconcile(devices, func(added, retired []string) error {
+		now := time.Now()
+		records := make([]walRecord, 0, len(added)+len(retired))
+		for _, id := range added {
+			records = append(records, walRecord{kind: recordList, deviceID: id, sentAt: now})
+		}
+		for _, id := range retired {
+			records = append(records, walRecord{kind: recordRetire, deviceID: id, sentAt: now})
+		}
+		if err := f.wal.append(records...); err != nil {
+			return fmt.Errorf("append reconciliation: %w", err)
+		}
+		return nil
+	})
+}
+
+// DecommissionDevice logs and applies a device decommission
+func (f *fileStore) DecommissionDevice(ctx context.Context, deviceID string, purge bool) error {
+	f.registryMu.Lock()
+	defer f.registryMu.Unlock()
+
+	if err := f.checkActive(deviceID); errors.Is(err, ErrDeviceNotFound) {
+		return err
+	}
+
+	f.snapMu.RLock()
+	defer f.snapMu.RUnlock()
+
+	rec := walRecord{kind: recordDecommission, deviceID: deviceID, sentAt: time.Now()}
+	if purge {
+		rec.value = purgeHistory
+	}
+	if err := f.wal.append(rec); err != nil {
+		return fmt.Errorf("append decommission: %w", err)
+	}
+
+	return f.memoryStore.DecommissionDevice(ctx, deviceID, purge)
+}
+
+// Snapshot writes the current aggregates to a new snapshot, then removes
+// snapshots beyond the retained generations and the log segments they covered
+func (f *fileStore) Snapshot() error {
+	// Cut the log and capture state while no writer is between append and apply
+	f.snapMu.Lock()
+	seq, err := f.wal.rotate()
+	if err != nil {
+		f.snapMu.Unlock()
+		return fmt.Errorf("rotate write-ahead log: %w", err)
+	}
+	state := f.memoryStore.exportState()
+	f.snapMu.Unlock()
+
+	if err := writeSnapshot(f.config.Dir, seq, state); err != nil {
+		return err
+	}
+	return f.compact()
+}
+
+// compact deletes snapshots older than the retained generations and every
+// segment that the oldest retained snapshot already covers
+func (f *fileStore) compact() error {
+	seqs, err := listSnapshots(f.config.Dir)
+	if err != nil {
+		return err
+	}
+	if len(seqs) > f.config.RetainSnapshots {
+		for _, seq := range seqs[:len(seqs)-f.config.RetainSnapshots] {
+			if err := os.Remove(snapshotPath(f.config.Dir, seq)); err != nil {
+				return fmt.Errorf("remove snapshot: %w", err)
+			}
+		}
+		seqs = seqs[len(seqs)-f.config.RetainSnapshots:]
+	}
+	if len(seqs) == 0 {
+		return nil
+	}
+	return f.wal.removeSegmentsBefore(seqs[0])
+}
+
+// snapshotLoop takes periodic snapshots until the store is closed
+func (f *fileStore) snapshotLoop() {
+	defer close(f.done)
+	if f.config.SnapshotInterval <= 0 {
+		<-f.stop
+		return
+	}
+
+	ticker := time.NewTicker(f.config.SnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// A failed snapshot leaves the log intact; the next tick retries
+			_ = f.Snapshot()
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// Close stops periodic snapshots, takes a final one when they are enabled,
+// and closes the write-ahead log
+func (f *fileStore) Close() error {
+	select {
+	case <-f.stop:
+		return nil // Already closed
+	default:
+	}
+	close(f.stop)
+	<-f.done
+
+	var err error
+	if f.config.SnapshotInterval > 0 {
+		err = f.Snapshot()
+	}
+	if cerr := f.wal.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// loadLatestSnapshot restores mem from the newest valid snapshot in dir,
+// falling back to older generations when one fails validation. It returns
+// the first segment sequence number that still has to be replayed.
+func loadLatestSnapshot(dir string, mem *memoryStore, deviceIDs []string) (uint64, error) {
+	snaps, err := listSnapshots(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := len(snaps) - 1; i >= 0; i-- {
+		state, err := readSnapshot(snapshotPath(dir, snaps[i]))
+		if errors.Is(err, errCorruptSnapshot) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if err := mem.restoreState(state); err != nil {
+			// Discard the partial restore before trying an older generation
+			mem.reset(deviceIDs)
+			continue
+		}
+		return snaps[i], nil
+	}
+
+	// Without a snapshot the log must still be complete from the first segment
+	segs, err := listSegments(dir)
+	if err != nil {
+		return 0, err
+	}
+	if len(snaps) > 0 && len(segs) > 0 && segs[0] > 1 {
+		return 0, fmt.Errorf("%w: no valid snapshot and log segments before %d were compacted", errCorruptSnapshot, segs[0])
+	}
+	return 0, nil
+}
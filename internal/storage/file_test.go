@@ -0,0 +1,590 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileStore_ReplayRebuildsAggregates(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := NewFileStore(FileStoreConfig{Dir: dir}, []string{"device1"})
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	for _, sec := range []int64{60, 90, 180, 300} {
+		if err := store.AddHeartbeat(ctx, "device1", time.Unix(sec, 0)); err != nil {
+			t.Fatalf("AddHeartbeat failed: %v", err)
+		}
+	}
+	if err := store.AddUpload(ctx, "device1", time.Time{}, 1000); err != nil {
+		t.Fatalf("AddUpload failed: %v", err)
+	}
+	if err := store.AddUpload(ctx, "device1", time.Unix(120, 0), 3000); err != nil {
+		t.Fatalf("AddUpload failed: %v", err)
+	}
+	wantUptime, wantAvg, _ := store.GetStats(ctx, "device1")
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	reopened, err := NewFileStore(FileStoreConfig{Dir: dir}, []string{"device1"})
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer reopened.Close()
+
+	uptime, avg, err := reopened.GetStats(ctx, "device1")
+	if err != nil {
+		t.Fatalf("GetStats failed: %v", err)
+	}
+	if uptime != wantUptime || avg != wantAvg {
+		t.Errorf("after replay got uptime=%v avg=%v, want uptime=%v avg=%v", uptime, avg, wantUptime, wantAvg)
+	}
+}
+
+func TestFileStore_UnknownDeviceNotLogged(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(FileStoreConfig{Dir: dir}, []string{"device1"})
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	defer store.Close()
+
+	err = store.AddHeartbeat(context.Background(), "unknown", time.Unix(60, 0))
+	if err != ErrDeviceNotFound {
+		t.Fatalf("expected ErrDeviceNotFound, got %v", err)
+	}
+
+	info, err := os.Stat(segmentPath(dir, 1))
+	if err != nil {
+		t.Fatalf("stat segment: %v", err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("expected empty segment, got %d bytes", info.Size())
+	}
+}
+
+func TestFileStore_TruncatesTornTail(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := NewFileStore(FileStoreConfig{Dir: dir}, []string{"device1"})
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	if err := store.AddHeartbeat(ctx, "device1", time.Unix(60, 0)); err != nil {
+		t.Fatalf("AddHeartbeat failed: %v", err)
+	}
+	if err := store.AddHeartbeat(ctx, "device1", time.Unix(120, 0)); err != nil {
+		t.Fatalf("AddHeartbeat failed: %v", err)
+	}
+	store.Close()
+
+	// Simulate a crash halfway through writing the second record
+	path := segmentPath(dir, 1)
+	info, _ := os.Stat(path)
+	intact := info.Size() / 2
+	if err := os.Truncate(path, info.Size()-5); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+
+	reopened, err := NewFileStore(FileStoreConfig{Dir: dir}, []string{"device1"})
+	if err != nil {
+		t.Fatalf("reopen with torn tail failed: %v", err)
+	}
+
+	info, _ = os.Stat(path)
+	if info.Size() != intact {
+		t.Errorf("expected segment truncated to %d bytes, got %d", intact, info.Size())
+	}
+
+	// Appends continue cleanly after the truncated record
+	if err := reopened.AddHeartbeat(ctx, "device1", time.Unix(240, 0)); err != nil {
+		t.Fatalf("AddHeartbeat after recovery failed: %v", err)
+	}
+	reopened.Close()
+
+	final, err := NewFileStore(FileStoreConfig{Dir: dir}, []string{"device1"})
+	if err != nil {
+		t.Fatalf("final reopen failed: %v", err)
+	}
+	defer final.Close()
+
+	device := final.devices["device1"]
+	device.mu.RLock()
+	defer device.mu.RUnlock()
+	if device.minutes.Len() != 2 {
+		t.Errorf("expected 2 minutes, got %d", device.minutes.Len())
+	}
+	if device.firstMinute != 1 || device.lastMinute != 4 {
+		t.Errorf("expected minutes 1..4, got %d..%d", device.firstMinute, device.lastMinute)
+	}
+}
+
+// tornWriter writes half of the first buffer it is given, then fails
+type tornWriter struct {
+	segmentFile
+	torn bool
+}
+
+func (w *tornWriter) Write(p []byte) (int, error) {
+	if w.torn {
+		return w.segmentFile.Write(p)
+	}
+	w.torn = true
+	n, _ := w.segmentFile.Write(p[:len(p)/2])
+	return n, errors.New("no space left on device")
+}
+
+func TestFileStore_FailedAppendDiscardsTornFrame(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := NewFileStore(FileStoreConfig{Dir: dir}, []string{"device1"})
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	if err := store.AddHeartbeat(ctx, "device1", time.Unix(60, 0)); err != nil {
+		t.Fatalf("AddHeartbeat failed: %v", err)
+	}
+	store.wal.file = &tornWriter{segmentFile: store.wal.file}
+	if err := store.AddHeartbeat(ctx, "device1", time.Unix(120, 0)); err == nil {
+		t.Fatal("expected the torn append to fail")
+	}
+
+	// Later appends follow the last intact record rather than the torn one
+	if err := store.AddHeartbeat(ctx, "device1", time.Unix(240, 0)); err != nil {
+		t.Fatalf("AddHeartbeat after failed append failed: %v", err)
+	}
+	store.Close()
+
+	reopened, err := NewFileStore(FileStoreConfig{Dir: dir}, []string{"device1"})
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer reopened.Close()
+
+	device := reopened.devices["device1"]
+	device.mu.RLock()
+	defer device.mu.RUnlock()
+	if device.minutes.Len() != 2 || !device.minutes.Contains(1) || !device.minutes.Contains(4) {
+		t.Errorf("expected minutes 1 and 4 replayed, got %d minutes", device.minutes.Len())
+	}
+}
+
+func TestFileStore_CorruptChecksumTreatedAsTorn(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := NewFileStore(FileStoreConfig{Dir: dir}, []string{"device1"})
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	store.AddHeartbeat(ctx, "device1", time.Unix(60, 0))
+	store.Close()
+
+	path := segmentPath(dir, 1)
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(path, data, 0o644)
+
+	reopened, err := NewFileStore(FileStoreConfig{Dir: dir}, []string{"device1"})
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer reopened.Close()
+
+	uptime, _, _ := reopened.GetStats(ctx, "device1")
+	if uptime != 0 {
+		t.Errorf("expected corrupt record to be discarded, got uptime %v", uptime)
+	}
+}
+
+func TestFileStore_SnapshotCompactsLog(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	config := FileStoreConfig{Dir: dir, RetainSnapshots: 2}
+
+	store, err := NewFileStore(config, []string{"device1"})
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	for i := int64(1); i <= 3; i++ {
+		if err := store.AddHeartbeat(ctx, "device1", time.Unix(i*60, 0)); err != nil {
+			t.Fatalf("AddHeartbeat failed: %v", err)
+		}
+		if err := store.AddUpload(ctx, "device1", time.Unix(i*60, 0), int(i*1000)); err != nil {
+			t.Fatalf("AddUpload failed: %v", err)
+		}
+		if err := store.Snapshot(); err != nil {
+			t.Fatalf("Snapshot failed: %v", err)
+		}
+	}
+	// Tail written after the last snapshot
+	store.AddHeartbeat(ctx, "device1", time.Unix(600, 0))
+	wantUptime, wantAvg, _ := store.GetStats(ctx, "device1")
+	store.Close()
+
+	snaps, _ := listSnapshots(dir)
+	if len(snaps) != 2 {
+		t.Fatalf("expected 2 retained snapshots, got %v", snaps)
+	}
+	segs, _ := listSegments(dir)
+	if segs[0] != snaps[0] {
+		t.Errorf("expected segments before %d to be compacted, oldest is %d", snaps[0], segs[0])
+	}
+
+	reopened, err := NewFileStore(config, []string{"device1"})
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer reopened.Close()
+
+	uptime, avg, _ := reopened.GetStats(ctx, "device1")
+	if uptime != wantUptime || avg != wantAvg {
+		t.Errorf("after restore got uptime=%v avg=%v, want uptime=%v avg=%v", uptime, avg, wantUptime, wantAvg)
+	}
+}
+
+func TestFileStore_CorruptSnapshotFallsBack(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	config := FileStoreConfig{Dir: dir, RetainSnapshots: 2}
+
+	store, err := NewFileStore(config, []string{"device1"})
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	store.AddHeartbeat(ctx, "device1", time.Unix(60, 0))
+	store.Snapshot()
+	store.AddHeartbeat(ctx, "device1", time.Unix(240, 0))
+	store.AddUpload(ctx, "device1", time.Unix(240, 0), 500)
+	store.Snapshot()
+	wantUptime, wantAvg, _ := store.GetStats(ctx, "device1")
+	store.Close()
+
+	// Damage the newest snapshot's body
+	snaps, _ := listSnapshots(dir)
+	path := snapshotPath(dir, snaps[len(snaps)-1])
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(path, data, 0o644)
+
+	reopened, err := NewFileStore(config, []string{"device1"})
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer reopened.Close()
+
+	uptime, avg, _ := reopened.GetStats(ctx, "device1")
+	if uptime != wantUptime || avg != wantAvg {
+		t.Errorf("after fallback got uptime=%v avg=%v, want uptime=%v avg=%v", uptime, avg, wantUptime, wantAvg)
+	}
+}
+
+func TestFileStore_UnknownSnapshotVersionRejected(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(FileStoreConfig{Dir: dir}, []string{"device1"})
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	store.AddHeartbeat(context.Background(), "device1", time.Unix(60, 0))
+	if err := store.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	store.Close()
+
+	// The version sits outside the checksummed body
+	snaps, _ := listSnapshots(dir)
+	path := snapshotPath(dir, snaps[len(snaps)-1])
+	data, _ := os.ReadFile(path)
+	data[8] = snapshotVersion + 1
+	os.WriteFile(path, data, 0o644)
+
+	if _, err := readSnapshot(path); !errors.Is(err, errCorruptSnapshot) {
+		t.Errorf("expected errCorruptSnapshot, got %v", err)
+	}
+}
+
+func TestFileStore_RegistryChangesSurviveRestart(t *testing.T) {
+	ctx := context.Background()
+	initial := []string{"device1", "device2"}
+
+	// Replay from the log alone, then from a snapshot
+	for _, snapshot := range []bool{false, true} {
+		dir := t.TempDir()
+		store, err := NewFileStore(FileStoreConfig{Dir: dir}, initial)
+		if err != nil {
+			t.Fatalf("NewFileStore failed: %v", err)
+		}
+		if _, err := store.RegisterDevices(ctx, []string{"device3"}); err != nil {
+			t.Fatalf("RegisterDevices failed: %v", err)
+		}
+		store.AddHeartbeat(ctx, "device3", time.Unix(60, 0))
+		store.AddHeartbeat(ctx, "device1", time.Unix(60, 0))
+		store.AddHeartbeat(ctx, "device2", time.Unix(60, 0))
+		if err := store.DecommissionDevice(ctx, "device1", false); err != nil {
+			t.Fatalf("DecommissionDevice failed: %v", err)
+		}
+		if err := store.DecommissionDevice(ctx, "device2", true); err != nil {
+			t.Fatalf("DecommissionDevice purge failed: %v", err)
+		}
+		if snapshot {
+			if err := store.Snapshot(); err != nil {
+				t.Fatalf("Snapshot failed: %v", err)
+			}
+		}
+		store.Close()
+
+		reopened, err := NewFileStore(FileStoreConfig{Dir: dir}, initial)
+		if err != nil {
+			t.Fatalf("reopen failed: %v", err)
+		}
+
+		if uptime, _, err := reopened.GetStats(ctx, "device3"); err != nil || uptime != 100 {
+			t.Errorf("snapshot=%t: device3 got uptime=%v err=%v, want 100", snapshot, uptime, err)
+		}
+		if err := reopened.AddHeartbeat(ctx, "device1", time.Unix(120, 0)); err != ErrDeviceDecommissioned {
+			t.Errorf("snapshot=%t: expected device1 decommissioned, got %v", snapshot, err)
+		}
+		if uptime, _, _ := reopened.GetStats(ctx, "device1"); uptime != 100 {
+			t.Errorf("snapshot=%t: expected device1 history retained, got uptime=%v", snapshot, uptime)
+		}
+		if summary := reopened.devices["device2"].summary("device2"); !summary.NeverSeen() || !summary.Decommissioned {
+			t.Errorf("snapshot=%t: expected device2 purged and decommissioned, got %+v", snapshot, summary)
+		}
+		reopened.Close()
+	}
+}
+
+func TestFileStore_RegistryReloadSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	initial := []DeviceInfo{{ID: "device1"}, {ID: "device2"}}
+	reloaded := []DeviceInfo{{ID: "device1"}, {ID: "device3"}}
+
+	// Replay from the log alone, then from a snapshot
+	for _, snapshot := range []bool{false, true} {
+		dir := t.TempDir()
+		store, err := NewFileStore(FileStoreConfig{Dir: dir}, []string{"device1", "device2"})
+		if err != nil {
+			t.Fatalf("NewFileStore failed: %v", err)
+		}
+		store.AddHeartbeat(ctx, "device2", time.Unix(60, 0))
+		if _, _, err := store.ReconcileDevices(ctx, reloaded); err != nil {
+			t.Fatalf("ReconcileDevices failed: %v", err)
+		}
+		store.AddHeartbeat(ctx, "device3", time.Unix(60, 0))
+		if snapshot {
+			if err := store.Snapshot(); err != nil {
+				t.Fatalf("Snapshot failed: %v", err)
+			}
+		}
+		store.Close()
+
+		// Restart with the original file, which lists device2 but not device3
+		reopened, err := NewFileStore(FileStoreConfig{Dir: dir}, []string{"device1", "device2"})
+		if err != nil {
+			t.Fatalf("reopen failed: %v", err)
+		}
+		if err := reopened.AddHeartbeat(ctx, "device2", time.Unix(120, 0)); err != ErrDeviceDecommissioned {
+			t.Errorf("snapshot=%t: expected device2 retired, got %v", snapshot, err)
+		}
+		if uptime, _, err := reopened.GetStats(ctx, "device2"); err != nil || uptime != 100 {
+			t.Errorf("snapshot=%t: device2 got uptime=%v err=%v, want 100", snapshot, uptime, err)
+		}
+		if uptime, _, err := reopened.GetStats(ctx, "device3"); err != nil || uptime != 100 {
+			t.Errorf("snapshot=%t: device3 got uptime=%v err=%v, want 100", snapshot, uptime, err)
+		}
+
+		// Reconciling with the file reinstates device2 and retires device3, keeping its history
+		added, retired, err := reopened.ReconcileDevices(ctx, initial)
+		if err != nil {
+			t.Fatalf("ReconcileDevices failed: %v", err)
+		}
+		if len(added) != 1 || added[0] != "device2" || len(retired) != 1 || retired[0] != "device3" {
+			t.Errorf("snapshot=%t: got added=%v retired=%v, want [device2] and [device3]", snapshot, added, retired)
+		}
+		if uptime, _, err := reopened.GetStats(ctx, "device3"); err != nil || uptime != 100 {
+			t.Errorf("snapshot=%t: retired device3 got uptime=%v err=%v, want 100", snapshot, uptime, err)
+		}
+		if usage, _ := reopened.Usage(ctx); usage.Devices != 3 || usage.ActiveDevices != 2 {
+			t.Errorf("snapshot=%t: got %d devices, %d active; want 3 and 2", snapshot, usage.Devices, usage.ActiveDevices)
+		}
+		reopened.Close()
+	}
+}
+
+func TestFileStore_FailedReconcileKeepsRegistry(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewFileStore(FileStoreConfig{Dir: t.TempDir()}, []string{"device1", "device2"})
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	defer store.Close()
+
+	reloaded := []DeviceInfo{{ID: "device1"}, {ID: "device3"}}
+	store.wal.file = &tornWriter{segmentFile: store.wal.file}
+	if added, retired, err := store.ReconcileDevices(ctx, reloaded); err == nil || added != nil || retired != nil {
+		t.Fatalf("expected the reconciliation to fail without changes, got added=%v retired=%v err=%v", added, retired, err)
+	}
+	if err := store.AddHeartbeat(ctx, "device2", time.Unix(60, 0)); err != nil {
+		t.Errorf("expected device2 still active, got %v", err)
+	}
+	if err := store.AddHeartbeat(ctx, "device3", time.Unix(60, 0)); err != ErrDeviceNotFound {
+		t.Errorf("expected device3 not added, got %v", err)
+	}
+
+	// The next attempt logs and applies the whole change
+	added, retired, err := store.ReconcileDevices(ctx, reloaded)
+	if err != nil || len(added) != 1 || added[0] != "device3" || len(retired) != 1 || retired[0] != "device2" {
+		t.Errorf("got added=%v retired=%v err=%v, want [device3] and [device2]", added, retired, err)
+	}
+}
+
+func TestFileStore_ConcurrentDecommissionReplaysLiveState(t *testing.T) {
+	ctx := context.Background()
+
+	for run := 0; run < 20; run++ {
+		dir := t.TempDir()
+		store, err := NewFileStore(FileStoreConfig{Dir: dir}, []string{"device1"})
+		if err != nil {
+			t.Fatalf("NewFileStore failed: %v", err)
+		}
+
+		// Heartbeats, uploads and batches race a decommission; whatever the
+		// live store accepted must be exactly what replay restores
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					sentAt := time.Unix(int64(w*1000+i)*60, 0)
+					switch i % 3 {
+					case 0:
+						store.AddHeartbeat(ctx, "device1", sentAt)
+					case 1:
+						store.AddUpload(ctx, "device1", sentAt, i)
+					default:
+						store.AddEvents(ctx, []Event{{DeviceID: "device1", Kind: EventHeartbeat, SentAt: sentAt}})
+					}
+				}
+			}(w)
+		}
+		time.Sleep(time.Duration(run) * 50 * time.Microsecond)
+		if err := store.DecommissionDevice(ctx, "device1", false); err != nil {
+			t.Fatalf("DecommissionDevice failed: %v", err)
+		}
+		wg.Wait()
+
+		live := store.devices["device1"].summary("device1")
+		store.Close()
+
+		reopened, err := NewFileStore(FileStoreConfig{Dir: dir}, []string{"device1"})
+		if err != nil {
+			t.Fatalf("reopen failed: %v", err)
+		}
+		restored := reopened.devices["device1"].summary("device1")
+		reopened.Close()
+		if restored.Uptime != live.Uptime || restored.UploadCount != live.UploadCount || !restored.LastSeen.Equal(live.LastSeen) {
+			t.Fatalf("run %d: replay restored %+v, live store had %+v", run, restored, live)
+		}
+	}
+}
+
+func TestFileStore_AddEventsReplay(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	ids := []string{"device1", "device2"}
+
+	store, err := NewFileStore(FileStoreConfig{Dir: dir}, ids)
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	results, err := store.AddEvents(ctx, []Event{
+		{DeviceID: "device1", Kind: EventHeartbeat, SentAt: time.Unix(60, 0)},
+		{DeviceID: "unknown", Kind: EventHeartbeat, SentAt: time.Unix(60, 0)},
+		{DeviceID: "device2", Kind: EventUpload, SentAt: time.Unix(60, 0), UploadTime: 500},
+		{DeviceID: "device1", Kind: EventHeartbeat, SentAt: time.Unix(120, 0)},
+	})
+	if err != nil {
+		t.Fatalf("AddEvents failed: %v", err)
+	}
+	if results[0] != nil || results[1] != ErrDeviceNotFound || results[2] != nil || results[3] != nil {
+		t.Errorf("unexpected results %v", results)
+	}
+	store.Close()
+
+	reopened, err := NewFileStore(FileStoreConfig{Dir: dir}, ids)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer reopened.Close()
+
+	if uptime, _, _ := reopened.GetStats(ctx, "device1"); uptime != 200 {
+		t.Errorf("device1 uptime after replay = %v, want 200", uptime)
+	}
+	if _, avg, _ := reopened.GetStats(ctx, "device2"); avg != 500 {
+		t.Errorf("device2 avg upload after replay = %v, want 500", avg)
+	}
+}
+
+func TestFileStore_UploadRetention(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	config := FileStoreConfig{Dir: dir, UploadRetention: 24 * time.Hour}
+
+	store, err := NewFileStore(config, []string{"device1"})
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	now := time.Now()
+	for _, upload := range []struct {
+		age   time.Duration
+		value int
+	}{{72 * time.Hour, 1000}, {2 * time.Hour, 3000}, {time.Hour, 5000}} {
+		if err := store.AddUpload(ctx, "device1", now.Add(-upload.age), upload.value); err != nil {
+			t.Fatalf("AddUpload failed: %v", err)
+		}
+	}
+	if err := store.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	store.Close()
+
+	// Only retained samples are snapshotted, alongside the lifetime sketch
+	snaps, _ := listSnapshots(dir)
+	state, err := readSnapshot(snapshotPath(dir, snaps[len(snaps)-1]))
+	if err != nil {
+		t.Fatalf("readSnapshot failed: %v", err)
+	}
+	if n := len(state.Devices[0].Uploads); n != 2 {
+		t.Errorf("expected 2 snapshotted samples, got %d", n)
+	}
+
+	reopened, err := NewFileStore(config, []string{"device1"})
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer reopened.Close()
+
+	// Windowed queries see the retained samples, lifetime ones every upload
+	if _, avg, _ := reopened.GetStatsWindow(ctx, "device1", now.Add(-30*24*time.Hour), time.Time{}); avg != 4000 {
+		t.Errorf("windowed avg = %v, want 4000", avg)
+	}
+	if _, avg, _ := reopened.GetStats(ctx, "device1"); avg != 3000 {
+		t.Errorf("lifetime avg = %v, want 3000", avg)
+	}
+	if dist, _ := reopened.GetUploadDistribution(ctx, "device1", time.Time{}, time.Time{}); dist.Count != 3 || dist.Min != 1000 {
+		t.Errorf("lifetime distribution = %+v, want 3 uploads from 1000", dist)
+	}
+	if usage, _ := reopened.Usage(ctx); usage.UploadSamples != 2 {
+		t.Errorf("expected 2 samples held, got %d", usage.UploadSamples)
+	}
+}
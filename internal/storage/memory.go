@@ -3,48 +3,120 @@ package storage
 import (
 	"context"
 	"device-fleet-monitoring/internal/core"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+	"unsafe"
 )
 
+// DefaultUploadRetention is how long upload samples are kept for windowed
+// queries when a retention is configured through the server flags
+const DefaultUploadRetention = 30 * 24 * time.Hour
+
 // DeviceAgg holds aggregate data for a single device
 type DeviceAgg struct {
 	mu sync.RWMutex
 
 	// Heartbeat tracking
-	firstMinute int64              // Unix minute of first heartbeat
-	lastMinute  int64              // Unix minute of last heartbeat
-	minutes     map[int64]struct{} // Set of minutes with ≥1 heartbeat
+	firstMinute int64           // Unix minute of first heartbeat
+	lastMinute  int64           // Unix minute of last heartbeat
+	minutes     *core.MinuteSet // Set of minutes with ≥1 heartbeat
+	lastSeen    time.Time       // Latest heartbeat sent_at
 
 	// Upload tracking (incremental average)
 	uploadCount int64
 	uploadSum   float64
+
+	// Upload samples indexed by sent_at for windowed queries, back to the
+	// store's upload retention
+	uploads uploadSeries
+
+	// Upload time distribution over the device's lifetime
+	uploadSketch *core.QuantileSketch
+
+	// Registry state
+	registered     bool // Added at runtime rather than from the initial device list
+	decommissioned bool // Retired through the API
+	retired        bool // Removed from the registry file by ReconcileDevices
+	metadata       DeviceMetadata
+}
+
+// active reports whether the device accepts new events; the caller must hold device.mu
+func (device *DeviceAgg) active() bool {
+	return !device.decommissioned && !device.retired
+}
+
+// newDeviceAgg creates an empty aggregate
+func newDeviceAgg() *DeviceAgg {
+	return &DeviceAgg{
+		minutes:      core.NewMinuteSet(),
+		uploadSketch: core.NewQuantileSketch(),
+	}
+}
+
+// clear discards every aggregate; the caller must hold device.mu
+func (device *DeviceAgg) clear() {
+	device.firstMinute = 0
+	device.lastMinute = 0
+	device.lastSeen = time.Time{}
+	device.minutes = core.NewMinuteSet()
+	device.uploadCount = 0
+	device.uploadSum = 0
+	device.uploads = uploadSeries{}
+	device.uploadSketch = core.NewQuantileSketch()
 }
 
 // memoryStore implements the Store interface with in-memory storage
 type memoryStore struct {
-	mu      sync.RWMutex
-	devices map[string]*DeviceAgg
+	mu              sync.RWMutex
+	devices         map[string]*DeviceAgg
+	uploadRetention time.Duration    // Zero keeps every upload sample
+	now             func() time.Time // Ends open windows; time.Now outside tests
+}
+
+// MemoryOption configures a memory store
+type MemoryOption func(*memoryStore)
+
+// WithUploadRetention keeps upload samples for windowed queries only while
+// their sent_at is within d of the current time. Lifetime averages and
+// distributions still count every upload. Zero, the default, keeps every
+// sample.
+func WithUploadRetention(d time.Duration) MemoryOption {
+	return func(m *memoryStore) {
+		m.uploadRetention = d
+	}
 }
 
 // NewMemoryStore creates a new in-memory store initialized with the given device IDs
-func NewMemoryStore(deviceIDs []string) *memoryStore {
+func NewMemoryStore(deviceIDs []string, options ...MemoryOption) *memoryStore {
 	devices := make(map[string]*DeviceAgg, len(deviceIDs))
 	for _, id := range deviceIDs {
-		devices[id] = &DeviceAgg{
-			minutes: make(map[int64]struct{}),
-		}
+		devices[id] = newDeviceAgg()
 	}
-	return &memoryStore{
+	m := &memoryStore{
 		devices: devices,
+		now:     time.Now,
 	}
+	for _, option := range options {
+		option(m)
+	}
+	return m
+}
+
+// uploadCutoff returns the sent_at before which upload samples are dropped,
+// or the zero time when they are all kept
+func (m *memoryStore) uploadCutoff() time.Time {
+	if m.uploadRetention <= 0 {
+		return time.Time{}
+	}
+	return m.now().Add(-m.uploadRetention)
 }
 
 // AddHeartbeat records a heartbeat for a device at the given timestamp
 func (m *memoryStore) AddHeartbeat(ctx context.Context, deviceID string, sentAt time.Time) error {
-	// Convert sentAt to minute bucket
-	minute := sentAt.Unix() / 60
-
 	// Acquire device with read lock on map
 	m.mu.RLock()
 	device, exists := m.devices[deviceID]
@@ -58,8 +130,21 @@ func (m *memoryStore) AddHeartbeat(ctx context.Context, deviceID string, sentAt
 	device.mu.Lock()
 	defer device.mu.Unlock()
 
+	if !device.active() {
+		return ErrDeviceDecommissioned
+	}
+
+	device.addHeartbeat(sentAt)
+	return nil
+}
+
+// addHeartbeat updates heartbeat aggregates; the caller must hold device.mu
+func (device *DeviceAgg) addHeartbeat(sentAt time.Time) {
+	// Convert sentAt to minute bucket
+	minute := sentAt.Unix() / 60
+
 	// Update firstMinute and lastMinute
-	if len(device.minutes) == 0 {
+	if device.minutes.Len() == 0 {
 		device.firstMinute = minute
 		device.lastMinute = minute
 	} else {
@@ -72,9 +157,10 @@ func (m *memoryStore) AddHeartbeat(ctx context.Context, deviceID string, sentAt
 	}
 
 	// Add minute to set (idempotent)
-	device.minutes[minute] = struct{}{}
-
-	return nil
+	device.minutes.Add(minute)
+	if sentAt.After(device.lastSeen) {
+		device.lastSeen = sentAt
+	}
 }
 
 // AddUpload records an upload time measurement for a device
@@ -92,11 +178,89 @@ func (m *memoryStore) AddUpload(ctx context.Context, deviceID string, sentAt tim
 	device.mu.Lock()
 	defer device.mu.Unlock()
 
+	if !device.active() {
+		return ErrDeviceDecommissioned
+	}
+
+	device.addUpload(sentAt, uploadTime, m.uploadCutoff())
+	return nil
+}
+
+// addUpload updates upload aggregates, retaining the sample for windowed
+// queries unless it was sent before cutoff. An upload without a sent_at only
+// counts towards the lifetime totals, since no window can place it. The
+// caller must hold device.mu.
+func (device *DeviceAgg) addUpload(sentAt time.Time, uploadTime int, cutoff time.Time) {
 	// Update incremental average
 	device.uploadCount++
 	device.uploadSum += float64(uploadTime)
+	device.uploadSketch.Add(float64(uploadTime))
 
-	return nil
+	if !sentAt.IsZero() && (cutoff.IsZero() || !sentAt.Before(cutoff)) {
+		device.uploads.add(sentAt, int64(uploadTime))
+	}
+	device.uploads.prune(cutoff)
+}
+
+// AddEvents records a batch of heartbeats and uploads, taking each device's
+// lock once for all of its events. Events for one device are applied in
+// batch order.
+func (m *memoryStore) AddEvents(ctx context.Context, events []Event) ([]error, error) {
+	results := make([]error, len(events))
+	cutoff := m.uploadCutoff()
+	for _, group := range groupEvents(events) {
+		// Acquire device with read lock on map
+		m.mu.RLock()
+		device, exists := m.devices[group.deviceID]
+		m.mu.RUnlock()
+
+		if !exists {
+			for _, i := range group.indexes {
+				results[i] = ErrDeviceNotFound
+			}
+			continue
+		}
+
+		// Write lock on device once for the whole group
+		device.mu.Lock()
+		active := device.active()
+		for _, i := range group.indexes {
+			switch event := events[i]; {
+			case !active:
+				results[i] = ErrDeviceDecommissioned
+			case event.Kind == EventHeartbeat:
+				device.addHeartbeat(event.SentAt)
+			case event.Kind == EventUpload:
+				device.addUpload(event.SentAt, event.UploadTime, cutoff)
+			default:
+				results[i] = fmt.Errorf("%w: unknown event kind %d", ErrInvalidInput, event.Kind)
+			}
+		}
+		device.mu.Unlock()
+	}
+	return results, nil
+}
+
+// eventGroup lists the positions of one device's events within a batch
+type eventGroup struct {
+	deviceID string
+	indexes  []int
+}
+
+// groupEvents groups batch positions by device, in order of first appearance
+func groupEvents(events []Event) []eventGroup {
+	var groups []eventGroup
+	byDevice := make(map[string]int)
+	for i, event := range events {
+		g, ok := byDevice[event.DeviceID]
+		if !ok {
+			g = len(groups)
+			byDevice[event.DeviceID] = g
+			groups = append(groups, eventGroup{deviceID: event.DeviceID})
+		}
+		groups[g].indexes = append(groups[g].indexes, i)
+	}
+	return groups
 }
 
 // GetStats retrieves computed statistics for a device
@@ -122,3 +286,483 @@ func (m *memoryStore) GetStats(ctx context.Context, deviceID string) (uptime flo
 
 	return uptime, avgUpload, nil
 }
+
+// GetStatsWindow retrieves statistics computed only from heartbeats and uploads within [from, to]
+func (m *memoryStore) GetStatsWindow(ctx context.Context, deviceID string, from, to time.Time) (uptime float64, avgUpload float64, err error) {
+	// Acquire device with read lock on map
+	m.mu.RLock()
+	device, exists := m.devices[deviceID]
+	m.mu.RUnlock()
+
+	if !exists {
+		return 0, 0, ErrDeviceNotFound
+	}
+
+	// Convert window bounds to minute buckets, unbounded sides span everything
+	fromMinute, toMinute := int64(math.MinInt64), int64(math.MaxInt64)
+	if !from.IsZero() {
+		fromMinute = from.Unix() / 60
+	}
+	if !to.IsZero() {
+		toMinute = to.Unix() / 60
+	}
+
+	// Read lock on device for calculations
+	device.mu.RLock()
+	defer device.mu.RUnlock()
+
+	// Calculate uptime over the minutes of the window the device was expected in
+	uptime = core.CalculateWindowUptime(device.minutes, fromMinute, toMinute, m.now().Unix()/60)
+
+	// Calculate average over uploads sent inside the window
+	uploadSum, uploadCount := device.uploads.sum(from, to)
+	avgUpload = core.CalculateAverageUpload(uploadSum, uploadCount)
+
+	return uptime, avgUpload, nil
+}
+
+// GetUploadDistribution retrieves the upload time distribution for a device.
+// With an unbounded window the lifetime sketch is used; otherwise a sketch
+// is built from the samples within [from, to].
+func (m *memoryStore) GetUploadDistribution(ctx context.Context, deviceID string, from, to time.Time) (core.Distribution, error) {
+	// Acquire device with read lock on map
+	m.mu.RLock()
+	device, exists := m.devices[deviceID]
+	m.mu.RUnlock()
+
+	if !exists {
+		return core.Distribution{}, ErrDeviceNotFound
+	}
+
+	// Read lock on device for calculations
+	device.mu.RLock()
+	defer device.mu.RUnlock()
+
+	if from.IsZero() && to.IsZero() {
+		return device.uploadSketch.Distribution(), nil
+	}
+
+	sketch := core.NewQuantileSketch()
+	for _, sample := range device.uploads.window(from, to) {
+		sketch.Add(float64(sample.uploadTime))
+	}
+	return sketch.Distribution(), nil
+}
+
+// ScanDevices calls fn with a summary of each registered device in ID order
+// until fn returns false. The device map is only locked while the device list
+// is copied and each device only while its own summary is computed, so a
+// fleet-wide scan never blocks ingest for more than one device at a time.
+func (m *memoryStore) ScanDevices(ctx context.Context, fn func(DeviceSummary) bool) error {
+	// Copy the device list under the map lock
+	m.mu.RLock()
+	ids := make([]string, 0, len(m.devices))
+	for id := range m.devices {
+		ids = append(ids, id)
+	}
+	m.mu.RUnlock()
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		m.mu.RLock()
+		device, exists := m.devices[id]
+		m.mu.RUnlock()
+		if !exists {
+			continue
+		}
+
+		if !fn(device.summary(id)) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// deviceOverheadBytes approximates the fixed cost of a device: its DeviceAgg,
+// map entry, ID and empty containers
+const deviceOverheadBytes = 256
+
+// Usage reports device counts and an estimate of the memory held by aggregates
+func (m *memoryStore) Usage(ctx context.Context) (Usage, error) {
+	// Copy the device list under the map lock
+	m.mu.RLock()
+	devices := make([]*DeviceAgg, 0, len(m.devices))
+	for _, device := range m.devices {
+		devices = append(devices, device)
+	}
+	m.mu.RUnlock()
+
+	usage := Usage{Devices: len(devices)}
+	for _, device := range devices {
+		if err := ctx.Err(); err != nil {
+			return Usage{}, err
+		}
+
+		device.mu.RLock()
+		if device.active() {
+			usage.ActiveDevices++
+		}
+		usage.MinuteBuckets += int64(device.minutes.Len())
+		usage.UploadSamples += int64(len(device.uploads.samples))
+		usage.EstimatedBytes += deviceOverheadBytes +
+			int64(device.minutes.SizeBytes()) +
+			int64(device.uploadSketch.SizeBytes()) +
+			int64(cap(device.uploads.samples))*int64(unsafe.Sizeof(uploadSample{}))
+		device.mu.RUnlock()
+	}
+	return usage, nil
+}
+
+// summary computes a DeviceSummary under the device's read lock
+func (device *DeviceAgg) summary(id string) DeviceSummary {
+	device.mu.RLock()
+	defer device.mu.RUnlock()
+
+	summary := DeviceSummary{
+		ID:          id,
+		Uptime:      core.CalculateUptime(device.minutes, device.firstMinute, device.lastMinute),
+		AvgUpload:   core.CalculateAverageUpload(device.uploadSum, device.uploadCount),
+		UploadCount: device.uploadCount,
+		UploadSum:   device.uploadSum,
+		LastSeen:    device.lastSeen,
+		Uploads:     device.uploadSketch.Clone(),
+
+		Metadata:       device.metadata,
+		Decommissioned: !device.active(),
+	}
+	if device.minutes.Len() > 0 {
+		summary.FirstSeen = time.Unix(device.firstMinute*60, 0).UTC()
+	}
+	return summary
+}
+
+// GetMetadata retrieves the registry metadata of a device
+func (m *memoryStore) GetMetadata(ctx context.Context, deviceID string) (DeviceMetadata, error) {
+	// Acquire device with read lock on map
+	m.mu.RLock()
+	device, exists := m.devices[deviceID]
+	m.mu.RUnlock()
+
+	if !exists {
+		return DeviceMetadata{}, ErrDeviceNotFound
+	}
+
+	device.mu.RLock()
+	defer device.mu.RUnlock()
+	return device.metadata, nil
+}
+
+// RegisterDevices adds devices to the registry or reactivates decommissioned ones
+func (m *memoryStore) RegisterDevices(ctx context.Context, deviceIDs []string) ([]string, error) {
+	if err := validateDeviceIDs(deviceIDs); err != nil {
+		return nil, err
+	}
+
+	// Write lock on map for insertion
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var added []string
+	for _, id := range deviceIDs {
+		device, exists := m.devices[id]
+		if !exists {
+			device = newDeviceAgg()
+			device.registered = true
+			m.devices[id] = device
+			added = append(added, id)
+			continue
+		}
+
+		device.mu.Lock()
+		if !device.active() {
+			// Registering through the API takes ownership from the registry file
+			device.registered = device.registered || device.retired
+			device.decommissioned = false
+			device.retired = false
+			added = append(added, id)
+		}
+		device.mu.Unlock()
+	}
+	return added, nil
+}
+
+// DecommissionDevice retires a device, optionally discarding its history
+func (m *memoryStore) DecommissionDevice(ctx context.Context, deviceID string, purge bool) error {
+	// Acquire device with read lock on map
+	m.mu.RLock()
+	device, exists := m.devices[deviceID]
+	m.mu.RUnlock()
+
+	if !exists {
+		return ErrDeviceNotFound
+	}
+
+	// Write lock on device so in-flight ingest either lands before or is rejected
+	device.mu.Lock()
+	defer device.mu.Unlock()
+
+	device.decommissioned = true
+	if purge {
+		device.clear()
+	}
+	return nil
+}
+
+// ReconcileDevices makes the devices listed in a registry file match devices.
+// Listed devices that are unknown are added, those previously retired are
+// reactivated, and every listed device takes the file's metadata; devices
+// that came from the file but are no longer listed are retired. Aggregates
+// are untouched, and devices registered at runtime or decommissioned through
+// the API keep that state. The whole change is applied under the map lock,
+// so concurrent ingest sees either the old or the new registry.
+func (m *memoryStore) ReconcileDevices(ctx context.Context, devices []DeviceInfo) (added, retired []string, err error) {
+	return m.reconcile(devices, nil)
+}
+
+// reconcile implements ReconcileDevices. When commit is set it is called
+// with the devices about to be added or reactivated and retired before
+// anything changes, and an error from it leaves the registry as it was.
+func (m *memoryStore) reconcile(devices []DeviceInfo, commit func(added, retired []string) error) (added, retired []string, err error) {
+	listed := make(map[string]bool, len(devices))
+	for _, info := range devices {
+		if err := validateDeviceIDs([]string{info.ID}); err != nil {
+			return nil, nil, err
+		}
+		listed[info.ID] = true
+	}
+
+	// Write lock on map for the whole reconciliation
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Work out the change first so that it can be committed before it is applied
+	planned := make(map[string]bool)
+	for _, info := range devices {
+		if !planned[info.ID] && m.listsDevice(info.ID) {
+			planned[info.ID] = true
+			added = append(added, info.ID)
+		}
+	}
+	for id, device := range m.devices {
+		device.mu.RLock()
+		retire := !listed[id] && !device.registered && !device.retired
+		device.mu.RUnlock()
+		if retire {
+			retired = append(retired, id)
+		}
+	}
+	sort.Strings(retired)
+	if commit != nil && len(added)+len(retired) > 0 {
+		if err := commit(added, retired); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, info := range devices {
+		m.listDevice(info.ID, info.Metadata)
+	}
+	for _, id := range retired {
+		m.retireDevice(id)
+	}
+	return added, retired, nil
+}
+
+// listsDevice reports whether listDevice would add or reactivate the device;
+// the caller must hold m.mu
+func (m *memoryStore) listsDevice(id string) bool {
+	device, exists := m.devices[id]
+	if !exists {
+		return true
+	}
+	device.mu.RLock()
+	defer device.mu.RUnlock()
+	return device.retired
+}
+
+// listDevice adds a device listed in the registry file, or reactivates it
+// if it was retired, and sets its metadata; the caller must hold m.mu for
+// writing
+func (m *memoryStore) listDevice(id string, metadata DeviceMetadata) {
+	device, exists := m.devices[id]
+	if !exists {
+		device = newDeviceAgg()
+		device.metadata = metadata
+		m.devices[id] = device
+		return
+	}
+
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	device.retired = false
+	device.metadata = metadata
+}
+
+// retireDevice retires a device that came from the registry file and is no
+// longer listed; the caller must hold m.mu
+func (m *memoryStore) retireDevice(id string) {
+	device, exists := m.devices[id]
+	if !exists {
+		return
+	}
+
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	if !device.registered {
+		device.retired = true
+	}
+}
+
+// validateDeviceIDs rejects IDs that cannot be routed or logged
+func validateDeviceIDs(deviceIDs []string) error {
+	for _, id := range deviceIDs {
+		if id == "" || len(id) > maxDeviceIDLen || strings.Contains(id, "/") {
+			return fmt.Errorf("%w: device ID %q", ErrInvalidInput, id)
+		}
+	}
+	return nil
+}
+
+// checkActive reports whether deviceID is registered and accepting events
+func (m *memoryStore) checkActive(deviceID string) error {
+	m.mu.RLock()
+	device, exists := m.devices[deviceID]
+	m.mu.RUnlock()
+
+	if !exists {
+		return ErrDeviceNotFound
+	}
+
+	device.mu.RLock()
+	defer device.mu.RUnlock()
+	if !device.active() {
+		return ErrDeviceDecommissioned
+	}
+	return nil
+}
+
+// applyRecord applies a replayed write-ahead log record.
+// Records for unknown or inactive devices are ignored.
+func (m *memoryStore) applyRecord(rec walRecord) {
+	ctx := context.Background()
+	switch rec.kind {
+	case recordHeartbeat:
+		_ = m.AddHeartbeat(ctx, rec.deviceID, rec.sentAt)
+	case recordUpload:
+		_ = m.AddUpload(ctx, rec.deviceID, rec.sentAt, int(rec.value))
+	case recordRegister:
+		_, _ = m.RegisterDevices(ctx, []string{rec.deviceID})
+	case recordDecommission:
+		_ = m.DecommissionDevice(ctx, rec.deviceID, rec.value == purgeHistory)
+	case recordList, recordRetire:
+		m.mu.Lock()
+		if rec.kind == recordList {
+			// Metadata is not logged; the next reconciliation reattaches it
+			m.listDevice(rec.deviceID, DeviceMetadata{})
+		} else {
+			m.retireDevice(rec.deviceID)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// exportState copies every device aggregate into its serialized form,
+// first dropping upload samples past the retention of devices that have
+// not reported since they expired
+func (m *memoryStore) exportState() snapshotState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	cutoff := m.uploadCutoff()
+	state := snapshotState{Devices: make([]snapshotDevice, 0, len(m.devices))}
+	for id, device := range m.devices {
+		device.mu.Lock()
+		device.uploads.prune(cutoff)
+		minutes, _ := device.minutes.MarshalBinary()
+		sketch, _ := device.uploadSketch.MarshalBinary()
+		uploads := make([]snapshotUpload, len(device.uploads.samples))
+		for i, sample := range device.uploads.samples {
+			uploads[i] = snapshotUpload{SentAt: sample.sentAt, UploadTime: sample.uploadTime}
+		}
+		state.Devices = append(state.Devices, snapshotDevice{
+			ID:          id,
+			FirstMinute: device.firstMinute,
+			LastMinute:  device.lastMinute,
+			LastSeen:    device.lastSeen,
+			MinuteSet:   minutes,
+			UploadCount: device.uploadCount,
+			UploadSum:   device.uploadSum,
+			Uploads:     uploads,
+			Sketch:      sketch,
+
+			Registered:     device.registered,
+			Decommissioned: device.decommissioned,
+			Retired:        device.retired,
+		})
+		device.mu.Unlock()
+	}
+	return state
+}
+
+// restoreState replaces device aggregates with those from a snapshot.
+// Devices missing from the initial list, whether registered at runtime or
+// added by a registry file reload, are recreated with the registry state
+// they were saved in; reconciling with the registry file afterwards retires
+// those it no longer lists.
+func (m *memoryStore) restoreState(state snapshotState) error {
+	// Write lock on map since devices may be recreated
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := m.uploadCutoff()
+	for _, snap := range state.Devices {
+		device, exists := m.devices[snap.ID]
+		if !exists {
+			device = newDeviceAgg()
+			m.devices[snap.ID] = device
+		}
+
+		minutes := core.NewMinuteSet()
+		if err := minutes.UnmarshalBinary(snap.MinuteSet); err != nil {
+			return fmt.Errorf("%w: device %s: %v", errCorruptSnapshot, snap.ID, err)
+		}
+		sketch := core.NewQuantileSketch()
+		if err := sketch.UnmarshalBinary(snap.Sketch); err != nil {
+			return fmt.Errorf("%w: device %s: %v", errCorruptSnapshot, snap.ID, err)
+		}
+		var uploads uploadSeries
+		for _, upload := range snap.Uploads {
+			uploads.add(upload.SentAt, upload.UploadTime)
+		}
+		uploads.prune(cutoff)
+
+		device.mu.Lock()
+		device.firstMinute = snap.FirstMinute
+		device.lastMinute = snap.LastMinute
+		device.lastSeen = snap.LastSeen
+		device.minutes = minutes
+		device.uploadCount = snap.UploadCount
+		device.uploadSum = snap.UploadSum
+		device.uploads = uploads
+		device.uploadSketch = sketch
+		device.registered = snap.Registered
+		device.decommissioned = snap.Decommissioned
+		device.retired = snap.Retired
+		device.mu.Unlock()
+	}
+	return nil
+}
+
+// reset discards every device aggregate and returns the registry to deviceIDs
+func (m *memoryStore) reset(deviceIDs []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.devices = make(map[string]*DeviceAgg, len(deviceIDs))
+	for _, id := range deviceIDs {
+		m.devices[id] = newDeviceAgg()
+	}
+}
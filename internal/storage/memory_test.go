@@ -2,6 +2,9 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
 	"testing"
 	"time"
 )
@@ -20,10 +23,10 @@ func TestAddHeartbeat(t *testing.T) {
 	// Verify minute was added
 	device := store.devices["device1"]
 	device.mu.RLock()
-	if len(device.minutes) != 1 {
-		t.Errorf("Expected 1 minute, got %d", len(device.minutes))
+	if device.minutes.Len() != 1 {
+		t.Errorf("Expected 1 minute, got %d", device.minutes.Len())
 	}
-	if _, exists := device.minutes[1]; !exists {
+	if !device.minutes.Contains(1) {
 		t.Error("Expected minute 1 to be recorded")
 	}
 	device.mu.RUnlock()
@@ -36,8 +39,8 @@ func TestAddHeartbeat(t *testing.T) {
 	}
 
 	device.mu.RLock()
-	if len(device.minutes) != 1 {
-		t.Errorf("Expected 1 minute after deduplication, got %d", len(device.minutes))
+	if device.minutes.Len() != 1 {
+		t.Errorf("Expected 1 minute after deduplication, got %d", device.minutes.Len())
 	}
 	device.mu.RUnlock()
 
@@ -49,8 +52,8 @@ func TestAddHeartbeat(t *testing.T) {
 	}
 
 	device.mu.RLock()
-	if len(device.minutes) != 2 {
-		t.Errorf("Expected 2 minutes, got %d", len(device.minutes))
+	if device.minutes.Len() != 2 {
+		t.Errorf("Expected 2 minutes, got %d", device.minutes.Len())
 	}
 	if device.firstMinute != 1 {
 		t.Errorf("Expected firstMinute=1, got %d", device.firstMinute)
@@ -60,3 +63,269 @@ func TestAddHeartbeat(t *testing.T) {
 	}
 	device.mu.RUnlock()
 }
+
+func TestGetStatsWindow(t *testing.T) {
+	store := NewMemoryStore([]string{"device1"})
+	store.now = func() time.Time { return time.Unix(39*60+30, 0) }
+	ctx := context.Background()
+
+	// Heartbeats in minutes 0-9 and 20-29, with minute 25 missing, and none
+	// since up to now in minute 39
+	for minute := int64(0); minute < 30; minute++ {
+		if (minute >= 10 && minute < 20) || minute == 25 {
+			continue
+		}
+		store.AddHeartbeat(ctx, "device1", time.Unix(minute*60, 0))
+	}
+	// Uploads out of order, one per 10 minutes
+	for _, upload := range []struct {
+		sec   int64
+		value int
+	}{{1200, 300}, {0, 100}, {600, 200}, {1800, 400}} {
+		store.AddUpload(ctx, "device1", time.Unix(upload.sec, 0), upload.value)
+	}
+
+	tests := []struct {
+		name       string
+		from, to   time.Time
+		wantUptime float64
+		wantAvg    float64
+	}{
+		{"unbounded spans first heartbeat to now", time.Time{}, time.Time{}, 47.5, 250},
+		{"second half", time.Unix(20*60, 0), time.Unix(30*60, 0), 900.0 / 11.0, 350},
+		{"open start", time.Time{}, time.Unix(9*60+59, 0), 100, 100},
+		{"trailing outage", time.Unix(20*60, 0), time.Time{}, 45, 350},
+		{"no heartbeats", time.Unix(11*60, 0), time.Unix(19*60, 0), 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uptime, avg, err := store.GetStatsWindow(ctx, "device1", tt.from, tt.to)
+			if err != nil {
+				t.Fatalf("GetStatsWindow failed: %v", err)
+			}
+			if math.Abs(uptime-tt.wantUptime) > 1e-9 {
+				t.Errorf("uptime = %v, want %v", uptime, tt.wantUptime)
+			}
+			if avg != tt.wantAvg {
+				t.Errorf("avg = %v, want %v", avg, tt.wantAvg)
+			}
+		})
+	}
+
+	if _, _, err := store.GetStatsWindow(ctx, "unknown", time.Time{}, time.Time{}); err != ErrDeviceNotFound {
+		t.Errorf("expected ErrDeviceNotFound, got %v", err)
+	}
+}
+
+func TestGetUploadDistribution(t *testing.T) {
+	store := NewMemoryStore([]string{"device1"})
+	ctx := context.Background()
+
+	for i := 1; i <= 100; i++ {
+		store.AddUpload(ctx, "device1", time.Unix(int64(i*60), 0), i*1000)
+	}
+
+	dist, err := store.GetUploadDistribution(ctx, "device1", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("GetUploadDistribution failed: %v", err)
+	}
+	if dist.Count != 100 || dist.Min != 1000 || dist.Max != 100000 {
+		t.Errorf("count/min/max = %d/%v/%v, want 100/1000/100000", dist.Count, dist.Min, dist.Max)
+	}
+	if dist.P50 < 50000*0.99 || dist.P50 > 50000*1.01 {
+		t.Errorf("p50 = %v, want ~50000", dist.P50)
+	}
+
+	// Window covering uploads 91-100
+	dist, _ = store.GetUploadDistribution(ctx, "device1", time.Unix(91*60, 0), time.Time{})
+	if dist.Count != 10 || dist.Min != 91000 || dist.Max != 100000 {
+		t.Errorf("windowed count/min/max = %d/%v/%v, want 10/91000/100000", dist.Count, dist.Min, dist.Max)
+	}
+
+	// An upload without sent_at counts over the lifetime but in no window
+	store.AddUpload(ctx, "device1", time.Time{}, 500)
+	if dist, _ := store.GetUploadDistribution(ctx, "device1", time.Time{}, time.Time{}); dist.Count != 101 || dist.Min != 500 {
+		t.Errorf("lifetime count/min = %d/%v, want 101/500", dist.Count, dist.Min)
+	}
+	if dist, _ := store.GetUploadDistribution(ctx, "device1", time.Time{}, time.Unix(60, 0)); dist.Count != 1 || dist.Min != 1000 {
+		t.Errorf("open start count/min = %d/%v, want 1/1000", dist.Count, dist.Min)
+	}
+}
+
+func TestScanDevices(t *testing.T) {
+	store := NewMemoryStore([]string{"c", "a", "b"})
+	ctx := context.Background()
+
+	store.AddHeartbeat(ctx, "a", time.Unix(60, 0))
+	store.AddHeartbeat(ctx, "a", time.Unix(185, 0))
+	store.AddUpload(ctx, "b", time.Unix(60, 0), 500)
+
+	var got []DeviceSummary
+	if err := store.ScanDevices(ctx, func(d DeviceSummary) bool {
+		got = append(got, d)
+		return true
+	}); err != nil {
+		t.Fatalf("ScanDevices failed: %v", err)
+	}
+
+	if len(got) != 3 || got[0].ID != "a" || got[1].ID != "b" || got[2].ID != "c" {
+		t.Fatalf("expected devices a, b, c in order, got %+v", got)
+	}
+	if got[0].NeverSeen() || !got[0].LastSeen.Equal(time.Unix(185, 0)) || !got[0].FirstSeen.Equal(time.Unix(60, 0)) {
+		t.Errorf("unexpected summary for a: %+v", got[0])
+	}
+	if !got[1].NeverSeen() || got[1].UploadCount != 1 || got[1].Uploads.Count() != 1 {
+		t.Errorf("unexpected summary for b: %+v", got[1])
+	}
+
+	// Stops early when fn returns false
+	visited := 0
+	store.ScanDevices(ctx, func(DeviceSummary) bool {
+		visited++
+		return false
+	})
+	if visited != 1 {
+		t.Errorf("expected scan to stop after 1 device, visited %d", visited)
+	}
+}
+
+func TestRegisterAndDecommission(t *testing.T) {
+	store := NewMemoryStore([]string{"device1"})
+	ctx := context.Background()
+
+	added, err := store.RegisterDevices(ctx, []string{"device1", "device2"})
+	if err != nil {
+		t.Fatalf("RegisterDevices failed: %v", err)
+	}
+	if len(added) != 1 || added[0] != "device2" {
+		t.Errorf("expected only device2 added, got %v", added)
+	}
+	if err := store.AddHeartbeat(ctx, "device2", time.Unix(60, 0)); err != nil {
+		t.Fatalf("AddHeartbeat on registered device failed: %v", err)
+	}
+	if _, err := store.RegisterDevices(ctx, []string{"bad/id"}); !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput for bad ID, got %v", err)
+	}
+
+	// Decommissioned devices reject events but keep history
+	if err := store.DecommissionDevice(ctx, "device2", false); err != nil {
+		t.Fatalf("DecommissionDevice failed: %v", err)
+	}
+	if err := store.AddHeartbeat(ctx, "device2", time.Unix(120, 0)); err != ErrDeviceDecommissioned {
+		t.Errorf("expected ErrDeviceDecommissioned, got %v", err)
+	}
+	if err := store.AddUpload(ctx, "device2", time.Unix(120, 0), 10); err != ErrDeviceDecommissioned {
+		t.Errorf("expected ErrDeviceDecommissioned, got %v", err)
+	}
+	if uptime, _, _ := store.GetStats(ctx, "device2"); uptime != 100 {
+		t.Errorf("expected retained uptime 100, got %v", uptime)
+	}
+
+	// Purging discards history; registering again reactivates
+	if err := store.DecommissionDevice(ctx, "device2", true); err != nil {
+		t.Fatalf("DecommissionDevice purge failed: %v", err)
+	}
+	if added, _ := store.RegisterDevices(ctx, []string{"device2"}); len(added) != 1 {
+		t.Errorf("expected device2 reactivated, got %v", added)
+	}
+	if store.devices["device2"].minutes.Len() != 0 {
+		t.Errorf("expected purged history")
+	}
+	if err := store.AddHeartbeat(ctx, "device2", time.Unix(180, 0)); err != nil {
+		t.Errorf("AddHeartbeat after reactivation failed: %v", err)
+	}
+
+	if err := store.DecommissionDevice(ctx, "unknown", false); err != ErrDeviceNotFound {
+		t.Errorf("expected ErrDeviceNotFound, got %v", err)
+	}
+}
+
+func TestReconcileDevices(t *testing.T) {
+	store := NewMemoryStore([]string{"device1", "device2", "device3"})
+	ctx := context.Background()
+
+	store.AddHeartbeat(ctx, "device2", time.Unix(60, 0))
+	store.RegisterDevices(ctx, []string{"runtime1"})
+	store.DecommissionDevice(ctx, "device3", false)
+
+	camera := DeviceMetadata{Type: "camera", Site: "lab", Tags: []string{"outdoor"}}
+	added, retired, err := store.ReconcileDevices(ctx, []DeviceInfo{
+		{ID: "device1", Metadata: camera},
+		{ID: "device3"},
+		{ID: "device4", Metadata: camera},
+	})
+	if err != nil {
+		t.Fatalf("ReconcileDevices failed: %v", err)
+	}
+	if fmt.Sprint(added) != "[device4]" || fmt.Sprint(retired) != "[device2]" {
+		t.Errorf("got added=%v retired=%v, want [device4] [device2]", added, retired)
+	}
+
+	for _, id := range []string{"device1", "device4"} {
+		if md, _ := store.GetMetadata(ctx, id); md.Type != "camera" || md.Site != "lab" {
+			t.Errorf("%s: expected file metadata, got %+v", id, md)
+		}
+	}
+
+	// Retired devices reject events but keep aggregates
+	if err := store.AddHeartbeat(ctx, "device2", time.Unix(120, 0)); err != ErrDeviceDecommissioned {
+		t.Errorf("expected ErrDeviceDecommissioned for retired device, got %v", err)
+	}
+	if uptime, _, _ := store.GetStats(ctx, "device2"); uptime != 100 {
+		t.Errorf("expected retained uptime 100, got %v", uptime)
+	}
+	// Runtime registrations and API decommissions are left alone
+	if err := store.AddHeartbeat(ctx, "runtime1", time.Unix(60, 0)); err != nil {
+		t.Errorf("expected runtime device to stay active, got %v", err)
+	}
+	if err := store.AddHeartbeat(ctx, "device3", time.Unix(60, 0)); err != ErrDeviceDecommissioned {
+		t.Errorf("expected decommissioned device to stay decommissioned, got %v", err)
+	}
+
+	// Listing a retired device again reactivates it
+	added, retired, _ = store.ReconcileDevices(ctx, []DeviceInfo{{ID: "device1"}, {ID: "device2"}, {ID: "device3"}, {ID: "device4"}})
+	if fmt.Sprint(added) != "[device2]" || len(retired) != 0 {
+		t.Errorf("got added=%v retired=%v, want [device2] []", added, retired)
+	}
+	if err := store.AddHeartbeat(ctx, "device2", time.Unix(120, 0)); err != nil {
+		t.Errorf("expected reactivated device to accept heartbeats, got %v", err)
+	}
+	if md, _ := store.GetMetadata(ctx, "device1"); !md.IsZero() {
+		t.Errorf("expected metadata removed from the file to be cleared, got %+v", md)
+	}
+}
+
+func TestAddEvents(t *testing.T) {
+	store := NewMemoryStore([]string{"device1", "device2", "device3"})
+	ctx := context.Background()
+	store.DecommissionDevice(ctx, "device3", false)
+
+	events := []Event{
+		{DeviceID: "device1", Kind: EventHeartbeat, SentAt: time.Unix(60, 0)},
+		{DeviceID: "device2", Kind: EventUpload, SentAt: time.Unix(60, 0), UploadTime: 100},
+		{DeviceID: "unknown", Kind: EventHeartbeat, SentAt: time.Unix(60, 0)},
+		{DeviceID: "device1", Kind: EventHeartbeat, SentAt: time.Unix(180, 0)},
+		{DeviceID: "device3", Kind: EventHeartbeat, SentAt: time.Unix(60, 0)},
+		{DeviceID: "device2", Kind: EventUpload, SentAt: time.Unix(120, 0), UploadTime: 300},
+		{DeviceID: "device1", Kind: EventKind(99)},
+	}
+	results, err := store.AddEvents(ctx, events)
+	if err != nil {
+		t.Fatalf("AddEvents failed: %v", err)
+	}
+
+	want := []error{nil, nil, ErrDeviceNotFound, nil, ErrDeviceDecommissioned, nil, ErrInvalidInput}
+	for i := range want {
+		if !errors.Is(results[i], want[i]) && results[i] != want[i] {
+			t.Errorf("event %d: got %v, want %v", i, results[i], want[i])
+		}
+	}
+
+	// device1: minutes 1 and 3 over a 2 minute span; device2: two uploads
+	if uptime, _, _ := store.GetStats(ctx, "device1"); uptime != 100 {
+		t.Errorf("device1 uptime = %v, want 100", uptime)
+	}
+	if _, avg, _ := store.GetStats(ctx, "device2"); avg != 200 {
+		t.Errorf("device2 avg upload = %v, want 200", avg)
+	}
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotPrefix  = "snapshot-"
+	snapshotSuffix  = ".snap"
+	snapshotMagic   = "FLEETSNP"
+	snapshotVersion = 1
+
+	// Header: magic (8) + version (4) + body length (8) + body CRC32C (4)
+	snapshotHeaderSize = 24
+)
+
+// errCorruptSnapshot reports a snapshot file that failed validation
+var errCorruptSnapshot = errors.New("corrupt snapshot")
+
+// snapshotState is the serialized form of every device aggregate
+type snapshotState struct {
+	Devices []snapshotDevice
+}
+
+// snapshotDevice is the serialized form of a single DeviceAgg
+type snapshotDevice struct {
+	ID          string
+	FirstMinute int64
+	LastMinute  int64
+	LastSeen    time.Time // Latest heartbeat sent_at
+	MinuteSet   []byte    // core.MinuteSet binary encoding
+	UploadCount int64
+	UploadSum   float64
+	Uploads     []snapshotUpload // Samples for windowed queries, back to the upload retention
+	Sketch      []byte           // core.QuantileSketch binary encoding of every upload
+
+	Registered     bool // Added at runtime, recreated on restore
+	Decommissioned bool // Rejects new events
+	Retired        bool // No longer listed in the registry file
+}
+
+// snapshotUpload is the serialized form of a single upload sample
+type snapshotUpload struct {
+	SentAt     time.Time
+	UploadTime int64
+}
+
+// writeSnapshot atomically writes state to dir as the snapshot for segment seq.
+// The snapshot covers every record in segments before seq.
+func writeSnapshot(dir string, seq uint64, state snapshotState) error {
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(state); err != nil {
+		return fmt.Errorf("encode snapshot: %w", err)
+	}
+
+	header := make([]byte, snapshotHeaderSize)
+	copy(header, snapshotMagic)
+	binary.LittleEndian.PutUint32(header[8:], snapshotVersion)
+	binary.LittleEndian.PutUint64(header[12:], uint64(body.Len()))
+	binary.LittleEndian.PutUint32(header[20:], crc32.Checksum(body.Bytes(), crcTable))
+
+	// Write to a temporary file first so a crash never leaves a partial snapshot
+	final := snapshotPath(dir, seq)
+	tmp, err := os.CreateTemp(dir, snapshotPrefix+"*.tmp")
+	if err != nil {
+		return fmt.Errorf("create snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(header); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	if _, err := tmp.Write(body.Bytes()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), final); err != nil {
+		return fmt.Errorf("rename snapshot: %w", err)
+	}
+	return syncDir(dir)
+}
+
+// readSnapshot loads and validates a snapshot file
+func readSnapshot(path string) (snapshotState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return snapshotState{}, fmt.Errorf("read snapshot: %w", err)
+	}
+
+	if len(data) < snapshotHeaderSize || string(data[:8]) != snapshotMagic {
+		return snapshotState{}, fmt.Errorf("%w: bad header", errCorruptSnapshot)
+	}
+	version := binary.LittleEndian.Uint32(data[8:])
+	if version != snapshotVersion {
+		return snapshotState{}, fmt.Errorf("%w: unsupported version %d", errCorruptSnapshot, version)
+	}
+	size := binary.LittleEndian.Uint64(data[12:])
+	sum := binary.LittleEndian.Uint32(data[20:])
+	body := data[snapshotHeaderSize:]
+	if uint64(len(body)) != size || crc32.Checksum(body, crcTable) != sum {
+		return snapshotState{}, fmt.Errorf("%w: checksum mismatch", errCorruptSnapshot)
+	}
+
+	var state snapshotState
+	if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&state); err != nil {
+		return snapshotState{}, fmt.Errorf("%w: %v", errCorruptSnapshot, err)
+	}
+	return state, nil
+}
+
+// listSnapshots returns the segment sequence numbers of all snapshots in dir, ascending
+func listSnapshots(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read data directory: %w", err)
+	}
+
+	var seqs []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, snapshotSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotSuffix), 10, 64)
+		if err != nil {
+			continue // Not one of ours
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// snapshotPath returns the file path for the snapshot covering segments before seq
+func snapshotPath(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%020d%s", snapshotPrefix, seq, snapshotSuffix))
+}
@@ -2,16 +2,133 @@ package storage
 
 import (
 	"context"
+	"device-fleet-monitoring/internal/core"
 	"errors"
+	"strings"
 	"time"
 )
 
 // Error types
 var (
-	ErrDeviceNotFound = errors.New("device not found")
-	ErrInvalidInput   = errors.New("invalid input")
+	ErrDeviceNotFound       = errors.New("device not found")
+	ErrDeviceDecommissioned = errors.New("device decommissioned")
+	ErrInvalidInput         = errors.New("invalid input")
 )
 
+// EventKind identifies the type of a batched Event
+type EventKind int
+
+// Event kinds accepted by AddEvents
+const (
+	EventHeartbeat EventKind = iota + 1
+	EventUpload
+)
+
+// Event is a single heartbeat or upload measurement in a batch
+type Event struct {
+	DeviceID   string
+	Kind       EventKind
+	SentAt     time.Time
+	UploadTime int // Uploads only, in the same units as AddUpload
+}
+
+// DeviceMetadata describes a device as listed in the registry file.
+// Values are replaced as a whole, never modified in place, so copies may
+// share Tags and Labels and must treat them as read-only.
+type DeviceMetadata struct {
+	Type     string // e.g. camera, server, switch
+	Site     string
+	Model    string
+	Firmware string
+	Tags     []string
+	Labels   map[string]string // Registry columns without a dedicated field
+}
+
+// IsZero reports whether no metadata is set
+func (md DeviceMetadata) IsZero() bool {
+	return md.Type == "" && md.Site == "" && md.Model == "" && md.Firmware == "" &&
+		len(md.Tags) == 0 && len(md.Labels) == 0
+}
+
+// Metadata keys addressable by filters, grouping and alert rules. Labels
+// are addressed as label.<name>.
+const (
+	MetadataType     = "type"
+	MetadataSite     = "site"
+	MetadataModel    = "model"
+	MetadataFirmware = "firmware"
+	MetadataTag      = "tag"
+	LabelPrefix      = "label."
+)
+
+// IsMetadataKey reports whether key names a metadata field or label
+func IsMetadataKey(key string) bool {
+	switch key {
+	case MetadataType, MetadataSite, MetadataModel, MetadataFirmware, MetadataTag:
+		return true
+	}
+	return strings.HasPrefix(key, LabelPrefix) && len(key) > len(LabelPrefix)
+}
+
+// Values returns the values of a metadata key. Tags may yield several
+// values; unset fields yield none.
+func (md DeviceMetadata) Values(key string) []string {
+	var value string
+	switch key {
+	case MetadataType:
+		value = md.Type
+	case MetadataSite:
+		value = md.Site
+	case MetadataModel:
+		value = md.Model
+	case MetadataFirmware:
+		value = md.Firmware
+	case MetadataTag:
+		return md.Tags
+	default:
+		value = md.Labels[strings.TrimPrefix(key, LabelPrefix)]
+	}
+	if value == "" {
+		return nil
+	}
+	return []string{value}
+}
+
+// DeviceInfo is a device entry from the registry file
+type DeviceInfo struct {
+	ID       string
+	Metadata DeviceMetadata
+}
+
+// Usage reports the size of a store
+type Usage struct {
+	Devices        int   // Every registered device, including decommissioned ones
+	ActiveDevices  int   // Devices accepting events
+	MinuteBuckets  int64 // Distinct heartbeat minutes across all devices
+	UploadSamples  int64 // Upload samples retained for windowed queries
+	EstimatedBytes int64 // Approximate heap memory held by device aggregates
+}
+
+// DeviceSummary is a point-in-time view of one device's lifetime statistics
+type DeviceSummary struct {
+	ID          string
+	Uptime      float64
+	AvgUpload   float64
+	UploadCount int64
+	UploadSum   float64
+	FirstSeen   time.Time            // Start of the first heartbeat minute; zero if never seen
+	LastSeen    time.Time            // Latest heartbeat sent_at; zero if never seen
+	Uploads     *core.QuantileSketch // Copy of the lifetime upload time sketch
+	Metadata    DeviceMetadata
+
+	Decommissioned bool // Decommissioned or retired devices keep their history but reject new events
+}
+
+// NeverSeen reports whether the device has never sent a heartbeat
+func (d DeviceSummary) NeverSeen() bool {
+	return d.FirstSeen.IsZero()
+}
+
 // Store defines the interface for device telemetry storage operations
 type Store interface {
 	// AddHeartbeat records a heartbeat for a device at the given timestamp
@@ -21,7 +138,55 @@ type Store interface {
 	// uploadTime is treated as an opaque duration value in units provided by the device
 	AddUpload(ctx context.Context, deviceID string, sentAt time.Time, uploadTime int) error
 
+	// AddEvents records a batch of heartbeats and uploads, possibly for many
+	// devices, locking each device once. It returns one result per event:
+	// nil when accepted, otherwise the reason it was rejected (e.g.
+	// ErrDeviceNotFound). A non-nil error means the batch as a whole failed
+	// and no event was recorded.
+	AddEvents(ctx context.Context, events []Event) ([]error, error)
+
 	// GetStats retrieves computed statistics for a device
 	// avgUpload is returned in the same units as the input uploadTime values
 	GetStats(ctx context.Context, deviceID string) (uptime float64, avgUpload float64, err error)
+
+	// GetStatsWindow retrieves statistics computed only from heartbeats and
+	// uploads whose sent_at falls within [from, to]
+	// A zero from or to leaves that side of the window unbounded. Uptime is
+	// the share of the window's minutes with a heartbeat, with the window
+	// clamped to the device's first heartbeat and the current time.
+	GetStatsWindow(ctx context.Context, deviceID string, from, to time.Time) (uptime float64, avgUpload float64, err error)
+
+	// GetUploadDistribution retrieves count, min, max and percentiles of upload
+	// times whose sent_at falls within [from, to], with the same window rules
+	// as GetStatsWindow
+	GetUploadDistribution(ctx context.Context, deviceID string, from, to time.Time) (core.Distribution, error)
+
+	// ScanDevices calls fn with a summary of each registered device in ID
+	// order until fn returns false. Devices are locked one at a time, so each
+	// summary is internally consistent but the scan is not a global snapshot.
+	ScanDevices(ctx context.Context, fn func(DeviceSummary) bool) error
+
+	// Usage reports device counts and an estimate of the memory held by
+	// aggregates. Like ScanDevices it locks one device at a time.
+	Usage(ctx context.Context) (Usage, error)
+
+	// GetMetadata retrieves the registry metadata of a device
+	GetMetadata(ctx context.Context, deviceID string) (DeviceMetadata, error)
+
+	// RegisterDevices adds devices to the registry at runtime. Decommissioned
+	// devices listed again are reactivated with whatever history they kept.
+	// It returns the IDs that were added or reactivated, in input order.
+	RegisterDevices(ctx context.Context, deviceIDs []string) ([]string, error)
+
+	// DecommissionDevice retires a device so that further heartbeats and
+	// uploads fail with ErrDeviceDecommissioned. Its history stays queryable
+	// unless purge is set, in which case every aggregate is discarded.
+	DecommissionDevice(ctx context.Context, deviceID string, purge bool) error
+
+	// ReconcileDevices applies a reloaded registry file: unknown IDs are
+	// added, previously retired IDs are reactivated, listed devices take the
+	// file's metadata, and devices that came from the file but are no longer
+	// listed are retired with their history kept. Retired devices reject
+	// events with ErrDeviceDecommissioned.
+	ReconcileDevices(ctx context.Context, devices []DeviceInfo) (added, retired []string, err error)
 }
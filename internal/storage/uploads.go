@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"sort"
+	"time"
+)
+
+// uploadSample is a single upload time measurement
+type uploadSample struct {
+	sentAt     time.Time
+	uploadTime int64
+}
+
+// uploadSeries keeps upload samples ordered by sent_at so that windowed
+// queries only touch the samples inside the window
+type uploadSeries struct {
+	samples []uploadSample
+}
+
+// add inserts a sample, keeping the series ordered by sentAt
+func (s *uploadSeries) add(sentAt time.Time, uploadTime int64) {
+	sample := uploadSample{sentAt: sentAt, uploadTime: uploadTime}
+
+	// Uploads are reported mostly in order, so this is usually an append
+	n := len(s.samples)
+	if n == 0 || !sentAt.Before(s.samples[n-1].sentAt) {
+		s.samples = append(s.samples, sample)
+		return
+	}
+
+	i := sort.Search(n, func(i int) bool { return s.samples[i].sentAt.After(sentAt) })
+	s.samples = append(s.samples, uploadSample{})
+	copy(s.samples[i+1:], s.samples[i:])
+	s.samples[i] = sample
+}
+
+// prune drops the samples sent before cutoff. A zero cutoff keeps every sample.
+func (s *uploadSeries) prune(cutoff time.Time) {
+	if cutoff.IsZero() || len(s.samples) == 0 || !s.samples[0].sentAt.Before(cutoff) {
+		return
+	}
+	i := sort.Search(len(s.samples), func(i int) bool { return !s.samples[i].sentAt.Before(cutoff) })
+	if i == len(s.samples) {
+		s.samples = nil
+		return
+	}
+	// Copy into a new slice so the dropped samples' memory is released
+	s.samples = append([]uploadSample(nil), s.samples[i:]...)
+}
+
+// window returns the samples with from <= sentAt <= to.
+// A zero from or to leaves that side unbounded.
+func (s *uploadSeries) window(from, to time.Time) []uploadSample {
+	start := 0
+	if !from.IsZero() {
+		start = sort.Search(len(s.samples), func(i int) bool { return !s.samples[i].sentAt.Before(from) })
+	}
+	end := len(s.samples)
+	if !to.IsZero() {
+		end = sort.Search(len(s.samples), func(i int) bool { return s.samples[i].sentAt.After(to) })
+	}
+	if start >= end {
+		return nil
+	}
+	return s.samples[start:end]
+}
+
+// sum returns the total and count of upload times within the window
+func (s *uploadSeries) sum(from, to time.Time) (sum float64, count int64) {
+	for _, sample := range s.window(from, to) {
+		sum += float64(sample.uploadTime)
+		count++
+	}
+	return sum, count
+}
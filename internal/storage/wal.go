@@ -0,0 +1,378 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record kinds written to the write-ahead log
+const (
+	recordHeartbeat    byte = 1
+	recordUpload       byte = 2
+	recordRegister     byte = 3
+	recordDecommission byte = 4
+	recordList         byte = 5 // Added or reactivated by the registry file
+	recordRetire       byte = 6 // Retired by the registry file
+)
+
+// purgeHistory is the value of a decommission record that discards history
+const purgeHistory int64 = 1
+
+const (
+	walSuffix = ".wal"
+
+	// Frame header: 4-byte payload length followed by 4-byte CRC32C of the payload
+	frameHeaderSize = 8
+
+	// Payload: kind (1) + sentAt seconds (8) + sentAt nanoseconds (4) + value (8) +
+	// device ID length (2) + device ID
+	payloadFixedSize = 23
+	maxDeviceIDLen   = 1<<16 - 1
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errTornRecord reports a partially written or corrupt record
+var errTornRecord = errors.New("torn or corrupt record")
+
+// walRecord is a single telemetry event persisted in the write-ahead log
+type walRecord struct {
+	kind     byte
+	deviceID string
+	sentAt   time.Time
+	value    int64 // Upload time for uploads, purgeHistory for purging decommissions, else unused
+}
+
+// segmentFile is the subset of *os.File the log writes segments through
+type segmentFile interface {
+	io.Writer
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// wal is an append-only, checksummed log split into numbered segment files
+type wal struct {
+	mu   sync.Mutex
+	dir  string
+	seq  uint64      // Sequence number of the active segment
+	file segmentFile // Active segment opened for appending
+	size int64       // Length of the active segment's intact records
+}
+
+// openWAL opens the newest segment in dir for appending, creating the first one if needed.
+// Segments must be replayed with replayWAL before the log is opened for writing.
+func openWAL(dir string) (*wal, error) {
+	seqs, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seq := uint64(1)
+	if len(seqs) > 0 {
+		seq = seqs[len(seqs)-1]
+	}
+
+	file, err := os.OpenFile(segmentPath(dir, seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open segment: %w", err)
+	}
+	if err := syncDir(dir); err != nil {
+		file.Close()
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("stat segment: %w", err)
+	}
+
+	return &wal{dir: dir, seq: seq, file: file, size: info.Size()}, nil
+}
+
+// append encodes and writes records to the active segment, then fsyncs it.
+// A failed write or fsync is cut back off the segment, so the caller can
+// reject the records and later appends still follow the last intact one.
+// If even that fails the segment is closed and every later append fails.
+func (w *wal) append(records ...walRecord) error {
+	var buf []byte
+	for _, rec := range records {
+		var err error
+		buf, err = appendFrame(buf, rec)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return os.ErrClosed
+	}
+	if _, err := w.file.Write(buf); err != nil {
+		return w.discardTail(fmt.Errorf("write segment: %w", err))
+	}
+	if err := w.file.Sync(); err != nil {
+		return w.discardTail(fmt.Errorf("sync segment: %w", err))
+	}
+	w.size += int64(len(buf))
+	return nil
+}
+
+// discardTail truncates the active segment back to its intact records after
+// the failed append err, closing it if that fails too; the caller must hold w.mu
+func (w *wal) discardTail(err error) error {
+	terr := w.file.Truncate(w.size)
+	if terr == nil {
+		terr = w.file.Sync()
+	}
+	if terr != nil {
+		w.file.Close()
+		w.file = nil
+		return fmt.Errorf("%w; discard torn tail: %v", err, terr)
+	}
+	return err
+}
+
+// rotate syncs and closes the active segment and starts a new one.
+// It returns the sequence number of the new segment.
+func (w *wal) rotate() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	next := w.seq + 1
+	file, err := os.OpenFile(segmentPath(w.dir, next), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return 0, fmt.Errorf("open segment: %w", err)
+	}
+	if err := syncDir(w.dir); err != nil {
+		file.Close()
+		return 0, err
+	}
+
+	if err := w.file.Sync(); err != nil {
+		file.Close()
+		return 0, fmt.Errorf("sync segment: %w", err)
+	}
+	w.file.Close()
+
+	w.file = file
+	w.seq = next
+	w.size = 0
+	return next, nil
+}
+
+// removeSegmentsBefore deletes every segment older than seq
+func (w *wal) removeSegmentsBefore(seq uint64) error {
+	seqs, err := listSegments(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, s := range seqs {
+		if s >= seq {
+			break
+		}
+		if err := os.Remove(segmentPath(w.dir, s)); err != nil {
+			return fmt.Errorf("remove segment: %w", err)
+		}
+	}
+	return syncDir(w.dir)
+}
+
+// close syncs and closes the active segment
+func (w *wal) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Sync()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	w.file = nil
+	return err
+}
+
+// replayWAL calls apply for every record in segments numbered from or after
+// start, in order. A torn or corrupt tail in the newest segment is truncated away so that
+// appends continue from the last intact record; damage in any older segment
+// is reported as an error.
+func replayWAL(dir string, start uint64, apply func(walRecord)) error {
+	seqs, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	for i, seq := range seqs {
+		if seq < start {
+			continue
+		}
+		last := i == len(seqs)-1
+		if err := replaySegment(segmentPath(dir, seq), last, apply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaySegment replays a single segment file
+func replaySegment(path string, truncateTail bool, apply func(walRecord)) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("open segment: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		rec, n, err := readFrame(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if errors.Is(err, errTornRecord) {
+			if !truncateTail {
+				return fmt.Errorf("segment %s at offset %d: %w", filepath.Base(path), offset, err)
+			}
+			if err := file.Truncate(offset); err != nil {
+				return fmt.Errorf("truncate torn segment tail: %w", err)
+			}
+			return file.Sync()
+		}
+		if err != nil {
+			return fmt.Errorf("read segment %s: %w", filepath.Base(path), err)
+		}
+
+		apply(rec)
+		offset += int64(n)
+	}
+}
+
+// appendFrame appends the framed encoding of rec to buf
+func appendFrame(buf []byte, rec walRecord) ([]byte, error) {
+	if len(rec.deviceID) > maxDeviceIDLen {
+		return nil, fmt.Errorf("%w: device ID too long", ErrInvalidInput)
+	}
+
+	payload := make([]byte, payloadFixedSize+len(rec.deviceID))
+	payload[0] = rec.kind
+	binary.LittleEndian.PutUint64(payload[1:], uint64(rec.sentAt.Unix()))
+	binary.LittleEndian.PutUint32(payload[9:], uint32(rec.sentAt.Nanosecond()))
+	binary.LittleEndian.PutUint64(payload[13:], uint64(rec.value))
+	binary.LittleEndian.PutUint16(payload[21:], uint16(len(rec.deviceID)))
+	copy(payload[payloadFixedSize:], rec.deviceID)
+
+	var header [frameHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:], crc32.Checksum(payload, crcTable))
+
+	buf = append(buf, header[:]...)
+	return append(buf, payload...), nil
+}
+
+// readFrame decodes one framed record and returns it with its encoded size.
+// io.EOF is returned only at a clean record boundary.
+func readFrame(r io.Reader) (walRecord, int, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return walRecord{}, 0, io.EOF
+		}
+		if err == io.ErrUnexpectedEOF {
+			return walRecord{}, 0, errTornRecord
+		}
+		return walRecord{}, 0, err
+	}
+
+	size := binary.LittleEndian.Uint32(header[0:])
+	sum := binary.LittleEndian.Uint32(header[4:])
+	if size < payloadFixedSize || size > payloadFixedSize+maxDeviceIDLen {
+		return walRecord{}, 0, errTornRecord
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return walRecord{}, 0, errTornRecord
+		}
+		return walRecord{}, 0, err
+	}
+	if crc32.Checksum(payload, crcTable) != sum {
+		return walRecord{}, 0, errTornRecord
+	}
+
+	idLen := int(binary.LittleEndian.Uint16(payload[21:]))
+	if payloadFixedSize+idLen != len(payload) {
+		return walRecord{}, 0, errTornRecord
+	}
+
+	rec := walRecord{
+		kind: payload[0],
+		sentAt: time.Unix(
+			int64(binary.LittleEndian.Uint64(payload[1:])),
+			int64(binary.LittleEndian.Uint32(payload[9:])),
+		).UTC(),
+		value:    int64(binary.LittleEndian.Uint64(payload[13:])),
+		deviceID: string(payload[payloadFixedSize:]),
+	}
+	return rec, frameHeaderSize + len(payload), nil
+}
+
+// listSegments returns the sequence numbers of all segments in dir, ascending
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read data directory: %w", err)
+	}
+
+	var seqs []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, walSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, walSuffix), 10, 64)
+		if err != nil {
+			continue // Not one of ours
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// segmentPath returns the file path for a segment sequence number
+func segmentPath(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", seq, walSuffix))
+}
+
+// syncDir fsyncs a directory so that created or renamed entries are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("open data directory: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("sync data directory: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,457 @@
+// Package websocket implements the RFC 6455 WebSocket protocol over
+// hijacked HTTP/1.1 connections: the opening handshake, framing, masking,
+// fragmented messages, ping and pong, and the closing handshake. Extensions
+// and subprotocols are not supported.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// acceptGUID is appended to the client's key to derive Sec-WebSocket-Accept
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// DefaultMaxMessageSize bounds received messages when Config leaves it zero
+const DefaultMaxMessageSize int64 = 64 << 10
+
+// maxControlPayload is the largest payload of a control frame
+const maxControlPayload = 125
+
+// Opcode is the type of a frame
+type Opcode byte
+
+// Frame opcodes
+const (
+	OpContinuation Opcode = 0x0
+	OpText         Opcode = 0x1
+	OpBinary       Opcode = 0x2
+	OpClose        Opcode = 0x8
+	OpPing         Opcode = 0x9
+	OpPong         Opcode = 0xA
+)
+
+// control reports whether op is a control frame opcode
+func (op Opcode) control() bool {
+	return op&0x8 != 0
+}
+
+// Close status codes
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005 // Never sent; reported when a close frame had no code
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+// Handshake errors returned by CheckHandshake
+var (
+	ErrNotWebSocket       = errors.New("not a websocket handshake")
+	ErrUnsupportedVersion = errors.New("unsupported websocket version, must be 13")
+)
+
+// CloseError is returned by ReadMessage once the peer has closed the connection
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+// protocolError is a violation by the peer that closes the connection with code
+type protocolError struct {
+	code   int
+	reason string
+}
+
+func (e *protocolError) Error() string {
+	return "websocket protocol error: " + e.reason
+}
+
+// Config holds the limits of a connection
+type Config struct {
+	// MaxMessageSize bounds received messages, after reassembling
+	// fragments; larger ones close the connection with CloseMessageTooBig.
+	// Defaults to DefaultMaxMessageSize.
+	MaxMessageSize int64
+
+	// ReadTimeout bounds the wait for each frame, including pongs, so a
+	// peer that pings or is pinged keeps the connection alive. Zero waits
+	// forever.
+	ReadTimeout time.Duration
+
+	// WriteTimeout bounds each frame written. Zero waits forever.
+	WriteTimeout time.Duration
+}
+
+// Conn is a WebSocket connection. ReadMessage must be called from one
+// goroutine at a time; writes may be made concurrently with it and with
+// each other.
+type Conn struct {
+	config Config
+	conn   net.Conn
+	reader *bufio.Reader
+	client bool // Masks written frames and expects unmasked ones
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+// CheckHandshake reports whether r is a valid WebSocket opening handshake,
+// returning ErrUnsupportedVersion if only the version is wrong
+func CheckHandshake(r *http.Request) error {
+	if r.Method != http.MethodGet || r.ProtoMajor != 1 || r.ProtoMinor < 1 ||
+		!headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		return ErrNotWebSocket
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return ErrUnsupportedVersion
+	}
+	if key, err := base64.StdEncoding.DecodeString(r.Header.Get("Sec-WebSocket-Key")); err != nil || len(key) != 16 {
+		return fmt.Errorf("%w: invalid Sec-WebSocket-Key", ErrNotWebSocket)
+	}
+	return nil
+}
+
+// Upgrade completes the opening handshake of r, which must have passed
+// CheckHandshake, and takes over its connection. Headers already set on w,
+// such as a request ID, are sent with the 101 response. After an error
+// nothing has been written to w.
+func Upgrade(w http.ResponseWriter, r *http.Request, config Config) (*Conn, error) {
+	if err := CheckHandshake(r); err != nil {
+		return nil, err
+	}
+	netConn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to take over connection: %w", err)
+	}
+
+	// The server's timeouts no longer apply; Config's take over per frame
+	netConn.SetDeadline(time.Time{})
+	if config.WriteTimeout > 0 {
+		netConn.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
+	}
+	header := w.Header().Clone()
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "Upgrade")
+	header.Set("Sec-WebSocket-Accept", acceptKey(r.Header.Get("Sec-WebSocket-Key")))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	header.Write(rw)
+	rw.WriteString("\r\n")
+	if err := rw.Flush(); err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("failed to write handshake: %w", err)
+	}
+	return newConn(netConn, rw.Reader, config, false), nil
+}
+
+// Dial opens a client connection to a ws:// URL, sending header with the
+// handshake. It is meant for tests and tools; wss:// is not supported.
+func Dial(rawURL string, header http.Header, config Config) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "ws" || u.Host == "" {
+		return nil, fmt.Errorf("unsupported websocket URL %q", rawURL)
+	}
+	netConn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	u.Scheme = "http"
+	req, _ := http.NewRequest(http.MethodGet, u.String(), nil)
+	if header != nil {
+		req.Header = header.Clone()
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	if err := req.Write(netConn); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(netConn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		netConn.Close()
+		return nil, fmt.Errorf("websocket handshake failed: %s %s", resp.Status, body)
+	}
+	return newConn(netConn, reader, config, true), nil
+}
+
+// newConn wraps an upgraded connection
+func newConn(netConn net.Conn, reader *bufio.Reader, config Config, client bool) *Conn {
+	if config.MaxMessageSize <= 0 {
+		config.MaxMessageSize = DefaultMaxMessageSize
+	}
+	return &Conn{config: config, conn: netConn, reader: reader, client: client}
+}
+
+// acceptKey derives Sec-WebSocket-Accept from Sec-WebSocket-Key
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerContains reports whether a comma-separated header has token, ignoring case
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadMessage returns the next text or binary message, answering pings and
+// reassembling fragments on the way. Once the peer closes the connection it
+// returns a *CloseError after replying with a close frame. A protocol
+// violation by the peer closes the connection with the matching code.
+// Either way the caller should then Close the connection.
+func (c *Conn) ReadMessage() (Opcode, []byte, error) {
+	var messageOp Opcode
+	var message []byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			var perr *protocolError
+			if errors.As(err, &perr) {
+				c.WriteClose(perr.code, perr.reason)
+			}
+			return 0, nil, err
+		}
+
+		switch {
+		case op == OpPing:
+			if err := c.writeFrame(OpPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case op == OpPong:
+			continue
+		case op == OpClose:
+			return 0, nil, c.closeReceived(payload)
+		case op == OpContinuation && message == nil:
+			return 0, nil, c.fail(CloseProtocolError, "continuation without a message")
+		case op != OpContinuation && message != nil:
+			return 0, nil, c.fail(CloseProtocolError, "message interrupted by a new one")
+		case op == OpText || op == OpBinary:
+			messageOp, message = op, []byte{}
+		case op != OpContinuation:
+			return 0, nil, c.fail(CloseProtocolError, fmt.Sprintf("unknown opcode %d", op))
+		}
+
+		if int64(len(message)+len(payload)) > c.config.MaxMessageSize {
+			return 0, nil, c.fail(CloseMessageTooBig, fmt.Sprintf("message exceeds %d bytes", c.config.MaxMessageSize))
+		}
+		message = append(message, payload...)
+		if !fin {
+			continue
+		}
+		if messageOp == OpText && !utf8.Valid(message) {
+			return 0, nil, c.fail(CloseInvalidPayload, "text message is not valid UTF-8")
+		}
+		return messageOp, message, nil
+	}
+}
+
+// fail closes the connection with code and returns the protocol error
+func (c *Conn) fail(code int, reason string) error {
+	c.WriteClose(code, reason)
+	return &protocolError{code: code, reason: reason}
+}
+
+// closeReceived handles the peer's close frame, echoing its code
+func (c *Conn) closeReceived(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatus}
+	switch {
+	case len(payload) == 1:
+		return c.fail(CloseProtocolError, "invalid close frame")
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !validCloseCode(closeErr.Code) || !utf8.Valid(payload[2:]) {
+			return c.fail(CloseProtocolError, "invalid close frame")
+		}
+	}
+	reply := closeErr.Code
+	if reply == CloseNoStatus {
+		reply = CloseNormal
+	}
+	c.WriteClose(reply, "")
+	return closeErr
+}
+
+// validCloseCode reports whether code may be sent in a close frame
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// readFrame reads and unmasks one frame
+func (c *Conn) readFrame() (fin bool, op Opcode, payload []byte, err error) {
+	if c.config.ReadTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.config.ReadTimeout))
+	}
+	var head [2]byte
+	if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, op = head[0]&0x80 != 0, Opcode(head[0]&0x0f)
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, &protocolError{CloseProtocolError, "reserved bits set without an extension"}
+	}
+	if masked := head[1]&0x80 != 0; masked == c.client {
+		return false, 0, nil, &protocolError{CloseProtocolError, "frame masking is wrong for its direction"}
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if op.control() && (!fin || length > maxControlPayload) {
+		return false, 0, nil, &protocolError{CloseProtocolError, "control frames must be whole and at most 125 bytes"}
+	}
+	if length > uint64(c.config.MaxMessageSize) {
+		return false, 0, nil, &protocolError{CloseMessageTooBig, fmt.Sprintf("message exceeds %d bytes", c.config.MaxMessageSize)}
+	}
+
+	var mask [4]byte
+	if !c.client {
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if !c.client {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, op, payload, nil
+}
+
+// WriteMessage sends data as a single text or binary frame
+func (c *Conn) WriteMessage(op Opcode, data []byte) error {
+	if op != OpText && op != OpBinary {
+		return fmt.Errorf("WriteMessage takes text or binary, got opcode %d", op)
+	}
+	return c.writeFrame(op, data)
+}
+
+// WritePing sends a ping; the peer's pong keeps ReadMessage's timeout from expiring
+func (c *Conn) WritePing() error {
+	return c.writeFrame(OpPing, nil)
+}
+
+// WriteClose starts or completes the closing handshake with code and
+// reason. Only the first close is sent; messages may not follow it.
+func (c *Conn) WriteClose(code int, reason string) error {
+	if len(reason) > maxControlPayload-2 {
+		reason = reason[:maxControlPayload-2]
+	}
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return c.writeFrame(OpClose, append(payload, reason...))
+}
+
+// writeFrame writes one whole frame, masked if c is a client
+func (c *Conn) writeFrame(op Opcode, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		if op == OpClose {
+			return nil
+		}
+		return net.ErrClosed
+	}
+	if op == OpClose {
+		c.closeSent = true
+	}
+
+	frame := []byte{0x80 | byte(op), 0}
+	switch n := len(payload); {
+	case n <= 125:
+		frame[1] = byte(n)
+	case n <= 0xffff:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if c.client {
+		var mask [4]byte
+		rand.Read(mask[:])
+		frame[1] |= 0x80
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range payload {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	if c.config.WriteTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout))
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Close closes the underlying connection without a closing handshake; call
+// WriteClose first for a clean close
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,160 @@
+package websocket
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoServer upgrades each request and echoes its messages back, sending
+// the error that ended each connection to errs
+func echoServer(t *testing.T, config Config) (string, <-chan error) {
+	t.Helper()
+	errs := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r, config)
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+		for {
+			op, data, err := conn.ReadMessage()
+			if err != nil {
+				errs <- err
+				return
+			}
+			conn.WriteMessage(op, data)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http"), errs
+}
+
+// rawFrame builds a frame as a client would, masked unless unmasked is set
+func rawFrame(fin bool, op Opcode, payload []byte, unmasked bool) []byte {
+	frame := []byte{byte(op), byte(len(payload))}
+	if fin {
+		frame[0] |= 0x80
+	}
+	if !unmasked {
+		frame[1] |= 0x80
+		frame = append(frame, 0, 0, 0, 0) // A zero mask leaves the payload as is
+	}
+	return append(frame, payload...)
+}
+
+// dial connects to url, failing the test on error
+func dial(t *testing.T, url string) *Conn {
+	t.Helper()
+	conn, err := Dial(url, nil, Config{ReadTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestConn_EchoesAndCloses(t *testing.T) {
+	url, errs := echoServer(t, Config{})
+	conn := dial(t, url)
+
+	// A message split across frames, with a ping between them
+	conn.conn.Write(rawFrame(false, OpText, []byte("hel"), false))
+	conn.conn.Write(rawFrame(true, OpPing, nil, false))
+	conn.conn.Write(rawFrame(true, OpContinuation, []byte("lo"), false))
+	conn.WriteMessage(OpBinary, []byte{0, 1, 2})
+	if op, data, err := conn.ReadMessage(); err != nil || op != OpText || string(data) != "hello" {
+		t.Fatalf("expected hello echoed, got %v %q %v", op, data, err)
+	}
+	if op, data, err := conn.ReadMessage(); err != nil || op != OpBinary || string(data) != "\x00\x01\x02" {
+		t.Fatalf("expected binary echoed, got %v %q %v", op, data, err)
+	}
+
+	// The server echoes the close code and reports it
+	conn.WriteClose(CloseNormal, "bye")
+	var closeErr *CloseError
+	if _, _, err := conn.ReadMessage(); !errors.As(err, &closeErr) || closeErr.Code != CloseNormal {
+		t.Errorf("expected the close to be echoed, got %v", err)
+	}
+	if err := <-errs; !errors.As(err, &closeErr) || closeErr.Code != CloseNormal || closeErr.Reason != "bye" {
+		t.Errorf("expected the server to see the close, got %v", err)
+	}
+	if err := conn.WriteMessage(OpText, []byte("late")); err == nil {
+		t.Error("expected writes after a close to fail")
+	}
+}
+
+func TestConn_ClosesOnProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+		code   int
+	}{
+		{"unmasked frame", [][]byte{rawFrame(true, OpText, []byte("hi"), true)}, CloseProtocolError},
+		{"message too big", [][]byte{rawFrame(false, OpText, []byte("1234"), false), rawFrame(true, OpContinuation, []byte("5678"), false)}, CloseMessageTooBig},
+		{"invalid UTF-8", [][]byte{rawFrame(true, OpText, []byte{0xff, 0xfe}, false)}, CloseInvalidPayload},
+		{"fragmented ping", [][]byte{rawFrame(false, OpPing, nil, false)}, CloseProtocolError},
+		{"stray continuation", [][]byte{rawFrame(true, OpContinuation, []byte("x"), false)}, CloseProtocolError},
+		{"unknown opcode", [][]byte{rawFrame(true, Opcode(0x3), nil, false)}, CloseProtocolError},
+		{"invalid close code", [][]byte{rawFrame(true, OpClose, []byte{0x03, 0xed}, false)}, CloseProtocolError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, errs := echoServer(t, Config{MaxMessageSize: 6})
+			conn := dial(t, url)
+			for _, frame := range tt.frames {
+				conn.conn.Write(frame)
+			}
+			var closeErr *CloseError
+			if _, _, err := conn.ReadMessage(); !errors.As(err, &closeErr) || closeErr.Code != tt.code {
+				t.Errorf("expected close %d, got %v", tt.code, err)
+			}
+			var perr *protocolError
+			if err := <-errs; !errors.As(err, &perr) || perr.code != tt.code {
+				t.Errorf("expected a protocol error with %d, got %v", tt.code, err)
+			}
+		})
+	}
+}
+
+func TestCheckHandshake(t *testing.T) {
+	valid := func() *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/stream", nil)
+		r.Header.Set("Connection", "keep-alive, Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-WebSocket-Version", "13")
+		r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		return r
+	}
+	if err := CheckHandshake(valid()); err != nil {
+		t.Errorf("expected a valid handshake, got %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(r *http.Request)
+		want   error
+	}{
+		{"POST", func(r *http.Request) { r.Method = http.MethodPost }, ErrNotWebSocket},
+		{"no upgrade", func(r *http.Request) { r.Header.Del("Upgrade") }, ErrNotWebSocket},
+		{"HTTP/1.0", func(r *http.Request) { r.ProtoMinor = 0 }, ErrNotWebSocket},
+		{"version 8", func(r *http.Request) { r.Header.Set("Sec-WebSocket-Version", "8") }, ErrUnsupportedVersion},
+		{"short key", func(r *http.Request) { r.Header.Set("Sec-WebSocket-Key", "c2hvcnQ=") }, ErrNotWebSocket},
+	}
+	for _, tt := range tests {
+		r := valid()
+		tt.modify(r)
+		if err := CheckHandshake(r); !errors.Is(err, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, err)
+		}
+	}
+
+	// The accept key from RFC 6455 section 1.3
+	if got := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("unexpected accept key %q", got)
+	}
+}